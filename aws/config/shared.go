@@ -0,0 +1,107 @@
+package config
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// SharedConfig is the content of an AWS shared config file, such as ~/.aws/config
+type SharedConfig struct {
+	// Profiles are the names of the profiles defined in [profile <name>] sections, in the order they appear.
+	// The [default] profile is not included.
+	Profiles []string
+
+	sections map[string]map[string]string
+}
+
+// SharedConfigPath returns the path of the AWS shared config file, which is set by the AWS_CONFIG_FILE
+// environment variable or defaults to ~/.aws/config
+func SharedConfigPath() string {
+	if path := os.Getenv("AWS_CONFIG_FILE"); path != "" {
+		return path
+	}
+
+	dir, _ := homedir.Dir()
+	return filepath.Join(dir, ".aws", "config")
+}
+
+// LoadSharedConfig reads and parses the AWS shared config file at path
+func LoadSharedConfig(path string) (*SharedConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseSharedConfig(f)
+}
+
+// ParseSharedConfig parses an AWS shared config file. Lines that are not part of a section, nested
+// properties (such as the settings under s3 =) and comments are ignored.
+func ParseSharedConfig(r io.Reader) (*SharedConfig, error) {
+	c := &SharedConfig{sections: make(map[string]map[string]string)}
+
+	var section map[string]string
+	var nested bool
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			name := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			if _, ok := c.sections[name]; !ok {
+				c.sections[name] = make(map[string]string)
+				if strings.HasPrefix(name, "profile ") {
+					c.Profiles = append(c.Profiles, strings.TrimPrefix(name, "profile "))
+				}
+			}
+			section, nested = c.sections[name], false
+
+		case section == nil:
+			continue
+
+		// Indented lines following a key without a value are its nested properties
+		case nested && raw != line:
+			continue
+
+		default:
+			idx := strings.Index(line, "=")
+			if idx < 0 {
+				continue
+			}
+
+			key, value := strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+			section[key], nested = value, value == ""
+		}
+	}
+
+	return c, scanner.Err()
+}
+
+// Profile returns the settings of the named profile, where "default" is the [default] section
+func (c *SharedConfig) Profile(name string) (map[string]string, bool) {
+	if name == "default" {
+		if s, ok := c.sections["default"]; ok {
+			return s, true
+		}
+	}
+
+	s, ok := c.sections["profile "+name]
+	return s, ok
+}
+
+// SSOSession returns the settings of the named [sso-session <name>] section
+func (c *SharedConfig) SSOSession(name string) (map[string]string, bool) {
+	s, ok := c.sections["sso-session "+name]
+	return s, ok
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSharedConfig = `
+# comment
+[default]
+region = us-east-1
+
+[profile dev]
+sso_session = corp
+sso_account_id = 111111111111
+sso_role_name = Admin ; not a comment
+s3 =
+    max_concurrent_requests = 20
+region = us-west-2
+
+[ profile  prod ]
+role_arn = arn:aws:iam::222222222222:role/Admin
+source_profile = dev
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start
+sso_region = us-east-1
+`
+
+func TestParseSharedConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := ParseSharedConfig(strings.NewReader(testSharedConfig))
+	assert.NoError(err)
+	assert.Equal([]string{"dev", "prod"}, cfg.Profiles)
+
+	settings, ok := cfg.Profile("default")
+	assert.True(ok)
+	assert.Equal("us-east-1", settings["region"])
+
+	// Nested properties are skipped, the keys that follow them are not
+	settings, ok = cfg.Profile("dev")
+	assert.True(ok)
+	assert.Equal("corp", settings["sso_session"])
+	assert.Equal("Admin ; not a comment", settings["sso_role_name"])
+	assert.Equal("us-west-2", settings["region"])
+	assert.NotContains(settings, "max_concurrent_requests")
+
+	settings, ok = cfg.Profile("prod")
+	assert.True(ok)
+	assert.Equal("dev", settings["source_profile"])
+
+	settings, ok = cfg.SSOSession("corp")
+	assert.True(ok)
+	assert.Equal("https://corp.awsapps.com/start", settings["sso_start_url"])
+
+	_, ok = cfg.Profile("corp")
+	assert.False(ok)
+}
+
+func TestSharedConfigPath(t *testing.T) {
+	t.Setenv("AWS_CONFIG_FILE", "/tmp/aws-config")
+	assert.Equal(t, "/tmp/aws-config", SharedConfigPath())
+}
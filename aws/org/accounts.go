@@ -0,0 +1,208 @@
+// Package org discovers the accounts of an AWS Organization and builds sessions that assume a role in each of them
+package org
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+)
+
+// DefaultRole is the role AWS Organizations creates in the accounts it creates
+const DefaultRole = "OrganizationAccountAccessRole"
+
+// Selector describes which accounts of an organization to target and the role to assume in them
+type Selector struct {
+	// Role is the name of the role assumed in each account
+	Role string
+
+	// OrganizationalUnits limits the accounts to those in these OUs or any OU nested below them
+	OrganizationalUnits []string
+
+	// Tags limits the accounts to those that have all of these tags
+	Tags map[string]string
+}
+
+// Account is an active account of an organization
+type Account struct {
+	ID   string
+	Name string
+}
+
+// ListAccounts returns the active accounts of the organization that match the selector, sorted by name
+func ListAccounts(client organizationsiface.OrganizationsAPI, sel Selector) ([]Account, error) {
+	var found []*organizations.Account
+	collect := func(accounts []*organizations.Account) {
+		for _, a := range accounts {
+			if aws.StringValue(a.Status) == organizations.AccountStatusActive {
+				found = append(found, a)
+			}
+		}
+	}
+
+	if len(sel.OrganizationalUnits) == 0 {
+		if err := client.ListAccountsPages(&organizations.ListAccountsInput{},
+			func(page *organizations.ListAccountsOutput, lastPage bool) bool {
+				collect(page.Accounts)
+				return true
+			}); err != nil {
+			return nil, fmt.Errorf("Error listing the accounts of the organization: %v", err)
+		}
+	}
+
+	for _, ou := range sel.OrganizationalUnits {
+		if err := listAccountsForParent(client, ou, collect); err != nil {
+			return nil, fmt.Errorf("Error listing the accounts in organizational unit %s: %v", ou, err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var accounts []Account
+	for _, a := range found {
+		id := aws.StringValue(a.Id)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if len(sel.Tags) > 0 {
+			ok, err := hasTags(client, id, sel.Tags)
+			if err != nil {
+				return nil, fmt.Errorf("Error listing the tags of account %s: %v", id, err)
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		accounts = append(accounts, Account{ID: id, Name: aws.StringValue(a.Name)})
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].Name != accounts[j].Name {
+			return accounts[i].Name < accounts[j].Name
+		}
+		return accounts[i].ID < accounts[j].ID
+	})
+
+	return accounts, nil
+}
+
+// listAccountsForParent passes the accounts directly below the parent, and those of the OUs nested below it, to collect
+func listAccountsForParent(client organizationsiface.OrganizationsAPI, parent string, collect func([]*organizations.Account)) error {
+	if err := client.ListAccountsForParentPages(&organizations.ListAccountsForParentInput{ParentId: aws.String(parent)},
+		func(page *organizations.ListAccountsForParentOutput, lastPage bool) bool {
+			collect(page.Accounts)
+			return true
+		}); err != nil {
+		return err
+	}
+
+	var children []string
+	if err := client.ListOrganizationalUnitsForParentPages(&organizations.ListOrganizationalUnitsForParentInput{ParentId: aws.String(parent)},
+		func(page *organizations.ListOrganizationalUnitsForParentOutput, lastPage bool) bool {
+			for _, ou := range page.OrganizationalUnits {
+				children = append(children, aws.StringValue(ou.Id))
+			}
+			return true
+		}); err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if err := listAccountsForParent(client, child, collect); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func hasTags(client organizationsiface.OrganizationsAPI, id string, tags map[string]string) (bool, error) {
+	accountTags := make(map[string]string)
+	if err := client.ListTagsForResourcePages(&organizations.ListTagsForResourceInput{ResourceId: aws.String(id)},
+		func(page *organizations.ListTagsForResourceOutput, lastPage bool) bool {
+			for _, t := range page.Tags {
+				accountTags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+			return true
+		}); err != nil {
+		return false, err
+	}
+
+	for k, v := range tags {
+		if value, ok := accountTags[k]; !ok || value != v {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// RoleARN returns the ARN of the named role in an account, in the partition the region belongs to
+func RoleARN(accountID, role, region string) string {
+	partition := endpoints.AwsPartitionID
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		partition = p.ID()
+	}
+
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, accountID, role)
+}
+
+// BuildPool lists the accounts of the organization with each of the profiles, which must belong to the management
+// account or a delegated administrator, and creates a session in each region assuming the selector's role in every
+// account found. Sessions are named after the accounts.
+func BuildPool(profiles []string, regions []string, sel Selector, logger *log.Logger) (*session.Pool, error) {
+	if len(regions) == 0 {
+		return &session.Pool{Sessions: map[string]*session.Session{}}, nil
+	}
+	if sel.Role == "" {
+		sel.Role = DefaultRole
+	}
+
+	roles := make(map[string]session.Role)
+	ids := make(map[string]bool)
+
+	for _, profile := range profiles {
+		pool, err := session.BuildPool([]string{profile}, regions[:1], logger)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sess := range pool.Sessions {
+			accounts, err := ListAccounts(organizations.New(sess.Session), sel)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, a := range accounts {
+				if ids[a.ID] {
+					continue
+				}
+				ids[a.ID] = true
+
+				name := a.Name
+				if _, ok := roles[name]; ok || name == "" {
+					name = a.ID
+				}
+
+				roles[name] = session.Role{
+					SourceProfile: sess.ProfileName,
+					ARN:           RoleARN(a.ID, sel.Role, regions[0]),
+				}
+			}
+		}
+	}
+
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("No accounts of the organization matched")
+	}
+
+	return session.BuildRolePool(roles, regions, logger)
+}
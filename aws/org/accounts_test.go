@@ -0,0 +1,49 @@
+package org
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+)
+
+func accountNames(accounts []Account) (names []string) {
+	for _, a := range accounts {
+		names = append(names, a.Name)
+	}
+
+	return names
+}
+
+func TestListAccounts(t *testing.T) {
+	assert := assert.New(t)
+	client := mocks.NewMockOrganizationsClient()
+
+	// Suspended accounts are skipped
+	accounts, err := ListAccounts(client, Selector{})
+	assert.NoError(err)
+	assert.Equal([]string{"dev", "management", "prod-eu", "prod-us"}, accountNames(accounts))
+	assert.Equal(Account{ID: "111111111111", Name: "dev"}, accounts[0])
+
+	// Accounts in nested OUs are included, and only listed once
+	accounts, err = ListAccounts(client, Selector{OrganizationalUnits: []string{"ou-prod", "ou-prod-eu"}})
+	assert.NoError(err)
+	assert.Equal([]string{"prod-eu", "prod-us"}, accountNames(accounts))
+
+	accounts, err = ListAccounts(client, Selector{Tags: map[string]string{"team": "platform"}})
+	assert.NoError(err)
+	assert.Equal([]string{"dev", "prod-us"}, accountNames(accounts))
+
+	accounts, err = ListAccounts(client, Selector{OrganizationalUnits: []string{"ou-prod"}, Tags: map[string]string{"team": "platform", "env": "prod"}})
+	assert.NoError(err)
+	assert.Equal([]string{"prod-us"}, accountNames(accounts))
+}
+
+func TestRoleARN(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("arn:aws:iam::111111111111:role/OrganizationAccountAccessRole", RoleARN("111111111111", DefaultRole, "us-east-1"))
+	assert.Equal("arn:aws-us-gov:iam::111111111111:role/Admin", RoleARN("111111111111", "Admin", "us-gov-west-1"))
+	assert.Equal("arn:aws-cn:iam::111111111111:role/Admin", RoleARN("111111111111", "Admin", "cn-north-1"))
+}
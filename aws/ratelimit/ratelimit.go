@@ -0,0 +1,175 @@
+// Package ratelimit limits the rate of the calls made to each AWS API in each profile/region combination, slowing
+// them down further while AWS throttles them
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+)
+
+// DefaultRate is the number of calls per second allowed to each API in each profile/region combination
+const DefaultRate = 10.0
+
+// MinRate is the rate that throttling slows the calls to an API down to at most
+var MinRate = 0.5
+
+// recoveryStep is the fraction of the configured rate that each successful call adds back after throttling
+const recoveryStep = 0.05
+
+// Retryer retries throttled calls with exponential backoff, more times and for longer than the SDK does by default
+var Retryer = client.DefaultRetryer{
+	NumMaxRetries:    8,
+	MinThrottleDelay: 500 * time.Millisecond,
+	MaxThrottleDelay: 30 * time.Second,
+}
+
+// Bucket is a token bucket whose refill rate adapts to throttling: it is halved each time a call is throttled,
+// and recovers gradually as calls succeed
+type Bucket struct {
+	mu      sync.Mutex
+	maxRate float64
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	now     func() time.Time
+}
+
+// NewBucket returns a full Bucket that refills at rate tokens per second and holds at most burst tokens
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{
+		maxRate: rate,
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+		now:     time.Now,
+	}
+}
+
+// Rate returns the current refill rate of the bucket, in tokens per second
+func (b *Bucket) Rate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rate
+}
+
+// reserve takes a token if one is available, otherwise it returns how long to wait for the next one
+func (b *Bucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Wait blocks until a token is available and takes it, or returns the error of ctx if it is done first
+func (b *Bucket) Wait(ctx context.Context) error {
+	for {
+		wait := b.reserve()
+		if wait == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Throttled halves the rate of the bucket, down to MinRate, and empties it
+func (b *Bucket) Throttled() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = math.Max(MinRate, b.rate/2)
+	b.tokens = 0
+}
+
+// Succeeded raises the rate of the bucket back towards its configured rate
+func (b *Bucket) Succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = math.Min(b.maxRate, b.rate+b.maxRate*recoveryStep)
+}
+
+// Limiter holds a Bucket for each API of each profile/region combination
+type Limiter struct {
+	// Rate is the number of calls per second allowed to each API
+	Rate float64
+
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// New returns a Limiter that allows rate calls per second to each API of each profile/region combination
+func New(rate float64) *Limiter {
+	return &Limiter{Rate: rate, buckets: make(map[string]*Bucket)}
+}
+
+// Bucket returns the bucket of the key, creating it if needed
+func (l *Limiter) Bucket(key string) *Bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.Rate, int(math.Ceil(l.Rate)))
+		l.buckets[key] = b
+	}
+
+	return b
+}
+
+// Install rate limits every call made by the clients created from the session from now on, and retries them
+// with Retryer when they are throttled. Sessions of the same profile and region share their buckets.
+func (l *Limiter) Install(sess *session.Session) {
+	prefix := fmt.Sprintf("%s@%s/", sess.ProfileName, *sess.Session.Config.Region)
+	bucket := func(r *request.Request) *Bucket {
+		return l.Bucket(prefix + r.ClientInfo.ServiceName + "." + r.Operation.Name)
+	}
+
+	sess.Session.Config.Retryer = Retryer
+
+	// Signing happens before each attempt, including retries
+	sess.Session.Handlers.Sign.PushFrontNamed(request.NamedHandler{
+		Name: "ssmhelpers.ratelimit.Wait",
+		Fn: func(r *request.Request) {
+			if err := bucket(r).Wait(r.Context()); err != nil {
+				r.Error = err
+			}
+		},
+	})
+
+	sess.Session.Handlers.CompleteAttempt.PushBackNamed(request.NamedHandler{
+		Name: "ssmhelpers.ratelimit.Adapt",
+		Fn: func(r *request.Request) {
+			switch {
+			case r.Error == nil:
+				bucket(r).Succeeded()
+			case request.IsErrorThrottle(r.Error):
+				bucket(r).Throttled()
+			}
+		},
+	})
+}
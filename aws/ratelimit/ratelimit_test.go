@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+)
+
+func TestBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2020, 3, 5, 17, 0, 0, 0, time.UTC)
+	b := NewBucket(10, 2)
+	b.now, b.last = func() time.Time { return now }, now
+
+	// The burst is available at once, then tokens refill at the rate of the bucket
+	assert.Equal(time.Duration(0), b.reserve())
+	assert.Equal(time.Duration(0), b.reserve())
+	assert.Equal(100*time.Millisecond, b.reserve())
+
+	now = now.Add(100 * time.Millisecond)
+	assert.Equal(time.Duration(0), b.reserve())
+
+	// Throttling halves the rate, successes restore it gradually
+	b.Throttled()
+	assert.Equal(5.0, b.Rate())
+	assert.Equal(200*time.Millisecond, b.reserve())
+
+	for i := 0; i < 5; i++ {
+		b.Succeeded()
+	}
+	assert.InDelta(7.5, b.Rate(), 0.001)
+	for i := 0; i < 100; i++ {
+		b.Succeeded()
+	}
+	assert.Equal(10.0, b.Rate())
+
+	for i := 0; i < 100; i++ {
+		b.Throttled()
+	}
+	assert.Equal(MinRate, b.Rate())
+
+	// Waiting stops when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, b.Wait(ctx))
+}
+
+func TestLimiterInstall(t *testing.T) {
+	assert := assert.New(t)
+
+	defaultRetryer := Retryer
+	Retryer = client.DefaultRetryer{NumMaxRetries: 3, MinThrottleDelay: time.Millisecond, MaxThrottleDelay: time.Millisecond}
+	defer func() { Retryer = defaultRetryer }()
+
+	// The first two calls are throttled
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "ThrottlingException", "message": "Rate exceeded"}`))
+			return
+		}
+		w.Write([]byte(`{"Status": "connected", "Target": "i-123"}`))
+	}))
+	defer server.Close()
+
+	sess := &session.Session{
+		ProfileName: "profile1",
+		Session: awssession.Must(awssession.NewSession(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(server.URL),
+			Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+		})),
+	}
+
+	l := New(100)
+	l.Install(sess)
+
+	// Throttled calls are retried instead of failing, and slow the API down
+	output, err := ssm.New(sess.Session).GetConnectionStatus(&ssm.GetConnectionStatusInput{Target: aws.String("i-123")})
+	assert.NoError(err)
+	assert.Equal("connected", aws.StringValue(output.Status))
+	assert.Equal(int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(30.0, l.Bucket("profile1@us-east-1/ssm.GetConnectionStatus").Rate())
+
+	// Other APIs are limited separately
+	assert.Equal(100.0, l.Bucket("profile1@us-east-1/ssm.DescribeInstanceInformation").Rate())
+}
@@ -0,0 +1,255 @@
+// Package regions discovers the regions enabled in the account of each profile, caching them on disk
+package regions
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	"github.com/disneystreaming/ssm-helpers/util"
+)
+
+// DefaultRegion is used to look up the enabled regions of profiles that don't configure a region
+const DefaultRegion = "us-east-1"
+
+// DefaultTTL is how long the regions of a profile are cached before they are looked up again
+var DefaultTTL = 24 * time.Hour
+
+// notOptedIn is the opt-in status of the regions that an account has not been enabled in
+const notOptedIn = "not-opted-in"
+
+// Enabled returns the regions enabled in the account of the client, i.e. those that don't require opting in
+// and those the account has opted in to, sorted by name
+func Enabled(client ec2iface.EC2API) ([]string, error) {
+	output, err := client.DescribeRegions(&ec2.DescribeRegionsInput{AllRegions: aws.Bool(true)})
+	if err != nil {
+		return nil, fmt.Errorf("Could not list the enabled regions\n%v", err)
+	}
+
+	var regions []string
+	for _, r := range output.Regions {
+		if aws.StringValue(r.OptInStatus) != notOptedIn {
+			regions = append(regions, aws.StringValue(r.RegionName))
+		}
+	}
+	sort.Strings(regions)
+
+	return regions, nil
+}
+
+// ValidateExclude returns an error if any of the patterns of regions to exclude is malformed
+func ValidateExclude(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("Invalid region pattern %s", p)
+		}
+	}
+
+	return nil
+}
+
+// Exclude returns the regions that don't match any of the patterns, which may contain * wildcards (e.g. ap-*)
+func Exclude(regions []string, patterns []string) []string {
+	var kept []string
+	for _, r := range regions {
+		excluded := false
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, r); ok {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, r)
+		}
+	}
+
+	return kept
+}
+
+// cacheEntry is the cached list of regions enabled for a single profile
+type cacheEntry struct {
+	Regions []string  `json:"regions"`
+	Updated time.Time `json:"updated"`
+}
+
+// DefaultCachePath returns the file the regions of each profile are cached in by default
+func DefaultCachePath() (string, error) {
+	dir, err := util.CacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "regions.json"), nil
+}
+
+// Resolver returns the regions enabled for each profile, excluding those that match any of the Exclude patterns
+type Resolver struct {
+	Logger *log.Logger
+
+	// CachePath is the file the enabled regions of each profile are cached in, caching is disabled if empty
+	CachePath string
+
+	// TTL is how long the cached regions of a profile are used before they are looked up again
+	TTL time.Duration
+
+	// Exclude are patterns of regions to skip, which may contain * wildcards
+	Exclude []string
+
+	newEC2 func(profile string) (ec2iface.EC2API, error)
+	now    func() time.Time
+}
+
+// NewResolver returns a Resolver that caches the regions of each profile in the file at cachePath for DefaultTTL
+func NewResolver(cachePath string, exclude []string, logger *log.Logger) *Resolver {
+	r := &Resolver{
+		Logger:    logger,
+		CachePath: cachePath,
+		TTL:       DefaultTTL,
+		Exclude:   exclude,
+		now:       time.Now,
+	}
+	r.newEC2 = func(profile string) (ec2iface.EC2API, error) {
+		pool, err := session.BuildPool([]string{profile}, []string{""}, r.Logger)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sess := range pool.Sessions {
+			if aws.StringValue(sess.Session.Config.Region) == "" {
+				return ec2.New(sess.Session, &aws.Config{Region: aws.String(DefaultRegion)}), nil
+			}
+			return ec2.New(sess.Session), nil
+		}
+
+		return nil, fmt.Errorf("Could not create a session for profile %s", profile)
+	}
+
+	return r
+}
+
+// Regions returns the regions enabled for the profile, from the cache if they were looked up within the TTL
+func (r *Resolver) Regions(profile string) ([]string, error) {
+	cache := r.loadCache()
+	if entry, ok := cache[profile]; ok && r.now().Sub(entry.Updated) < r.TTL {
+		return Exclude(entry.Regions, r.Exclude), nil
+	}
+
+	client, err := r.newEC2(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	regions, err := Enabled(client)
+	if err != nil {
+		return nil, err
+	}
+	r.Logger.Debugf("Found %d enabled regions for %s", len(regions), profile)
+
+	if err := r.saveCache(profile, cacheEntry{Regions: regions, Updated: r.now().UTC()}); err != nil {
+		// The regions can still be used, they will be looked up again next time
+		r.Logger.Warn(err)
+	}
+
+	return Exclude(regions, r.Exclude), nil
+}
+
+// loadCache returns the cached regions of every profile, or an empty cache if it can't be read
+func (r *Resolver) loadCache() map[string]cacheEntry {
+	cache := make(map[string]cacheEntry)
+	if r.CachePath == "" {
+		return cache
+	}
+
+	data, err := ioutil.ReadFile(r.CachePath)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		r.Logger.Debugf("Ignoring invalid region cache %s: %v", r.CachePath, err)
+		return make(map[string]cacheEntry)
+	}
+
+	return cache
+}
+
+// saveCache caches the regions of the profile. The cache is read again right before it is replaced, in a single
+// step, as other invocations may be caching the regions of other profiles at the same time.
+func (r *Resolver) saveCache(profile string, entry cacheEntry) error {
+	if r.CachePath == "" {
+		return nil
+	}
+
+	dir := filepath.Dir(r.CachePath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Could not create cache directory %s\n%v", dir, err)
+	}
+
+	cache := r.loadCache()
+	cache[profile] = entry
+
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".regions-*")
+	if err != nil {
+		return fmt.Errorf("Could not write region cache %s\n%v", r.CachePath, err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), r.CachePath)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not write region cache %s\n%v", r.CachePath, err)
+	}
+
+	return nil
+}
+
+// BuildPool creates the sessions of each profile in every region enabled for it with build, e.g. session.BuildPool.
+// Profiles whose regions can't be looked up are logged and skipped, unless none of the profiles could be.
+func BuildPool(profiles []string, r *Resolver, build func(profiles, regions []string) (*session.Pool, error)) (*session.Pool, error) {
+	sessions := map[string]*session.Session{}
+
+	var lookupErr error
+	for _, profile := range profiles {
+		regions, err := r.Regions(profile)
+		if err != nil {
+			lookupErr = fmt.Errorf("Could not look up the regions of profile %s, skipping it\n%v", profile, err)
+			r.Logger.Error(lookupErr)
+			continue
+		}
+
+		pool, err := build([]string{profile}, regions)
+		if err != nil {
+			return nil, err
+		}
+		for name, sess := range pool.Sessions {
+			sessions[name] = sess
+		}
+	}
+
+	if len(sessions) == 0 && lookupErr != nil {
+		return nil, lookupErr
+	}
+
+	return &session.Pool{Sessions: sessions}, nil
+}
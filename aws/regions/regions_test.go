@@ -0,0 +1,142 @@
+package regions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+)
+
+func TestEnabled(t *testing.T) {
+	assert := assert.New(t)
+
+	// Regions that require opting in are only included once the account has opted in
+	regions, err := Enabled(&mocks.MockEC2Client{})
+	assert.NoError(err)
+	assert.Equal([]string{"ap-east-1", "ap-southeast-1", "eu-west-1", "us-east-1", "us-west-2"}, regions)
+}
+
+func TestExclude(t *testing.T) {
+	assert := assert.New(t)
+
+	regions := []string{"ap-east-1", "ap-southeast-1", "eu-west-1", "us-east-1", "us-west-2"}
+	assert.Equal([]string{"eu-west-1", "us-east-1"}, Exclude(regions, []string{"ap-*", "us-west-2"}))
+	assert.Equal(regions, Exclude(regions, nil))
+
+	assert.NoError(ValidateExclude([]string{"ap-*", "us-west-2"}))
+	assert.Error(ValidateExclude([]string{"us-[east"}))
+}
+
+func TestResolver(t *testing.T) {
+	assert := assert.New(t)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	now := time.Date(2020, 3, 5, 17, 0, 0, 0, time.UTC)
+	lookups := 0
+	newResolver := func(exclude []string) *Resolver {
+		r := NewResolver(filepath.Join(t.TempDir(), "cache", "regions.json"), exclude, logger)
+		r.newEC2 = func(profile string) (ec2iface.EC2API, error) {
+			lookups++
+			return &mocks.MockEC2Client{}, nil
+		}
+		r.now = func() time.Time { return now }
+		return r
+	}
+
+	r := newResolver([]string{"ap-*"})
+	regions, err := r.Regions("profile1")
+	assert.NoError(err)
+	assert.Equal([]string{"eu-west-1", "us-east-1", "us-west-2"}, regions)
+	assert.Equal(1, lookups)
+
+	// Cached regions are used until the TTL expires, and the exclusions apply to them as well
+	r.Exclude = []string{"us-*"}
+	regions, err = r.Regions("profile1")
+	assert.NoError(err)
+	assert.Equal([]string{"ap-east-1", "ap-southeast-1", "eu-west-1"}, regions)
+	assert.Equal(1, lookups)
+
+	_, err = r.Regions("profile2")
+	assert.NoError(err)
+	assert.Equal(2, lookups)
+
+	now = now.Add(DefaultTTL)
+	_, err = r.Regions("profile1")
+	assert.NoError(err)
+	assert.Equal(3, lookups)
+
+	// Without a cache, regions are looked up every time
+	r = newResolver(nil)
+	r.CachePath = ""
+	r.Regions("profile1")
+	r.Regions("profile1")
+	assert.Equal(5, lookups)
+}
+
+func TestResolverSharedCache(t *testing.T) {
+	assert := assert.New(t)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	// Resolvers sharing a cache, like concurrent invocations, keep each other's profiles
+	cachePath := filepath.Join(t.TempDir(), "regions.json")
+	r1, r2 := NewResolver(cachePath, nil, logger), NewResolver(cachePath, nil, logger)
+	for _, r := range []*Resolver{r1, r2} {
+		r.newEC2 = func(profile string) (ec2iface.EC2API, error) { return &mocks.MockEC2Client{}, nil }
+	}
+
+	_, err := r1.Regions("profile1")
+	assert.NoError(err)
+	_, err = r2.Regions("profile2")
+	assert.NoError(err)
+
+	cache := r1.loadCache()
+	assert.Contains(cache, "profile1")
+	assert.Contains(cache, "profile2")
+}
+
+func TestBuildPool(t *testing.T) {
+	assert := assert.New(t)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	r := NewResolver("", []string{"ap-*", "eu-*"}, logger)
+	r.newEC2 = func(profile string) (ec2iface.EC2API, error) {
+		if profile == "broken" {
+			return nil, fmt.Errorf("AccessDenied")
+		}
+		return &mocks.MockEC2Client{}, nil
+	}
+
+	build := func(profiles, regions []string) (*session.Pool, error) {
+		pool := &session.Pool{Sessions: map[string]*session.Session{}}
+		for _, p := range profiles {
+			for _, region := range regions {
+				pool.Sessions[p+"-"+region] = &session.Session{ProfileName: p}
+			}
+		}
+		return pool, nil
+	}
+
+	// Profiles whose regions can't be looked up are skipped
+	pool, err := BuildPool([]string{"profile1", "broken"}, r, build)
+	assert.NoError(err)
+	assert.Len(pool.Sessions, 2)
+	assert.Contains(pool.Sessions, "profile1-us-east-1")
+
+	// Unless none of them can be
+	_, err = BuildPool([]string{"broken"}, r, build)
+	assert.Error(err)
+}
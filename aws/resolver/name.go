@@ -0,0 +1,46 @@
+package resolver
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// NameTagResolver resolves names to the IDs of the running instances with a matching Name tag.
+type NameTagResolver struct {
+	names []string
+}
+
+func NewNameTagResolver(names []string) *NameTagResolver {
+	return &NameTagResolver{
+		names: names,
+	}
+}
+
+func (nr *NameTagResolver) ResolveToInstanceId(client ec2iface.EC2API) (output []string, err error) {
+	diInput := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:Name"), Values: aws.StringSlice(nr.names)},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{ec2.InstanceStateNameRunning})},
+		},
+	}
+
+	describeInstancesPager := func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, i := range reservation.Instances {
+				output = append(output, *i.InstanceId)
+			}
+		}
+
+		// If it's not the last page, continue
+		return !lastPage
+	}
+
+	if err = client.DescribeInstancesPages(diInput, describeInstancesPager); err != nil {
+		return nil, fmt.Errorf("could not describe instances\n%v", err)
+	}
+
+	return output, nil
+}
@@ -1,6 +1,7 @@
 package resolver
 
 import (
+	"context"
 	"fmt"
 	"net"
 
@@ -25,9 +26,14 @@ func NewHostnameResolver(addrs []string) *HostnameResolver {
 }
 
 func (hr *HostnameResolver) ResolveToInstanceId(client ec2iface.EC2API) (output []string, err error) {
-	ips := make([]*string, 1)
+	return hr.ResolveToInstanceIdWithContext(context.Background(), client)
+}
+
+// ResolveToInstanceIdWithContext is ResolveToInstanceId, stopping the lookups once ctx is canceled
+func (hr *HostnameResolver) ResolveToInstanceIdWithContext(ctx context.Context, client ec2iface.EC2API) (output []string, err error) {
+	ips := make([]*string, 0, len(hr.addrs))
 	for _, addr := range hr.addrs {
-		ip, err := resolveToFirst(addr)
+		ip, err := resolveToFirst(ctx, addr)
 		if err != nil {
 			return nil, fmt.Errorf("unable to resolve hostname to %v to ip", hr.addrs)
 		}
@@ -45,6 +51,10 @@ func (hr *HostnameResolver) ResolveToInstanceId(client ec2iface.EC2API) (output
 
 	describeNetworkInterfacesPager := func(page *ec2.DescribeNetworkInterfacesOutput, lastPage bool) bool {
 		for _, nic := range page.NetworkInterfaces {
+			// Interfaces of other resources, e.g. load balancers or Lambda functions, have no instance attached
+			if nic.Attachment == nil || nic.Attachment.InstanceId == nil {
+				continue
+			}
 			output = append(output, *nic.Attachment.InstanceId)
 		}
 
@@ -53,19 +63,19 @@ func (hr *HostnameResolver) ResolveToInstanceId(client ec2iface.EC2API) (output
 	}
 
 	// Fetch all the instances described
-	if err = client.DescribeNetworkInterfacesPages(dniInput, describeNetworkInterfacesPager); err != nil {
+	if err = client.DescribeNetworkInterfacesPagesWithContext(ctx, dniInput, describeNetworkInterfacesPager); err != nil {
 		return nil, fmt.Errorf("could not describe network interfaces\n%v", err)
 	}
 
 	return output, nil
 }
 
-func resolveToFirst(addr string) (net.IP, error) {
+func resolveToFirst(ctx context.Context, addr string) (net.IP, error) {
 	if ip := net.ParseIP(addr); ip != nil {
 		return ip, nil
-	} else if ips, err := net.LookupIP(addr); err == nil {
-		if len(ips[0]) > 0 {
-			return ips[0], nil
+	} else if addrs, err := net.DefaultResolver.LookupIPAddr(ctx, addr); err == nil {
+		if len(addrs[0].IP) > 0 {
+			return addrs[0].IP, nil
 		}
 	}
 
@@ -1,10 +1,13 @@
 package resolver
 
 import (
+	"context"
 	"io/ioutil"
 	"net"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/sirupsen/logrus"
@@ -14,9 +17,21 @@ import (
 type mockedEC2 struct {
 	ec2iface.EC2API
 	DescribeNetworkInterfacesOutput []*ec2.DescribeNetworkInterfacesOutput
+	DescribeInstancesOutput         []*ec2.DescribeInstancesOutput
+	DescribeInstancesInput          *ec2.DescribeInstancesInput
 }
 
-func (c *mockedEC2) DescribeNetworkInterfacesPages(input *ec2.DescribeNetworkInterfacesInput, fn func(*ec2.DescribeNetworkInterfacesOutput, bool) bool) error {
+func (c *mockedEC2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	c.DescribeInstancesInput = input
+	for i, output := range c.DescribeInstancesOutput {
+		if !fn(output, i == len(c.DescribeInstancesOutput)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *mockedEC2) DescribeNetworkInterfacesPagesWithContext(ctx aws.Context, input *ec2.DescribeNetworkInterfacesInput, fn func(*ec2.DescribeNetworkInterfacesOutput, bool) bool, opts ...request.Option) error {
 	totalPages := len(c.DescribeNetworkInterfacesOutput)
 	for i, output := range c.DescribeNetworkInterfacesOutput {
 		isLastPage := (i == (totalPages - 1))
@@ -50,14 +65,14 @@ func TestHostnameResolver(t *testing.T) {
 	logger.SetOutput(ioutil.Discard)
 
 	t.Run("test passed ip causes a short circuit", func(t *testing.T) {
-		validIp, err := resolveToFirst(examplePrivateIpAddress)
+		validIp, err := resolveToFirst(context.Background(), examplePrivateIpAddress)
 		assert.Nil(err)
 		assert.NotNil(validIp)
 		assert.EqualValues(validIp, net.ParseIP(examplePrivateIpAddress))
 	})
 
 	t.Run("test passed passed hostname resolves to an IP", func(t *testing.T) {
-		validIp, err := resolveToFirst("example.com")
+		validIp, err := resolveToFirst(context.Background(), "example.com")
 		assert.Nil(err)
 		assert.NotNil(validIp)
 	})
@@ -71,3 +86,22 @@ func TestHostnameResolver(t *testing.T) {
 		assert.EqualValues(resp, []string{exampleInstanceId})
 	})
 }
+
+func TestNameTagResolver(t *testing.T) {
+	assert := assert.New(t)
+
+	mockClient := &mockedEC2{DescribeInstancesOutput: []*ec2.DescribeInstancesOutput{
+		{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}}},
+		{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{{InstanceId: aws.String("i-456")}}}}},
+	}}
+	testResolver := NewNameTagResolver([]string{"web-1.example.com", "web-1"})
+
+	resp, err := testResolver.ResolveToInstanceId(mockClient)
+	assert.NoError(err)
+	assert.Equal([]string{"i-123", "i-456"}, resp)
+
+	filters := mockClient.DescribeInstancesInput.Filters
+	assert.Equal("tag:Name", *filters[0].Name)
+	assert.Equal([]string{"web-1.example.com", "web-1"}, aws.StringValueSlice(filters[0].Values))
+	assert.Equal([]string{"running"}, aws.StringValueSlice(filters[1].Values))
+}
@@ -10,15 +10,29 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/disneystreaming/ssm-helpers/aws/config"
+	"github.com/disneystreaming/ssm-helpers/aws/sso"
 )
 
 // NewPool is used to create a pool of AWS sessions with different profile/region permutations
 func NewPool(profiles []string, regions []string, logger *log.Logger) *Pool {
+	pool, err := BuildPool(profiles, regions, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	return pool
+}
+
+// BuildPool creates the same pool of sessions as NewPool, returning an error if any of them could not be created
+func BuildPool(profiles []string, regions []string, logger *log.Logger) (*Pool, error) {
 	sessions := map[string]*Session{}
 
 	for _, region := range regions {
 		if stsCredentialsSet() {
-			session := newSession("", region, logger)
+			session, err := newSession("", region, logger)
+			if err != nil {
+				return nil, err
+			}
 			name := fmt.Sprintf("default-%s", region)
 			sessions[name] = session
 
@@ -26,13 +40,48 @@ func NewPool(profiles []string, regions []string, logger *log.Logger) *Pool {
 		}
 
 		for _, profile := range profiles {
-			session := newSession(profile, region, logger)
+			session, err := newSession(profile, region, logger)
+			if err != nil {
+				return nil, err
+			}
 			name := fmt.Sprintf("%s-%s", profile, region)
 			sessions[name] = session
 		}
 	}
 
-	return &Pool{Sessions: sessions}
+	return &Pool{Sessions: sessions}, nil
+}
+
+// BuildRolePool creates a session in each region for each of the roles, keyed by the name given to the
+// account they belong to, assuming them with the credentials of their source profiles
+func BuildRolePool(roles map[string]Role, regions []string, logger *log.Logger) (*Pool, error) {
+	sessions := map[string]*Session{}
+
+	for _, region := range regions {
+		// Roles assumed from the same profile share its session
+		sources := make(map[string]*Session)
+
+		for name, role := range roles {
+			source, ok := sources[role.SourceProfile]
+			if !ok {
+				var err error
+				if source, err = newSession(role.SourceProfile, region, logger); err != nil {
+					return nil, err
+				}
+				sources[role.SourceProfile] = source
+			}
+
+			role := role
+			sessions[fmt.Sprintf("%s-%s", name, region)] = &Session{
+				Logger:      logger,
+				ProfileName: name,
+				Session:     source.Session.Copy(&aws.Config{Credentials: stscreds.NewCredentials(source.Session, role.ARN)}),
+				Role:        &role,
+			}
+		}
+	}
+
+	return &Pool{Sessions: sessions}, nil
 }
 
 func stsCredentialsSet() bool {
@@ -47,7 +96,7 @@ func stsCredentialsSet() bool {
 	return true
 }
 
-func newSession(profile string, region string, logger *log.Logger) *Session {
+func newSession(profile string, region string, logger *log.Logger) (*Session, error) {
 	options := session.Options{
 		Config:                  *config.NewDefaultConfig(region),
 		Profile:                 profile,
@@ -55,9 +104,23 @@ func newSession(profile string, region string, logger *log.Logger) *Session {
 		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
 	}
 
+	// The SDK does not support profiles that refer to an sso-session, so the credentials of every SSO profile
+	// are provided by the sso package instead
+	if profile != "" {
+		ssoProfile, err := sso.LoadProfile(profile)
+		if err != nil {
+			return nil, fmt.Errorf("Error when trying to create session:\n%v", err)
+		}
+		if ssoProfile != nil {
+			if options.Config.Credentials, err = sso.NewCredentials(ssoProfile); err != nil {
+				return nil, fmt.Errorf("Error when trying to create session:\n%v", err)
+			}
+		}
+	}
+
 	session, err := session.NewSessionWithOptions(options)
 	if err != nil {
-		logger.Fatalf("Error when trying to create session:\n%v", err)
+		return nil, fmt.Errorf("Error when trying to create session:\n%v", err)
 	}
 
 	if logger.Level == log.TraceLevel {
@@ -68,5 +131,5 @@ func newSession(profile string, region string, logger *log.Logger) *Session {
 		Logger:      logger,
 		ProfileName: profile,
 		Session:     session,
-	}
+	}, nil
 }
@@ -3,10 +3,13 @@ package session
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/aws/sso"
 )
 
 func TestCreateAWSSession(t *testing.T) {
@@ -18,10 +21,12 @@ func TestCreateAWSSession(t *testing.T) {
 	// Set AWS_REGION to a made-up value to ensure no overlap with real regions
 	os.Setenv("AWS_REGION", "us-test-1")
 
-	session := newSession(os.Getenv("AWS_PROFILE"), "", logger)
+	session, err := newSession(os.Getenv("AWS_PROFILE"), "", logger)
+	assert.NoError(err)
 	assert.Equalf(*session.Session.Config.Region, "us-test-1", "AWS SDK did not load correct region from envvar, expected 'us-test-1', got %s", *session.Session.Config.Region)
 
-	session = newSession(os.Getenv("AWS_PROFILE"), "us-test-2", logger)
+	session, err = newSession(os.Getenv("AWS_PROFILE"), "us-test-2", logger)
+	assert.NoError(err)
 	assert.Equalf(*session.Session.Config.Region, "us-test-2", "AWS SDK did not load correct region from envvar, expected 'us-test-2', got %s", *session.Session.Config.Region)
 }
 
@@ -58,3 +63,51 @@ func TestCreateAWSSessionPool(t *testing.T) {
 	})
 
 }
+
+func TestCreateSSOSession(t *testing.T) {
+	assert := assert.New(t)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	// Profiles that refer to an sso-session are not supported by the SDK itself
+	path := filepath.Join(t.TempDir(), "config")
+	assert.NoError(ioutil.WriteFile(path, []byte(`[profile sso-test]
+sso_session = ssm-helpers-test
+sso_account_id = 111111111111
+sso_role_name = Admin
+
+[sso-session ssm-helpers-test]
+sso_start_url = https://ssm-helpers-test.awsapps.com/start
+sso_region = us-east-1
+`), 0600))
+	t.Setenv("AWS_CONFIG_FILE", path)
+
+	session, err := newSession("sso-test", "us-west-2", logger)
+	assert.NoError(err)
+	assert.Equal("us-west-2", *session.Session.Config.Region)
+
+	_, err = session.Session.Config.Credentials.Get()
+	assert.IsType(&sso.LoginRequiredError{}, err)
+}
+
+func TestCreateRoleSessionPool(t *testing.T) {
+	assert := assert.New(t)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	roles := map[string]Role{
+		"dev":  {SourceProfile: "profile1", ARN: "arn:aws:iam::111111111111:role/OrganizationAccountAccessRole"},
+		"prod": {SourceProfile: "profile1", ARN: "arn:aws:iam::222222222222:role/OrganizationAccountAccessRole"},
+	}
+	pool, err := BuildRolePool(roles, []string{"us-test-1", "us-test-2"}, logger)
+	assert.NoError(err)
+	assert.Len(pool.Sessions, 4)
+
+	// Sessions are named after the account and remember the role they assume
+	session := pool.Sessions["prod-us-test-2"]
+	assert.Equal("prod", session.ProfileName)
+	assert.Equal("us-test-2", *session.Session.Config.Region)
+	assert.Equal(roles["prod"], *session.Role)
+}
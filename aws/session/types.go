@@ -10,6 +10,15 @@ type Session struct {
 	Logger      *logrus.Logger
 	Session     *session.Session
 	ProfileName string
+
+	// Role is set for sessions that assume a role in another account, in which case ProfileName names that account
+	Role *Role
+}
+
+// Role is a role in another account, assumed with the credentials of a profile
+type Role struct {
+	SourceProfile string `json:"source_profile"`
+	ARN           string `json:"arn"`
 }
 
 // Pool contains a set of session configurations for the target profiles and regions
@@ -0,0 +1,129 @@
+package sso
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Token is an SSO access token cached by a sign-in, along with the client registration used to obtain it
+type Token struct {
+	StartURL    string    `json:"startUrl,omitempty"`
+	Region      string    `json:"region,omitempty"`
+	AccessToken string    `json:"accessToken"`
+	ExpiresAt   time.Time `json:"-"`
+
+	ClientID              string    `json:"clientId,omitempty"`
+	ClientSecret          string    `json:"clientSecret,omitempty"`
+	RegistrationExpiresAt time.Time `json:"-"`
+}
+
+// tokenFile is the format of the token files of the AWS CLI
+type tokenFile struct {
+	*tokenAlias
+	ExpiresAt             string `json:"expiresAt"`
+	RegistrationExpiresAt string `json:"registrationExpiresAt,omitempty"`
+}
+
+type tokenAlias Token
+
+// cacheTimeFormats are the formats of the expiry times written by the different versions of the AWS CLI
+var cacheTimeFormats = []string{time.RFC3339, "2006-01-02T15:04:05UTC"}
+
+// MarshalJSON encodes the token in the format of the token files of the AWS CLI
+func (t Token) MarshalJSON() ([]byte, error) {
+	f := tokenFile{tokenAlias: (*tokenAlias)(&t), ExpiresAt: t.ExpiresAt.UTC().Format(time.RFC3339)}
+	if !t.RegistrationExpiresAt.IsZero() {
+		f.RegistrationExpiresAt = t.RegistrationExpiresAt.UTC().Format(time.RFC3339)
+	}
+
+	return json.Marshal(f)
+}
+
+// UnmarshalJSON decodes a token file of the AWS CLI
+func (t *Token) UnmarshalJSON(data []byte) (err error) {
+	f := tokenFile{tokenAlias: (*tokenAlias)(t)}
+	if err = json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+
+	if t.ExpiresAt, err = parseCacheTime(f.ExpiresAt); err != nil {
+		return err
+	}
+	if f.RegistrationExpiresAt != "" {
+		t.RegistrationExpiresAt, err = parseCacheTime(f.RegistrationExpiresAt)
+	}
+
+	return err
+}
+
+func parseCacheTime(s string) (t time.Time, err error) {
+	for _, format := range cacheTimeFormats {
+		if t, err = time.Parse(format, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return t, fmt.Errorf("Invalid expiry time %q in SSO token", s)
+}
+
+// Valid returns whether the token can still be used at the given time
+func (t *Token) Valid(now time.Time) bool {
+	return t.AccessToken != "" && now.Before(t.ExpiresAt)
+}
+
+// registered returns whether the client registration of the token can still be used at the given time
+func (t *Token) registered(now time.Time) bool {
+	return t.ClientID != "" && t.ClientSecret != "" && now.Before(t.RegistrationExpiresAt)
+}
+
+// CacheDir returns the directory in which the AWS CLI caches SSO tokens
+func CacheDir() string {
+	dir, _ := homedir.Dir()
+	return filepath.Join(dir, ".aws", "sso", "cache")
+}
+
+// TokenPath returns the path of the token file of the profile's sign-in in dir, named after the SHA-1
+// of its cache key like the AWS CLI does
+func TokenPath(dir string, p *Profile) string {
+	sum := sha1.Sum([]byte(p.CacheKey()))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// LoadToken returns the cached token of the profile's sign-in in dir, or nil if there is none
+func LoadToken(dir string, p *Profile) (*Token, error) {
+	data, err := ioutil.ReadFile(TokenPath(dir, p))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	t := &Token{}
+	if err = json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("Could not read the cached SSO token of profile %s\n%v", p.Name, err)
+	}
+
+	return t, nil
+}
+
+// SaveToken caches the token of the profile's sign-in in dir, readable only by the current user
+func SaveToken(dir string, p *Profile, t *Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(TokenPath(dir, p), data, 0600)
+}
@@ -0,0 +1,60 @@
+package sso
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenPath(t *testing.T) {
+	assert := assert.New(t)
+
+	// Tokens are shared with the AWS CLI, which names them after the SHA-1 of the session name or start URL
+	assert.Equal(filepath.Join("cache", "ee0bfd2552fbd840c02cc48b6e823320543c450f.json"), TokenPath("cache", &Profile{SessionName: "corp"}))
+	assert.Equal(filepath.Join("cache", "79e435d7a515078e81c9dffc35f38d5687ebd3a7.json"), TokenPath("cache", &Profile{StartURL: "https://legacy.awsapps.com/start"}))
+}
+
+func TestTokenCache(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	p := &Profile{Name: "dev", SessionName: "corp"}
+
+	token, err := LoadToken(dir, p)
+	assert.NoError(err)
+	assert.Nil(token)
+
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(SaveToken(dir, p, &Token{StartURL: "https://corp.awsapps.com/start", AccessToken: "access-token", ExpiresAt: expiry}))
+
+	token, err = LoadToken(dir, p)
+	assert.NoError(err)
+	assert.Equal("access-token", token.AccessToken)
+	assert.True(expiry.Equal(token.ExpiresAt))
+	assert.True(token.RegistrationExpiresAt.IsZero())
+	assert.True(token.Valid(expiry.Add(-time.Second)))
+	assert.False(token.Valid(expiry))
+
+	data, err := ioutil.ReadFile(TokenPath(dir, p))
+	assert.NoError(err)
+
+	var raw map[string]string
+	assert.NoError(json.Unmarshal(data, &raw))
+	assert.Equal("2030-01-02T03:04:05Z", raw["expiresAt"])
+	assert.NotContains(raw, "registrationExpiresAt")
+}
+
+func TestTokenUnmarshal(t *testing.T) {
+	assert := assert.New(t)
+
+	// Older versions of the AWS CLI write a different time format
+	var token Token
+	assert.NoError(json.Unmarshal([]byte(`{"accessToken": "a", "expiresAt": "2030-01-02T03:04:05UTC", "registrationExpiresAt": "2030-02-01T00:00:00Z"}`), &token))
+	assert.Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), token.ExpiresAt)
+	assert.Equal(time.Date(2030, 2, 1, 0, 0, 0, 0, time.UTC), token.RegistrationExpiresAt)
+
+	assert.Error(json.Unmarshal([]byte(`{"accessToken": "a", "expiresAt": "tomorrow"}`), &token))
+}
@@ -0,0 +1,94 @@
+package sso
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/sso/ssoiface"
+	"github.com/aws/aws-sdk-go/service/ssooidc"
+	"github.com/aws/aws-sdk-go/service/ssooidc/ssooidciface"
+)
+
+// ProviderName is the name of the credentials provider of SSO profiles
+const ProviderName = "SSOProvider"
+
+// LoginRequiredError is returned when a profile has no valid cached token, so that the user must sign in again
+type LoginRequiredError struct {
+	Profile string
+}
+
+func (e *LoginRequiredError) Error() string {
+	return fmt.Sprintf("The SSO session of profile %s is missing or has expired, run ssm login --profile %s to sign in", e.Profile, e.Profile)
+}
+
+// Provider retrieves the credentials of the role of an SSO profile with the token cached by a sign-in. Unlike
+// the provider of the AWS SDK, it supports profiles that refer to an sso-session.
+type Provider struct {
+	credentials.Expiry
+
+	Profile  *Profile
+	CacheDir string
+	Client   ssoiface.SSOAPI
+}
+
+// NewCredentials returns the credentials of the profile, using the tokens cached in the directory of the AWS CLI
+func NewCredentials(p *Profile) (*credentials.Credentials, error) {
+	sess, err := newAnonymousSession(p.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials.NewCredentials(&Provider{Profile: p, CacheDir: CacheDir(), Client: sso.New(sess)}), nil
+}
+
+// NewOIDCClient returns a client of the SSO OIDC service of the profile's SSO region, for use with Login
+func NewOIDCClient(p *Profile) (ssooidciface.SSOOIDCAPI, error) {
+	sess, err := newAnonymousSession(p.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssooidc.New(sess), nil
+}
+
+// newAnonymousSession returns a session without credentials, as the SSO services authenticate with tokens
+func newAnonymousSession(region string) (*session.Session, error) {
+	return session.NewSession(&aws.Config{Region: aws.String(region), Credentials: credentials.AnonymousCredentials})
+}
+
+// Retrieve exchanges the cached token for the credentials of the profile's role
+func (p *Provider) Retrieve() (credentials.Value, error) {
+	token, err := LoadToken(p.CacheDir, p.Profile)
+	if err != nil {
+		return credentials.Value{ProviderName: ProviderName}, err
+	}
+	if token == nil || !token.Valid(time.Now()) {
+		return credentials.Value{ProviderName: ProviderName}, &LoginRequiredError{Profile: p.Profile.Name}
+	}
+
+	output, err := p.Client.GetRoleCredentials(&sso.GetRoleCredentialsInput{
+		AccessToken: aws.String(token.AccessToken),
+		AccountId:   aws.String(p.Profile.AccountID),
+		RoleName:    aws.String(p.Profile.RoleName),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == sso.ErrCodeUnauthorizedException {
+		return credentials.Value{ProviderName: ProviderName}, &LoginRequiredError{Profile: p.Profile.Name}
+	} else if err != nil {
+		return credentials.Value{ProviderName: ProviderName}, fmt.Errorf("Could not get the credentials of role %s in account %s\n%v", p.Profile.RoleName, p.Profile.AccountID, err)
+	}
+
+	creds := output.RoleCredentials
+	p.SetExpiration(time.Unix(0, aws.Int64Value(creds.Expiration)*int64(time.Millisecond)), time.Minute)
+
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(creds.AccessKeyId),
+		SecretAccessKey: aws.StringValue(creds.SecretAccessKey),
+		SessionToken:    aws.StringValue(creds.SessionToken),
+		ProviderName:    ProviderName,
+	}, nil
+}
@@ -0,0 +1,38 @@
+package sso
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+)
+
+func TestProviderRetrieve(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	p := &Profile{Name: "dev", SessionName: "corp", AccountID: "111111111111", RoleName: "Admin"}
+	provider := &Provider{Profile: p, CacheDir: dir, Client: &mocks.MockSSOClient{}}
+
+	// Without a cached token, the user must sign in
+	_, err := provider.Retrieve()
+	assert.IsType(&LoginRequiredError{}, err)
+
+	assert.NoError(SaveToken(dir, p, &Token{AccessToken: "access-token", ExpiresAt: time.Now().Add(-time.Minute)}))
+	_, err = provider.Retrieve()
+	assert.IsType(&LoginRequiredError{}, err)
+
+	assert.NoError(SaveToken(dir, p, &Token{AccessToken: "access-token", ExpiresAt: time.Now().Add(time.Hour)}))
+	value, err := provider.Retrieve()
+	assert.NoError(err)
+	assert.Equal("AKIA111111111111", value.AccessKeyID)
+	assert.Equal("session-token", value.SessionToken)
+	assert.Equal(ProviderName, value.ProviderName)
+	assert.False(provider.IsExpired())
+
+	// Tokens rejected by SSO, e.g. after signing out, also require signing in again
+	assert.NoError(SaveToken(dir, p, &Token{AccessToken: "revoked", ExpiresAt: time.Now().Add(time.Hour)}))
+	_, err = provider.Retrieve()
+	assert.EqualError(err, "The SSO session of profile dev is missing or has expired, run ssm login --profile dev to sign in")
+}
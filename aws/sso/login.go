@@ -0,0 +1,108 @@
+package sso
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssooidc"
+	"github.com/aws/aws-sdk-go/service/ssooidc/ssooidciface"
+)
+
+// clientName is the name the client is registered under, shown to the user when they confirm a sign-in
+const clientName = "ssm-helpers"
+
+// DefaultPollInterval is the delay between attempts to obtain the token while the user has not yet confirmed
+// the sign-in, if the authorization server does not set one
+var DefaultPollInterval = 5 * time.Second
+
+// Authorization is the code the user confirms in a browser to complete a sign-in
+type Authorization struct {
+	UserCode string
+
+	// VerificationURL is the page on which the code is confirmed, with the code filled in
+	VerificationURL string
+}
+
+// Login signs in to the profile's SSO start URL with the device authorization flow and returns the resulting
+// token, which the caller should cache with SaveToken. The client registration of a previous token is reused
+// while it is valid. prompt is called with the code the user must confirm; Login then waits until they do,
+// the code expires or ctx is canceled.
+func Login(ctx context.Context, client ssooidciface.SSOOIDCAPI, p *Profile, previous *Token, prompt func(Authorization)) (*Token, error) {
+	token := &Token{StartURL: p.StartURL, Region: p.Region}
+
+	if previous != nil && previous.registered(time.Now()) {
+		token.ClientID, token.ClientSecret, token.RegistrationExpiresAt = previous.ClientID, previous.ClientSecret, previous.RegistrationExpiresAt
+	} else {
+		input := &ssooidc.RegisterClientInput{ClientName: aws.String(clientName), ClientType: aws.String("public")}
+		if len(p.Scopes) > 0 {
+			input.Scopes = aws.StringSlice(p.Scopes)
+		}
+
+		registration, err := client.RegisterClient(input)
+		if err != nil {
+			return nil, fmt.Errorf("Could not register with the SSO OIDC service\n%v", err)
+		}
+
+		token.ClientID, token.ClientSecret = aws.StringValue(registration.ClientId), aws.StringValue(registration.ClientSecret)
+		token.RegistrationExpiresAt = time.Unix(aws.Int64Value(registration.ClientSecretExpiresAt), 0)
+	}
+
+	auth, err := client.StartDeviceAuthorization(&ssooidc.StartDeviceAuthorizationInput{
+		ClientId:     aws.String(token.ClientID),
+		ClientSecret: aws.String(token.ClientSecret),
+		StartUrl:     aws.String(p.StartURL),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not start signing in to %s\n%v", p.StartURL, err)
+	}
+
+	prompt(Authorization{
+		UserCode:        aws.StringValue(auth.UserCode),
+		VerificationURL: aws.StringValue(auth.VerificationUriComplete),
+	})
+
+	interval := time.Duration(aws.Int64Value(auth.Interval)) * time.Second
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	deadline := time.Now().Add(time.Duration(aws.Int64Value(auth.ExpiresIn)) * time.Second)
+
+	for {
+		output, err := client.CreateToken(&ssooidc.CreateTokenInput{
+			ClientId:     aws.String(token.ClientID),
+			ClientSecret: aws.String(token.ClientSecret),
+			DeviceCode:   auth.DeviceCode,
+			GrantType:    aws.String("urn:ietf:params:oauth:grant-type:device_code"),
+		})
+		if err == nil {
+			token.AccessToken = aws.StringValue(output.AccessToken)
+			token.ExpiresAt = time.Now().Add(time.Duration(aws.Int64Value(output.ExpiresIn)) * time.Second)
+			return token, nil
+		}
+
+		// Keep polling until the user has confirmed the code, more slowly if asked to
+		aerr, ok := err.(awserr.Error)
+		switch {
+		case ok && aerr.Code() == ssooidc.ErrCodeAuthorizationPendingException:
+		case ok && aerr.Code() == ssooidc.ErrCodeSlowDownException:
+			interval += 5 * time.Second
+		case ok && aerr.Code() == ssooidc.ErrCodeExpiredTokenException:
+			return nil, fmt.Errorf("The code %s expired before it was confirmed", aws.StringValue(auth.UserCode))
+		default:
+			return nil, fmt.Errorf("Could not sign in to %s\n%v", p.StartURL, err)
+		}
+
+		if aws.Int64Value(auth.ExpiresIn) > 0 && time.Now().Add(interval).After(deadline) {
+			return nil, fmt.Errorf("The code %s expired before it was confirmed", aws.StringValue(auth.UserCode))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package sso
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+)
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	DefaultPollInterval = time.Millisecond
+	p := &Profile{Name: "dev", SessionName: "corp", StartURL: "https://corp.awsapps.com/start", Region: "us-east-1"}
+
+	client := &mocks.MockSSOOIDCClient{Pending: 2}
+	var prompted Authorization
+	token, err := Login(context.Background(), client, p, nil, func(auth Authorization) {
+		prompted = auth
+	})
+	assert.NoError(err)
+	assert.Equal("ABCD-EFGH", prompted.UserCode)
+	assert.Equal("https://device.sso.us-east-1.amazonaws.com/?user_code=ABCD-EFGH", prompted.VerificationURL)
+	assert.Equal(3, client.TokenRequests)
+
+	assert.Equal("access-token", token.AccessToken)
+	assert.Equal("client-id", token.ClientID)
+	assert.True(token.Valid(time.Now()))
+	assert.Equal(p.StartURL, token.StartURL)
+
+	// The client registration of the previous token is reused
+	client = &mocks.MockSSOOIDCClient{}
+	_, err = Login(context.Background(), client, p, token, func(Authorization) {})
+	assert.NoError(err)
+	assert.Equal(0, client.Registrations)
+
+	// Waiting for the user stops when the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	client = &mocks.MockSSOOIDCClient{Pending: 1000}
+	_, err = Login(ctx, client, p, nil, func(Authorization) { cancel() })
+	assert.Equal(context.Canceled, err)
+}
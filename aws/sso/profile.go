@@ -0,0 +1,113 @@
+// Package sso resolves AWS IAM Identity Center (SSO) profiles, signs in to them with the device authorization
+// flow and provides the credentials of their roles, sharing the token cache of the AWS CLI (~/.aws/sso/cache).
+package sso
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/disneystreaming/ssm-helpers/aws/config"
+)
+
+// Profile is the SSO configuration of a profile, either set on the profile itself or on the [sso-session]
+// section it refers to
+type Profile struct {
+	Name string
+
+	// SessionName is the name of the sso-session of the profile, empty for profiles that set sso_start_url
+	SessionName string
+
+	StartURL  string
+	Region    string
+	AccountID string
+	RoleName  string
+
+	// Scopes are the sso_registration_scopes of the sso-session
+	Scopes []string
+}
+
+// IsSSOProfile returns whether the settings of a profile configure it to use SSO
+func IsSSOProfile(settings map[string]string) bool {
+	for _, key := range []string{"sso_session", "sso_start_url", "sso_account_id", "sso_role_name"} {
+		if settings[key] != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LookupProfile returns the SSO configuration of the named profile, or nil if the profile does not use SSO.
+// An error is returned if its configuration is incomplete.
+func LookupProfile(cfg *config.SharedConfig, name string) (*Profile, error) {
+	settings, ok := cfg.Profile(name)
+	if !ok || !IsSSOProfile(settings) {
+		return nil, nil
+	}
+
+	p := &Profile{
+		Name:      name,
+		AccountID: settings["sso_account_id"],
+		RoleName:  settings["sso_role_name"],
+	}
+
+	if p.SessionName = settings["sso_session"]; p.SessionName != "" {
+		session, ok := cfg.SSOSession(p.SessionName)
+		if !ok {
+			return nil, fmt.Errorf("Profile %s refers to sso-session %s, which does not exist", name, p.SessionName)
+		}
+
+		p.StartURL, p.Region = session["sso_start_url"], session["sso_region"]
+		for _, scope := range strings.Split(session["sso_registration_scopes"], ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				p.Scopes = append(p.Scopes, scope)
+			}
+		}
+	} else {
+		p.StartURL, p.Region = settings["sso_start_url"], settings["sso_region"]
+	}
+
+	var missing []string
+	for key, value := range map[string]string{
+		"sso_start_url":  p.StartURL,
+		"sso_region":     p.Region,
+		"sso_account_id": p.AccountID,
+		"sso_role_name":  p.RoleName,
+	} {
+		if value == "" {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("Profile %s is configured to use SSO but is missing %s", name, strings.Join(missing, ", "))
+	}
+
+	return p, nil
+}
+
+// LoadProfile returns the SSO configuration of the named profile in the AWS shared config file, or nil if
+// the profile does not use SSO, which is the case of every profile if there is no config file
+func LoadProfile(name string) (*Profile, error) {
+	cfg, err := config.LoadSharedConfig(config.SharedConfigPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return LookupProfile(cfg, name)
+}
+
+// CacheKey identifies the sign-in shared by profiles: the sso-session name, or the start URL of profiles
+// that set it themselves
+func (p *Profile) CacheKey() string {
+	if p.SessionName != "" {
+		return p.SessionName
+	}
+
+	return p.StartURL
+}
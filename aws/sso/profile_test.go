@@ -0,0 +1,85 @@
+package sso
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/aws/config"
+)
+
+const testConfig = `
+[profile dev]
+sso_session = corp
+sso_account_id = 111111111111
+sso_role_name = Admin
+
+[profile legacy]
+sso_start_url = https://legacy.awsapps.com/start
+sso_region = eu-west-1
+sso_account_id = 222222222222
+sso_role_name = ReadOnly
+
+[profile static]
+region = us-east-1
+
+[profile incomplete]
+sso_session = corp
+sso_account_id = 333333333333
+
+[profile dangling]
+sso_session = other
+sso_account_id = 333333333333
+sso_role_name = Admin
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start
+sso_region = us-east-1
+sso_registration_scopes = sso:account:access, codecatalyst:read_write
+`
+
+func loadTestConfig(t *testing.T) *config.SharedConfig {
+	cfg, err := config.ParseSharedConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cfg
+}
+
+func TestLookupProfile(t *testing.T) {
+	assert := assert.New(t)
+	cfg := loadTestConfig(t)
+
+	p, err := LookupProfile(cfg, "dev")
+	assert.NoError(err)
+	assert.Equal(&Profile{
+		Name:        "dev",
+		SessionName: "corp",
+		StartURL:    "https://corp.awsapps.com/start",
+		Region:      "us-east-1",
+		AccountID:   "111111111111",
+		RoleName:    "Admin",
+		Scopes:      []string{"sso:account:access", "codecatalyst:read_write"},
+	}, p)
+	assert.Equal("corp", p.CacheKey())
+
+	p, err = LookupProfile(cfg, "legacy")
+	assert.NoError(err)
+	assert.Equal("eu-west-1", p.Region)
+	assert.Equal("https://legacy.awsapps.com/start", p.CacheKey())
+
+	// Profiles that don't use SSO, or don't exist
+	for _, name := range []string{"static", "missing"} {
+		p, err = LookupProfile(cfg, name)
+		assert.NoError(err)
+		assert.Nil(p)
+	}
+
+	_, err = LookupProfile(cfg, "incomplete")
+	assert.EqualError(err, "Profile incomplete is configured to use SSO but is missing sso_role_name")
+
+	_, err = LookupProfile(cfg, "dangling")
+	assert.Error(err)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -26,9 +27,39 @@ func AddRegionFlag(cmd *cobra.Command) {
 		"Please be careful.")
 }
 
+// AddAllRegionsFlag adds --all-regions to command
+func AddAllRegionsFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("all-regions", false, "Target every region enabled in the account of each profile, in place of --region.\nThe regions of each profile are looked up with DescribeRegions and cached for 24 hours.")
+}
+
+// AddExcludeRegionFlag adds --exclude-region to command
+func AddExcludeRegionFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("exclude-region", nil, "Skip the given regions when --all-regions is set. Regions may contain * wildcards.\nMultiple allowed, delimited by commas (e.g. --exclude-region ap-*,me-south-1)")
+}
+
+// AddParallelFlag adds --parallel to command
+func AddParallelFlag(cmd *cobra.Command, defaultLimit int) {
+	cmd.Flags().Int("parallel", defaultLimit, "Maximum number of profile/region combinations to work on at once.")
+}
+
+// AddRateLimitFlag adds --rate-limit to command
+func AddRateLimitFlag(cmd *cobra.Command, defaultRate float64) {
+	cmd.Flags().Float64("rate-limit", defaultRate, "Maximum number of calls per second to each AWS API in each profile/region combination, 0 for no limit.\nThrottled calls are retried with backoff, and slow the calls to the API down until they succeed again.")
+}
+
+// AddRefreshFlag adds --refresh to command
+func AddRefreshFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("refresh", false, "Look the instances up again instead of using those cached by a previous invocation.")
+}
+
+// AddCacheTTLFlag adds --cache-ttl to command
+func AddCacheTTLFlag(cmd *cobra.Command, defaultTTL time.Duration) {
+	cmd.Flags().Duration("cache-ttl", defaultTTL, "How long the instances of each profile/region combination are cached before they are refreshed in the background, 0 to disable caching.")
+}
+
 // AddFilterFlag adds --filter to command
 func AddFilterFlag(cmd *cobra.Command) {
-	cmd.Flags().StringSliceP("filter", "f", nil, "Filter instances based on tag value. Tags are evaluated with logical AND (instances must match all tags).\nMultiple allowed, delimited by commas (e.g. env=dev,foo=bar)")
+	cmd.Flags().StringSliceP("filter", "f", nil, "Filter instances based on tag value: key=value, key!=value or has:key. Values may contain * wildcards.\nAttributes of the instances are filtered on as attr:<attribute> (e.g. attr:InstanceType=t3.*).\nAn expression matches any of its comma-separated values (e.g. env=prod,staging); instances must match all expressions.\nMultiple allowed, delimited by commas (e.g. env=dev,app!=legacy,has:owner)")
 }
 
 // AddDryRunFlag adds --dry-run to command
@@ -81,14 +112,154 @@ func AddFileFlag(cmd *cobra.Command, desc string) {
 	cmd.Flags().String("file", "", desc)
 }
 
+// AddOutputFlag adds --output to command
+func AddOutputFlag(cmd *cobra.Command, defaultFormat string, desc string) {
+	cmd.Flags().StringP("output", "o", defaultFormat, desc)
+}
+
+// AddDocumentFlag adds --document to command
+func AddDocumentFlag(cmd *cobra.Command, defaultDocument string, desc string) {
+	cmd.Flags().String("document", defaultDocument, desc)
+}
+
+// AddDocumentVersionFlag adds --document-version to command
+func AddDocumentVersionFlag(cmd *cobra.Command) {
+	cmd.Flags().String("document-version", "", "Specify the version of the SSM document to run, e.g. 3, $DEFAULT or $LATEST.\nDefaults to the default version of the document.")
+}
+
+// AddParameterFlag adds --parameter to command
+func AddParameterFlag(cmd *cobra.Command) {
+	cmd.Flags().StringArray("parameter", nil, "Specify a parameter for the SSM document in key=value format.\nCan be repeated; repeating the same key passes a list of values for that parameter (e.g. --parameter playbookurl=s3://bucket/site.yml --parameter check=True)")
+}
+
+// AddParametersFileFlag adds --parameters-file to command
+func AddParametersFileFlag(cmd *cobra.Command) {
+	cmd.Flags().String("parameters-file", "", "Specify the path to a JSON or YAML file containing parameters for the SSM document.\nValues passed with --parameter take precedence over the same keys in this file.")
+}
+
+// AddS3BucketFlag adds --s3-bucket to command
+func AddS3BucketFlag(cmd *cobra.Command) {
+	cmd.Flags().String("s3-bucket", "", "Specify an S3 bucket for SSM to write the complete command output to.\nWhen set, the complete output is downloaded from S3 instead of using the first 24000 characters returned by the SSM API.")
+}
+
+// AddS3PrefixFlag adds --s3-prefix to command
+func AddS3PrefixFlag(cmd *cobra.Command) {
+	cmd.Flags().String("s3-prefix", "", "Specify a key prefix for command output written to the bucket set with --s3-bucket.")
+}
+
+// AddS3EndpointFlag adds --s3-endpoint to command
+func AddS3EndpointFlag(cmd *cobra.Command) {
+	cmd.Flags().String("s3-endpoint", "", "Override the endpoint used to download command output, e.g. for an S3-compatible service (e.g. http://localhost:9000)")
+}
+
+// AddAggregateFlag adds --aggregate to command
+func AddAggregateFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("aggregate", false, "Group instances that produced identical output, printing each distinct output once along with the instances that produced it.\nOutputs produced by fewer instances than the most common output are highlighted as outliers.")
+}
+
+// AddExecutionTimeoutFlag adds --execution-timeout to command
+func AddExecutionTimeoutFlag(cmd *cobra.Command, defaultTimeout time.Duration, desc string) {
+	cmd.Flags().Duration("execution-timeout", defaultTimeout, desc)
+}
+
+// AddDeliveryTimeoutFlag adds --delivery-timeout to command
+func AddDeliveryTimeoutFlag(cmd *cobra.Command, desc string) {
+	cmd.Flags().Duration("delivery-timeout", 0, desc)
+}
+
+// AddTimeoutFlag adds --timeout to command
+func AddTimeoutFlag(cmd *cobra.Command, desc string) {
+	cmd.Flags().Duration("timeout", 0, desc)
+}
+
+// AddBatchSizeFlag adds --batch-size to command
+func AddBatchSizeFlag(cmd *cobra.Command) {
+	cmd.Flags().String("batch-size", "", "Run the command on batches of instances one after the other, instead of on every instance at once.\nBoth numbers, such as 10, and percentages of all targeted instances, such as 10%, are allowed")
+}
+
+// AddBatchPauseFlag adds --batch-pause to command
+func AddBatchPauseFlag(cmd *cobra.Command) {
+	cmd.Flags().Duration("batch-pause", 0, "Time to wait between batches (e.g. 30s)")
+}
+
+// AddCanaryFlag adds --canary to command
+func AddCanaryFlag(cmd *cobra.Command) {
+	cmd.Flags().Int("canary", 0, "Number of instances to run the command on in a first batch, before the batches set with --batch-size")
+}
+
+// AddBatchMaxErrorsFlag adds --batch-max-errors to command
+func AddBatchMaxErrorsFlag(cmd *cobra.Command) {
+	cmd.Flags().String("batch-max-errors", "0", "Max failed instances allowed in a batch before the rollout is halted.\nBoth numbers, such as 1, and percentages of the batch, such as 10%, are allowed")
+}
+
+// AddHealthCheckFlag adds --health-check to command
+func AddHealthCheckFlag(cmd *cobra.Command) {
+	cmd.Flags().String("health-check", "", "Shell command to run on the instances of each batch once the command has completed on them.\nThe rollout is halted if the health check fails on any instance of the batch.")
+}
+
+// AddRetryFailedFlag adds --retry-failed to command
+func AddRetryFailedFlag(cmd *cobra.Command) {
+	cmd.Flags().String("retry-failed", "", "Run the command again on the instances that failed in a previous run, using the same document and parameters.\nSpecify the ID of the run, or \"last\" for the most recent run.")
+}
+
+// AddStatusFlag adds --status to command
+func AddStatusFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("status", nil, "Only list commands with the given status, one of: Pending, InProgress, Success, Cancelled, Failed, TimedOut, Cancelling.\nMultiple allowed, delimited by commas (e.g. --status Failed,TimedOut)")
+}
+
+// AddSinceFlag adds --since to command
+func AddSinceFlag(cmd *cobra.Command) {
+	cmd.Flags().String("since", "", "Only list commands requested after this time, either as a duration before now (e.g. 24h) or a date (e.g. 2020-03-05 or 2020-03-05T17:00:00Z)")
+}
+
+// AddUntilFlag adds --until to command
+func AddUntilFlag(cmd *cobra.Command) {
+	cmd.Flags().String("until", "", "Only list commands requested before this time, either as a duration before now (e.g. 1h) or a date (e.g. 2020-03-05 or 2020-03-05T17:00:00Z)")
+}
+
+// AddRequesterFlag adds --requester to command
+func AddRequesterFlag(cmd *cobra.Command) {
+	cmd.Flags().String("requester", "", "Only list commands sent with ssm run by the given local user")
+}
+
 // AddTagFlag adds --tag to command
 func AddTagFlag(cmd *cobra.Command) {
 	cmd.Flags().StringSliceP("tag", "t", nil, "Adds the specified tag as an additional column to be displayed during the instance selection prompt.")
 }
 
+// AddForwardFlag adds --forward to command
+func AddForwardFlag(cmd *cobra.Command) {
+	cmd.Flags().StringArrayP("forward", "L", nil, "Forward a local port through the session, in [local_port:][host:]remote_port format (e.g. -L 8080:80 or -L 5432:db.example.com:5432).\nForwards to a host are made from the instance, e.g. to reach an RDS endpoint through a bastion. If the local port is omitted, a free port is picked.\nCan be repeated to forward multiple ports at once.")
+}
+
 // AddsAttributeFlag adds the --attribute flag to command.
 func AddAttributeFlag(cmd *cobra.Command) {
-	cmd.Flags().StringSliceP("attribute", "x", nil, "Adds the specified attribute as an additional column to be displayed during the instance selection prompt.")
+	cmd.Flags().StringSliceP("attribute", "x", nil, "Adds the specified attribute as an additional column to be displayed during the instance selection prompt.\nAny of InstanceID, Region, Profile, VpcId, PingStatus, PlatformType, PlatformName, PlatformVersion, AgentVersion, IPAddress, ComputerName, LastPingDateTime, InstanceType, State, AvailabilityZone, PrivateIPAddress, PublicIPAddress, LaunchTime.")
+}
+
+// AddColumnsFlag adds --columns to command
+func AddColumnsFlag(cmd *cobra.Command, defaultColumns []string) {
+	cmd.Flags().StringSlice("columns", defaultColumns, "Columns to include in table and CSV output, delimited by commas (e.g. InstanceID,IPAddress,tag:Name).\nAny of InstanceID, Region, Profile, VpcId, PingStatus, PlatformType, PlatformName, PlatformVersion, AgentVersion, IPAddress, ComputerName, LastPingDateTime, InstanceType, State, AvailabilityZone, PrivateIPAddress, PublicIPAddress, LaunchTime or tag:<key>.")
+}
+
+// AddSortFlag adds --sort to command
+func AddSortFlag(cmd *cobra.Command, defaultSort []string) {
+	cmd.Flags().StringSlice("sort", defaultSort, "Columns to sort on, in order of precedence. Append :desc to a column to sort it in descending order (e.g. LastPingDateTime:desc).")
+}
+
+// AddCopyMethodFlag adds --method to command
+func AddCopyMethodFlag(cmd *cobra.Command) {
+	cmd.Flags().String("method", "scp", "How files are copied, one of: scp, command.\nscp copies through an SSH session tunnelled over SSM; command copies through SendCommand without SSH, for files of up to 256KiB.")
+}
+
+// AddSSHUserFlag adds --ssh-user to command
+func AddSSHUserFlag(cmd *cobra.Command) {
+	cmd.Flags().String("ssh-user", "", "User to log in as when copying with scp. Defaults to the user set in your SSH config.")
+}
+
+// AddSSHOptionFlag adds --ssh-option to command
+func AddSSHOptionFlag(cmd *cobra.Command) {
+	cmd.Flags().StringArray("ssh-option", nil, "Additional option passed to scp with -o, e.g. --ssh-option StrictHostKeyChecking=accept-new. Can be repeated.")
 }
 
 // AddSessionNameFlag adds --session-name to command
@@ -96,6 +267,46 @@ func AddSessionNameFlag(cmd *cobra.Command, defaultName string) {
 	cmd.Flags().String("session-name", defaultName, "Specify a name for the tmux session created when multiple instances are selected")
 }
 
+// AddRecordFlag adds --record to command
+func AddRecordFlag(cmd *cobra.Command) {
+	cmd.Flags().String("record", "", "Record the session to the given file in asciicast v2 format, for playback with ssm replay.\nWhen multiple instances are selected, each session is recorded to its own file, named after the instance.")
+}
+
+// AddSpeedFlag adds --speed to command
+func AddSpeedFlag(cmd *cobra.Command) {
+	cmd.Flags().Float64("speed", 1, "Playback speed, e.g. 2 to play twice as fast or 0.5 to play at half speed")
+}
+
+// AddIdleTimeLimitFlag adds --idle-time-limit to command
+func AddIdleTimeLimitFlag(cmd *cobra.Command) {
+	cmd.Flags().Duration("idle-time-limit", 0, "Shorten pauses longer than the given duration (e.g. 2s) to that duration")
+}
+
+// AddForceLoginFlag adds --force to command
+func AddForceLoginFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("force", false, "Sign in again even if the cached SSO session is still valid")
+}
+
+// AddOrgAccountsFlag adds --org-accounts to command
+func AddOrgAccountsFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("org-accounts", false, "Target the accounts of the AWS Organization, listed with the profiles given by --profile, which must belong to the management account or a delegated administrator.\nA role is assumed in each account, see --org-role.")
+}
+
+// AddOrgRoleFlag adds --org-role to command
+func AddOrgRoleFlag(cmd *cobra.Command, defaultRole string) {
+	cmd.Flags().String("org-role", defaultRole, "Name of the role to assume in each account of the organization when --org-accounts is set")
+}
+
+// AddOrgUnitFlag adds --org-unit to command
+func AddOrgUnitFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("org-unit", nil, "Only target the accounts in the given organizational units (e.g. ou-ab12-cdef3456), including those in OUs nested below them.\nCan be repeated or delimited by commas.")
+}
+
+// AddOrgTagFlag adds --org-tag to command
+func AddOrgTagFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("org-tag", nil, "Only target the accounts of the organization that have the given tag, in key=value format.\nCan be repeated or delimited by commas; accounts must have all of the tags.")
+}
+
 // ValidateArgs makes sure nothing extra was passed on CLI
 func ValidateArgs(cmd *cobra.Command, args []string) error {
 	if len(args) != 0 {
@@ -158,6 +369,14 @@ func GetFlagStringSlice(cmd *cobra.Command, flag string) (s []string, err error)
 	return s, nil
 }
 
+// GetFlagStringArray returns the []string value of a StringArray() flag
+func GetFlagStringArray(cmd *cobra.Command, flag string) (s []string, err error) {
+	if s, err = cmd.Flags().GetStringArray(flag); err != nil {
+		return nil, fmt.Errorf("Could not fetch flag %v for command %v\n%v", flag, cmd.Name(), err)
+	}
+	return s, nil
+}
+
 // GetFlagString returns the string value of a String() flag
 func GetFlagString(cmd *cobra.Command, flag string) (s string, err error) {
 	if s, err = cmd.Flags().GetString(flag); err != nil {
@@ -185,6 +404,24 @@ func GetFlagInt(cmd *cobra.Command, flag string) (i int, err error) {
 	return i, nil
 }
 
+// GetFlagFloat64 returns the float64 value from a Float64() flag
+func GetFlagFloat64(cmd *cobra.Command, flag string) (f float64, err error) {
+	if f, err = cmd.Flags().GetFloat64(flag); err != nil {
+		return f, fmt.Errorf("Could not fetch flag %v for command %v\n%v", flag, cmd.Name(), err)
+	}
+
+	return f, nil
+}
+
+// GetFlagDuration returns the time.Duration value from a Duration() flag
+func GetFlagDuration(cmd *cobra.Command, flag string) (d time.Duration, err error) {
+	if d, err = cmd.Flags().GetDuration(flag); err != nil {
+		return d, fmt.Errorf("Could not fetch flag %v for command %v\n%v", flag, cmd.Name(), err)
+	}
+
+	return d, nil
+}
+
 // GetMapFromStringSlice returns a k,v map from a StringSlice() flag
 func GetMapFromStringSlice(cmd *cobra.Command, flag string) (map[string]string, error) {
 	m := make(map[string]string)
@@ -420,6 +420,40 @@ func TestGetFlagInt(t *testing.T) {
 	})
 }
 
+func TestGetFlagFloat64(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("flag present, default value", func(t *testing.T) {
+		cmd := NewTestCmd()
+		AddSpeedFlag(cmd)
+		cmd.Execute()
+
+		flag, err := GetFlagFloat64(cmd, "speed")
+		assert.NoError(err)
+		assert.Equal(1.0, flag)
+	})
+
+	t.Run("flag present, set to 2.5", func(t *testing.T) {
+		cmd := NewTestCmd()
+		AddSpeedFlag(cmd)
+		cmd.SetArgs([]string{"--speed", "2.5"})
+		cmd.Execute()
+
+		flag, err := GetFlagFloat64(cmd, "speed")
+		assert.NoError(err)
+		assert.Equal(2.5, flag)
+	})
+
+	t.Run("flag not defined", func(t *testing.T) {
+		cmd := NewTestCmd()
+		cmd.Execute()
+
+		flag, err := GetFlagFloat64(cmd, "speed")
+		assert.Error(err)
+		assert.Empty(flag)
+	})
+}
+
 func TestGetMapFromStringSlice(t *testing.T) {
 	assert := assert.New(t)
 
@@ -0,0 +1,352 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/spf13/cobra"
+
+	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+)
+
+// maxParallelCopies is the maximum number of scp processes run at the same time
+const maxParallelCopies = 10
+
+func newCommandSSMCopy() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cp [@target] <source> <destination>",
+		Short: "copy files to and from instances using SSM",
+		Long: `Copy a file to or from instances using SSM, verifying its SHA-256 checksum on each instance.
+
+One of the source and destination must be a remote path: either <instance-id>:<path>, or :<path> to target the
+instances selected with the --instance, --address and --filter flags or an @target. When downloading from more than one instance,
+the destination is a directory, and the file from each instance is written to <destination>/<instance-id>/.`,
+		Example: `  ssm cp ./app.conf i-0d770cb81ae0fc316:/etc/app/
+  ssm cp ./app.conf :/etc/app/app.conf --filter app=web --method command
+  ssm cp :/var/log/app.log ./logs --filter app=web
+  ssm cp @web ./app.conf :/etc/app/`,
+		Run: func(cmd *cobra.Command, args []string) {
+			copyCommand(cmd, args)
+		},
+	}
+
+	addBaseFlags(cmd)
+	addCopyFlags(cmd)
+
+	return cmd
+}
+
+func copyCommand(cmd *cobra.Command, args []string) {
+	var err error
+	var instanceList, addressList, sshOptions []string
+	var paths copyPaths
+	var method, sshUser string
+
+	if args, err = applyNamedTarget(cmd, args); err != nil {
+		log.Fatal(err)
+	}
+	if len(args) != 2 {
+		log.Fatal(cmdutil.UsageError(cmd, "Expected a source and a destination, got %d argument(s).", len(args)))
+	}
+
+	if paths, err = getCopyPaths(cmd, args); err != nil {
+		log.Fatal(err)
+	}
+
+	if instanceList, err = cmdutil.GetFlagStringSlice(cmd, "instance"); err != nil {
+		log.Fatal(err)
+	}
+	if paths.InstanceID != "" {
+		instanceList = append(instanceList, paths.InstanceID)
+	}
+
+	if addressList, err = cmdutil.GetFlagStringSlice(cmd, "address"); err != nil {
+		log.Fatal(err)
+	}
+
+	var filterList ssmx.Filters
+	if filterList, err = getFilters(cmd); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = validateSessionFlags(cmd, instanceList, filterList); err != nil {
+		log.Fatal(err)
+	}
+
+	// Never copy to or from every instance because no targets were given
+	if len(instanceList) == 0 && len(addressList) == 0 && len(filterList) == 0 {
+		log.Fatal(cmdutil.UsageError(cmd, "You must supply target arguments using either an instance ID in the remote path, or the --filter, --instance or --address flags."))
+	}
+
+	if method, err = getCopyMethod(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if sshUser, err = cmdutil.GetFlagString(cmd, "ssh-user"); err != nil {
+		log.Fatal(err)
+	}
+	if sshOptions, err = cmdutil.GetFlagStringArray(cmd, "ssh-option"); err != nil {
+		log.Fatal(err)
+	}
+
+	var poolOpts poolOptions
+	if poolOpts, err = getPoolOptions(cmd); err != nil {
+		log.Fatal(err)
+	}
+
+	var dryRunFlag bool
+	if dryRunFlag, err = cmdutil.GetFlagBool(cmd, "dry-run"); err != nil {
+		log.Fatal(err)
+	}
+
+	var data []byte
+	if paths.Upload {
+		if data, err = readCopySource(paths.LocalPath, method); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	targets := getCopyTargets(poolOpts, instanceList, addressList, filterList)
+
+	var total int
+	for _, t := range targets {
+		total += len(t.Instances)
+		for _, id := range t.Instances {
+			log.Infof("%s (%s, %s)", id, t.Session.ProfileName, *t.Session.Session.Config.Region)
+		}
+	}
+	log.Infof("Found %d instance(s) to copy to or from", total)
+
+	if total == 0 || dryRunFlag {
+		return
+	}
+
+	ctx, _ := interruptContext()
+
+	var results []*ssmx.CopyResult
+	switch {
+	case method == "command" && paths.Upload:
+		results = ssmx.Upload(ctx, targets, data, paths.RemotePath, filepath.Base(paths.LocalPath))
+	case method == "command":
+		results = ssmx.Download(ctx, targets, paths.RemotePath)
+		writeDownloads(results, paths.LocalPath, total > 1)
+	default:
+		results = scpCopy(ctx, targets, paths, total > 1, sshUser, sshOptions)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			log.Errorf("%s (%s, %s): %v", r.InstanceID, r.Profile, r.Region, r.Err)
+			continue
+		}
+		log.Infof("%s (%s, %s): copied %s (sha256 %s)", r.InstanceID, r.Profile, r.Region, r.Path, r.Checksum)
+	}
+
+	if failed > 0 {
+		log.Errorf("Copy failed on %d of %d instance(s)", failed, len(results))
+		os.Exit(1)
+	}
+}
+
+// readCopySource reads the local file to upload
+func readCopySource(localPath, method string) ([]byte, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", localPath)
+	}
+
+	if method == "command" && info.Size() > ssmx.MaxCommandCopySize {
+		return nil, fmt.Errorf("%s is larger than the %d bytes that can be copied with --method command, use --method scp instead", localPath, ssmx.MaxCommandCopySize)
+	}
+
+	return ioutil.ReadFile(localPath)
+}
+
+// getCopyTargets returns the online managed instances that match the provided instance IDs, addresses and filters
+// in each profile/region combination
+func getCopyTargets(opts poolOptions, instanceList, addressList []string, filterList ssmx.Filters) (targets []*ssmx.RolloutTarget) {
+	var mu sync.Mutex
+
+	group := opts.newGroup()
+	sessionPool := opts.newSessionPool()
+	for _, sess := range sessionPool.Sessions {
+		sess := sess
+		group.Go(func() {
+			ssmClient := ssm.New(sess.Session)
+			sessionInstances, err := getSessionInstances(sess, ssmClient, instanceList, addressList, filterList)
+			if err != nil {
+				log.Errorf("%s in %s: %v", sess.ProfileName, *sess.Session.Config.Region, err)
+				return
+			}
+
+			t := &ssmx.RolloutTarget{Session: sess, Client: ssmClient}
+			for _, v := range sessionInstances {
+				if aws.StringValue(v.PingStatus) == ssm.PingStatusOnline {
+					t.Instances = append(t.Instances, aws.StringValue(v.InstanceId))
+				}
+			}
+
+			if len(t.Instances) > 0 {
+				mu.Lock()
+				targets = append(targets, t)
+				mu.Unlock()
+			}
+		})
+	}
+	group.Wait()
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Session.ProfileName+*targets[i].Session.Session.Config.Region <
+			targets[j].Session.ProfileName+*targets[j].Session.Session.Config.Region
+	})
+
+	return targets
+}
+
+// downloadPath returns the local path a file downloaded from an instance is written to. When downloading
+// from multiple instances, each file is written to a directory named after its instance.
+func downloadPath(localPath, remotePath, instanceID string, multiple bool) string {
+	if multiple {
+		return filepath.Join(localPath, instanceID, path.Base(remotePath))
+	}
+
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		return filepath.Join(localPath, path.Base(remotePath))
+	}
+
+	return localPath
+}
+
+// writeDownloads writes the data of each successful download to its local path
+func writeDownloads(results []*ssmx.CopyResult, localPath string, multiple bool) {
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+
+		dest := downloadPath(localPath, r.Path, r.InstanceID, multiple)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			r.Err = err
+			continue
+		}
+
+		if err := ioutil.WriteFile(dest, r.Data, 0644); err != nil {
+			r.Err = err
+			continue
+		}
+		r.Path = dest
+	}
+}
+
+// scpCopy copies the file to or from every instance of the targets with scp, tunnelled through
+// ssm proxy, then verifies the checksum of the file on each instance with SendCommand
+func scpCopy(ctx context.Context, targets []*ssmx.RolloutTarget, paths copyPaths, multiple bool, sshUser string, sshOptions []string) (results []*ssmx.CopyResult) {
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Could not find the path of the ssm executable for the scp ProxyCommand\n%v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan struct{}, maxParallelCopies)
+
+	// The instances that the file was copied to or from, so that its checksum can be verified
+	var copied []*ssmx.RolloutTarget
+	local := make(map[string]string)
+
+	for _, t := range targets {
+		ok := &ssmx.RolloutTarget{Session: t.Session, Client: t.Client}
+		copied = append(copied, ok)
+
+		for _, id := range t.Instances {
+			wg.Add(1)
+			go func(t *ssmx.RolloutTarget, id string) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				r := &ssmx.CopyResult{InstanceID: id, Profile: t.Session.ProfileName, Region: *t.Session.Session.Config.Region}
+
+				host := id
+				if sshUser != "" {
+					host = sshUser + "@" + id
+				}
+
+				args := []string{
+					"-q", "-o", "BatchMode=yes",
+					"-o", fmt.Sprintf("ProxyCommand='%s' proxy %%h %%p --profile '%s' --region '%s'", self, r.Profile, r.Region),
+				}
+				for _, o := range sshOptions {
+					args = append(args, "-o", o)
+				}
+
+				localPath := paths.LocalPath
+				if paths.Upload {
+					args = append(args, localPath, host+":"+paths.RemotePath)
+				} else {
+					localPath = downloadPath(paths.LocalPath, paths.RemotePath, id, multiple)
+					if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+						r.Err = err
+					}
+					args = append(args, host+":"+paths.RemotePath, localPath)
+				}
+
+				if r.Err == nil {
+					if out, err := exec.CommandContext(ctx, "scp", args...).CombinedOutput(); err != nil {
+						r.Err = fmt.Errorf("scp failed: %v\n%s", err, strings.TrimSpace(string(out)))
+					}
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if r.Err != nil {
+					results = append(results, r)
+					return
+				}
+				ok.Instances = append(ok.Instances, id)
+				local[id] = localPath
+			}(t, id)
+		}
+	}
+	wg.Wait()
+
+	// Compare the checksum of each remote file with the local one
+	for _, r := range ssmx.RemoteChecksums(ctx, copied, paths.RemotePath, filepath.Base(paths.LocalPath)) {
+		if r.Err == nil {
+			data, err := ioutil.ReadFile(local[r.InstanceID])
+			switch {
+			case err != nil:
+				r.Err = err
+			case ssmx.Checksum(data) != r.Checksum:
+				r.Err = fmt.Errorf("Checksum mismatch: %s on the instance, %s locally", r.Checksum, ssmx.Checksum(data))
+			}
+		}
+
+		if !paths.Upload {
+			r.Path = local[r.InstanceID]
+		}
+		results = append(results, r)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].InstanceID < results[j].InstanceID
+	})
+
+	return results
+}
@@ -3,18 +3,42 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ssm"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	awsx "github.com/disneystreaming/ssm-helpers/aws"
+	"github.com/disneystreaming/ssm-helpers/aws/org"
+	"github.com/disneystreaming/ssm-helpers/aws/ratelimit"
+	"github.com/disneystreaming/ssm-helpers/aws/regions"
 	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
 	"github.com/disneystreaming/ssm-helpers/cmd/logutil"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+	startsession "github.com/disneystreaming/ssm-helpers/ssm/session"
 	"github.com/disneystreaming/ssm-helpers/util"
+	"github.com/disneystreaming/ssm-helpers/util/batch"
+	"github.com/disneystreaming/ssm-helpers/util/parallel"
 )
 
+// defaultDocument is the SSM document used by the run subcommand unless --document is specified
+const defaultDocument = "AWS-RunShellScript"
+
+// shellDocuments are the documents that execute the "commands" parameter in a shell on the target
+var shellDocuments = map[string]bool{
+	"AWS-RunShellScript":      true,
+	"AWS-RunPowerShellScript": true,
+}
+
 func addBaseFlags(cmd *cobra.Command) {
 	cmdutil.AddAllProfilesFlag(cmd)
 	cmdutil.AddDryRunFlag(cmd)
@@ -23,13 +47,54 @@ func addBaseFlags(cmd *cobra.Command) {
 	cmdutil.AddHostnameFlag(cmd)
 	cmdutil.AddProfileFlag(cmd)
 	cmdutil.AddRegionFlag(cmd)
+	cmdutil.AddAllRegionsFlag(cmd)
+	cmdutil.AddExcludeRegionFlag(cmd)
+	cmdutil.AddParallelFlag(cmd, parallel.DefaultLimit)
+	cmdutil.AddRateLimitFlag(cmd, ratelimit.DefaultRate)
+}
+
+// addPoolFlags adds the flags that select the profile/region combinations to use, for commands that don't target instances
+func addPoolFlags(cmd *cobra.Command) {
+	cmdutil.AddAllProfilesFlag(cmd)
+	cmdutil.AddProfileFlag(cmd)
+	cmdutil.AddRegionFlag(cmd)
+	cmdutil.AddAllRegionsFlag(cmd)
+	cmdutil.AddExcludeRegionFlag(cmd)
+	cmdutil.AddParallelFlag(cmd, parallel.DefaultLimit)
+	cmdutil.AddRateLimitFlag(cmd, ratelimit.DefaultRate)
+}
+
+// addOrgFlags adds the flags that target the accounts of an AWS Organization instead of the profiles themselves
+func addOrgFlags(cmd *cobra.Command) {
+	cmdutil.AddOrgAccountsFlag(cmd)
+	cmdutil.AddOrgRoleFlag(cmd, org.DefaultRole)
+	cmdutil.AddOrgUnitFlag(cmd)
+	cmdutil.AddOrgTagFlag(cmd)
 }
 
 func addRunFlags(cmd *cobra.Command) {
 	cmdutil.AddCommandFlag(cmd)
-	cmdutil.AddFileFlag(cmd, "Specify the path to a shell script to use as input for the AWS-RunShellScript document.\nThis can be used in combination with the --commands/-c flag, and will be run after the specified commands.")
+	cmdutil.AddFileFlag(cmd, "Specify the path to a script to run with the shell-script documents, AWS-RunShellScript and AWS-RunPowerShellScript.\nThis can be used in combination with the --commands/-c flag, and will be run after the specified commands.")
 	cmdutil.AddMaxConcurrencyFlag(cmd, "50", "Max targets to run the command in parallel. Both numbers, such as 50, and percentages, such as 50%, are allowed")
 	cmdutil.AddMaxErrorsFlag(cmd, "0", "Max errors allowed before running on additional targets. Both numbers, such as 10, and percentages, such as 10%, are allowed")
+	cmdutil.AddDocumentFlag(cmd, defaultDocument, "Specify the name or ARN of the SSM document to run, e.g. AWS-RunPowerShellScript or your own custom document.")
+	cmdutil.AddDocumentVersionFlag(cmd)
+	cmdutil.AddParameterFlag(cmd)
+	cmdutil.AddParametersFileFlag(cmd)
+	cmdutil.AddExecutionTimeoutFlag(cmd, 10*time.Minute, "Maximum time the command may run on each instance before it is stopped (the executionTimeout document parameter).\nOnly set by default for the AWS-RunShellScript and AWS-RunPowerShellScript documents.")
+	cmdutil.AddDeliveryTimeoutFlag(cmd, "Maximum time to wait for the command to be delivered to each instance before it is marked as Delivery Timed Out, minimum 30s.\nDefaults to the SSM default of 1 hour.")
+	cmdutil.AddTimeoutFlag(cmd, "Maximum time to wait for the whole run to finish (e.g. 15m).\nWhen it is exceeded, polling stops and unfinished instances are reported as timed out.")
+	cmdutil.AddBatchSizeFlag(cmd)
+	cmdutil.AddBatchPauseFlag(cmd)
+	cmdutil.AddCanaryFlag(cmd)
+	cmdutil.AddBatchMaxErrorsFlag(cmd)
+	cmdutil.AddHealthCheckFlag(cmd)
+	cmdutil.AddS3BucketFlag(cmd)
+	cmdutil.AddS3PrefixFlag(cmd)
+	cmdutil.AddS3EndpointFlag(cmd)
+	cmdutil.AddAggregateFlag(cmd)
+	cmdutil.AddRetryFailedFlag(cmd)
+	cmdutil.AddOutputFlag(cmd, string(invocation.FormatTable), "Output format for invocation results, one of: table, json, ndjson, yaml.\nStructured formats write results to stdout and all log messages to stderr.")
 }
 
 func addSessionFlags(cmd *cobra.Command) {
@@ -37,6 +102,60 @@ func addSessionFlags(cmd *cobra.Command) {
 	cmdutil.AddAttributeFlag(cmd)
 	cmdutil.AddSessionNameFlag(cmd, "ssm-session")
 	cmdutil.AddLimitFlag(cmd, 10, "Set a limit for the number of instance results returned per profile/region combination.")
+	cmdutil.AddRecordFlag(cmd)
+	cmdutil.AddRefreshFlag(cmd)
+	cmdutil.AddCacheTTLFlag(cmd, instance.DefaultCacheTTL)
+}
+
+func addReplayFlags(cmd *cobra.Command) {
+	cmdutil.AddSpeedFlag(cmd)
+	cmdutil.AddIdleTimeLimitFlag(cmd)
+}
+
+func addForwardFlags(cmd *cobra.Command) {
+	cmdutil.AddForwardFlag(cmd)
+	cmdutil.AddTagFlag(cmd)
+	cmdutil.AddAttributeFlag(cmd)
+	cmdutil.AddLimitFlag(cmd, 10, "Set a limit for the number of instance results returned per profile/region combination.")
+	cmdutil.AddRefreshFlag(cmd)
+	cmdutil.AddCacheTTLFlag(cmd, instance.DefaultCacheTTL)
+}
+
+func addCopyFlags(cmd *cobra.Command) {
+	cmdutil.AddCopyMethodFlag(cmd)
+	cmdutil.AddSSHUserFlag(cmd)
+	cmdutil.AddSSHOptionFlag(cmd)
+}
+
+func addHistoryFlags(cmd *cobra.Command) {
+	cmdutil.AddStatusFlag(cmd)
+	cmdutil.AddDocumentFlag(cmd, "", "Only list commands that ran the given SSM document, e.g. AWS-RunShellScript")
+	cmdutil.AddSinceFlag(cmd)
+	cmdutil.AddUntilFlag(cmd)
+	cmdutil.AddRequesterFlag(cmd)
+	cmdutil.AddLimitFlag(cmd, 50, "Set a limit for the number of commands listed.")
+	cmdutil.AddOutputFlag(cmd, string(invocation.FormatTable), "Output format for the list of commands, one of: table, json, ndjson, yaml.")
+}
+
+func addHistoryShowFlags(cmd *cobra.Command) {
+	cmdutil.AddS3EndpointFlag(cmd)
+	cmdutil.AddAggregateFlag(cmd)
+	cmdutil.AddOutputFlag(cmd, string(invocation.FormatTable), "Output format for invocation results, one of: table, json, ndjson, yaml.\nStructured formats write results to stdout and all log messages to stderr.")
+}
+
+func addListFlags(cmd *cobra.Command) {
+	cmdutil.AddFilterFlag(cmd)
+	cmdutil.AddInstanceFlag(cmd)
+	cmdutil.AddHostnameFlag(cmd)
+	cmdutil.AddColumnsFlag(cmd, defaultListColumns)
+	cmdutil.AddSortFlag(cmd, []string{"Profile", "Region", "InstanceID"})
+	cmdutil.AddOutputFlag(cmd, string(invocation.FormatTable), "Output format for the list of instances, one of: table, csv, json, ndjson, yaml.\nStructured formats include every field of the instances, regardless of --columns.")
+}
+
+func addLoginFlags(cmd *cobra.Command) {
+	cmdutil.AddAllProfilesFlag(cmd)
+	cmdutil.AddProfileFlag(cmd)
+	cmdutil.AddForceLoginFlag(cmd)
 }
 
 func getCommandList(cmd *cobra.Command) (commandList []string, err error) {
@@ -56,6 +175,289 @@ func getCommandList(cmd *cobra.Command) (commandList []string, err error) {
 	return commandList, nil
 }
 
+// getDocumentParameters builds the parameters for the chosen SSM document from the --parameters-file and
+// --parameter flags, combined with any commands specified via the --command and --file flags
+func getDocumentParameters(cmd *cobra.Command, document string, commandList []string) (map[string][]*string, error) {
+	params := make(map[string][]string)
+
+	paramsFile, err := cmdutil.GetFlagString(cmd, "parameters-file")
+	if err != nil {
+		return nil, err
+	}
+
+	if paramsFile != "" {
+		if params, err = util.ReadParametersFile(paramsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	paramList, err := cmdutil.GetFlagStringArray(cmd, "parameter")
+	if err != nil {
+		return nil, err
+	}
+
+	// Repeated keys build up a list of values, and replace any value for the same key read from the file
+	flagParams := make(map[string][]string)
+	for _, v := range paramList {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, cmdutil.UsageError(cmd, "Invalid --parameter format: %s, expected key=value", v)
+		}
+		flagParams[kv[0]] = append(flagParams[kv[0]], kv[1])
+	}
+
+	for k, v := range flagParams {
+		params[k] = v
+	}
+
+	if len(commandList) > 0 {
+		if _, exists := params["commands"]; exists {
+			return nil, cmdutil.UsageError(cmd, "The commands parameter cannot be combined with the --command and --file flags.")
+		}
+		params["commands"] = commandList
+	}
+
+	executionTimeout, err := cmdutil.GetFlagDuration(cmd, "execution-timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	// To emulate the original script, shell documents default to an execution timeout of 10 minutes
+	if cmd.Flags().Changed("execution-timeout") || shellDocuments[document] {
+		_, exists := params["executionTimeout"]
+		switch {
+		case exists && cmd.Flags().Changed("execution-timeout"):
+			return nil, cmdutil.UsageError(cmd, "The executionTimeout parameter cannot be combined with the --execution-timeout flag.")
+		case executionTimeout < time.Second:
+			return nil, cmdutil.UsageError(cmd, "--execution-timeout must be at least 1s.")
+		case !exists:
+			params["executionTimeout"] = []string{strconv.Itoa(int(executionTimeout.Seconds()))}
+		}
+	}
+
+	parameters := make(map[string][]*string)
+	for k, v := range params {
+		parameters[k] = aws.StringSlice(v)
+	}
+
+	return parameters, nil
+}
+
+// getTimeouts returns the delivery timeout to set on the command, and the client-side deadline for the whole run
+func getTimeouts(cmd *cobra.Command) (deliveryTimeout time.Duration, timeout time.Duration, err error) {
+	if deliveryTimeout, err = cmdutil.GetFlagDuration(cmd, "delivery-timeout"); err != nil {
+		return 0, 0, err
+	}
+	if timeout, err = cmdutil.GetFlagDuration(cmd, "timeout"); err != nil {
+		return 0, 0, err
+	}
+
+	// SSM only accepts delivery timeouts between 30 seconds and 30 days
+	if deliveryTimeout != 0 && (deliveryTimeout < 30*time.Second || deliveryTimeout > 30*24*time.Hour) {
+		return 0, 0, cmdutil.UsageError(cmd, "--delivery-timeout must be between 30s and 720h.")
+	}
+
+	if timeout < 0 {
+		return 0, 0, cmdutil.UsageError(cmd, "--timeout cannot be negative.")
+	}
+
+	return deliveryTimeout, timeout, nil
+}
+
+// getRollout returns the rollout configured with the --batch-size, --canary, --batch-pause, --batch-max-errors
+// and --health-check flags, or nil if the command should be sent to every instance at once
+func getRollout(cmd *cobra.Command) (*ssmx.Rollout, error) {
+	var err error
+	var batchSize, batchMaxErrors, healthCheck string
+	var canary int
+	var pause, executionTimeout time.Duration
+
+	if batchSize, err = cmdutil.GetFlagString(cmd, "batch-size"); err != nil {
+		return nil, err
+	}
+	if canary, err = cmdutil.GetFlagInt(cmd, "canary"); err != nil {
+		return nil, err
+	}
+	if pause, err = cmdutil.GetFlagDuration(cmd, "batch-pause"); err != nil {
+		return nil, err
+	}
+	if batchMaxErrors, err = cmdutil.GetFlagString(cmd, "batch-max-errors"); err != nil {
+		return nil, err
+	}
+	if healthCheck, err = cmdutil.GetFlagString(cmd, "health-check"); err != nil {
+		return nil, err
+	}
+	if executionTimeout, err = cmdutil.GetFlagDuration(cmd, "execution-timeout"); err != nil {
+		return nil, err
+	}
+
+	if batchSize == "" && canary == 0 {
+		if pause != 0 || cmd.Flags().Changed("batch-max-errors") || healthCheck != "" {
+			return nil, cmdutil.UsageError(cmd, "The --batch-pause, --batch-max-errors and --health-check flags require --batch-size or --canary to be set.")
+		}
+		return nil, nil
+	}
+
+	if canary < 0 || pause < 0 {
+		return nil, cmdutil.UsageError(cmd, "The --canary and --batch-pause flags cannot be negative.")
+	}
+
+	rollout := &ssmx.Rollout{
+		Canary: canary,
+		Pause:  pause,
+		Logger: log,
+	}
+
+	// With only --canary set, every other instance is part of a single second batch
+	if batchSize == "" {
+		batchSize = "100%"
+	}
+	if rollout.BatchSize, err = batch.ParseSize(batchSize); err != nil || rollout.BatchSize.Count == 0 {
+		return nil, cmdutil.UsageError(cmd, "--batch-size: must be a number greater than 0 (e.g. 10) or a percentage (e.g. 10%%)")
+	}
+	if rollout.MaxErrors, err = batch.ParseSize(batchMaxErrors); err != nil {
+		return nil, cmdutil.UsageError(cmd, "--batch-max-errors: %v", err)
+	}
+
+	if healthCheck != "" {
+		rollout.HealthCheck = &ssm.SendCommandInput{
+			DocumentName: aws.String(defaultDocument),
+			Parameters: map[string][]*string{
+				"commands":         aws.StringSlice([]string{healthCheck}),
+				"executionTimeout": aws.StringSlice([]string{strconv.Itoa(int(executionTimeout.Seconds()))}),
+			},
+			MaxErrors: aws.String("100%"),
+		}
+	}
+
+	return rollout, nil
+}
+
+// retryConflicts are the flags that cannot be combined with --retry-failed, as it reuses the
+// targets, document and parameters of the original run
+var retryConflicts = []string{
+	"instance", "address", "filter", "profile", "all-profiles", "region",
+	"org-accounts", "org-role", "org-unit", "org-tag", "all-regions", "exclude-region",
+	"command", "file", "document", "document-version", "parameter", "parameters-file", "execution-timeout",
+}
+
+// getRunsDir returns the directory that the record of each run is saved to
+func getRunsDir() (string, error) {
+	dir, err := util.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "runs"), nil
+}
+
+// getRetryRun returns the record of the run selected with --retry-failed, or nil if the flag is not set
+func getRetryRun(cmd *cobra.Command) (*invocation.RunRecord, error) {
+	id, err := cmdutil.GetFlagString(cmd, "retry-failed")
+	if err != nil || id == "" {
+		return nil, err
+	}
+
+	for _, flag := range retryConflicts {
+		if cmd.Flags().Changed(flag) {
+			return nil, cmdutil.UsageError(cmd, "The --%s flag cannot be combined with --retry-failed, which reuses the targets, document and parameters of the original run.", flag)
+		}
+	}
+
+	dir, err := getRunsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	run, err := invocation.LoadRun(dir, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(run.RetrySessions()) == 0 {
+		return nil, fmt.Errorf("Run %s has no failed instances to retry", run.ID)
+	}
+
+	return run, nil
+}
+
+// getCommandFilter returns the filter for the commands listed by the history subcommand
+func getCommandFilter(cmd *cobra.Command, now time.Time) (filter ssmx.CommandFilter, err error) {
+	var since, until string
+
+	if filter.Statuses, err = cmdutil.GetFlagStringSlice(cmd, "status"); err != nil {
+		return filter, err
+	}
+	if filter.Document, err = cmdutil.GetFlagString(cmd, "document"); err != nil {
+		return filter, err
+	}
+	if filter.Requester, err = cmdutil.GetFlagString(cmd, "requester"); err != nil {
+		return filter, err
+	}
+	if since, err = cmdutil.GetFlagString(cmd, "since"); err != nil {
+		return filter, err
+	}
+	if until, err = cmdutil.GetFlagString(cmd, "until"); err != nil {
+		return filter, err
+	}
+
+	if filter.After, err = parseTime(since, now); err != nil {
+		return filter, cmdutil.UsageError(cmd, "--since: %v", err)
+	}
+	if filter.Before, err = parseTime(until, now); err != nil {
+		return filter, cmdutil.UsageError(cmd, "--until: %v", err)
+	}
+
+	if !filter.After.IsZero() && !filter.Before.IsZero() && filter.Before.Before(filter.After) {
+		return filter, cmdutil.UsageError(cmd, "--until must be later than --since.")
+	}
+
+	return filter, nil
+}
+
+// parseTime parses a point in time given either as a duration before now, or as a date with an optional time
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid time %q, expected a duration (e.g. 24h) or a date (e.g. 2020-03-05 or 2020-03-05T17:00:00Z)", value)
+}
+
+// getOutputLocation returns the S3 location that SSM should write complete command output to, and the
+// endpoint used to download it. A nil location is returned if --s3-bucket is not set.
+func getOutputLocation(cmd *cobra.Command) (loc *invocation.OutputLocation, endpoint string, err error) {
+	var bucket, prefix string
+	if bucket, err = cmdutil.GetFlagString(cmd, "s3-bucket"); err != nil {
+		return nil, "", err
+	}
+	if prefix, err = cmdutil.GetFlagString(cmd, "s3-prefix"); err != nil {
+		return nil, "", err
+	}
+	if endpoint, err = cmdutil.GetFlagString(cmd, "s3-endpoint"); err != nil {
+		return nil, "", err
+	}
+
+	if bucket == "" {
+		if prefix != "" || endpoint != "" {
+			return nil, "", cmdutil.UsageError(cmd, "The --s3-prefix and --s3-endpoint flags require --s3-bucket to be set.")
+		}
+		return nil, "", nil
+	}
+
+	return &invocation.OutputLocation{Bucket: bucket, Prefix: prefix}, endpoint, nil
+}
+
 func getRegionList(cmd *cobra.Command) ([]string, error) {
 	regions, err := cmdutil.GetFlagStringSlice(cmd, "region")
 	if err != nil {
@@ -80,13 +482,95 @@ func getRegionList(cmd *cobra.Command) ([]string, error) {
 	return []string{""}, nil
 }
 
-func getTargetList(cmd *cobra.Command) (targets []*ssm.Target, err error) {
-	var filterList []string
+// getRegionResolver returns the resolver of the regions enabled for each profile, or nil if --all-regions is not set
+func getRegionResolver(cmd *cobra.Command) (*regions.Resolver, error) {
+	allRegions, err := cmdutil.GetFlagBool(cmd, "all-regions")
+	if err != nil {
+		return nil, err
+	}
+
+	var exclude []string
+	if exclude, err = cmdutil.GetFlagStringSlice(cmd, "exclude-region"); err != nil {
+		return nil, err
+	}
+
+	if !allRegions {
+		if len(exclude) > 0 {
+			return nil, cmdutil.UsageError(cmd, "The --exclude-region flag can only be used with --all-regions.")
+		}
+		return nil, nil
+	}
+
+	if cmd.Flags().Changed("region") {
+		return nil, cmdutil.UsageError(cmd, "The --region and --all-regions flags cannot be used simultaneously.")
+	}
+	if err = regions.ValidateExclude(exclude); err != nil {
+		return nil, cmdutil.UsageError(cmd, "--exclude-region: %v", err)
+	}
+
+	// Regions are still discovered if the cache can't be located, they just aren't cached
+	cachePath, err := regions.DefaultCachePath()
+	if err != nil {
+		log.Debug(err)
+	}
+
+	return regions.NewResolver(cachePath, exclude, log), nil
+}
+
+// getInstanceCache returns the cache of the instances of each profile/region combination, or nil if --cache-ttl is 0
+func getInstanceCache(cmd *cobra.Command) (*instance.Cache, error) {
+	ttl, err := cmdutil.GetFlagDuration(cmd, "cache-ttl")
+	if err != nil {
+		return nil, err
+	}
+
+	var refresh bool
+	if refresh, err = cmdutil.GetFlagBool(cmd, "refresh"); err != nil {
+		return nil, err
+	}
+
+	if ttl < 0 {
+		return nil, cmdutil.UsageError(cmd, "--cache-ttl cannot be negative.")
+	}
+	if ttl == 0 {
+		return nil, nil
+	}
+
+	// Instances are still looked up if the cache can't be located, they just aren't cached
+	dir, err := instance.DefaultCacheDir()
+	if err != nil {
+		log.Debug(err)
+		return nil, nil
+	}
+
+	cache := instance.NewCache(dir, ttl, log)
+	cache.Refresh = refresh
+
+	return cache, nil
+}
+
+// getFilters returns the filter expressions specified with --filter. The values of an expression are separated
+// by commas like the expressions themselves, so elements that don't start a new expression belong to the previous one.
+func getFilters(cmd *cobra.Command) (filters ssmx.Filters, err error) {
+	var filterList, exprs []string
 	if filterList, err = cmdutil.GetFlagStringSlice(cmd, "filter"); err != nil {
 		return nil, err
 	}
 
-	return util.SliceToTargets(filterList), nil
+	for _, v := range filterList {
+		// Only key=value and key!=value expressions take multiple values, anything else is parsed on its own
+		if len(exprs) > 0 && !strings.Contains(v, "=") && !strings.HasPrefix(v, "has:") && strings.Contains(exprs[len(exprs)-1], "=") {
+			exprs[len(exprs)-1] += "," + v
+			continue
+		}
+		exprs = append(exprs, v)
+	}
+
+	if filters, err = ssmx.ParseFilters(exprs); err != nil {
+		return nil, cmdutil.UsageError(cmd, "--filter: %v", err)
+	}
+
+	return filters, nil
 }
 
 func getProfileList(cmd *cobra.Command) (profileList []string, err error) {
@@ -120,6 +604,45 @@ func getProfileList(cmd *cobra.Command) (profileList []string, err error) {
 	return profileList, nil
 }
 
+// getOrgSelector returns the accounts of the organization to target, or nil if --org-accounts is not set
+func getOrgSelector(cmd *cobra.Command) (*org.Selector, error) {
+	orgAccounts, err := cmdutil.GetFlagBool(cmd, "org-accounts")
+	if err != nil {
+		return nil, err
+	}
+
+	sel := &org.Selector{}
+	if sel.Role, err = cmdutil.GetFlagString(cmd, "org-role"); err != nil {
+		return nil, err
+	}
+	if sel.OrganizationalUnits, err = cmdutil.GetFlagStringSlice(cmd, "org-unit"); err != nil {
+		return nil, err
+	}
+	if sel.Tags, err = cmdutil.GetMapFromStringSlice(cmd, "org-tag"); err != nil {
+		return nil, err
+	}
+
+	if !orgAccounts {
+		if cmd.Flags().Changed("org-role") || len(sel.OrganizationalUnits) > 0 || len(sel.Tags) > 0 {
+			return nil, cmdutil.UsageError(cmd, "The --org-role, --org-unit and --org-tag flags can only be used with --org-accounts.")
+		}
+		return nil, nil
+	}
+
+	var allProfilesFlag bool
+	if allProfilesFlag, err = cmdutil.GetFlagBool(cmd, "all-profiles"); err != nil {
+		return nil, err
+	}
+	if allProfilesFlag {
+		return nil, cmdutil.UsageError(cmd, "The --org-accounts and --all-profiles flags cannot be used simultaneously.")
+	}
+	if sel.Role == "" {
+		return nil, cmdutil.UsageError(cmd, "--org-role cannot be empty.")
+	}
+
+	return sel, nil
+}
+
 func getMaxConcurrency(cmd *cobra.Command) (maxConcurrency string, err error) {
 	if maxConcurrency, err = cmdutil.GetFlagString(cmd, "max-concurrency"); err != nil {
 		return "", err
@@ -148,20 +671,316 @@ Pattern: %q`, 1, 7, "^([1-9][0-9]*|[0]|[1-9][0-9]%|[0-9]%|100%)$")
 	return maxErrors, nil
 }
 
-func validateSessionFlags(cmd *cobra.Command, instanceList []string, filterList map[string]string) error {
+func getOutputFormat(cmd *cobra.Command) (invocation.Format, error) {
+	output, err := cmdutil.GetFlagString(cmd, "output")
+	if err != nil {
+		return "", err
+	}
+
+	format, err := invocation.ParseFormat(output)
+	if err != nil {
+		return "", cmdutil.UsageError(cmd, "--output: %v", err)
+	}
+
+	return format, nil
+}
+
+// getListFormat returns the output format of the list subcommand, which also supports CSV
+func getListFormat(cmd *cobra.Command) (invocation.Format, error) {
+	output, err := cmdutil.GetFlagString(cmd, "output")
+	if err != nil {
+		return "", err
+	}
+
+	if strings.EqualFold(output, string(formatCSV)) {
+		return formatCSV, nil
+	}
+
+	return getOutputFormat(cmd)
+}
+
+// getListColumns returns the fields shown as columns by the list subcommand, specified with --columns
+func getListColumns(cmd *cobra.Command) (columns []string, err error) {
+	var names []string
+	if names, err = cmdutil.GetFlagStringSlice(cmd, "columns"); err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		field, err := instance.ParseField(name)
+		if err != nil {
+			return nil, cmdutil.UsageError(cmd, "--columns: %v", err)
+		}
+		columns = append(columns, field)
+	}
+
+	if len(columns) == 0 {
+		return nil, cmdutil.UsageError(cmd, "--columns: at least one column must be specified")
+	}
+
+	return columns, nil
+}
+
+// getAttributeList returns the attributes shown as additional columns of the instance selection prompt, specified with --attribute
+func getAttributeList(cmd *cobra.Command) (attributes []string, err error) {
+	var names []string
+	if names, err = cmdutil.GetFlagStringSlice(cmd, "attribute"); err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		field, err := instance.ParseField(name)
+		if err != nil || strings.HasPrefix(field, "tag:") {
+			return nil, cmdutil.UsageError(cmd, "--attribute: unknown attribute %q, must be one of %v", name, instance.Fields)
+		}
+		attributes = append(attributes, field)
+	}
+
+	return attributes, nil
+}
+
+// getListSort returns the fields that instances are sorted on by the list subcommand, specified with --sort
+func getListSort(cmd *cobra.Command) (keys []instance.SortKey, err error) {
+	var names []string
+	if names, err = cmdutil.GetFlagStringSlice(cmd, "sort"); err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		key := instance.SortKey{}
+		if idx := strings.LastIndex(name, ":"); idx >= 0 {
+			switch strings.ToLower(name[idx+1:]) {
+			case "desc":
+				key.Descending = true
+				name = name[:idx]
+			case "asc":
+				name = name[:idx]
+			}
+		}
+
+		if key.Field, err = instance.ParseField(name); err != nil {
+			return nil, cmdutil.UsageError(cmd, "--sort: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func validateSessionFlags(cmd *cobra.Command, instanceList []string, filterList ssmx.Filters) error {
 	if len(instanceList) > 0 && len(filterList) > 0 {
 		return cmdutil.UsageError(cmd, "The --filter and --instance flags cannot be used simultaneously.")
 	}
 
-	if len(filterList) > 5 {
-		return cmdutil.UsageError(cmd, "A maximum of 5 tag filters can be specified at a time.")
+	return nil
+}
+
+// getPortForwards returns the ports to forward specified with --forward
+func getPortForwards(cmd *cobra.Command) (forwards []startsession.PortForward, err error) {
+	var specs []string
+	if specs, err = cmdutil.GetFlagStringArray(cmd, "forward"); err != nil {
+		return nil, err
+	}
+
+	if len(specs) == 0 {
+		return nil, cmdutil.UsageError(cmd, "At least one port to forward must be specified with --forward.")
+	}
+
+	localPorts := make(map[int]bool)
+	for _, spec := range specs {
+		f, err := startsession.ParsePortForward(spec)
+		if err != nil {
+			return nil, cmdutil.UsageError(cmd, "%v", err)
+		}
+
+		if f.LocalPort != 0 {
+			if localPorts[f.LocalPort] {
+				return nil, cmdutil.UsageError(cmd, "Local port %d is used by more than one --forward.", f.LocalPort)
+			}
+			localPorts[f.LocalPort] = true
+		}
+
+		forwards = append(forwards, f)
+	}
+
+	return forwards, nil
+}
+
+// copyMethods are the accepted values of --method for the cp subcommand
+var copyMethods = map[string]bool{"scp": true, "command": true}
+
+// copyPaths are the source and destination of the cp subcommand
+type copyPaths struct {
+	// Upload is set when the file is copied from the local machine to the instances
+	Upload bool
+
+	LocalPath  string
+	RemotePath string
+
+	// InstanceID is the instance in the remote path, if any
+	InstanceID string
+}
+
+// remotePathPattern matches remote paths for the cp subcommand, optionally prefixed with an instance ID (e.g. i-123:/tmp)
+var remotePathPattern = regexp.MustCompile(`^(m?i-[0-9a-f]+)?:(.*)$`)
+
+// getCopyPaths returns the source and destination of the cp subcommand. Exactly one of them must be a remote path.
+func getCopyPaths(cmd *cobra.Command, args []string) (paths copyPaths, err error) {
+	src, dst := remotePathPattern.FindStringSubmatch(args[0]), remotePathPattern.FindStringSubmatch(args[1])
+
+	switch {
+	case src == nil && dst != nil:
+		paths = copyPaths{Upload: true, LocalPath: args[0], InstanceID: dst[1], RemotePath: dst[2]}
+	case src != nil && dst == nil:
+		paths = copyPaths{LocalPath: args[1], InstanceID: src[1], RemotePath: src[2]}
+	default:
+		return copyPaths{}, cmdutil.UsageError(cmd, "Exactly one of the source and destination must be a remote path, e.g. i-123:/tmp/file or :/tmp/file.")
+	}
+
+	if paths.RemotePath == "" || paths.LocalPath == "" {
+		return copyPaths{}, cmdutil.UsageError(cmd, "The source and destination paths cannot be empty.")
+	}
+
+	return paths, nil
+}
+
+// getCopyMethod returns the method used to copy files with the cp subcommand
+func getCopyMethod(cmd *cobra.Command) (method string, err error) {
+	if method, err = cmdutil.GetFlagString(cmd, "method"); err != nil {
+		return "", err
+	}
+
+	if !copyMethods[method] {
+		return "", cmdutil.UsageError(cmd, "Invalid copy method %q, must be one of: scp, command.", method)
+	}
+
+	return method, nil
+}
+
+// targetSelectionFlags are the flags that select instances. When any of them is set on the command line,
+// the instances of a named target are replaced rather than combined with it.
+var targetSelectionFlags = []string{"instance", "address", "filter"}
+
+// applyNamedTarget sets the flags defined by the target named with @name in args, read from the user config file,
+// and returns the remaining args. Flags set on the command line take precedence over those of the target.
+func applyNamedTarget(cmd *cobra.Command, args []string) ([]string, error) {
+	var rest, names []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") && len(arg) > 1 {
+			names = append(names, strings.TrimPrefix(arg, "@"))
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+
+	switch len(names) {
+	case 0:
+		return args, nil
+	case 1:
+	default:
+		return nil, cmdutil.UsageError(cmd, "Only one @target can be used at a time.")
+	}
+
+	path, err := util.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := util.ReadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := config.Target(names[0])
+	if err != nil {
+		return nil, cmdutil.UsageError(cmd, "%v\nTargets are defined in %s", err, path)
+	}
+
+	return rest, setTargetFlags(cmd, target)
+}
+
+// setTargetFlags sets the flags of the command from the target, except for those set on the command line
+func setTargetFlags(cmd *cobra.Command, target *util.Target) error {
+	values := map[string][]string{
+		"profile":   target.Profiles,
+		"region":    target.Regions,
+		"instance":  target.Instances,
+		"address":   target.Addresses,
+		"filter":    target.Filters,
+		"tag":       target.Tags,
+		"attribute": target.Attributes,
+	}
+	if target.Limit > 0 {
+		values["limit"] = []string{strconv.Itoa(target.Limit)}
+	}
+
+	for _, name := range targetSelectionFlags {
+		if cmd.Flags().Changed(name) {
+			for _, n := range targetSelectionFlags {
+				delete(values, n)
+			}
+		}
+	}
+
+	// --all-regions replaces the regions of the target
+	if cmd.Flags().Changed("all-regions") {
+		delete(values, "region")
+	}
+
+	for name, v := range values {
+		if cmd.Flags().Lookup(name) == nil || cmd.Flags().Changed(name) {
+			continue
+		}
+
+		for _, value := range v {
+			if err := cmd.Flags().Set(name, value); err != nil {
+				return fmt.Errorf("Invalid %s %q in target\n%v", name, value, err)
+			}
+		}
 	}
 
 	return nil
 }
 
+// getRecordPath returns the absolute path of the file that sessions are recorded to, or "" if they aren't recorded.
+// The path is absolute so that sessions started in tmux panes record to the same place.
+func getRecordPath(cmd *cobra.Command) (string, error) {
+	recordPath, err := cmdutil.GetFlagString(cmd, "record")
+	if err != nil || recordPath == "" {
+		return "", err
+	}
+
+	return filepath.Abs(recordPath)
+}
+
+// instanceRecordPath returns the path that the session with the instance is recorded to when multiple instances are
+// selected, which is the record path with the instance ID appended to its name, e.g. debug-i-123.cast for debug.cast
+func instanceRecordPath(recordPath, instanceID string) string {
+	ext := filepath.Ext(recordPath)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(recordPath, ext), instanceID, ext)
+}
+
+// getReplaySpeed returns the playback speed and the idle time limit of the replay subcommand
+func getReplaySpeed(cmd *cobra.Command) (speed float64, idleTimeLimit time.Duration, err error) {
+	if speed, err = cmdutil.GetFlagFloat64(cmd, "speed"); err != nil {
+		return 0, 0, err
+	}
+	if speed <= 0 {
+		return 0, 0, cmdutil.UsageError(cmd, "The --speed flag must be greater than 0.")
+	}
+
+	if idleTimeLimit, err = cmdutil.GetFlagDuration(cmd, "idle-time-limit"); err != nil {
+		return 0, 0, err
+	}
+	if idleTimeLimit < 0 {
+		return 0, 0, cmdutil.UsageError(cmd, "The --idle-time-limit flag cannot be negative.")
+	}
+
+	return speed, idleTimeLimit, nil
+}
+
 // validateRunFlags validates the usage of certain flags required by the run subcommand
-func validateRunFlags(cmd *cobra.Command, instanceList []string, addressList []string, commandList []string, filterList []*ssm.Target) error {
+func validateRunFlags(cmd *cobra.Command, instanceList []string, addressList []string, document string, parameters map[string][]*string, filterList ssmx.Filters) error {
 	if len(instanceList) > 0 && len(filterList) > 0 {
 		return cmdutil.UsageError(cmd, "The --filter and --instance flags cannot be used simultaneously.")
 	}
@@ -170,15 +989,15 @@ func validateRunFlags(cmd *cobra.Command, instanceList []string, addressList []s
 		return cmdutil.UsageError(cmd, "You must supply target arguments using either the --filter or --instance flags.")
 	}
 
-	if len(filterList) > 5 {
-		return cmdutil.UsageError(cmd, "A maximum of 5 tag filters can be specified at a time.")
-	}
-
 	if len(instanceList) > 50 {
 		return cmdutil.UsageError(cmd, "The --instance flag can only be used to specify a maximum of 50 instances.")
 	}
 
-	if len(commandList) == 0 {
+	if document == "" {
+		return cmdutil.UsageError(cmd, "Please specify the SSM document to be run on your instances.")
+	}
+
+	if shellDocuments[document] && len(parameters["commands"]) == 0 {
 		return cmdutil.UsageError(cmd, "Please specify a command to be run on your instances.")
 	}
 
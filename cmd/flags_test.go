@@ -1,15 +1,31 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/AlecAivazis/survey/v2/terminal"
+	"github.com/aws/aws-sdk-go/aws"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/disneystreaming/ssm-helpers/aws/org"
+	"github.com/disneystreaming/ssm-helpers/aws/ratelimit"
+	"github.com/disneystreaming/ssm-helpers/aws/regions"
+	"github.com/disneystreaming/ssm-helpers/aws/session"
 	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+	startsession "github.com/disneystreaming/ssm-helpers/ssm/session"
+	"github.com/disneystreaming/ssm-helpers/util/batch"
+	"github.com/disneystreaming/ssm-helpers/util/parallel"
 )
 
 func NewTestCmd() *cobra.Command {
@@ -128,6 +144,48 @@ func Test_getProfileList(t *testing.T) {
 	})
 }
 
+func Test_getOrgSelector(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	parse := func(args ...string) (*org.Selector, error) {
+		addPoolFlags(cmd)
+		addOrgFlags(cmd)
+		cmd.SetArgs(args)
+		cmd.Execute()
+		defer cmd.ResetFlags()
+
+		return getOrgSelector(cmd)
+	}
+
+	sel, err := parse()
+	assert.NoError(err)
+	assert.Nil(sel)
+
+	sel, err = parse("--org-accounts", "-p", "management")
+	assert.NoError(err)
+	assert.Equal(org.DefaultRole, sel.Role)
+	assert.Empty(sel.OrganizationalUnits)
+
+	sel, err = parse("--org-accounts", "--org-role", "Admin", "--org-unit", "ou-ab12-cdef3456,ou-ab12-ghij7890", "--org-tag", "env=prod", "--org-tag", "team=platform")
+	assert.NoError(err)
+	assert.Equal(&org.Selector{
+		Role:                "Admin",
+		OrganizationalUnits: []string{"ou-ab12-cdef3456", "ou-ab12-ghij7890"},
+		Tags:                map[string]string{"env": "prod", "team": "platform"},
+	}, sel)
+
+	// The organization flags only apply to --org-accounts, which lists the accounts with the given profiles
+	_, err = parse("--org-unit", "ou-ab12-cdef3456")
+	assert.Error(err)
+
+	_, err = parse("--org-accounts", "--all-profiles")
+	assert.Error(err)
+
+	_, err = parse("--org-accounts", "--org-tag", "env")
+	assert.Error(err)
+}
+
 func Test_getRegionList(t *testing.T) {
 	assert := assert.New(t)
 	cmd := NewTestCmd()
@@ -184,15 +242,117 @@ func Test_getRegionList(t *testing.T) {
 	})
 }
 
-func Test_getTargetList(t *testing.T) {
+func Test_getRegionResolver(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+	t.Setenv("XDG_CACHE_HOME", "/tmp/xdg-cache")
+
+	parse := func(args ...string) (*regions.Resolver, error) {
+		addPoolFlags(cmd)
+		cmd.SetArgs(args)
+		cmd.Execute()
+		defer cmd.ResetFlags()
+
+		return getRegionResolver(cmd)
+	}
+
+	resolver, err := parse("-r", "us-east-1")
+	assert.NoError(err)
+	assert.Nil(resolver)
+
+	resolver, err = parse("--all-regions", "--exclude-region", "ap-*,me-south-1")
+	assert.NoError(err)
+	assert.Equal([]string{"ap-*", "me-south-1"}, resolver.Exclude)
+	assert.Equal("/tmp/xdg-cache/ssm-helpers/regions.json", resolver.CachePath)
+
+	_, err = parse("--all-regions", "-r", "us-east-1")
+	assert.Error(err)
+
+	_, err = parse("--exclude-region", "ap-*")
+	assert.Error(err)
+
+	_, err = parse("--all-regions", "--exclude-region", "us-[east")
+	assert.Error(err)
+}
+
+func Test_getPoolLimits(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	parse := func(args ...string) (int, *ratelimit.Limiter, error) {
+		addPoolFlags(cmd)
+		cmd.SetArgs(args)
+		cmd.Execute()
+		defer cmd.ResetFlags()
+
+		return getPoolLimits(cmd)
+	}
+
+	limit, limiter, err := parse()
+	assert.NoError(err)
+	assert.Equal(parallel.DefaultLimit, limit)
+	assert.Equal(ratelimit.DefaultRate, limiter.Rate)
+
+	limit, limiter, err = parse("--parallel", "5", "--rate-limit", "2.5")
+	assert.NoError(err)
+	assert.Equal(5, limit)
+	assert.Equal(2.5, limiter.Rate)
+
+	// A rate limit of 0 disables rate limiting
+	_, limiter, err = parse("--rate-limit", "0")
+	assert.NoError(err)
+	assert.Nil(limiter)
+
+	_, _, err = parse("--parallel", "0")
+	assert.Error(err)
+
+	_, _, err = parse("--rate-limit", "-1")
+	assert.Error(err)
+}
+
+func Test_getInstanceCache(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+	t.Setenv("XDG_CACHE_HOME", "/tmp/xdg-cache")
+
+	parse := func(args ...string) (*instance.Cache, error) {
+		addSessionFlags(cmd)
+		cmd.SetArgs(args)
+		cmd.Execute()
+		defer cmd.ResetFlags()
+
+		return getInstanceCache(cmd)
+	}
+
+	cache, err := parse()
+	assert.NoError(err)
+	assert.Equal("/tmp/xdg-cache/ssm-helpers/instances", cache.Dir)
+	assert.Equal(instance.DefaultCacheTTL, cache.TTL)
+	assert.False(cache.Refresh)
+
+	cache, err = parse("--refresh", "--cache-ttl", "1h")
+	assert.NoError(err)
+	assert.Equal(time.Hour, cache.TTL)
+	assert.True(cache.Refresh)
+
+	// A TTL of 0 disables caching
+	cache, err = parse("--cache-ttl", "0")
+	assert.NoError(err)
+	assert.Nil(cache)
+
+	_, err = parse("--cache-ttl", "-1m")
+	assert.Error(err)
+}
+
+func Test_getFilters(t *testing.T) {
 	assert := assert.New(t)
 	cmd := NewTestCmd()
 
 	t.Run("filter flag undefined", func(t *testing.T) {
 		cmd.Execute()
 
-		targetList, err := getTargetList(cmd)
-		assert.Len(targetList, 0)
+		filters, err := getFilters(cmd)
+		assert.Len(filters, 0)
 		assert.Error(err)
 
 		cmd.ResetFlags()
@@ -203,8 +363,8 @@ func Test_getTargetList(t *testing.T) {
 		cmd.SetArgs([]string{"-f", "foo=bar"})
 		cmd.Execute()
 
-		targetList, err := getTargetList(cmd)
-		assert.Len(targetList, 1)
+		filters, err := getFilters(cmd)
+		assert.Len(filters, 1)
 		assert.NoError(err)
 
 		cmd.ResetFlags()
@@ -215,9 +375,48 @@ func Test_getTargetList(t *testing.T) {
 		cmd.SetArgs([]string{"-f", "foo=bar,baz=bat"})
 		cmd.Execute()
 
-		targetList, err := getTargetList(cmd)
-		assert.Len(targetList, 2)
+		filters, err := getFilters(cmd)
+		assert.Len(filters, 2)
+		assert.NoError(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("filter expressions", func(t *testing.T) {
+		cmdutil.AddFilterFlag(cmd)
+		cmd.SetArgs([]string{"-f", "env=prod,staging,app!=legacy", "-f", "has:owner,role=web-*"})
+		cmd.Execute()
+
+		filters, err := getFilters(cmd)
 		assert.NoError(err)
+		assert.Equal(ssmx.Filters{
+			{Key: "env", Operator: ssmx.FilterEquals, Values: []string{"prod", "staging"}},
+			{Key: "app", Operator: ssmx.FilterNotEquals, Values: []string{"legacy"}},
+			{Key: "owner", Operator: ssmx.FilterExists},
+			{Key: "role", Operator: ssmx.FilterEquals, Values: []string{"web-*"}},
+		}, filters)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		cmdutil.AddFilterFlag(cmd)
+		cmd.SetArgs([]string{"-f", "env"})
+		cmd.Execute()
+
+		_, err := getFilters(cmd)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("value after has", func(t *testing.T) {
+		cmdutil.AddFilterFlag(cmd)
+		cmd.SetArgs([]string{"-f", "has:owner,foo"})
+		cmd.Execute()
+
+		_, err := getFilters(cmd)
+		assert.Error(err)
 
 		cmd.ResetFlags()
 	})
@@ -309,110 +508,922 @@ func Test_getCommandList(t *testing.T) {
 	})
 }
 
-func Test_validateRunFlags(t *testing.T) {
+func Test_getOutputFormat(t *testing.T) {
 	assert := assert.New(t)
-
 	cmd := NewTestCmd()
-	cmdutil.AddCommandFlag(cmd)
-	cmdutil.AddFilterFlag(cmd)
-	cmdutil.AddInstanceFlag(cmd)
-	cmdutil.AddHostnameFlag(cmd)
-	cmd.Execute()
 
-	instanceList := make([]string, 51)
+	t.Run("output flag undefined", func(t *testing.T) {
+		cmd.Execute()
 
-	t.Run("try to use --filter and --instance flags", func(t *testing.T) {
-		targetList := make([]*ssm.Target, 2)
-		err := validateRunFlags(cmd, instanceList, nil, []string{"hostname"}, targetList)
+		_, err := getOutputFormat(cmd)
 		assert.Error(err)
+
+		cmd.ResetFlags()
 	})
 
-	t.Run("specify more than 5 filters", func(t *testing.T) {
-		targetList := make([]*ssm.Target, 6)
-		err := validateRunFlags(cmd, nil, nil, []string{"hostname"}, targetList)
-		assert.Error(err)
+	t.Run("default format", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{})
+		cmd.Execute()
+
+		format, err := getOutputFormat(cmd)
+		assert.Equal(invocation.FormatTable, format)
+		assert.NoError(err)
+
+		cmd.ResetFlags()
 	})
 
-	t.Run("no instances or filters specified", func(t *testing.T) {
-		err := validateRunFlags(cmd, nil, nil, []string{"hostname"}, nil)
-		assert.Error(err)
+	t.Run("ndjson format", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"-o", "ndjson"})
+		cmd.Execute()
+
+		format, err := getOutputFormat(cmd)
+		assert.Equal(invocation.FormatNDJSON, format)
+		assert.NoError(err)
+
+		cmd.ResetFlags()
 	})
 
-	t.Run(">50 specified instances", func(t *testing.T) {
-		err := validateRunFlags(cmd, instanceList, nil, []string{"hostname"}, nil)
+	t.Run("invalid format", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--output", "xml"})
+		cmd.Execute()
+
+		_, err := getOutputFormat(cmd)
 		assert.Error(err)
+
+		cmd.ResetFlags()
 	})
+}
 
-	t.Run("no command specified", func(t *testing.T) {
-		err := validateRunFlags(cmd, []string{"myInstance"}, nil, nil, nil)
-		assert.Error(err)
+func Test_getListFlags(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	t.Run("defaults", func(t *testing.T) {
+		addListFlags(cmd)
+		cmd.SetArgs([]string{})
+		cmd.Execute()
+
+		format, err := getListFormat(cmd)
+		assert.NoError(err)
+		assert.Equal(invocation.FormatTable, format)
+
+		columns, err := getListColumns(cmd)
+		assert.NoError(err)
+		assert.Equal(defaultListColumns, columns)
+
+		keys, err := getListSort(cmd)
+		assert.NoError(err)
+		assert.Equal([]instance.SortKey{{Field: "Profile"}, {Field: "Region"}, {Field: "InstanceID"}}, keys)
+
+		cmd.ResetFlags()
 	})
 
-	t.Run("valid flag combination", func(t *testing.T) {
-		err := validateRunFlags(cmd, []string{"myInstance"}, nil, []string{"hostname"}, nil)
+	t.Run("csv output, columns and sorting", func(t *testing.T) {
+		addListFlags(cmd)
+		cmd.SetArgs([]string{"-o", "CSV", "--columns", "instanceid,ipaddress,tag:Name", "--sort", "tag:team,lastpingdatetime:desc"})
+		cmd.Execute()
+
+		format, err := getListFormat(cmd)
+		assert.NoError(err)
+		assert.Equal(formatCSV, format)
+
+		columns, err := getListColumns(cmd)
 		assert.NoError(err)
+		assert.Equal([]string{"InstanceID", "IPAddress", "tag:Name"}, columns)
+
+		keys, err := getListSort(cmd)
+		assert.NoError(err)
+		assert.Equal([]instance.SortKey{{Field: "tag:team"}, {Field: "LastPingDateTime", Descending: true}}, keys)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("unknown column", func(t *testing.T) {
+		addListFlags(cmd)
+		cmd.SetArgs([]string{"--columns", "InstanceID,Color", "--sort", "Size"})
+		cmd.Execute()
+
+		_, err := getListColumns(cmd)
+		assert.Error(err)
+
+		_, err = getListSort(cmd)
+		assert.Error(err)
+
+		cmd.ResetFlags()
 	})
 }
 
-func Test_validateSessionFlags(t *testing.T) {
+func Test_getAttributeList(t *testing.T) {
 	assert := assert.New(t)
-
 	cmd := NewTestCmd()
-	cmdutil.AddFilterFlag(cmd)
-	cmdutil.AddInstanceFlag(cmd)
-	cmd.Execute()
 
-	instanceList := make([]string, 51)
+	t.Run("valid attributes", func(t *testing.T) {
+		cmdutil.AddAttributeFlag(cmd)
+		cmd.SetArgs([]string{"-x", "instancetype,PrivateIPAddress"})
+		cmd.Execute()
 
-	t.Run("try to use --filter and --instance flags", func(t *testing.T) {
-		filterList := map[string]string{
-			"foo": "bar",
-		}
-		err := validateSessionFlags(cmd, instanceList, filterList)
+		attributes, err := getAttributeList(cmd)
+		assert.NoError(err)
+		assert.Equal([]string{"InstanceType", "PrivateIPAddress"}, attributes)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("unknown attribute", func(t *testing.T) {
+		cmdutil.AddAttributeFlag(cmd)
+		cmd.SetArgs([]string{"-x", "tag:Name"})
+		cmd.Execute()
+
+		_, err := getAttributeList(cmd)
 		assert.Error(err)
+
+		cmd.ResetFlags()
 	})
+}
 
-	t.Run("specify more than 5 filters", func(t *testing.T) {
-		targetList := map[string]string{
-			"1": "a",
-			"2": "b",
-			"3": "c",
-			"4": "d",
-			"5": "e",
-			"6": "f",
-		}
-		err := validateSessionFlags(cmd, nil, targetList)
+func Test_getDocumentParameters(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	t.Run("parameter flags undefined", func(t *testing.T) {
+		cmd.Execute()
+
+		params, err := getDocumentParameters(cmd, defaultDocument, nil)
+		assert.Nil(params)
 		assert.Error(err)
+
+		cmd.ResetFlags()
 	})
 
-	t.Run("valid flag combination", func(t *testing.T) {
-		err := validateSessionFlags(cmd, instanceList, nil)
+	t.Run("commands with default document", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{})
+		cmd.Execute()
+
+		params, err := getDocumentParameters(cmd, defaultDocument, []string{"uname -a", "hostname"})
 		assert.NoError(err)
+		assert.Equal([]string{"uname -a", "hostname"}, aws.StringValueSlice(params["commands"]))
+		assert.Equal([]string{"600"}, aws.StringValueSlice(params["executionTimeout"]))
+
+		cmd.ResetFlags()
 	})
-}
 
-func Test_setLogLevel(t *testing.T) {
-	assert := assert.New(t)
+	t.Run("repeated parameters for custom document", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--parameter", "extravars=a=1,b=2", "--parameter", "extravars=c=3", "--parameter", "check=True"})
+		cmd.Execute()
 
-	cmd := NewTestCmd()
+		params, err := getDocumentParameters(cmd, "AWS-ApplyAnsiblePlaybooks", nil)
+		assert.NoError(err)
+		assert.Len(params, 2)
+		assert.Equal([]string{"a=1,b=2", "c=3"}, aws.StringValueSlice(params["extravars"]))
 
-	testLogger := logrus.New()
+		cmd.ResetFlags()
+	})
 
-	t.Run("verbose flag undefined", func(t *testing.T) {
+	t.Run("parameters file with flag override", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--parameters-file", "../testing/test_parameters.yaml", "--parameter", "check=True"})
 		cmd.Execute()
-		err := setLogLevel(cmd, testLogger)
+
+		params, err := getDocumentParameters(cmd, "AWS-ApplyAnsiblePlaybooks", nil)
+		assert.NoError(err)
+		assert.Equal([]string{"True"}, aws.StringValueSlice(params["check"]))
+		assert.Equal([]string{"s3://bucket/site.yml"}, aws.StringValueSlice(params["playbookurl"]))
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("execution timeout flag", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--execution-timeout", "1h"})
+		cmd.Execute()
+
+		params, err := getDocumentParameters(cmd, "Custom-Document", nil)
+		assert.NoError(err)
+		assert.Equal([]string{"3600"}, aws.StringValueSlice(params["executionTimeout"]))
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("no default execution timeout for custom documents", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{})
+		cmd.Execute()
+
+		params, err := getDocumentParameters(cmd, "Custom-Document", nil)
+		assert.NoError(err)
+		assert.NotContains(params, "executionTimeout")
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("execution timeout specified twice", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--execution-timeout", "1h", "--parameter", "executionTimeout=60"})
+		cmd.Execute()
+
+		params, err := getDocumentParameters(cmd, defaultDocument, []string{"hostname"})
+		assert.Nil(params)
 		assert.Error(err)
+
+		cmd.ResetFlags()
 	})
 
-	t.Run("check that correct level is set", func(t *testing.T) {
-		cmdutil.AddVerboseFlag(cmd)
-		cmd.SetArgs([]string{"-v", "0"})
+	t.Run("commands specified twice", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--parameter", "commands=uptime"})
 		cmd.Execute()
 
-		err := setLogLevel(cmd, testLogger)
-		assert.Equal(logrus.FatalLevel, testLogger.GetLevel())
+		params, err := getDocumentParameters(cmd, defaultDocument, []string{"hostname"})
+		assert.Nil(params)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("invalid parameter format", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--parameter", "novalue"})
+		cmd.Execute()
+
+		params, err := getDocumentParameters(cmd, defaultDocument, []string{"hostname"})
+		assert.Nil(params)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+}
+
+func Test_getTimeouts(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	t.Run("defaults", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{})
+		cmd.Execute()
+
+		deliveryTimeout, timeout, err := getTimeouts(cmd)
+		assert.Zero(deliveryTimeout)
+		assert.Zero(timeout)
 		assert.NoError(err)
+
 		cmd.ResetFlags()
 	})
 
+	t.Run("valid timeouts", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--delivery-timeout", "5m", "--timeout", "15m"})
+		cmd.Execute()
+
+		deliveryTimeout, timeout, err := getTimeouts(cmd)
+		assert.Equal(5*time.Minute, deliveryTimeout)
+		assert.Equal(15*time.Minute, timeout)
+		assert.NoError(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("delivery timeout too short", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--delivery-timeout", "10s"})
+		cmd.Execute()
+
+		_, _, err := getTimeouts(cmd)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+}
+
+func Test_getRollout(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	t.Run("disabled by default", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{})
+		cmd.Execute()
+
+		rollout, err := getRollout(cmd)
+		assert.Nil(rollout)
+		assert.NoError(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("batched rollout", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--batch-size", "10%", "--canary", "1", "--batch-pause", "30s", "--batch-max-errors", "2", "--health-check", "curl -f localhost/health"})
+		cmd.Execute()
+
+		rollout, err := getRollout(cmd)
+		assert.NoError(err)
+		assert.Equal(batch.Size{Count: 10, Percent: true}, rollout.BatchSize)
+		assert.Equal(1, rollout.Canary)
+		assert.Equal(30*time.Second, rollout.Pause)
+		assert.Equal(batch.Size{Count: 2}, rollout.MaxErrors)
+		assert.Equal([]string{"curl -f localhost/health"}, aws.StringValueSlice(rollout.HealthCheck.Parameters["commands"]))
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("canary only", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--canary", "2"})
+		cmd.Execute()
+
+		rollout, err := getRollout(cmd)
+		assert.NoError(err)
+		assert.Equal([][2]int{{0, 2}, {2, 10}}, rollout.Batches(10))
+		assert.Nil(rollout.HealthCheck)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("health check without batches", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--health-check", "true"})
+		cmd.Execute()
+
+		rollout, err := getRollout(cmd)
+		assert.Nil(rollout)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("invalid batch size", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--batch-size", "0"})
+		cmd.Execute()
+
+		rollout, err := getRollout(cmd)
+		assert.Nil(rollout)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+}
+
+func Test_getRetryRun(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	dir, err := getRunsDir()
+	assert.NoError(err)
+
+	run := invocation.NewRunRecord("AWS-RunShellScript", "", nil)
+	run.AddSession("profile1", "us-east-1", nil, &ssm.SendCommandInput{InstanceIds: aws.StringSlice([]string{"i-123"})}, nil)
+	run.AddResult(&invocation.Result{
+		InvocationResult: &ssm.GetCommandInvocationOutput{InstanceId: aws.String("i-123")},
+		ProfileName:      "profile1",
+		Region:           "us-east-1",
+		Status:           invocation.CommandFailed,
+	})
+	assert.NoError(invocation.SaveRun(dir, run))
+
+	t.Run("not set", func(t *testing.T) {
+		addBaseFlags(cmd)
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{})
+		cmd.Execute()
+
+		retry, err := getRetryRun(cmd)
+		assert.Nil(retry)
+		assert.NoError(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("last run", func(t *testing.T) {
+		addBaseFlags(cmd)
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--retry-failed", "last"})
+		cmd.Execute()
+
+		retry, err := getRetryRun(cmd)
+		assert.NoError(err)
+		assert.Equal(run.ID, retry.ID)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("combined with targets", func(t *testing.T) {
+		addBaseFlags(cmd)
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--retry-failed", "last", "--instance", "i-456"})
+		cmd.Execute()
+
+		retry, err := getRetryRun(cmd)
+		assert.Nil(retry)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("unknown run", func(t *testing.T) {
+		addBaseFlags(cmd)
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--retry-failed", "20200101T000000.000Z"})
+		cmd.Execute()
+
+		retry, err := getRetryRun(cmd)
+		assert.Nil(retry)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+}
+
+func Test_getPortForwards(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	t.Run("multiple forwards", func(t *testing.T) {
+		addForwardFlags(cmd)
+		cmd.SetArgs([]string{"-L", "8080:80", "--forward", "5432:db.example.com:5432", "-L", "443"})
+		cmd.Execute()
+
+		forwards, err := getPortForwards(cmd)
+		assert.NoError(err)
+		assert.Equal([]startsession.PortForward{
+			{LocalPort: 8080, RemotePort: 80},
+			{LocalPort: 5432, Host: "db.example.com", RemotePort: 5432},
+			{RemotePort: 443},
+		}, forwards)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("no forwards", func(t *testing.T) {
+		addForwardFlags(cmd)
+		cmd.SetArgs([]string{})
+		cmd.Execute()
+
+		_, err := getPortForwards(cmd)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("invalid forward", func(t *testing.T) {
+		addForwardFlags(cmd)
+		cmd.SetArgs([]string{"-L", "8080:http"})
+		cmd.Execute()
+
+		_, err := getPortForwards(cmd)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("duplicate local port", func(t *testing.T) {
+		addForwardFlags(cmd)
+		cmd.SetArgs([]string{"-L", "8080:80", "-L", "8080:db.example.com:5432"})
+		cmd.Execute()
+
+		_, err := getPortForwards(cmd)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+}
+
+func Test_getCopyPaths(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	paths, err := getCopyPaths(cmd, []string{"./app.conf", "i-0d770cb81ae0fc316:/etc/app/"})
+	assert.NoError(err)
+	assert.Equal(copyPaths{Upload: true, LocalPath: "./app.conf", RemotePath: "/etc/app/", InstanceID: "i-0d770cb81ae0fc316"}, paths)
+
+	paths, err = getCopyPaths(cmd, []string{":/var/log/app.log", "./logs:old"})
+	assert.NoError(err)
+	assert.Equal(copyPaths{LocalPath: "./logs:old", RemotePath: "/var/log/app.log"}, paths)
+
+	for _, args := range [][]string{
+		{"./a", "./b"},
+		{":/a", "i-123:/b"},
+		{"./a", "i-123:"},
+	} {
+		_, err = getCopyPaths(cmd, args)
+		assert.Error(err, args)
+	}
+}
+
+func Test_getCopyMethod(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	addCopyFlags(cmd)
+	cmd.SetArgs([]string{"--method", "command"})
+	cmd.Execute()
+
+	method, err := getCopyMethod(cmd)
+	assert.NoError(err)
+	assert.Equal("command", method)
+	cmd.ResetFlags()
+
+	addCopyFlags(cmd)
+	cmd.SetArgs([]string{"--method", "rsync"})
+	cmd.Execute()
+
+	_, err = getCopyMethod(cmd)
+	assert.Error(err)
+	cmd.ResetFlags()
+}
+
+func Test_applyNamedTarget(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	os.MkdirAll(filepath.Join(dir, "ssm-helpers"), 0700)
+	os.WriteFile(filepath.Join(dir, "ssm-helpers", "config.yaml"), []byte(`targets:
+  api-prod:
+    profiles: [prod-a, prod-b]
+    regions: [us-east-1, us-west-2]
+    filters: [app=api, env=prod]
+    tags: [Name]
+    limit: 20
+`), 0600)
+
+	t.Run("target flags are set", func(t *testing.T) {
+		cmd := NewTestCmd()
+		addBaseFlags(cmd)
+		addSessionFlags(cmd)
+		cmd.Execute()
+
+		args, err := applyNamedTarget(cmd, []string{"@api-prod"})
+		assert.NoError(err)
+		assert.Empty(args)
+
+		profiles, _ := cmdutil.GetFlagStringSlice(cmd, "profile")
+		regions, _ := cmdutil.GetFlagStringSlice(cmd, "region")
+		filters, _ := cmdutil.GetFlagStringSlice(cmd, "filter")
+		tags, _ := cmdutil.GetFlagStringSlice(cmd, "tag")
+		limit, _ := cmdutil.GetFlagInt(cmd, "limit")
+		assert.Equal([]string{"prod-a", "prod-b"}, profiles)
+		assert.Equal([]string{"us-east-1", "us-west-2"}, regions)
+		assert.Equal([]string{"app=api", "env=prod"}, filters)
+		assert.Equal([]string{"Name"}, tags)
+		assert.Equal(20, limit)
+	})
+
+	t.Run("command line flags take precedence", func(t *testing.T) {
+		cmd := NewTestCmd()
+		addBaseFlags(cmd)
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--region", "eu-west-1", "--instance", "i-123"})
+		cmd.Execute()
+
+		args, err := applyNamedTarget(cmd, []string{"@api-prod", "extra"})
+		assert.NoError(err)
+		assert.Equal([]string{"extra"}, args)
+
+		profiles, _ := cmdutil.GetFlagStringSlice(cmd, "profile")
+		regions, _ := cmdutil.GetFlagStringSlice(cmd, "region")
+		filters, _ := cmdutil.GetFlagStringSlice(cmd, "filter")
+		assert.Equal([]string{"prod-a", "prod-b"}, profiles)
+		assert.Equal([]string{"eu-west-1"}, regions)
+
+		// Instances replace the filters of the target rather than being combined with them
+		assert.Empty(filters)
+	})
+
+	t.Run("unknown targets", func(t *testing.T) {
+		cmd := NewTestCmd()
+		addBaseFlags(cmd)
+		cmd.Execute()
+
+		_, err := applyNamedTarget(cmd, []string{"@api-dev"})
+		assert.Error(err)
+
+		_, err = applyNamedTarget(cmd, []string{"@api-prod", "@api-dev"})
+		assert.Error(err)
+
+		args, err := applyNamedTarget(cmd, []string{"i-123:/tmp", "./file"})
+		assert.NoError(err)
+		assert.Equal([]string{"i-123:/tmp", "./file"}, args)
+	})
+}
+
+func Test_getRecordPath(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	addSessionFlags(cmd)
+	cmd.Execute()
+
+	recordPath, err := getRecordPath(cmd)
+	assert.NoError(err)
+	assert.Empty(recordPath)
+	cmd.ResetFlags()
+
+	addSessionFlags(cmd)
+	cmd.SetArgs([]string{"--record", "debug.cast"})
+	cmd.Execute()
+
+	wd, _ := os.Getwd()
+	recordPath, err = getRecordPath(cmd)
+	assert.NoError(err)
+	assert.Equal(filepath.Join(wd, "debug.cast"), recordPath)
+	cmd.ResetFlags()
+
+	assert.Equal("/tmp/debug-i-123.cast", instanceRecordPath("/tmp/debug.cast", "i-123"))
+	assert.Equal("/tmp/debug-i-123", instanceRecordPath("/tmp/debug", "i-123"))
+}
+
+func Test_getReplaySpeed(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	addReplayFlags(cmd)
+	cmd.SetArgs([]string{"--speed", "2", "--idle-time-limit", "1s"})
+	cmd.Execute()
+
+	speed, idleTimeLimit, err := getReplaySpeed(cmd)
+	assert.NoError(err)
+	assert.Equal(2.0, speed)
+	assert.Equal(time.Second, idleTimeLimit)
+	cmd.ResetFlags()
+
+	addReplayFlags(cmd)
+	cmd.SetArgs([]string{"--speed", "0"})
+	cmd.Execute()
+
+	_, _, err = getReplaySpeed(cmd)
+	assert.Error(err)
+	cmd.ResetFlags()
+}
+
+func Test_getCommandFilter(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+	now := time.Date(2020, 3, 5, 17, 0, 0, 0, time.UTC)
+
+	t.Run("all filters", func(t *testing.T) {
+		addHistoryFlags(cmd)
+		cmd.SetArgs([]string{"--status", "Failed,TimedOut", "--document", "AWS-RunShellScript", "--requester", "alice", "--since", "24h", "--until", "2020-03-05T16:00:00Z"})
+		cmd.Execute()
+
+		filter, err := getCommandFilter(cmd, now)
+		assert.NoError(err)
+		assert.Equal([]string{"Failed", "TimedOut"}, filter.Statuses)
+		assert.Equal("AWS-RunShellScript", filter.Document)
+		assert.Equal("alice", filter.Requester)
+		assert.Equal(now.Add(-24*time.Hour), filter.After)
+		assert.Equal(now.Add(-time.Hour), filter.Before)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("date only", func(t *testing.T) {
+		addHistoryFlags(cmd)
+		cmd.SetArgs([]string{"--since", "2020-03-01"})
+		cmd.Execute()
+
+		filter, err := getCommandFilter(cmd, now)
+		assert.NoError(err)
+		assert.Equal(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), filter.After)
+		assert.True(filter.Before.IsZero())
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("invalid time", func(t *testing.T) {
+		addHistoryFlags(cmd)
+		cmd.SetArgs([]string{"--since", "yesterday"})
+		cmd.Execute()
+
+		_, err := getCommandFilter(cmd, now)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("empty time range", func(t *testing.T) {
+		addHistoryFlags(cmd)
+		cmd.SetArgs([]string{"--since", "1h", "--until", "2h"})
+		cmd.Execute()
+
+		_, err := getCommandFilter(cmd, now)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+}
+
+func Test_getOutputLocation(t *testing.T) {
+	assert := assert.New(t)
+	cmd := NewTestCmd()
+
+	t.Run("no bucket", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{})
+		cmd.Execute()
+
+		loc, endpoint, err := getOutputLocation(cmd)
+		assert.Nil(loc)
+		assert.Empty(endpoint)
+		assert.NoError(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("prefix without bucket", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--s3-prefix", "output"})
+		cmd.Execute()
+
+		loc, _, err := getOutputLocation(cmd)
+		assert.Nil(loc)
+		assert.Error(err)
+
+		cmd.ResetFlags()
+	})
+
+	t.Run("bucket, prefix and endpoint", func(t *testing.T) {
+		addRunFlags(cmd)
+		cmd.SetArgs([]string{"--s3-bucket", "bucket", "--s3-prefix", "output", "--s3-endpoint", "http://localhost:9000"})
+		cmd.Execute()
+
+		loc, endpoint, err := getOutputLocation(cmd)
+		assert.Equal(&invocation.OutputLocation{Bucket: "bucket", Prefix: "output"}, loc)
+		assert.Equal("http://localhost:9000", endpoint)
+		assert.NoError(err)
+
+		cmd.ResetFlags()
+	})
+}
+
+func Test_validateRunFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd := NewTestCmd()
+	cmdutil.AddCommandFlag(cmd)
+	cmdutil.AddFilterFlag(cmd)
+	cmdutil.AddInstanceFlag(cmd)
+	cmdutil.AddHostnameFlag(cmd)
+	cmd.Execute()
+
+	instanceList := make([]string, 51)
+	commands := map[string][]*string{
+		"commands": aws.StringSlice([]string{"hostname"}),
+	}
+
+	t.Run("try to use --filter and --instance flags", func(t *testing.T) {
+		targetList := make(ssmx.Filters, 2)
+		err := validateRunFlags(cmd, instanceList, nil, defaultDocument, commands, targetList)
+		assert.Error(err)
+	})
+
+	t.Run("specify more than 5 filters", func(t *testing.T) {
+		targetList := make(ssmx.Filters, 6)
+		err := validateRunFlags(cmd, nil, nil, defaultDocument, commands, targetList)
+		assert.NoError(err)
+	})
+
+	t.Run("no instances or filters specified", func(t *testing.T) {
+		err := validateRunFlags(cmd, nil, nil, defaultDocument, commands, nil)
+		assert.Error(err)
+	})
+
+	t.Run(">50 specified instances", func(t *testing.T) {
+		err := validateRunFlags(cmd, instanceList, nil, defaultDocument, commands, nil)
+		assert.Error(err)
+	})
+
+	t.Run("no command specified", func(t *testing.T) {
+		err := validateRunFlags(cmd, []string{"myInstance"}, nil, defaultDocument, nil, nil)
+		assert.Error(err)
+	})
+
+	t.Run("no document specified", func(t *testing.T) {
+		err := validateRunFlags(cmd, []string{"myInstance"}, nil, "", commands, nil)
+		assert.Error(err)
+	})
+
+	t.Run("custom document without commands", func(t *testing.T) {
+		err := validateRunFlags(cmd, []string{"myInstance"}, nil, "AWS-ApplyAnsiblePlaybooks", nil, nil)
+		assert.NoError(err)
+	})
+
+	t.Run("valid flag combination", func(t *testing.T) {
+		err := validateRunFlags(cmd, []string{"myInstance"}, nil, defaultDocument, commands, nil)
+		assert.NoError(err)
+	})
+}
+
+func Test_validateSessionFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd := NewTestCmd()
+	cmdutil.AddFilterFlag(cmd)
+	cmdutil.AddInstanceFlag(cmd)
+	cmd.Execute()
+
+	instanceList := make([]string, 51)
+
+	t.Run("try to use --filter and --instance flags", func(t *testing.T) {
+		filterList := ssmx.Filters{{Key: "foo", Values: []string{"bar"}}}
+		err := validateSessionFlags(cmd, instanceList, filterList)
+		assert.Error(err)
+	})
+
+	t.Run("specify more than 5 filters", func(t *testing.T) {
+		targetList := make(ssmx.Filters, 6)
+		err := validateSessionFlags(cmd, nil, targetList)
+		assert.NoError(err)
+	})
+
+	t.Run("valid flag combination", func(t *testing.T) {
+		err := validateSessionFlags(cmd, instanceList, nil)
+		assert.NoError(err)
+	})
+}
+
+func Test_setLogLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd := NewTestCmd()
+
+	testLogger := logrus.New()
+
+	t.Run("verbose flag undefined", func(t *testing.T) {
+		cmd.Execute()
+		err := setLogLevel(cmd, testLogger)
+		assert.Error(err)
+	})
+
+	t.Run("check that correct level is set", func(t *testing.T) {
+		cmdutil.AddVerboseFlag(cmd)
+		cmd.SetArgs([]string{"-v", "0"})
+		cmd.Execute()
+
+		err := setLogLevel(cmd, testLogger)
+		assert.Equal(logrus.FatalLevel, testLogger.GetLevel())
+		assert.NoError(err)
+		cmd.ResetFlags()
+	})
+
+}
+
+func Test_instanceSession(t *testing.T) {
+	assert := assert.New(t)
+
+	newSession := func(profile, region string) *session.Session {
+		return &session.Session{ProfileName: profile, Session: awssession.Must(awssession.NewSession(&aws.Config{Region: aws.String(region)}))}
+	}
+	pool := &session.Pool{Sessions: map[string]*session.Session{
+		"profile1-us-east-1": newSession("profile1", "us-east-1"),
+		"profile1-us-west-2": newSession("profile1", "us-west-2"),
+		"profile2-us-east-1": newSession("profile2", "us-east-1"),
+	}}
+
+	sess, err := instanceSession(pool, instance.InstanceInfo{InstanceID: "i-123", Profile: "profile1", Region: "us-west-2"})
+	assert.NoError(err)
+	assert.Equal(pool.Sessions["profile1-us-west-2"], sess)
+
+	// Instances are only started through the session they were found with
+	_, err = instanceSession(pool, instance.InstanceInfo{InstanceID: "i-123", Profile: "profile3", Region: "us-east-1"})
+	assert.Error(err)
+}
+
+func Test_selectionExitCode(t *testing.T) {
+	assert := assert.New(t)
+
+	// Interrupting the prompt is not an error
+	assert.Equal(0, selectionExitCode(terminal.InterruptErr))
+	assert.Equal(1, selectionExitCode(fmt.Errorf("no terminal")))
+}
+
+func Test_invalidateInstanceCache(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := instance.NewCache(t.TempDir(), time.Hour, log)
+	fetches := 0
+	fetch := func() ([]instance.InstanceInfo, error) {
+		fetches++
+		return []instance.InstanceInfo{{InstanceID: "i-123", Profile: "profile1", Region: "us-east-1"}}, nil
+	}
+
+	_, err := cache.Get("profile1", "us-east-1", fetch)
+	assert.NoError(err)
+
+	// Every instance that failed to start is looked up again next time
+	invalidateInstanceCache(cache, []instance.InstanceInfo{{InstanceID: "i-123", Profile: "profile1", Region: "us-east-1"}})
+	_, err = cache.Get("profile1", "us-east-1", fetch)
+	assert.NoError(err)
+	cache.Wait()
+	assert.Equal(2, fetches)
+
+	// Caching can be disabled
+	invalidateInstanceCache(nil, []instance.InstanceInfo{{InstanceID: "i-123"}})
 }
@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/spf13/cobra"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	startsession "github.com/disneystreaming/ssm-helpers/ssm/session"
+)
+
+func newCommandSSMForward() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "forward [@target]",
+		Short: "forward local ports to instances or hosts reachable from them using SSM",
+		Long:  "Forward local ports to instances, or to hosts reachable from them such as RDS endpoints, using SSM port forwarding sessions.\nInstances are selected the same way as for the session subcommand, and every forward runs until interrupted.",
+		Run: func(cmd *cobra.Command, args []string) {
+			forwardCommand(cmd, args)
+		},
+	}
+
+	addBaseFlags(cmd)
+	addForwardFlags(cmd)
+
+	return cmd
+}
+
+func forwardCommand(cmd *cobra.Command, args []string) {
+	var err error
+	var instanceList, addressList, tagList, attributeList []string
+	var forwards []startsession.PortForward
+
+	// Get all of our CLI flag values
+	if args, err = applyNamedTarget(cmd, args); err != nil {
+		log.Fatal(err)
+	}
+	if err = cmdutil.ValidateArgs(cmd, args); err != nil {
+		log.Fatal(err)
+	}
+
+	if instanceList, err = cmdutil.GetFlagStringSlice(cmd, "instance"); err != nil {
+		log.Fatal(err)
+	}
+
+	if addressList, err = cmdutil.GetFlagStringSlice(cmd, "address"); err != nil {
+		log.Fatal(err)
+	}
+
+	var filterList ssmx.Filters
+	if filterList, err = getFilters(cmd); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = validateSessionFlags(cmd, instanceList, filterList); err != nil {
+		log.Fatal(err)
+	}
+
+	if forwards, err = getPortForwards(cmd); err != nil {
+		log.Fatal(err)
+	}
+
+	var poolOpts poolOptions
+	if poolOpts, err = getPoolOptions(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if tagList, err = cmdutil.GetFlagStringSlice(cmd, "tag"); err != nil {
+		log.Fatal(err)
+	}
+	if attributeList, err = getAttributeList(cmd); err != nil {
+		log.Fatal(err)
+	}
+
+	var dryRunFlag bool
+	if dryRunFlag, err = cmdutil.GetFlagBool(cmd, "dry-run"); err != nil {
+		log.Fatal(err)
+	}
+
+	var limitFlag int
+	if limitFlag, err = cmdutil.GetFlagInt(cmd, "limit"); err != nil {
+		log.Fatal(err)
+	}
+
+	var cache *instance.Cache
+	if cache, err = getInstanceCache(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if cache != nil {
+		// Let the instances being refreshed in the background finish caching before exiting
+		defer cache.Wait()
+	}
+
+	// Get the number of cores available for parallelization
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	instancePool, totalInstances, sessionPool := findSessionInstances(poolOpts, cache, instanceList, addressList, filterList, limitFlag)
+
+	log.Infof("Retrieved %d usable instances.", len(instancePool.AllInstances))
+
+	// No functional results, exit now
+	if len(instancePool.AllInstances) == 0 || dryRunFlag {
+		return
+	}
+
+	selectedInstances, err := selectSessionInstances(instancePool, totalInstances, instanceList, tagList, attributeList)
+	if err != nil {
+		exitAfterCaching(cache, selectionExitCode(err))
+	}
+
+	// The same local port can't be listened on for more than one instance
+	if len(selectedInstances) > 1 {
+		for _, f := range forwards {
+			if f.LocalPort != 0 {
+				log.Fatal(cmdutil.UsageError(cmd, "Local ports cannot be specified when forwarding through more than one instance; omit them to pick free ports."))
+			}
+		}
+	}
+
+	if err = startPortForwards(sessionPool, selectedInstances, forwards); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// startPortForwards starts a port forwarding session for every forward through each of the instances, with the
+// session of the pool that each instance was found with, and waits until they have all ended. Interrupts close
+// every session.
+func startPortForwards(pool *session.Pool, instances []instance.InstanceInfo, forwards []startsession.PortForward) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Every local port is listened on before any session is started, so that no session is left running if
+	// that fails, and the ports can't be taken before the sessions start
+	type portForward struct {
+		instance.InstanceInfo
+		startsession.PortForward
+		sess     *session.Session
+		listener net.Listener
+	}
+	var sessions []portForward
+	closeListeners := func() {
+		for _, s := range sessions {
+			s.listener.Close()
+		}
+	}
+
+	for _, v := range instances {
+		sess, err := instanceSession(pool, v)
+		if err != nil {
+			closeListeners()
+			return err
+		}
+
+		for _, f := range forwards {
+			l, err := f.Listen()
+			if err != nil {
+				closeListeners()
+				return err
+			}
+			sessions = append(sessions, portForward{v, f, sess, l})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		log.Infof("Forwarding %s through instance %s (%s, %s)", s.PortForward, s.InstanceID, s.Profile, s.Region)
+
+		wg.Add(1)
+		go func(s portForward) {
+			defer wg.Done()
+			startPortForward(ctx, s.sess, s.InstanceInfo, s.PortForward, s.listener)
+		}(s)
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// startPortForward runs a single port forwarding session through the listener of the forward until it ends or ctx
+// is canceled, logging how it ended prefixed with the instance and forward
+func startPortForward(ctx context.Context, sess *session.Session, v instance.InstanceInfo, f startsession.PortForward, l net.Listener) {
+	prefix := fmt.Sprintf("[%s %s]", v.InstanceID, f)
+
+	client, dialer := ssm.New(sess.Session), startsession.NewDialer(sess.Session.Config.HTTPClient)
+	if err := startsession.Forward(ctx, client, dialer, v.InstanceID, f, l); err != nil && ctx.Err() == nil {
+		log.Errorf("%s Port forwarding session exited: %s", prefix, err)
+		return
+	}
+	log.Infof("%s Port forwarding session closed", prefix)
+}
@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
+	"github.com/disneystreaming/ssm-helpers/cmd/logutil"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+)
+
+func newCommandSSMHistory() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "list the commands previously sent with SSM",
+		Long:  "List the commands previously sent with SSM in each profile/region combination, most recent first.\nUse the show subcommand to print the per-instance results of a command.",
+		Run: func(cmd *cobra.Command, args []string) {
+			historyCommand(cmd, args)
+		},
+	}
+
+	addPoolFlags(cmd)
+	addOrgFlags(cmd)
+	addHistoryFlags(cmd)
+
+	show := &cobra.Command{
+		Use:   "show <command-id>",
+		Short: "print the per-instance results of a previous command",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			historyShowCommand(cmd, args)
+		},
+	}
+
+	addPoolFlags(show)
+	addOrgFlags(show)
+	addHistoryShowFlags(show)
+	cmd.AddCommand(show)
+
+	return cmd
+}
+
+// commandRecord is the serializable representation of a command listed by the history subcommand
+type commandRecord struct {
+	CommandID             string    `json:"command_id" yaml:"command_id"`
+	Profile               string    `json:"profile" yaml:"profile"`
+	Region                string    `json:"region" yaml:"region"`
+	Document              string    `json:"document" yaml:"document"`
+	Status                string    `json:"status" yaml:"status"`
+	RequestedAt           time.Time `json:"requested_at" yaml:"requested_at"`
+	Requester             string    `json:"requester" yaml:"requester"`
+	Comment               string    `json:"comment" yaml:"comment"`
+	TargetCount           int64     `json:"target_count" yaml:"target_count"`
+	CompletedCount        int64     `json:"completed_count" yaml:"completed_count"`
+	ErrorCount            int64     `json:"error_count" yaml:"error_count"`
+	DeliveryTimedOutCount int64     `json:"delivery_timed_out_count" yaml:"delivery_timed_out_count"`
+}
+
+func newCommandRecord(sess *session.Session, c *ssm.Command) commandRecord {
+	return commandRecord{
+		CommandID:             aws.StringValue(c.CommandId),
+		Profile:               sess.ProfileName,
+		Region:                *sess.Session.Config.Region,
+		Document:              aws.StringValue(c.DocumentName),
+		Status:                aws.StringValue(c.Status),
+		RequestedAt:           aws.TimeValue(c.RequestedDateTime),
+		Requester:             ssmx.CommentRequester(aws.StringValue(c.Comment)),
+		Comment:               aws.StringValue(c.Comment),
+		TargetCount:           aws.Int64Value(c.TargetCount),
+		CompletedCount:        aws.Int64Value(c.CompletedCount),
+		ErrorCount:            aws.Int64Value(c.ErrorCount),
+		DeliveryTimedOutCount: aws.Int64Value(c.DeliveryTimedOutCount),
+	}
+}
+
+func historyCommand(cmd *cobra.Command, args []string) {
+	var err error
+	var poolOpts poolOptions
+	var filter ssmx.CommandFilter
+	var limit int
+	var outputFormat invocation.Format
+
+	if err = cmdutil.ValidateArgs(cmd, args); err != nil {
+		log.Fatal(err)
+	}
+
+	if poolOpts, err = getPoolOptions(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if filter, err = getCommandFilter(cmd, time.Now()); err != nil {
+		log.Fatal(err)
+	}
+	if limit, err = cmdutil.GetFlagInt(cmd, "limit"); err != nil {
+		log.Fatal(err)
+	}
+	if outputFormat, err = getOutputFormat(cmd); err != nil {
+		log.Fatal(err)
+	}
+
+	// Keep stdout clean for machine-readable output
+	if outputFormat != invocation.FormatTable {
+		logutil.SetLogStderrOutput(log)
+	}
+
+	var mu sync.Mutex
+	var records []commandRecord
+
+	sessionPool := poolOpts.newSessionPool()
+	group := poolOpts.newGroup()
+	for _, sess := range sessionPool.Sessions {
+		sess := sess
+		group.Go(func() {
+			commands, err := ssmx.ListCommands(ssm.New(sess.Session), filter, limit)
+			if err != nil {
+				log.Errorf("%s in %s: %v", sess.ProfileName, *sess.Session.Config.Region, err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, c := range commands {
+				records = append(records, newCommandRecord(sess, c))
+			}
+		})
+	}
+	group.Wait()
+
+	// Show the most recent commands across every profile and region first
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].RequestedAt.After(records[j].RequestedAt)
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+
+	if err = writeCommandRecords(outputFormat, os.Stdout, records); err != nil {
+		log.Fatal(err)
+	}
+}
+
+const historyFormat = "%-36s %-20s %-15s %-15s %-11s %-25s %-15s %s"
+
+// writeCommandRecords writes the listed commands in the given format, as log lines for table output
+func writeCommandRecords(format invocation.Format, w io.Writer, records []commandRecord) error {
+	switch format {
+	case invocation.FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string][]commandRecord{"commands": records})
+
+	case invocation.FormatYAML:
+		enc := yaml.NewEncoder(w)
+		defer enc.Close()
+		return enc.Encode(map[string][]commandRecord{"commands": records})
+
+	case invocation.FormatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(records) == 0 {
+		log.Info("No commands found")
+		return nil
+	}
+
+	log.Infof(historyFormat, "Command ID", "Requested", "Profile", "Region", "Status", "Document", "Requester", "Completed")
+	for _, r := range records {
+		completed := fmt.Sprintf("%d/%d", r.CompletedCount, r.TargetCount)
+		if r.ErrorCount > 0 {
+			completed += fmt.Sprintf(" (%d errors)", r.ErrorCount)
+		}
+
+		logf := log.Infof
+		if r.Status != ssm.CommandStatusSuccess && r.Status != ssm.CommandStatusPending && r.Status != ssm.CommandStatusInProgress {
+			logf = log.Errorf
+		}
+		logf(historyFormat, r.CommandID, r.RequestedAt.Local().Format("2006-01-02 15:04:05"), r.Profile, r.Region, r.Status, r.Document, r.Requester, completed)
+	}
+
+	return nil
+}
+
+func historyShowCommand(cmd *cobra.Command, args []string) {
+	var err error
+	var poolOpts poolOptions
+	var outputFormat invocation.Format
+	var s3Endpoint string
+	var aggregateFlag bool
+
+	commandID := args[0]
+
+	if poolOpts, err = getPoolOptions(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if s3Endpoint, err = cmdutil.GetFlagString(cmd, "s3-endpoint"); err != nil {
+		log.Fatal(err)
+	}
+	if outputFormat, err = getOutputFormat(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if aggregateFlag, err = cmdutil.GetFlagBool(cmd, "aggregate"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Keep stdout clean for machine-readable output
+	if outputFormat != invocation.FormatTable {
+		logutil.SetLogStderrOutput(log)
+	}
+
+	// Command IDs are unique, so the first profile/region combination the command is found in is used
+	var sess *session.Session
+	var command *ssm.Command
+	sessionPool := poolOpts.newSessionPool()
+	for _, s := range sessionPool.Sessions {
+		if command, err = ssmx.GetCommand(ssm.New(s.Session), commandID); err != nil {
+			log.Errorf("%s in %s: %v", s.ProfileName, *s.Session.Config.Region, err)
+			continue
+		}
+		if command != nil {
+			sess = s
+			break
+		}
+	}
+
+	if command == nil {
+		log.Fatalf("Command %s was not found in any of the selected profiles and regions", commandID)
+	}
+
+	log.Infof("Command %s ran %s in %s in %s, requested at %s with status %s",
+		commandID, aws.StringValue(command.DocumentName), sess.ProfileName, *sess.Session.Config.Region,
+		aws.TimeValue(command.RequestedDateTime).Local().Format("2006-01-02 15:04:05"), aws.StringValue(command.Status))
+
+	// Retrieve the complete output from S3 if the command was configured to write it there
+	var s3Client s3iface.S3API
+	var outputLocation *invocation.OutputLocation
+	if bucket := aws.StringValue(command.OutputS3BucketName); bucket != "" {
+		outputLocation = &invocation.OutputLocation{Bucket: bucket, Prefix: aws.StringValue(command.OutputS3KeyPrefix)}
+		s3Client = invocation.NewS3Client(sess, s3Endpoint)
+	}
+
+	writer, summary := invocation.NewResultWriter(outputFormat, os.Stdout, log), invocation.NewSummary()
+	if aggregateFlag {
+		writer = invocation.NewAggregateWriter(outputFormat, os.Stdout, log)
+	}
+
+	results := make(chan *invocation.Result)
+	go func() {
+		ssmx.SendCommandResults(sess, ssm.New(sess.Session), commandID, results)
+		close(results)
+	}()
+
+	for v := range results {
+		if outputLocation != nil && v.InvocationResult != nil {
+			if err := invocation.FetchOutput(s3Client, *outputLocation, v); err != nil {
+				log.Warn(err)
+			}
+		}
+
+		summary.Add(v)
+		if err := writer.Write(v); err != nil {
+			log.Error(err)
+		}
+	}
+
+	if err := writer.WriteSummary(summary); err != nil {
+		log.Fatal(err)
+	}
+}
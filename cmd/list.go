@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
+	"github.com/disneystreaming/ssm-helpers/cmd/logutil"
+	"github.com/disneystreaming/ssm-helpers/fleet"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+)
+
+// formatCSV writes the listed instances as CSV, with a header row naming the columns
+const formatCSV invocation.Format = "csv"
+
+// defaultListColumns are the columns shown by the list subcommand unless --columns is specified
+var defaultListColumns = []string{
+	"InstanceID", "Profile", "Region", "PingStatus", "PlatformName", "AgentVersion", "IPAddress", "ComputerName", "LastPingDateTime",
+}
+
+func newCommandSSMList() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list [@target]",
+		Short: "list the instances managed by SSM",
+		Long: `List the managed instances that match the --instance, --address and --filter flags (or an @target) in each
+profile/region combination, along with their SSM attributes. Unlike ssm session, every matching instance is listed,
+whether or not it is online.`,
+		Example: `  ssm list --filter env=prod --columns InstanceID,IPAddress,tag:Name
+  ssm list --all-profiles --sort LastPingDateTime:desc
+  ssm list @web --output csv > web.csv`,
+		Run: func(cmd *cobra.Command, args []string) {
+			listCommand(cmd, args)
+		},
+	}
+
+	addPoolFlags(cmd)
+	addOrgFlags(cmd)
+	addListFlags(cmd)
+
+	return cmd
+}
+
+func listCommand(cmd *cobra.Command, args []string) {
+	var err error
+	var instanceList, addressList, columns []string
+	var filterList ssmx.Filters
+	var poolOpts poolOptions
+	var sortKeys []instance.SortKey
+	var outputFormat invocation.Format
+
+	if args, err = applyNamedTarget(cmd, args); err != nil {
+		log.Fatal(err)
+	}
+	if err = cmdutil.ValidateArgs(cmd, args); err != nil {
+		log.Fatal(err)
+	}
+
+	if instanceList, err = cmdutil.GetFlagStringSlice(cmd, "instance"); err != nil {
+		log.Fatal(err)
+	}
+	if addressList, err = cmdutil.GetFlagStringSlice(cmd, "address"); err != nil {
+		log.Fatal(err)
+	}
+	if filterList, err = getFilters(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if err = validateSessionFlags(cmd, instanceList, filterList); err != nil {
+		log.Fatal(err)
+	}
+
+	if poolOpts, err = getPoolOptions(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if columns, err = getListColumns(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if sortKeys, err = getListSort(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if outputFormat, err = getListFormat(cmd); err != nil {
+		log.Fatal(err)
+	}
+
+	// Keep stdout clean for machine-readable output
+	if outputFormat != invocation.FormatTable {
+		logutil.SetLogStderrOutput(log)
+	}
+
+	instances := listInstances(poolOpts, instanceList, addressList, filterList)
+	instance.Sort(instances, sortKeys)
+
+	if err = writeInstances(outputFormat, os.Stdout, instances, columns); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listInstances returns every managed instance that matches the provided instance IDs, addresses and filters
+// in each profile/region combination, or each account of the organization if an organization selector is set.
+// If a region resolver is set, every region enabled for each profile is searched in place of the regions.
+func listInstances(opts poolOptions, instanceList, addressList []string, filterList ssmx.Filters) []instance.InstanceInfo {
+	targets := opts.targets()
+	targets.Instances, targets.Addresses, targets.Filters = instanceList, addressList, filterList
+
+	instances, err := opts.newClient().Discover(context.Background(), targets)
+
+	// Profiles and regions that failed are reported, the instances found in the others are still listed
+	if errs, ok := err.(fleet.Errors); ok {
+		for _, err := range errs {
+			log.Error(err)
+		}
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	return instances
+}
+
+// writeInstances writes the listed instances in the given format. Table and CSV output only include the
+// provided columns, while structured formats include every field.
+func writeInstances(format invocation.Format, w io.Writer, instances []instance.InstanceInfo, columns []string) error {
+	if instances == nil {
+		instances = []instance.InstanceInfo{}
+	}
+
+	switch format {
+	case invocation.FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string][]instance.InstanceInfo{"instances": instances})
+
+	case invocation.FormatYAML:
+		enc := yaml.NewEncoder(w)
+		defer enc.Close()
+		return enc.Encode(map[string][]instance.InstanceInfo{"instances": instances})
+
+	case invocation.FormatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, i := range instances {
+			if err := enc.Encode(i); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(columns)
+		for _, i := range instances {
+			cw.Write(instanceRow(i, columns))
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	if len(instances) == 0 {
+		log.Info("No instances found")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 5, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	for _, i := range instances {
+		fmt.Fprintln(tw, strings.Join(instanceRow(i, columns), "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// instanceRow returns the value of each column for an instance
+func instanceRow(i instance.InstanceInfo, columns []string) (row []string) {
+	for _, c := range columns {
+		row = append(row, i.Field(c))
+	}
+	return row
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/disneystreaming/ssm-helpers/aws/config"
+	"github.com/disneystreaming/ssm-helpers/aws/sso"
+	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
+)
+
+func newCommandSSMLogin() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "login",
+		Short: "sign in to the AWS IAM Identity Center (SSO) profiles",
+		Long: `Sign in to the AWS IAM Identity Center (SSO) start URL of each selected profile, using the device authorization flow.
+The sign-in is cached in ~/.aws/sso/cache and shared with the AWS CLI, so profiles that use the same sso-session or
+start URL only need to sign in once. Profiles that don't use SSO are skipped.`,
+		Example: `  ssm login --profile prod
+  ssm login --all-profiles`,
+		Run: func(cmd *cobra.Command, args []string) {
+			loginCommand(cmd, args)
+		},
+	}
+
+	addLoginFlags(cmd)
+
+	return cmd
+}
+
+func loginCommand(cmd *cobra.Command, args []string) {
+	var err error
+	var profileList []string
+	var force bool
+
+	if err = cmdutil.ValidateArgs(cmd, args); err != nil {
+		log.Fatal(err)
+	}
+	if profileList, err = getProfileList(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if force, err = cmdutil.GetFlagBool(cmd, "force"); err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, err := config.LoadSharedConfig(config.SharedConfigPath())
+	if err != nil {
+		log.Fatalf("Could not load the AWS config file\n%v", err)
+	}
+
+	logins := groupLogins(cfg, profileList)
+	if len(logins) == 0 {
+		log.Fatal("None of the selected profiles use SSO")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dir := sso.CacheDir()
+	for _, l := range logins {
+		if err = login(ctx, dir, l, force); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// ssoLogin is a single sign-in, shared by every profile with the same cache key
+type ssoLogin struct {
+	profile  *sso.Profile
+	profiles []string
+}
+
+// groupLogins returns the sign-ins needed by the SSO profiles of the list, in the order of the profiles
+func groupLogins(cfg *config.SharedConfig, profileList []string) (logins []*ssoLogin) {
+	byKey := make(map[string]*ssoLogin)
+	for _, name := range profileList {
+		p, err := sso.LookupProfile(cfg, name)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		if p == nil {
+			log.Debugf("Skipping profile %s, which does not use SSO", name)
+			continue
+		}
+
+		l, ok := byKey[p.CacheKey()]
+		if !ok {
+			l = &ssoLogin{profile: p}
+			byKey[p.CacheKey()] = l
+			logins = append(logins, l)
+		}
+		l.profiles = append(l.profiles, name)
+	}
+
+	return logins
+}
+
+// login signs in with the device authorization flow, unless the cached token is still valid
+func login(ctx context.Context, dir string, l *ssoLogin, force bool) error {
+	profiles := strings.Join(l.profiles, ", ")
+
+	cached, err := sso.LoadToken(dir, l.profile)
+	if err != nil {
+		log.Warn(err)
+	}
+	if cached != nil && cached.Valid(time.Now()) && !force {
+		log.Infof("Already signed in to %s until %s (%s)", l.profile.StartURL, cached.ExpiresAt.Local().Format(time.RFC1123), profiles)
+		return nil
+	}
+
+	client, err := sso.NewOIDCClient(l.profile)
+	if err != nil {
+		return err
+	}
+
+	token, err := sso.Login(ctx, client, l.profile, cached, func(auth sso.Authorization) {
+		fmt.Fprintf(os.Stderr, "To sign in to %s, open the following page in a browser and confirm that it shows the code %s:\n\n    %s\n\n",
+			l.profile.StartURL, auth.UserCode, auth.VerificationURL)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = sso.SaveToken(dir, l.profile, token); err != nil {
+		return fmt.Errorf("Could not cache the SSO token\n%v", err)
+	}
+
+	log.Infof("Signed in to %s until %s (%s)", l.profile.StartURL, token.ExpiresAt.Local().Format(time.RFC1123), profiles)
+	return nil
+}
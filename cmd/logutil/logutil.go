@@ -60,6 +60,18 @@ func SetLogSplitOutput(l *log.Logger) {
 	})
 }
 
+// SetLogStderrOutput replaces the hooks of a *logrus.Logger so that every
+// log level is written to stderr, keeping stdout free for structured output
+func SetLogStderrOutput(l *log.Logger) {
+	l.SetOutput(ioutil.Discard)
+	l.ReplaceHooks(make(log.LevelHooks))
+
+	l.AddHook(&WriterHook{
+		Writer:    os.Stderr,
+		LogLevels: log.AllLevels,
+	})
+}
+
 // IntToLogLevel returns a log.Level value from an integer-based mapping
 func IntToLogLevel(levelInt int) log.Level {
 	var toLogLevel = map[int]log.Level{
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/spf13/cobra"
+
+	"github.com/disneystreaming/ssm-helpers/aws/org"
+	"github.com/disneystreaming/ssm-helpers/aws/ratelimit"
+	"github.com/disneystreaming/ssm-helpers/aws/regions"
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
+	"github.com/disneystreaming/ssm-helpers/fleet"
+	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	"github.com/disneystreaming/ssm-helpers/util/parallel"
+)
+
+// poolOptions select the sessions that a command works through, and bound how much work is done through them at once
+type poolOptions struct {
+	profiles []string
+	regions  []string
+
+	// regionResolver is set with --all-regions, in which case the regions enabled for each profile replace regions
+	regionResolver *regions.Resolver
+
+	// orgSelector is set with --org-accounts, in which case the accounts of the organization replace the profiles
+	orgSelector *org.Selector
+
+	// parallel is the number of sessions worked on at once
+	parallel int
+
+	// limiter rate limits the calls made through each session, it is nil with --rate-limit 0
+	limiter *ratelimit.Limiter
+}
+
+// getPoolOptions returns the pool options set with the flags of addBaseFlags or addPoolFlags, and of addOrgFlags for
+// the commands that have them
+func getPoolOptions(cmd *cobra.Command) (opts poolOptions, err error) {
+	if opts.profiles, err = getProfileList(cmd); err != nil {
+		return opts, err
+	}
+	if opts.regions, err = getRegionList(cmd); err != nil {
+		return opts, err
+	}
+	if opts.regionResolver, err = getRegionResolver(cmd); err != nil {
+		return opts, err
+	}
+	if cmd.Flags().Lookup("org-accounts") != nil {
+		if opts.orgSelector, err = getOrgSelector(cmd); err != nil {
+			return opts, err
+		}
+	}
+	if opts.parallel, opts.limiter, err = getPoolLimits(cmd); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// getPoolLimits returns the number of sessions to work on at once and the rate limiter of their calls, which is
+// nil if --rate-limit is 0
+func getPoolLimits(cmd *cobra.Command) (limit int, limiter *ratelimit.Limiter, err error) {
+	if limit, err = cmdutil.GetFlagInt(cmd, "parallel"); err != nil {
+		return 0, nil, err
+	}
+	if limit < 1 {
+		return 0, nil, cmdutil.UsageError(cmd, "--parallel must be at least 1.")
+	}
+
+	var rate float64
+	if rate, err = cmdutil.GetFlagFloat64(cmd, "rate-limit"); err != nil {
+		return 0, nil, err
+	}
+	if rate < 0 {
+		return 0, nil, cmdutil.UsageError(cmd, "--rate-limit cannot be negative.")
+	}
+	if rate > 0 {
+		limiter = ratelimit.New(rate)
+	}
+
+	return limit, limiter, nil
+}
+
+// targets returns the fleet targets selecting the same sessions as newSessionPool
+func (o poolOptions) targets() fleet.Targets {
+	t := fleet.Targets{Profiles: o.profiles, Regions: o.regions, Organization: o.orgSelector}
+	if o.regionResolver != nil {
+		t.AllRegions, t.ExcludeRegions = true, o.regionResolver.Exclude
+	}
+
+	return t
+}
+
+// newClient returns a fleet client working through the sessions with the limits of the options
+func (o poolOptions) newClient() *fleet.Client {
+	client := fleet.New(log)
+	client.Parallel, client.Limiter = o.parallel, o.limiter
+
+	return client
+}
+
+// newSessionPool returns a session for each profile/region combination, or if orgSelector is set, for each account
+// of the organization listed with the profiles in each region. If regionResolver is set, the regions enabled for
+// each profile are used in place of regions.
+func (o poolOptions) newSessionPool() *session.Pool {
+	build := func(profiles, regions []string) (*session.Pool, error) {
+		if o.orgSelector != nil {
+			return org.BuildPool(profiles, regions, *o.orgSelector, log)
+		}
+		return session.BuildPool(profiles, regions, log)
+	}
+
+	var pool *session.Pool
+	var err error
+	if o.regionResolver != nil {
+		pool, err = regions.BuildPool(o.profiles, o.regionResolver, build)
+	} else {
+		pool, err = build(o.profiles, o.regions)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Debugf("Targeting %d sessions", len(pool.Sessions))
+
+	o.install(pool)
+
+	return pool
+}
+
+// install rate limits the calls made through each session of the pool
+func (o poolOptions) install(pool *session.Pool) {
+	if o.limiter == nil {
+		return
+	}
+
+	for _, sess := range pool.Sessions {
+		o.limiter.Install(sess)
+	}
+}
+
+// instanceSession returns the session of the pool that the instance was found with, matching its profile, which
+// names the account of sessions that assume a role, and its region
+func instanceSession(pool *session.Pool, v instance.InstanceInfo) (*session.Session, error) {
+	for _, sess := range pool.Sessions {
+		if sess.ProfileName == v.Profile && aws.StringValue(sess.Session.Config.Region) == v.Region {
+			return sess, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No session found for instance %s in %s (%s)", v.InstanceID, v.Profile, v.Region)
+}
+
+// newGroup returns the group to work through the sessions of the pool with
+func (o poolOptions) newGroup() *parallel.Group {
+	return parallel.NewGroup(o.parallel)
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/spf13/cobra"
+
+	"github.com/disneystreaming/ssm-helpers/aws/resolver"
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
+	"github.com/disneystreaming/ssm-helpers/cmd/logutil"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	startsession "github.com/disneystreaming/ssm-helpers/ssm/session"
+)
+
+// instanceIDPattern matches EC2 instance IDs and the IDs of on-premises managed instances
+var instanceIDPattern = regexp.MustCompile(`^m?i-[0-9a-f]{8,17}$`)
+
+func newCommandSSMProxy() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy <host> <port>",
+		Short: "tunnel stdin/stdout to an instance using SSM, for use as an SSH ProxyCommand",
+		Long: `Tunnel stdin/stdout to a port of an instance using an AWS-StartSSHSession session.
+
+The host can be an instance ID, a hostname or IP address that resolves to the private IP of an instance,
+or the Name tag of an instance. The instance is looked up in each of the selected profile/region combinations.
+
+Add the following to ~/.ssh/config to connect to hosts with ssh, scp, rsync or ansible through SSM:
+
+    Host *.internal i-* mi-*
+        ProxyCommand ssm proxy %h %p --profile myprofile --region us-east-1`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			proxyCommand(cmd, args)
+		},
+	}
+
+	addPoolFlags(cmd)
+
+	return cmd
+}
+
+func proxyCommand(cmd *cobra.Command, args []string) {
+	var err error
+
+	// stdout carries the tunnel, so nothing else may be written to it
+	logutil.SetLogStderrOutput(log)
+
+	host := args[0]
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port < 1 || port > 65535 {
+		log.Fatal(cmdutil.UsageError(cmd, "%q is not a valid port number.", args[1]))
+	}
+
+	var poolOpts poolOptions
+	if poolOpts, err = getPoolOptions(cmd); err != nil {
+		log.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var targets []proxyTarget
+
+	group := poolOpts.newGroup()
+	sessionPool := poolOpts.newSessionPool()
+	for _, sess := range sessionPool.Sessions {
+		sess := sess
+		group.Go(func() {
+			ids, err := resolveProxyHost(sess, host)
+			if err != nil {
+				log.Errorf("%s in %s: %v", sess.ProfileName, *sess.Session.Config.Region, err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, id := range ids {
+				targets = append(targets, proxyTarget{InstanceID: id, sess: sess})
+			}
+		})
+	}
+	group.Wait()
+
+	switch len(targets) {
+	case 0:
+		log.Fatalf("No instance managed by SSM found for %s in the selected profiles and regions", host)
+	case 1:
+	default:
+		var matches []string
+		for _, v := range targets {
+			matches = append(matches, fmt.Sprintf("%s (%s, %s)", v.InstanceID, v.sess.ProfileName, *v.sess.Session.Config.Region))
+		}
+		log.Fatalf("%s matches more than one instance, use an instance ID or narrow down the profiles and regions:\n%s", host, strings.Join(matches, "\n"))
+	}
+
+	v := targets[0]
+	log.Debugf("Starting SSH session with instance %s (%s, %s) on port %d", v.InstanceID, v.sess.ProfileName, *v.sess.Session.Config.Region, port)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The session ends when ssh closes stdin
+	client, dialer := ssm.New(v.sess.Session), startsession.NewDialer(v.sess.Session.Config.HTTPClient)
+	if err = startsession.Start(ctx, client, dialer, startsession.SSHSessionInput(v.InstanceID, port), os.Stdin, os.Stdout, nil); err != nil {
+		log.Fatalf("SSH session with instance %s failed\n%s", v.InstanceID, err)
+	}
+}
+
+// proxyTarget is an instance that the proxy host resolved to, along with the session it was found with
+type proxyTarget struct {
+	InstanceID string
+	sess       *session.Session
+}
+
+// resolveProxyHost returns the IDs of the instances managed by SSM in the profile/region combination of the session
+// that the host refers to. The host can be an instance ID, an address or hostname, or the Name tag of an instance.
+func resolveProxyHost(sess *session.Session, host string) ([]string, error) {
+	var err error
+	var candidates []string
+
+	if instanceIDPattern.MatchString(host) {
+		candidates = []string{host}
+	} else {
+		ec2Client := ec2.New(sess.Session)
+
+		// Hostnames that don't resolve to the private IP of an instance in this account fall back to the Name tag
+		if candidates, err = resolver.NewHostnameResolver([]string{host}).ResolveToInstanceId(ec2Client); err != nil {
+			log.Debugf("Could not resolve %s to an instance by address: %v", host, err)
+		}
+
+		if len(candidates) == 0 {
+			names := []string{host}
+			if short := strings.SplitN(host, ".", 2)[0]; short != host && net.ParseIP(host) == nil {
+				names = append(names, short)
+			}
+
+			if candidates, err = resolver.NewNameTagResolver(names).ResolveToInstanceId(ec2Client); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	// Only instances managed by SSM in this profile/region combination can be connected to
+	managed, err := instance.GetSessionInstances(ssm.New(sess.Session), ssmx.CreateSSMDescribeInstanceInput(nil, candidates))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, v := range managed {
+		ids = append(ids, aws.StringValue(v.InstanceId))
+	}
+
+	return ids, nil
+}
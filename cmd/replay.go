@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/disneystreaming/ssm-helpers/cmd/logutil"
+	startsession "github.com/disneystreaming/ssm-helpers/ssm/session"
+)
+
+func newCommandSSMReplay() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replay <file>",
+		Short: "play back a session recorded with ssm session --record",
+		Long:  "Play back a session recorded with ssm session --record, or any other asciicast v2 recording, in the current terminal.",
+		Example: `  ssm replay debug.cast
+  ssm replay debug.cast --speed 2 --idle-time-limit 1s`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			replayCommand(cmd, args)
+		},
+	}
+
+	addReplayFlags(cmd)
+
+	return cmd
+}
+
+func replayCommand(cmd *cobra.Command, args []string) {
+	// stdout carries the recording, so nothing else may be written to it
+	logutil.SetLogStderrOutput(log)
+
+	speed, idleTimeLimit, err := getReplaySpeed(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	cast, err := startsession.NewCastReader(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cast.Header.Title != "" {
+		log.Infof("Replaying %s, recorded %s", cast.Header.Title, time.Unix(cast.Header.Timestamp, 0).Format(time.RFC1123))
+	}
+	if cols, rows, err := term.GetSize(int(os.Stdout.Fd())); err == nil && (cols < int(cast.Header.Width) || rows < int(cast.Header.Height)) {
+		log.Warnf("The session was recorded in a %dx%d terminal, larger than this one (%dx%d)", cast.Header.Width, cast.Header.Height, cols, rows)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err = startsession.Replay(ctx, cast, os.Stdout, speed, idleTimeLimit); err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+}
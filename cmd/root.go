@@ -47,6 +47,13 @@ Complete documentation is available at https://github.com/disneystreaming/ssm-he
 		Commands: []*cobra.Command{
 			newCommandSSMRun(),
 			newCommandSSMSession(),
+			newCommandSSMList(),
+			newCommandSSMReplay(),
+			newCommandSSMForward(),
+			newCommandSSMProxy(),
+			newCommandSSMCopy(),
+			newCommandSSMHistory(),
+			newCommandSSMLogin(),
 		},
 	}
 
@@ -1,27 +1,35 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"os/user"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 
-	"github.com/disneystreaming/ssm-helpers/aws/resolver"
-	"github.com/disneystreaming/ssm-helpers/aws/session"
 	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
+	"github.com/disneystreaming/ssm-helpers/cmd/logutil"
+	"github.com/disneystreaming/ssm-helpers/fleet"
 	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
 	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
 )
 
 func newCommandSSMRun() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "run",
-		Short: "execute commands using the AWS-RunShellScript document",
+		Use:   "run [@target]",
+		Short: "execute commands using the AWS-RunShellScript document, or any other SSM command document",
 		Long:  "foo bar baz",
 		Run: func(cmd *cobra.Command, args []string) {
 			runCommand(cmd, args)
@@ -29,6 +37,7 @@ func newCommandSSMRun() *cobra.Command {
 	}
 
 	addBaseFlags(cmd)
+	addOrgFlags(cmd)
 	addRunFlags(cmd)
 
 	return cmd
@@ -36,11 +45,23 @@ func newCommandSSMRun() *cobra.Command {
 
 func runCommand(cmd *cobra.Command, args []string) {
 	var err error
-	var instanceList, addressList, commandList, profileList, regionList []string
-	var maxConcurrency, maxErrors string
-	var targets []*ssm.Target
+	var instanceList, addressList, commandList []string
+	var maxConcurrency, maxErrors, document, documentVersion string
+	var parameters map[string][]*string
+	var outputFormat invocation.Format
+	var outputLocation *invocation.OutputLocation
+	var s3Endpoint string
+	var aggregateFlag bool
+	var deliveryTimeout, timeout time.Duration
+	var rollout *ssmx.Rollout
+	var retryRun *invocation.RunRecord
+	var filters ssmx.Filters
+	var poolOpts poolOptions
 
 	// Get all of our CLI flag values
+	if args, err = applyNamedTarget(cmd, args); err != nil {
+		log.Fatal(err)
+	}
 	if err = cmdutil.ValidateArgs(cmd, args); err != nil {
 		log.Fatal(err)
 	}
@@ -54,116 +75,313 @@ func runCommand(cmd *cobra.Command, args []string) {
 	if commandList, err = getCommandList(cmd); err != nil {
 		log.Fatal(err)
 	}
-	if targets, err = getTargetList(cmd); err != nil {
+	if filters, err = getFilters(cmd); err != nil {
+		log.Fatal(err)
+	}
+
+	if retryRun, err = getRetryRun(cmd); err != nil {
 		log.Fatal(err)
 	}
 
-	if err := validateRunFlags(cmd, instanceList, addressList, commandList, targets); err != nil {
+	if retryRun != nil {
+		// Retries reuse the document and parameters of the original run
+		document, documentVersion, parameters = retryRun.DocumentName, retryRun.DocumentVersion, retryRun.SSMParameters()
+
+		if poolOpts.parallel, poolOpts.limiter, err = getPoolLimits(cmd); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if document, err = cmdutil.GetFlagString(cmd, "document"); err != nil {
+			log.Fatal(err)
+		}
+		if documentVersion, err = cmdutil.GetFlagString(cmd, "document-version"); err != nil {
+			log.Fatal(err)
+		}
+		if parameters, err = getDocumentParameters(cmd, document, commandList); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := validateRunFlags(cmd, instanceList, addressList, document, parameters, filters); err != nil {
+			log.Fatal(err)
+		}
+
+		if poolOpts, err = getPoolOptions(cmd); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if maxConcurrency, err = getMaxConcurrency(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if maxErrors, err = getMaxErrors(cmd); err != nil {
 		log.Fatal(err)
 	}
 
-	if profileList, err = getProfileList(cmd); err != nil {
+	if deliveryTimeout, timeout, err = getTimeouts(cmd); err != nil {
 		log.Fatal(err)
 	}
-	if regionList, err = getRegionList(cmd); err != nil {
+	if rollout, err = getRollout(cmd); err != nil {
 		log.Fatal(err)
 	}
 
-	if maxConcurrency, err = getMaxConcurrency(cmd); err != nil {
+	if outputLocation, s3Endpoint, err = getOutputLocation(cmd); err != nil {
 		log.Fatal(err)
 	}
-	if maxErrors, err = getMaxErrors(cmd); err != nil {
+	if outputFormat, err = getOutputFormat(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if aggregateFlag, err = cmdutil.GetFlagBool(cmd, "aggregate"); err != nil {
 		log.Fatal(err)
 	}
 
+	// Keep stdout clean for machine-readable output
+	if outputFormat != invocation.FormatTable {
+		logutil.SetLogStderrOutput(log)
+	}
+
 	// Get the number of cores available for parallelization
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	log.Info("Command(s) to be executed:\n", strings.Join(commandList, "\n"))
-
-	sciInput := &ssm.SendCommandInput{
-		InstanceIds:  aws.StringSlice(instanceList),
-		Targets:      targets,
-		DocumentName: aws.String("AWS-RunShellScript"),
-		Parameters: map[string][]*string{
-			/*
-				ssm.SendCommandInput objects require parameters for the DocumentName chosen
-
-				For AWS-RunShellScript, the only required parameter is "commands",
-				which is the shell command to be executed on the target. To emulate
-				the original script, we also set "executionTimeout" to 10 minutes.
-			*/
-			"commands":         aws.StringSlice(commandList),
-			"executionTimeout": aws.StringSlice([]string{"600"}),
-		},
-		MaxConcurrency: aws.String(maxConcurrency),
-		MaxErrors:      aws.String(maxErrors),
+	log.Infof("Document to be executed: %s", document)
+	if commands, exists := parameters["commands"]; exists {
+		log.Info("Command(s) to be executed:\n", strings.Join(aws.StringValueSlice(commands), "\n"))
 	}
 
-	wg, output := sync.WaitGroup{}, invocation.ResultSafe{}
+	progress := invocation.NewProgress()
+	opts := fleet.Options{
+		MaxConcurrency:  maxConcurrency,
+		MaxErrors:       maxErrors,
+		DeliveryTimeout: deliveryTimeout,
+		OutputLocation:  outputLocation,
+		S3Endpoint:      s3Endpoint,
+		Rollout:         rollout,
+		Progress:        progress,
+	}
 
-	// Set up our AWS session for each permutation of profile + region and iterate over them
-	sessionPool := session.NewPool(profileList, regionList, log)
-	for _, sess := range sessionPool.Sessions {
-		wg.Add(1)
-		var threadLocalSendCommandInput *ssm.SendCommandInput = &(*sciInput)
-		ssmClient := ssm.New(sess.Session)
+	// Record who sent the command, as the SSM API does not, so that it can be found with ssm history --requester
+	if user := currentUser(); user != "" {
+		opts.Comment = ssmx.RequesterComment(user)
+	}
 
-		if len(addressList) > 0 {
-			ec2Client := ec2.New(sess.Session)
-			hr := resolver.NewHostnameResolver(addressList)
-			ids, _ := hr.ResolveToInstanceId(ec2Client)
-			for _, id := range ids {
-				threadLocalSendCommandInput.InstanceIds = append(threadLocalSendCommandInput.InstanceIds, &id)
-			}
+	// Cancel any running commands if we're interrupted; a second interrupt exits immediately
+	ctx, interrupted := interruptContext()
+
+	// Stop waiting for results once the deadline for the whole run has passed
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Set up the command sent through each permutation of profile + region
+	client := poolOpts.newClient()
+	var commands []*fleet.SessionCommand
+	if retryRun != nil {
+		log.Infof("Retrying the failed instances of run %s", retryRun.ID)
+		commands, err = client.RetryCommands(retryRun, opts)
+	} else {
+		targets := poolOpts.targets()
+		targets.Instances, targets.Addresses, targets.Filters = instanceList, addressList, filters
+
+		doc := fleet.Document{Name: document, Version: documentVersion, Parameters: make(map[string][]string)}
+		for k, v := range parameters {
+			doc.Parameters[k] = aws.StringValueSlice(v)
 		}
+		commands, err = client.Commands(ctx, targets, doc, opts)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		log.Debugf("Starting invocation targeting account %s in %s", sess.ProfileName, *sess.Session.Config.Region)
-		go ssmx.RunInvocations(sess, ssmClient, &wg, sciInput, &output)
+	results, err := client.Send(ctx, commands, opts)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	wg.Wait() // Wait for each account/region combo to finish
+	// Record the run, so that its failed instances can be retried later. Rollouts have resolved the instances
+	// of each command by now.
+	record := invocation.NewRunRecord(document, documentVersion, parameters)
+	for _, c := range commands {
+		record.AddSession(c.Session.ProfileName, *c.Session.Session.Config.Region, c.Session.Role, c.Input, c.Instances)
+	}
 
-	resultFormat := "%-24s %-15s %-15s %s"
-	var successCounter, failedCounter int
+	output, summary := invocation.ResultSafe{}, invocation.NewSummary()
+	writer := invocation.NewResultWriter(outputFormat, os.Stdout, log)
+	if aggregateFlag {
+		writer = invocation.NewAggregateWriter(outputFormat, os.Stdout, log)
+	}
 
-	// Output our results
-	log.Infof(resultFormat, "Instance ID", "Region", "Profile", "Status")
-	for _, v := range output.InvocationResults {
+	// Show a live progress line on stderr, unless it has been redirected or output is quieted
+	status := newProgressLine(os.Stderr, progress, term.IsTerminal(int(os.Stderr.Fd())) && log.IsLevelEnabled(logrus.InfoLevel))
+	defer status.Stop()
 
-		if v.Status == invocation.ClientError {
-			log.Errorf(resultFormat, "---", v.Region, v.ProfileName, v.Status)
-			failedCounter++
+	// Output each result as soon as it is received
+	var rolloutErr error
+	for v := range results {
+		// Errors that stopped the whole run, i.e. a halted rollout, belong to no profile or region
+		if v.ProfileName == "" {
+			rolloutErr = v.Error
 			continue
 		}
 
-		if v.Status == invocation.CommandSuccess {
-			log.Infof(resultFormat, *v.InvocationResult.InstanceId, v.Region, v.ProfileName, v.Status)
-			successCounter++
-		} else {
-			log.Errorf(resultFormat, *v.InvocationResult.InstanceId, v.Region, v.ProfileName, v.Status)
-			failedCounter++
-		}
+		output.Add(v)
+		summary.Add(v)
+		record.AddResult(v)
+		status.Clear(func() {
+			if err := writer.Write(v); err != nil {
+				log.Error(err)
+			}
+		})
+	}
+	status.Stop()
+
+	if err := writer.WriteSummary(summary); err != nil {
+		log.Fatal(err)
+	}
+
+	if interrupted() {
+		reportCanceled(output.InvocationResults)
+	}
+
+	if err := saveRun(record); err != nil {
+		log.Warn(err)
+	} else if summary.Failed > 0 {
+		log.Infof("Run %s was saved, use --retry-failed %s (or --retry-failed last) to retry the failed instances", record.ID, record.ID)
+	}
+
+	if rolloutErr != nil {
+		log.Error(rolloutErr)
+		os.Exit(1)
+	}
+
+	if summary.Failed > 0 { // Exit code 1 to indicate that there was some sort of error returned from invocation
+		os.Exit(1)
+	}
+
+	return
+}
 
-		// stdout is always written back at info level
-		if *v.InvocationResult.StandardOutputContent != "" {
-			log.Info(*v.InvocationResult.StandardOutputContent)
+// currentUser returns the name of the local user running the command
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+// saveRun saves the record of the run to the run history directory
+func saveRun(record *invocation.RunRecord) error {
+	dir, err := getRunsDir()
+	if err != nil {
+		return err
+	}
+
+	return invocation.SaveRun(dir, record)
+}
+
+// interruptContext returns a context that is canceled on the first SIGINT or SIGTERM, along with a func
+// reporting whether that has happened. Later signals are no longer caught, so they terminate the process.
+func interruptContext() (context.Context, func() bool) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	var interrupted int32
+	go func() {
+		<-ctx.Done()
+		stop()
+		atomic.StoreInt32(&interrupted, 1)
+		log.Warn("Interrupted, canceling running commands. Press Ctrl-C again to exit immediately.")
+	}()
+
+	return ctx, func() bool {
+		return atomic.LoadInt32(&interrupted) == 1
+	}
+}
+
+// reportCanceled logs which instances completed before their commands were canceled, and which did not
+func reportCanceled(results []*invocation.Result) {
+	var completed, canceled []string
+	for _, v := range results {
+		switch {
+		case v.InstanceID() == "":
+			continue
+		case v.Status == invocation.CommandCanceled:
+			canceled = append(canceled, v.InstanceID())
+		default:
+			completed = append(completed, fmt.Sprintf("%s (%s)", v.InstanceID(), v.Status))
 		}
+	}
+
+	log.Warnf("%d instance(s) had already completed before the commands were canceled: %s", len(completed), strings.Join(completed, ", "))
+	log.Warnf("%d instance(s) were canceled: %s", len(canceled), strings.Join(canceled, ", "))
+}
+
+// progressLine periodically redraws the invocation progress on a single terminal line
+type progressLine struct {
+	sync.Mutex
+	w        io.Writer
+	progress *invocation.Progress
+	enabled  bool
+	done     chan struct{}
+	stopped  bool
+}
+
+func newProgressLine(w io.Writer, progress *invocation.Progress, enabled bool) *progressLine {
+	p := &progressLine{
+		w:        w,
+		progress: progress,
+		enabled:  enabled,
+		done:     make(chan struct{}),
+	}
 
-		// stderr is written back at warn if the invocation was successful, and error if not
-		if *v.InvocationResult.StandardErrorContent != "" {
-			if v.Status == invocation.CommandSuccess {
-				log.Warn(*v.InvocationResult.StandardErrorContent)
-			} else {
-				log.Error(*v.InvocationResult.StandardErrorContent)
+	if enabled {
+		go p.run()
+	}
+
+	return p
+}
+
+func (p *progressLine) run() {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.Lock()
+			if line := p.progress.String(); line != "" {
+				fmt.Fprintf(p.w, "\r\033[K%s", line)
 			}
+			p.Unlock()
 		}
 	}
+}
 
-	log.Infof("Execution results: %d SUCCESS, %d FAILED", successCounter, failedCounter)
-	if failedCounter > 0 { // Exit code 1 to indicate that there was some sort of error returned from invocation
-		os.Exit(1)
+// Clear erases the progress line before running fn, so that other output is not mixed into it
+func (p *progressLine) Clear(fn func()) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.enabled {
+		fmt.Fprint(p.w, "\r\033[K")
 	}
+	fn()
+}
 
-	return
+// Stop erases the progress line and stops redrawing it
+func (p *progressLine) Stop() {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	close(p.done)
+
+	if p.enabled {
+		fmt.Fprint(p.w, "\r\033[K")
+	}
 }
@@ -1,21 +1,26 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"syscall"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/AlecAivazis/survey/v2/terminal"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 
 	"github.com/disneystreaming/gomux"
 
@@ -24,11 +29,12 @@ import (
 	"github.com/disneystreaming/ssm-helpers/cmd/cmdutil"
 	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
 	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	startsession "github.com/disneystreaming/ssm-helpers/ssm/session"
 )
 
 func newCommandSSMSession() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "session",
+		Use:   "session [@target]",
 		Short: "open a terminal session to an instance using SSM",
 		Long:  "foo bar baz",
 		Run: func(cmd *cobra.Command, args []string) {
@@ -44,9 +50,12 @@ func newCommandSSMSession() *cobra.Command {
 
 func startSessionCommand(cmd *cobra.Command, args []string) {
 	var err error
-	var instanceList, addressList, profileList, regionList, tagList, attributeList []string
+	var instanceList, addressList, tagList, attributeList []string
 
 	// Get all of our CLI flag values
+	if args, err = applyNamedTarget(cmd, args); err != nil {
+		log.Fatal(err)
+	}
 	if err = cmdutil.ValidateArgs(cmd, args); err != nil {
 		log.Fatal(err)
 	}
@@ -59,8 +68,8 @@ func startSessionCommand(cmd *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
-	var filterList map[string]string
-	if filterList, err = cmdutil.GetMapFromStringSlice(cmd, "filter"); err != nil {
+	var filterList ssmx.Filters
+	if filterList, err = getFilters(cmd); err != nil {
 		log.Fatal(err)
 	}
 
@@ -68,16 +77,14 @@ func startSessionCommand(cmd *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
-	if profileList, err = getProfileList(cmd); err != nil {
-		log.Fatal(err)
-	}
-	if regionList, err = getRegionList(cmd); err != nil {
+	var poolOpts poolOptions
+	if poolOpts, err = getPoolOptions(cmd); err != nil {
 		log.Fatal(err)
 	}
 	if tagList, err = cmdutil.GetFlagStringSlice(cmd, "tag"); err != nil {
 		log.Fatal(err)
 	}
-	if attributeList, err = cmdutil.GetFlagStringSlice(cmd, "attribute"); err != nil {
+	if attributeList, err = getAttributeList(cmd); err != nil {
 		log.Fatal(err)
 	}
 
@@ -91,122 +98,261 @@ func startSessionCommand(cmd *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
+	var recordPath string
+	if recordPath, err = getRecordPath(cmd); err != nil {
+		log.Fatal(err)
+	}
+
 	var limitFlag int
 	if limitFlag, err = cmdutil.GetFlagInt(cmd, "limit"); err != nil {
 		log.Fatal(err)
 	}
 
+	var cache *instance.Cache
+	if cache, err = getInstanceCache(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if cache != nil {
+		// Let the instances being refreshed in the background finish caching before exiting
+		defer cache.Wait()
+	}
+
 	// Get the number of cores available for parallelization
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	instancePool, totalInstances, sessionPool := findSessionInstances(poolOpts, cache, instanceList, addressList, filterList, limitFlag)
+
+	log.Infof("Retrieved %d usable instances.", len(instancePool.AllInstances))
+
+	// No functional results, exit now
+	if len(instancePool.AllInstances) == 0 || dryRunFlag {
+		return
+	}
+
+	selectedInstances, err := selectSessionInstances(instancePool, totalInstances, instanceList, tagList, attributeList)
+	if err != nil {
+		exitAfterCaching(cache, selectionExitCode(err))
+	}
+
+	// Single instance specified, found or selected, starting session in current terminal (non-multiplexed)
+	if len(selectedInstances) == 1 {
+		v := selectedInstances[0]
+		if err := startSSMSession(sessionPool, v, recordPath); err != nil {
+			log.Errorf("Failed to start ssm-session for instance %s\n%s", v.InstanceID, err)
+			invalidateInstanceCache(cache, selectedInstances)
+		}
+		return
+	}
+
+	// Multiple instances, start a tmux session with a pane for each of them. Each pane runs a single-instance session,
+	// which invalidates the cache itself if it fails to start.
+	if err = configTmuxSession(sessionName, selectedInstances, recordPath); err != nil {
+		log.Error(err)
+		invalidateInstanceCache(cache, selectedInstances)
+		exitAfterCaching(cache, 1)
+	}
+
+	// Make sure we aren't going to nest tmux sessions
+	currentTmuxSocket := os.Getenv("TMUX")
+	if len(currentTmuxSocket) == 0 {
+		if err := attachTmuxSession(sessionName); err != nil {
+			log.Errorf("Could not attach to tmux session '%s'\n%s", sessionName, err)
+		}
+	} else {
+		log.Info("To force nested tmux sessions, unset $TMUX.")
+		log.Infof("Attach to the session with `tmux attach -t %s`", sessionName)
+	}
+}
+
+// findSessionInstances returns the instances that match the provided instance IDs, addresses and filters and are
+// ready for sessions in each profile/region combination, along with the number of matching instances found in total
+// and the pool of sessions they were found with. When instances are only selected with filters, they are looked up in the cache if it is set, and are ready for
+// sessions if their agent was online.
+func findSessionInstances(opts poolOptions, cache *instance.Cache, instanceList, addressList []string, filterList ssmx.Filters, limit int) (*instance.InstanceInfoSafe, int32, *session.Pool) {
 	// Create threadsafe pool of instance info to use for selection
-	instancePool := instance.InstanceInfoSafe{
+	instancePool := &instance.InstanceInfoSafe{
 		AllInstances: make(map[string]instance.InstanceInfo),
 	}
 
 	var totalInstances int32
-	var wg sync.WaitGroup
+	group := opts.newGroup()
 
 	// Set up our AWS session for each permutation of profile + region and iterate over them
-	sessionPool := session.NewPool(profileList, regionList, log)
+	sessionPool := opts.newSessionPool()
 	for _, sess := range sessionPool.Sessions {
-		wg.Add(1)
-		go func(sess *session.Session, instancePool *instance.InstanceInfoSafe) {
-			defer wg.Done()
-			var threadLocalInstanceList []string
-			threadLocalInstanceList = append(threadLocalInstanceList, instanceList...)
-
+		sess := sess
+		group.Go(func() {
 			ssmClient := ssm.New(sess.Session)
 
-			if len(addressList) > 0 {
-				ec2Client := ec2.New(sess.Session)
-				hr := resolver.NewHostnameResolver(addressList)
-				ids, _ := hr.ResolveToInstanceId(ec2Client)
-				threadLocalInstanceList = append(threadLocalInstanceList, ids...)
-			}
+			// Instances specified by ID or address are always looked up, so that recently launched ones are found
+			if cache != nil && len(instanceList) == 0 && len(addressList) == 0 {
+				cachedInstances, err := getCachedSessionInstances(sess, ssmClient, cache, filterList)
+				if err != nil {
+					// The instances found in the other profiles and regions can still be used
+					log.Errorf("%s in %s: %v", sess.ProfileName, *sess.Session.Config.Region, err)
+					return
+				}
 
-			// Create our instance input object (filters, instances)
-			diiInput := ssmx.CreateSSMDescribeInstanceInput(filterList, threadLocalInstanceList)
+				atomic.AddInt32(&totalInstances, int32(len(cachedInstances)))
+				addOnlineInstances(cachedInstances, limit, instancePool)
+				return
+			}
 
-			sessionInstances, err := instance.GetSessionInstances(ssmClient, diiInput)
+			sessionInstances, err := getSessionInstances(sess, ssmClient, instanceList, addressList, filterList)
 			if err != nil {
-				log.Tracef("AWS Session Parameters: %s, %s", *sess.Session.Config.Region, sess.ProfileName)
-				log.Fatal(err)
+				// The instances found in the other profiles and regions can still be used
+				log.Errorf("%s in %s: %v", sess.ProfileName, *sess.Session.Config.Region, err)
+				return
 			}
 
 			atomic.AddInt32(&totalInstances, int32(len(sessionInstances)))
-			ssmx.CheckInstanceReadiness(sess, ssmClient, sessionInstances, limitFlag, instancePool)
-		}(sess, &instancePool)
+			ssmx.CheckInstanceReadiness(sess, ssmClient, sessionInstances, limit, instancePool)
+		})
 	}
 
-	wg.Wait()
+	group.Wait()
 
-	log.Infof("Retrieved %d usable instances.", len(instancePool.AllInstances))
+	return instancePool, totalInstances, sessionPool
+}
 
-	// No functional results, exit now
-	if len(instancePool.AllInstances) == 0 || dryRunFlag {
-		return
-	}
+// getCachedSessionInstances returns the instances of the session that match the provided filters, out of every
+// instance of the session, which are cached
+func getCachedSessionInstances(sess *session.Session, ssmClient ssmiface.SSMAPI, cache *instance.Cache, filterList ssmx.Filters) ([]instance.InstanceInfo, error) {
+	region := *sess.Session.Config.Region
+	instances, err := cache.Get(sess.ProfileName, region, func() ([]instance.InstanceInfo, error) {
+		found, err := instance.GetSessionInstances(ssmClient, ssmx.CreateSSMDescribeInstanceInput(nil, nil))
+		if err != nil {
+			return nil, err
+		}
 
-	// Single instance specified or found, starting session in current terminal (non-multiplexed)
-	if len(instancePool.AllInstances) == 1 {
-		for _, v := range instancePool.AllInstances {
-			if err := startSSMSession(v.Profile, v.Region, v.InstanceID); err != nil {
-				log.Errorf("Failed to start ssm-session for instance %s\n%s", v.InstanceID, err)
-			}
+		described, err := ssmx.DescribeInstances(ssmClient, ec2.New(sess.Session), found)
+		if err != nil {
+			return nil, err
 		}
-		return
+		for idx := range described {
+			described[idx].Profile, described[idx].Region = sess.ProfileName, region
+		}
+
+		return described, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Multiple instances specified or found, check to see if we're in a tmux session to avoid nesting
-	if len(instanceList) > 1 && len(instancePool.AllInstances) > 1 {
-		var instances []instance.InstanceInfo
-		for _, v := range instancePool.AllInstances {
-			instances = append(instances, v)
+	var matching []instance.InstanceInfo
+	for _, i := range instances {
+		if filterList.MatchInstance(&i) {
+			matching = append(matching, i)
 		}
+	}
+
+	return matching, nil
+}
+
+// addOnlineInstances adds the instances whose agent is online to the pool, at most limit of them
+func addOnlineInstances(instances []instance.InstanceInfo, limit int, instancePool *instance.InstanceInfoSafe) {
+	instancePool.Lock()
+	defer instancePool.Unlock()
 
-		if err := configTmuxSession(sessionName, instances); err != nil {
-			log.Fatal(err)
+	added := 0
+	for _, i := range instances {
+		if added >= limit {
+			break
 		}
-	} else {
-		// If -i was not specified, go to a selection prompt before starting sessions
-		selectedInstances, err := startSelectionPrompt(&instancePool, totalInstances, tagList, attributeList)
-		if err != nil {
-			if err == terminal.InterruptErr {
-				log.Info("Instance selection interrupted.")
-				os.Exit(0)
-			}
-			log.Errorf("Error during instance selection\n%s", err)
-			os.Exit(1)
+		if i.PingStatus != ssm.PingStatusOnline {
+			continue
 		}
 
-		// If only one instance was selected, don't bother with a tmux session
-		if len(selectedInstances) == 1 {
-			for _, v := range selectedInstances {
-				if err := startSSMSession(v.Profile, v.Region, v.InstanceID); err != nil {
-					log.Fatalf("Failed to start session for instance %s\n%s", v.InstanceID, err)
-				}
-			}
+		instancePool.AllInstances[i.InstanceID] = i
+		added++
+	}
+}
+
+// getSessionInstances returns the managed instances of the session that match the provided instance IDs, addresses and filters
+func getSessionInstances(sess *session.Session, ssmClient ssmiface.SSMAPI, instanceList, addressList []string, filterList ssmx.Filters) ([]*ssm.InstanceInformation, error) {
+	var threadLocalInstanceList []string
+	threadLocalInstanceList = append(threadLocalInstanceList, instanceList...)
+
+	if len(addressList) > 0 {
+		ec2Client := ec2.New(sess.Session)
+		hr := resolver.NewHostnameResolver(addressList)
+		ids, _ := hr.ResolveToInstanceId(ec2Client)
+		threadLocalInstanceList = append(threadLocalInstanceList, ids...)
+
+		// Without any instance IDs, every instance would match
+		if len(threadLocalInstanceList) == 0 {
+			return nil, nil
 		}
+	}
+
+	// Create our instance input object (filters, instances)
+	diiInput := ssmx.CreateSSMDescribeInstanceInput(filterList, threadLocalInstanceList)
+
+	instances, err := instance.GetSessionInstances(ssmClient, diiInput)
+	if err != nil {
+		return nil, err
+	}
 
-		if err = configTmuxSession(sessionName, selectedInstances); err != nil {
-			log.Fatal(err)
+	// Apply the filters that DescribeInstanceInformation can't evaluate itself
+	return ssmx.FilterInstances(ssmClient, ec2.New(sess.Session), filterList, instances)
+}
+
+// selectSessionInstances returns the instances to start sessions with. If only one instance was found, or
+// multiple instances were specified with --instance, they are all used; otherwise the user selects them.
+func selectSessionInstances(instancePool *instance.InstanceInfoSafe, totalInstances int32, instanceList, tagList, attributeList []string) (instances []instance.InstanceInfo, err error) {
+	if len(instancePool.AllInstances) == 1 || len(instanceList) > 1 {
+		for _, v := range instancePool.AllInstances {
+			instances = append(instances, v)
 		}
+
+		// Keep the order stable, as map iteration order is random
+		sort.Slice(instances, func(i, j int) bool {
+			return instances[i].InstanceID < instances[j].InstanceID
+		})
+
+		return instances, nil
 	}
 
-	// Make sure we aren't going to nest tmux sessions
-	currentTmuxSocket := os.Getenv("TMUX")
-	if len(currentTmuxSocket) == 0 {
-		if err := attachTmuxSession(sessionName); err != nil {
-			log.Errorf("Could not attach to tmux session '%s'\n%s", sessionName, err)
+	// If -i was not specified, go to a selection prompt before starting sessions
+	return startSelectionPrompt(instancePool, totalInstances, tagList, attributeList)
+}
+
+// selectionExitCode logs that an instance selection prompt failed or was interrupted, and returns the code to exit
+// with once the instances being cached in the background have been
+func selectionExitCode(err error) int {
+	if err == terminal.InterruptErr {
+		log.Info("Instance selection interrupted.")
+		return 0
+	}
+
+	log.Errorf("Error during instance selection\n%s", err)
+	return 1
+}
+
+// exitAfterCaching waits for the instances being cached in the background, if cache is set, then exits with code
+func exitAfterCaching(cache *instance.Cache, code int) {
+	if cache != nil {
+		cache.Wait()
+	}
+	os.Exit(code)
+}
+
+// invalidateInstanceCache discards the cached instances of the profile/region combinations of the instances, which
+// may be out of date after failing to start sessions with them, e.g. if an instance was terminated or its agent
+// went offline
+func invalidateInstanceCache(cache *instance.Cache, instances []instance.InstanceInfo) {
+	if cache == nil {
+		return
+	}
+
+	for _, v := range instances {
+		if err := cache.Invalidate(v.Profile, v.Region); err != nil {
+			log.Warn(err)
 		}
-	} else {
-		log.Info("To force nested tmux sessions, unset $TMUX.")
-		log.Infof("Attach to the session with `tmux attach -t %s`", sessionName)
 	}
 }
 
-func configTmuxSession(sessionName string, selectedInstances []instance.InstanceInfo) (err error) {
+func configTmuxSession(sessionName string, selectedInstances []instance.InstanceInfo, recordPath string) (err error) {
 	// Initialize our tmux session
 	tmuxSession, err := gomux.NewSession(sessionName)
 	if err != nil {
@@ -234,7 +380,7 @@ func configTmuxSession(sessionName string, selectedInstances []instance.Instance
 	// Multiple instances specified or found, starting tmux session and attaching current terminal to it
 	for _, v := range selectedInstances {
 		// Add a window for our instance to our tmux session
-		if err = addInstanceToTmuxWindow(tmuxWindow, v.Profile, v.Region, v.InstanceID); err != nil {
+		if err = addInstanceToTmuxWindow(tmuxWindow, v.Profile, v.Region, v.InstanceID, recordPath); err != nil {
 			return fmt.Errorf("Failed to add instance %s to tmux session\n%s", v.InstanceID, err)
 		}
 
@@ -264,39 +410,88 @@ func setSessionStatus(sessionName string, status string) (err error) {
 	return rawCmd.Run()
 }
 
-func startSSMSession(profile string, region string, instanceID string) error {
-	rawCmd := exec.Command("aws", "ssm", "start-session", "--profile", profile, "--region", region, "--target", instanceID)
-	rawCmd.Stdin = os.Stdin
-	rawCmd.Stdout = os.Stdout
-	rawCmd.Stderr = os.Stderr
-
-	err := rawCmd.Start()
+// startSSMSession starts an interactive session with the instance in the current terminal, through the session of
+// the pool it was found with, recording it to recordPath unless it is empty
+func startSSMSession(pool *session.Pool, v instance.InstanceInfo, recordPath string) error {
+	sess, err := instanceSession(pool, v)
 	if err != nil {
 		return err
 	}
 
-	// Set up to capture Ctrl+C
-	sigChan := make(chan os.Signal, 2)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
 
-	doneChan := make(chan struct{}, 2)
-
-	// Run Wait() in its own chan so we don't block
-	go func() {
-		err = rawCmd.Wait()
-		doneChan <- struct{}{}
-	}()
-	// Here we block until command is done
-	for {
-		select {
-		case s := <-sigChan:
-			// user typed Ctrl-C, most likley meant for ssm-session pass through
-			rawCmd.Process.Signal(s)
-		case <-doneChan:
-			// command is done
+	// In raw mode, Ctrl-C and the other control keys are sent to the instance instead of interrupting ssm
+	var sizes <-chan startsession.TerminalSize
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
 			return err
 		}
+		defer term.Restore(fd, state)
+
+		sizes = watchTerminalSize(ctx, int(os.Stdout.Fd()))
 	}
+
+	var stdout io.Writer = os.Stdout
+	if recordPath != "" {
+		f, err := os.OpenFile(recordPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("Could not create the recording\n%v", err)
+		}
+		defer f.Close()
+
+		recorder, err := newSessionRecorder(f, v.Profile, v.Region, v.InstanceID)
+		if err != nil {
+			return fmt.Errorf("Could not write the recording\n%v", err)
+		}
+		defer recorder.Close()
+
+		stdout = io.MultiWriter(os.Stdout, recorder)
+		sizes = recordTerminalSizes(ctx, recorder, sizes)
+	}
+
+	input := &ssm.StartSessionInput{Target: aws.String(v.InstanceID)}
+	return startsession.Start(ctx, ssm.New(sess.Session), startsession.NewDialer(sess.Session.Config.HTTPClient), input, os.Stdin, stdout, sizes)
+}
+
+// newSessionRecorder starts the recording of the session with the instance, at the current size of the terminal
+func newSessionRecorder(w io.Writer, profile, region, instanceID string) (*startsession.Recorder, error) {
+	size := startsession.TerminalSize{Cols: 80, Rows: 24}
+	if cols, rows, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		size = startsession.TerminalSize{Cols: uint32(cols), Rows: uint32(rows)}
+	}
+
+	env := map[string]string{}
+	for _, name := range []string{"TERM", "SHELL"} {
+		if v := os.Getenv(name); v != "" {
+			env[name] = v
+		}
+	}
+
+	return startsession.NewRecorder(w, size, fmt.Sprintf("%s (%s, %s)", instanceID, profile, region), env)
+}
+
+// recordTerminalSizes records each terminal size received from sizes before passing it on, until ctx is done
+func recordTerminalSizes(ctx context.Context, recorder *startsession.Recorder, sizes <-chan startsession.TerminalSize) <-chan startsession.TerminalSize {
+	if sizes == nil {
+		return nil
+	}
+
+	recorded := make(chan startsession.TerminalSize)
+	go func() {
+		defer close(recorded)
+		for size := range sizes {
+			recorder.Resize(size)
+			select {
+			case recorded <- size:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return recorded
 }
 
 func attachTmuxSession(sessionName string) (err error) {
@@ -309,7 +504,7 @@ func attachTmuxSession(sessionName string) (err error) {
 	return rawCmd.Run()
 }
 
-func addInstanceToTmuxWindow(tmuxWindow *gomux.Window, profile string, region string, instanceID string) (err error) {
+func addInstanceToTmuxWindow(tmuxWindow *gomux.Window, profile string, region string, instanceID string, recordPath string) (err error) {
 	tPane, err := tmuxWindow.Pane(0).Split()
 	if err != nil {
 		return err
@@ -319,7 +514,21 @@ func addInstanceToTmuxWindow(tmuxWindow *gomux.Window, profile string, region st
 		return err
 	}
 
-	return tPane.Exec(fmt.Sprintf("aws ssm start-session --profile %s --region %s --target %s", profile, region, instanceID))
+	// Each pane runs a single-instance session with this executable
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf("'%s' session --region '%s' --instance %s", self, region, instanceID)
+	if profile != "" {
+		command += fmt.Sprintf(" --profile '%s'", profile)
+	}
+	if recordPath != "" {
+		command += fmt.Sprintf(" --record '%s'", instanceRecordPath(recordPath, instanceID))
+	}
+
+	return tPane.Exec(command)
 }
 
 func startSelectionPrompt(instances *instance.InstanceInfoSafe, totalInstances int32, tags, attributes ssmx.ListSlice) (selectedInstances []instance.InstanceInfo, err error) {
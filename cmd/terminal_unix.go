@@ -0,0 +1,44 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+
+	startsession "github.com/disneystreaming/ssm-helpers/ssm/session"
+)
+
+// watchTerminalSize sends the size of the terminal now, then each time it is resized, until ctx is done
+func watchTerminalSize(ctx context.Context, fd int) <-chan startsession.TerminalSize {
+	sizes := make(chan startsession.TerminalSize, 1)
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+
+	go func() {
+		defer signal.Stop(winch)
+
+		for {
+			if cols, rows, err := term.GetSize(fd); err == nil {
+				select {
+				case sizes <- startsession.TerminalSize{Cols: uint32(cols), Rows: uint32(rows)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-winch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return sizes
+}
@@ -0,0 +1,48 @@
+//go:build windows
+
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/term"
+
+	startsession "github.com/disneystreaming/ssm-helpers/ssm/session"
+)
+
+// terminalPollInterval is the delay between checks of the size of the console, which has no resize signal
+const terminalPollInterval = 500 * time.Millisecond
+
+// watchTerminalSize sends the size of the terminal now, then each time it is resized, until ctx is done
+func watchTerminalSize(ctx context.Context, fd int) <-chan startsession.TerminalSize {
+	sizes := make(chan startsession.TerminalSize, 1)
+
+	go func() {
+		ticker := time.NewTicker(terminalPollInterval)
+		defer ticker.Stop()
+
+		var last startsession.TerminalSize
+		for {
+			if cols, rows, err := term.GetSize(fd); err == nil {
+				size := startsession.TerminalSize{Cols: uint32(cols), Rows: uint32(rows)}
+				if size != last {
+					select {
+					case sizes <- size:
+						last = size
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return sizes
+}
@@ -1,19 +1,28 @@
 package ec2
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
+// describeBatchSize is the number of instances described by each DescribeInstances call, which is the maximum
+// number of values of a filter
+const describeBatchSize = 200
+
+// GetEC2InstanceInfo returns the EC2 description of each of the instances, in the same order. Instances are
+// matched with a filter rather than by ID, so that those EC2 doesn't know about (e.g. terminated instances that are
+// still registered with SSM) are nil instead of failing the whole call with InvalidInstanceID.NotFound.
 func GetEC2InstanceInfo(client ec2iface.EC2API, instances []*string) (output []*ec2.Instance, err error) {
-	keyedInstances := make(map[string]*ec2.Instance)
+	return GetEC2InstanceInfoWithContext(context.Background(), client, instances)
+}
 
-	// Set up our DI input object
-	diInput := &ec2.DescribeInstancesInput{
-		InstanceIds: instances,
-	}
+// GetEC2InstanceInfoWithContext is GetEC2InstanceInfo, stopping the lookup once ctx is canceled
+func GetEC2InstanceInfoWithContext(ctx context.Context, client ec2iface.EC2API, instances []*string) (output []*ec2.Instance, err error) {
+	keyedInstances := make(map[string]*ec2.Instance)
 
 	describeInstancesPager := func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
 		for _, reservation := range page.Reservations {
@@ -27,9 +36,19 @@ func GetEC2InstanceInfo(client ec2iface.EC2API, instances []*string) (output []*
 		return !lastPage
 	}
 
-	// Fetch all the instances described
-	if err = client.DescribeInstancesPages(diInput, describeInstancesPager); err != nil {
-		return nil, fmt.Errorf("Could not describe EC2 instances\n%v", err)
+	// Fetch all the instances described, in batches
+	for start := 0; start < len(instances); start += describeBatchSize {
+		end := start + describeBatchSize
+		if end > len(instances) {
+			end = len(instances)
+		}
+
+		diInput := &ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{{Name: aws.String("instance-id"), Values: instances[start:end]}},
+		}
+		if err = client.DescribeInstancesPagesWithContext(ctx, diInput, describeInstancesPager); err != nil {
+			return nil, fmt.Errorf("Could not describe EC2 instances\n%v", err)
+		}
 	}
 
 	for _, i := range instances {
@@ -48,6 +67,11 @@ func GetEC2InstanceTags(client ec2iface.EC2API, instances []*string) (ec2Tags ma
 
 	ec2Tags = make(map[string]Tags)
 	for _, i := range instanceInfo {
+		// Instances that no longer exist have no tags
+		if i == nil {
+			continue
+		}
+
 		tagMap := make(map[string]string)
 
 		for _, tag := range i.Tags {
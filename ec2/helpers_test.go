@@ -1,9 +1,12 @@
 package ec2
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/stretchr/testify/assert"
 
 	mocks "github.com/disneystreaming/ssm-helpers/testing"
@@ -42,3 +45,34 @@ func TestGetEC2InstanceInfo(t *testing.T) {
 	})
 
 }
+
+// countingEC2Client counts the DescribeInstances calls made to the mock EC2 client
+type countingEC2Client struct {
+	mocks.MockEC2Client
+	calls int
+}
+
+func (m *countingEC2Client) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	m.calls++
+	return m.MockEC2Client.DescribeInstancesPagesWithContext(ctx, input, fn, opts...)
+}
+
+func TestGetEC2InstanceInfoBatches(t *testing.T) {
+	assert := assert.New(t)
+	mockSvc := &countingEC2Client{}
+
+	// Instances are described in batches, and those EC2 doesn't know about are nil rather than an error
+	ids := []string{"i-123", "i-456"}
+	for i := 0; i < describeBatchSize; i++ {
+		ids = append(ids, fmt.Sprintf("i-unknown-%d", i))
+	}
+	ids = append(ids, "i-789")
+
+	info, err := GetEC2InstanceInfo(mockSvc, aws.StringSlice(ids))
+	assert.NoError(err)
+	assert.Equal(2, mockSvc.calls)
+	assert.Len(info, len(ids))
+	assert.Equal("i-123", *info[0].InstanceId)
+	assert.Nil(info[2])
+	assert.Equal("i-789", *info[len(ids)-1].InstanceId)
+}
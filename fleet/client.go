@@ -0,0 +1,186 @@
+// Package fleet runs commands on, and discovers, the instances managed by SSM across multiple AWS profiles
+// and regions. It is the library behind the ssm command line tool, for use by other Go programs: errors are
+// returned instead of ending the process, and every operation stops once its context is canceled.
+package fleet
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/sirupsen/logrus"
+
+	"github.com/disneystreaming/ssm-helpers/aws/org"
+	"github.com/disneystreaming/ssm-helpers/aws/ratelimit"
+	"github.com/disneystreaming/ssm-helpers/aws/regions"
+	"github.com/disneystreaming/ssm-helpers/aws/resolver"
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+	"github.com/disneystreaming/ssm-helpers/util/parallel"
+)
+
+// Targets selects managed instances in every combination of the provided profiles and regions
+type Targets struct {
+	// Profiles are the AWS profiles to use. If the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+	// environment variables are set, they are used instead, once per region.
+	Profiles []string
+	Regions  []string
+
+	// AllRegions, if set, targets every region enabled in the account of each profile in place of Regions,
+	// except those matching ExcludeRegions, see regions.Exclude. The regions of each profile are cached on disk.
+	AllRegions     bool
+	ExcludeRegions []string
+
+	// Instances are the IDs of the instances to target
+	Instances []string
+
+	// Addresses are the IP addresses or DNS names of the instances to target, resolved in each profile and region
+	Addresses []string
+
+	// Filters match the tags and attributes of the instances, see ssmx.ParseFilters. Along with Instances or
+	// Addresses, only the instances provided that match the filters are targeted.
+	Filters ssmx.Filters
+
+	// Organization, if set, targets the accounts of the AWS Organization listed with the profiles instead of the
+	// profiles themselves, assuming a role in each account. The profiles must belong to the management account
+	// or a delegated administrator.
+	Organization *org.Selector
+}
+
+// SessionError is an error that occurred in a single profile/region combination
+type SessionError struct {
+	Profile string
+	Region  string
+	Err     error
+}
+
+func (e *SessionError) Error() string {
+	return fmt.Sprintf("%s in %s: %v", e.Profile, e.Region, e.Err)
+}
+
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
+
+// Errors lists the profile/region combinations that failed, when the others succeeded
+type Errors []*SessionError
+
+func (e Errors) Error() string {
+	var lines []string
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Client runs commands on and discovers managed instances, creating the AWS sessions and clients it needs
+type Client struct {
+	Logger *logrus.Logger
+
+	// Parallel is the number of profile/region combinations worked on at once, or any number of them if 0
+	Parallel int
+
+	// Limiter, if set, rate limits the AWS calls made in each profile/region combination and retries them with
+	// backoff when they are throttled
+	Limiter *ratelimit.Limiter
+
+	newPool func(t Targets) (*session.Pool, error)
+	newSSM  func(sess *session.Session) ssmiface.SSMAPI
+	newEC2  func(sess *session.Session) ec2iface.EC2API
+	newS3   func(sess *session.Session, endpoint string) s3iface.S3API
+}
+
+// New returns a Client that logs to logger, or discards its logs if logger is nil. It works on
+// parallel.DefaultLimit profile/region combinations at once, and makes ratelimit.DefaultRate calls per
+// second to each API in each of them at most.
+func New(logger *logrus.Logger) *Client {
+	if logger == nil {
+		logger = logrus.New()
+		logger.SetOutput(ioutil.Discard)
+	}
+
+	c := &Client{Logger: logger, Parallel: parallel.DefaultLimit, Limiter: ratelimit.New(ratelimit.DefaultRate)}
+	c.newPool = func(t Targets) (*session.Pool, error) {
+		build := func(profiles, regions []string) (*session.Pool, error) {
+			if t.Organization != nil {
+				return org.BuildPool(profiles, regions, *t.Organization, c.Logger)
+			}
+			return session.BuildPool(profiles, regions, c.Logger)
+		}
+
+		if !t.AllRegions {
+			return build(t.Profiles, t.Regions)
+		}
+
+		cachePath, err := regions.DefaultCachePath()
+		if err != nil {
+			c.Logger.Debug(err)
+		}
+		return regions.BuildPool(t.Profiles, regions.NewResolver(cachePath, t.ExcludeRegions, c.Logger), build)
+	}
+	c.newSSM = func(sess *session.Session) ssmiface.SSMAPI { return ssm.New(sess.Session) }
+	c.newEC2 = func(sess *session.Session) ec2iface.EC2API { return ec2.New(sess.Session) }
+	c.newS3 = invocation.NewS3Client
+
+	return c
+}
+
+// sessions returns a session for each profile/region combination of the targets, or each account of the
+// organization and region, sorted so that they are always used in the same order
+func (c *Client) sessions(t Targets) ([]*session.Session, error) {
+	if len(t.Regions) == 0 && !t.AllRegions {
+		return nil, fmt.Errorf("At least one region must be provided")
+	}
+	if err := regions.ValidateExclude(t.ExcludeRegions); err != nil {
+		return nil, err
+	}
+
+	pool, err := c.newPool(t)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range pool.Sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sessions []*session.Session
+	for _, name := range names {
+		if c.Limiter != nil {
+			c.Limiter.Install(pool.Sessions[name])
+		}
+		sessions = append(sessions, pool.Sessions[name])
+	}
+	c.Logger.Debugf("Targeting %d sessions", len(sessions))
+
+	return sessions, nil
+}
+
+// instanceIDs returns the IDs of the targeted instances in the session's account, resolving the addresses of
+// the targets. If addresses were provided but none of them resolved in the account, ok is false, as no instance
+// of the account is targeted.
+func (c *Client) instanceIDs(ctx context.Context, sess *session.Session, t Targets) (ids []string, ok bool, err error) {
+	ids = append(ids, t.Instances...)
+	if len(t.Addresses) == 0 {
+		return ids, true, nil
+	}
+
+	resolved, err := resolver.NewHostnameResolver(t.Addresses).ResolveToInstanceIdWithContext(ctx, c.newEC2(sess))
+	if err != nil {
+		return nil, false, fmt.Errorf("Could not resolve addresses\n%v", err)
+	}
+	ids = append(ids, resolved...)
+
+	return ids, len(ids) > 0, nil
+}
@@ -0,0 +1,141 @@
+package fleet
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+)
+
+// failingSSMClient fails every call listing instances
+type failingSSMClient struct {
+	ssmiface.SSMAPI
+}
+
+func (m *failingSSMClient) DescribeInstanceInformationPagesWithContext(ctx aws.Context, input *ssm.DescribeInstanceInformationInput, fn func(*ssm.DescribeInstanceInformationOutput, bool) bool, opts ...request.Option) error {
+	return fmt.Errorf("AccessDenied")
+}
+
+// newTestClient returns a client whose sessions use the SSM client returned by newSSM and the mock EC2 client
+func newTestClient(newSSM func(sess *session.Session) ssmiface.SSMAPI) *Client {
+	c := New(nil)
+	c.newPool = func(t Targets) (*session.Pool, error) {
+		pool := &session.Pool{Sessions: map[string]*session.Session{}}
+		for _, region := range t.Regions {
+			for _, profile := range t.Profiles {
+				pool.Sessions[profile+"-"+region] = &session.Session{
+					Logger:      c.Logger,
+					ProfileName: profile,
+					Session:     awssession.Must(awssession.NewSession(&aws.Config{Region: aws.String(region)})),
+				}
+			}
+		}
+		return pool, nil
+	}
+	c.newSSM = newSSM
+	c.newEC2 = func(sess *session.Session) ec2iface.EC2API { return &mocks.MockEC2Client{} }
+
+	return c
+}
+
+func TestDiscover(t *testing.T) {
+	assert := assert.New(t)
+	c := newTestClient(func(sess *session.Session) ssmiface.SSMAPI { return &mocks.MockSSMClient{} })
+
+	filters, err := ssmx.ParseFilters([]string{"attr:PingStatus=Online"})
+	assert.NoError(err)
+
+	instances, err := c.Discover(context.Background(), Targets{
+		Profiles: []string{"profile2", "profile1"},
+		Regions:  []string{"us-east-1"},
+		Filters:  filters,
+	})
+	assert.NoError(err)
+	assert.Len(instances, 10)
+	assert.Equal("profile1", instances[0].Profile)
+	assert.Equal("us-east-1", instances[0].Region)
+	assert.Equal("i-12345", instances[0].InstanceID)
+	assert.Equal("profile2", instances[9].Profile)
+
+	// Filters the API can't evaluate are applied to the instances it returned
+	filters, err = ssmx.ParseFilters([]string{"attr:PlatformType=Win*"})
+	assert.NoError(err)
+
+	instances, err = c.Discover(context.Background(), Targets{Profiles: []string{"profile1"}, Regions: []string{"us-east-1"}, Filters: filters})
+	assert.NoError(err)
+	assert.Len(instances, 2)
+	assert.Equal("i-67890", instances[0].InstanceID)
+	assert.Equal("i-78901", instances[1].InstanceID)
+
+	_, err = c.Discover(context.Background(), Targets{Profiles: []string{"profile1"}})
+	assert.Error(err)
+}
+
+func TestDiscoverErrors(t *testing.T) {
+	assert := assert.New(t)
+	c := newTestClient(func(sess *session.Session) ssmiface.SSMAPI {
+		if sess.ProfileName == "denied" {
+			return &failingSSMClient{}
+		}
+		return &mocks.MockSSMClient{}
+	})
+
+	// The instances found in the other profiles are still returned
+	instances, err := c.Discover(context.Background(), Targets{
+		Profiles: []string{"profile1", "denied"},
+		Regions:  []string{"us-east-1"},
+		Filters:  ssmx.Filters{{Key: "attr:PingStatus", Operator: ssmx.FilterEquals, Values: []string{"Online"}}},
+	})
+	assert.Len(instances, 5)
+	if assert.IsType(Errors{}, err) {
+		errs := err.(Errors)
+		assert.Len(errs, 1)
+		assert.Equal("denied", errs[0].Profile)
+		assert.EqualError(errs[0], "denied in us-east-1: Could not retrieve SSM instance info\nAccessDenied")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = c.Discover(ctx, Targets{Profiles: []string{"profile1"}, Regions: []string{"us-east-1"}})
+	assert.Equal(context.Canceled, err)
+}
+
+func TestDiscoverCancelsCalls(t *testing.T) {
+	assert := assert.New(t)
+
+	// The server never answers, so the lookup only returns once the call in flight is canceled
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-done }))
+	defer server.Close()
+	defer close(done)
+
+	c := newTestClient(func(sess *session.Session) ssmiface.SSMAPI {
+		return ssm.New(sess.Session, &aws.Config{
+			Endpoint:    aws.String(server.URL),
+			Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+			MaxRetries:  aws.Int(0),
+		})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := c.Discover(ctx, Targets{Profiles: []string{"profile1"}, Regions: []string{"us-east-1"}})
+	assert.Equal(context.DeadlineExceeded, err)
+}
@@ -0,0 +1,101 @@
+package fleet
+
+import (
+	"context"
+	"sync"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	"github.com/disneystreaming/ssm-helpers/util/parallel"
+)
+
+// defaultSort is the order of the instances returned by Discover
+var defaultSort = []instance.SortKey{{Field: "Profile"}, {Field: "Region"}, {Field: "InstanceID"}}
+
+// Discover returns every managed instance selected by the targets, whether or not it is online, sorted by
+// profile, region and instance ID. If only some profile/region combinations failed, the instances found in
+// the others are returned along with an Errors listing the failures.
+func (c *Client) Discover(ctx context.Context, t Targets) ([]instance.InstanceInfo, error) {
+	sessions, err := c.sessions(t)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var instances []instance.InstanceInfo
+	var errs Errors
+
+	group := parallel.NewGroup(c.Parallel)
+	for _, sess := range sessions {
+		sess := sess
+		group.Go(func() {
+			found, err := c.discover(ctx, sess, t)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, &SessionError{Profile: sess.ProfileName, Region: *sess.Session.Config.Region, Err: err})
+				return
+			}
+			instances = append(instances, found...)
+		})
+	}
+	group.Wait()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	instance.Sort(instances, defaultSort)
+
+	if len(errs) > 0 {
+		return instances, errs
+	}
+
+	return instances, nil
+}
+
+// Discover finds the targeted instances with a new Client that discards its logs, see Client.Discover
+func Discover(ctx context.Context, t Targets) ([]instance.InstanceInfo, error) {
+	return New(nil).Discover(ctx, t)
+}
+
+// discover returns the instances selected by the targets in a single session
+func (c *Client) discover(ctx context.Context, sess *session.Session, t Targets) ([]instance.InstanceInfo, error) {
+	ids, ok, err := c.instanceIDs(ctx, sess, t)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	ssmClient, ec2Client := c.newSSM(sess), c.newEC2(sess)
+	found, err := instance.GetSessionInstancesWithContext(ctx, ssmClient, ssmx.CreateSSMDescribeInstanceInput(t.Filters, ids))
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	described, err := ssmx.DescribeInstancesWithContext(ctx, ssmClient, ec2Client, found)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply the filters that DescribeInstanceInformation can't evaluate itself
+	var instances []instance.InstanceInfo
+	local := t.Filters.ClientSide()
+	for _, i := range described {
+		if local.MatchInstance(&i) {
+			i.Profile, i.Region = sess.ProfileName, *sess.Session.Config.Region
+			instances = append(instances, i)
+		}
+	}
+
+	return instances, nil
+}
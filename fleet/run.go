@@ -0,0 +1,365 @@
+package fleet
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+	"github.com/disneystreaming/ssm-helpers/util/batch"
+	"github.com/disneystreaming/ssm-helpers/util/parallel"
+)
+
+// Result is the result of a command on a single instance. Errors that prevented the command from being sent or
+// its results from being retrieved are reported as results with the ClientError status and no instance.
+type Result = invocation.Result
+
+// Document is the SSM command document to run, along with its parameters
+type Document struct {
+	Name string
+
+	// Version is the version of the document to run, the default version if empty
+	Version    string
+	Parameters map[string][]string
+}
+
+// ShellScript returns the AWS-RunShellScript document running the provided commands
+func ShellScript(commands ...string) Document {
+	return Document{Name: "AWS-RunShellScript", Parameters: map[string][]string{"commands": commands}}
+}
+
+// Options control how a command is sent. The zero value sends the command to 50 instances at a time and
+// stops sending it after the first error.
+type Options struct {
+	// MaxConcurrency and MaxErrors are numbers (e.g. 10) or percentages (e.g. 10%) of the targeted instances
+	MaxConcurrency string
+	MaxErrors      string
+
+	// DeliveryTimeout is the time allowed for the command to be delivered to each instance
+	DeliveryTimeout time.Duration
+
+	// Comment is recorded with the command, e.g. to identify who sent it
+	Comment string
+
+	// OutputLocation, if set, has SSM write the complete output of the command to S3, from which it is
+	// retrieved instead of the first 24000 characters returned by the API
+	OutputLocation *invocation.OutputLocation
+
+	// S3Endpoint, if set, retrieves the output from an S3-compatible service at this endpoint instead of S3
+	S3Endpoint string
+
+	// Rollout, if set, runs the command on the instances batch by batch. Filters that the SendCommand API
+	// can't evaluate always use a rollout, by default a single batch.
+	Rollout *ssmx.Rollout
+
+	// Progress, if set, is updated with the status of the invocations in each profile and region
+	Progress *invocation.Progress
+}
+
+// SessionCommand is the command sent through a single profile/region combination
+type SessionCommand struct {
+	Session *session.Session
+	Input   *ssm.SendCommandInput
+
+	// Filters, if set, select the instances the command is sent to among those of Input, or among every instance
+	// of the session if Input targets none, for filters that SendCommand can't evaluate. They are resolved to
+	// instance IDs before sending the command, which only rollouts do.
+	Filters ssmx.Filters
+
+	// Instances are the IDs of the instances that a rollout sends the command to across all of its batches,
+	// set by Send once it has resolved the targeting of Input and Filters
+	Instances []string
+}
+
+// Run sends the document to the instances selected by the targets in each profile/region combination and
+// returns a channel receiving the result of every instance, which is closed once every invocation has
+// completed. The channel must be read until it is closed.
+//
+// Canceling ctx cancels the running invocations; the results of the instances that had already completed
+// are still sent. An error is returned, before anything is sent, if the targets could not be resolved.
+func (c *Client) Run(ctx context.Context, t Targets, doc Document, opts Options) (<-chan *Result, error) {
+	commands, err := c.Commands(ctx, t, doc, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Send(ctx, commands, opts)
+}
+
+// Commands returns the command that Run sends through each profile/region combination of the targets, without
+// sending it, e.g. to record the commands before sending them with Send. Combinations in which none of the
+// addresses of the targets resolved are left out.
+func (c *Client) Commands(ctx context.Context, t Targets, doc Document, opts Options) ([]*SessionCommand, error) {
+	if doc.Name == "" {
+		return nil, fmt.Errorf("A document must be provided")
+	}
+	if len(t.Instances) == 0 && len(t.Addresses) == 0 && len(t.Filters) == 0 {
+		return nil, fmt.Errorf("At least one instance, address or filter must be provided")
+	}
+
+	sessions, err := c.sessions(t)
+	if err != nil {
+		return nil, err
+	}
+
+	input := newSendCommandInput(doc, opts)
+
+	// SendCommand doesn't accept targets along with instance IDs, so filters on the provided instances are
+	// always resolved, as are the filters that SendCommand can't evaluate
+	var filters ssmx.Filters
+	targets, sendFilters := t.Filters.Targets()
+	if len(t.Instances) > 0 || len(t.Addresses) > 0 || !sendFilters {
+		filters = t.Filters
+	} else {
+		input.Targets = targets
+	}
+
+	var commands []*SessionCommand
+	for _, sess := range sessions {
+		ids, ok, err := c.instanceIDs(ctx, sess, t)
+		if err != nil {
+			return nil, &SessionError{Profile: sess.ProfileName, Region: *sess.Session.Config.Region, Err: err}
+		}
+		if !ok {
+			continue
+		}
+
+		sessionInput := *input
+		sessionInput.InstanceIds = aws.StringSlice(ids)
+		commands = append(commands, &SessionCommand{Session: sess, Input: &sessionInput, Filters: filters})
+	}
+
+	return commands, nil
+}
+
+// RetryCommands returns the commands sending the document of a previous run again, through each profile/region
+// combination of the run that had failed instances, targeting only those instances. Combinations in which the
+// command couldn't run at all are retried with their original targeting.
+func (c *Client) RetryCommands(run *invocation.RunRecord, opts Options) ([]*SessionCommand, error) {
+	input := newSendCommandInput(Document{Name: run.DocumentName, Version: run.DocumentVersion, Parameters: run.Parameters}, opts)
+
+	var commands []*SessionCommand
+	for _, s := range run.RetrySessions() {
+		var sessions []*session.Session
+		var err error
+		if s.Role != nil {
+			// Accounts of an organization are retried through the role assumed in the original run
+			sessions, err = c.roleSessions(s.Profile, *s.Role, s.Region)
+		} else {
+			sessions, err = c.sessions(Targets{Profiles: []string{s.Profile}, Regions: []string{s.Region}})
+		}
+		if err != nil {
+			return nil, &SessionError{Profile: s.Profile, Region: s.Region, Err: err}
+		}
+
+		for _, sess := range sessions {
+			sessionInput := *input
+			sessionInput.InstanceIds, sessionInput.Targets = s.Input()
+			commands = append(commands, &SessionCommand{Session: sess, Input: &sessionInput})
+		}
+	}
+
+	return commands, nil
+}
+
+// roleSessions returns the session assuming the role in the account named by profile, in region
+func (c *Client) roleSessions(profile string, role session.Role, region string) ([]*session.Session, error) {
+	pool, err := session.BuildRolePool(map[string]session.Role{profile: role}, []string{region}, c.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*session.Session
+	for _, sess := range pool.Sessions {
+		if c.Limiter != nil {
+			c.Limiter.Install(sess)
+		}
+		sessions = append(sessions, sess)
+	}
+
+	return sessions, nil
+}
+
+// Send sends the commands returned by Commands or RetryCommands, see Run. The commands are sent as a rollout
+// if opts.Rollout is set or if any of them has filters, by default in a single batch; the input of the first
+// command is then sent to the instances of every command, which must all run the same document. An error
+// that stops a rollout is reported as a ClientError result with neither a profile nor a region.
+func (c *Client) Send(ctx context.Context, commands []*SessionCommand, opts Options) (<-chan *Result, error) {
+	results, sent := make(chan *Result), make(chan *Result)
+	if len(commands) == 0 {
+		close(results)
+		return results, nil
+	}
+
+	// The single batch of the default rollout can't be halted, as no batch is left to skip; the failures allowed
+	// are left to the MaxErrors of the command
+	rollout := opts.Rollout
+	for _, cmd := range commands {
+		if len(cmd.Filters) > 0 && rollout == nil {
+			rollout = &ssmx.Rollout{
+				BatchSize: batch.Size{Count: 100, Percent: true},
+				MaxErrors: batch.Size{Count: 100, Percent: true},
+			}
+		}
+	}
+
+	var rolloutTargets []*ssmx.RolloutTarget
+	if rollout != nil {
+		var err error
+		if rolloutTargets, err = c.rolloutTargets(ctx, commands); err != nil {
+			return nil, err
+		}
+
+		for _, cmd := range commands {
+			cmd.Instances = []string{}
+			for _, t := range rolloutTargets {
+				if t.Session == cmd.Session {
+					cmd.Instances = t.Instances
+				}
+			}
+		}
+	}
+
+	go c.fetchOutput(ctx, commands, opts, sent, results)
+
+	go func() {
+		defer close(sent)
+
+		if rollout == nil {
+			var wg sync.WaitGroup
+			group := parallel.NewGroup(c.Parallel)
+			for _, cmd := range commands {
+				wg.Add(1)
+				cmd, ssmClient := cmd, c.newSSM(cmd.Session)
+
+				c.Logger.Debugf("Starting invocation targeting account %s in %s", cmd.Session.ProfileName, *cmd.Session.Session.Config.Region)
+				group.Go(func() { ssmx.RunInvocations(ctx, cmd.Session, ssmClient, &wg, cmd.Input, sent, opts.Progress) })
+			}
+			wg.Wait()
+			return
+		}
+
+		r := *rollout
+		if r.Logger == nil {
+			r.Logger = c.Logger
+		}
+
+		total := 0
+		for _, t := range rolloutTargets {
+			total += len(t.Instances)
+		}
+		r.Logger.Infof("Rolling out to %d instance(s) in %d batch(es)", total, len(r.Batches(total)))
+
+		if err := r.Run(ctx, rolloutTargets, commands[0].Input, sent, opts.Progress); err != nil {
+			sent <- &Result{Status: invocation.ClientError, Error: err}
+		}
+	}()
+
+	return results, nil
+}
+
+// Run sends the document with a new Client that discards its logs, see Client.Run
+func Run(ctx context.Context, t Targets, doc Document, opts Options) (<-chan *Result, error) {
+	return New(nil).Run(ctx, t, doc, opts)
+}
+
+// newSendCommandInput returns the input sending the document with the provided options
+func newSendCommandInput(doc Document, opts Options) *ssm.SendCommandInput {
+	input := &ssm.SendCommandInput{
+		DocumentName:   aws.String(doc.Name),
+		MaxConcurrency: aws.String("50"),
+		MaxErrors:      aws.String("0"),
+	}
+
+	if len(doc.Parameters) > 0 {
+		input.Parameters = make(map[string][]*string)
+		for k, v := range doc.Parameters {
+			input.Parameters[k] = aws.StringSlice(v)
+		}
+	}
+
+	if doc.Version != "" {
+		input.SetDocumentVersion(doc.Version)
+	}
+	if opts.MaxConcurrency != "" {
+		input.SetMaxConcurrency(opts.MaxConcurrency)
+	}
+	if opts.MaxErrors != "" {
+		input.SetMaxErrors(opts.MaxErrors)
+	}
+	if opts.DeliveryTimeout > 0 {
+		input.SetTimeoutSeconds(int64(opts.DeliveryTimeout.Seconds()))
+	}
+	if opts.Comment != "" {
+		input.SetComment(opts.Comment)
+	}
+
+	if opts.OutputLocation != nil {
+		input.SetOutputS3BucketName(opts.OutputLocation.Bucket)
+		if opts.OutputLocation.Prefix != "" {
+			input.SetOutputS3KeyPrefix(opts.OutputLocation.Prefix)
+		}
+	}
+
+	return input
+}
+
+// rolloutTargets resolves the instances targeted by each command, so that they can be targeted by instance ID
+func (c *Client) rolloutTargets(ctx context.Context, commands []*SessionCommand) (targets []*ssmx.RolloutTarget, err error) {
+	for _, cmd := range commands {
+		ssmClient := c.newSSM(cmd.Session)
+
+		// Instances are always looked up, so that instance IDs and addresses only target the account they belong to
+		var ids []string
+		switch {
+		case len(cmd.Filters) > 0:
+			ids, err = ssmx.ResolveFilteredInstances(ctx, ssmClient, c.newEC2(cmd.Session), cmd.Filters, aws.StringValueSlice(cmd.Input.InstanceIds))
+		case len(cmd.Input.Targets) > 0:
+			ids, err = ssmx.ResolveInstances(ctx, ssmClient, cmd.Input.Targets)
+		case len(cmd.Input.InstanceIds) > 0:
+			ids, err = ssmx.ResolveInstances(ctx, ssmClient, []*ssm.Target{{Key: aws.String("InstanceIds"), Values: cmd.Input.InstanceIds}})
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, &SessionError{Profile: cmd.Session.ProfileName, Region: *cmd.Session.Session.Config.Region, Err: err}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		targets = append(targets, &ssmx.RolloutTarget{Session: cmd.Session, Client: ssmClient, Instances: ids})
+	}
+
+	return targets, nil
+}
+
+// fetchOutput relays each result from sent to results, replacing the output returned by the API with the
+// complete output written to S3, then closes results
+func (c *Client) fetchOutput(ctx context.Context, commands []*SessionCommand, opts Options, sent <-chan *Result, results chan<- *Result) {
+	defer close(results)
+
+	s3Clients := make(map[string]s3iface.S3API)
+	if opts.OutputLocation != nil {
+		for _, cmd := range commands {
+			s3Clients[cmd.Session.ProfileName+"@"+*cmd.Session.Session.Config.Region] = c.newS3(cmd.Session, opts.S3Endpoint)
+		}
+	}
+
+	for v := range sent {
+		if client, ok := s3Clients[v.ProfileName+"@"+v.Region]; ok && v.InvocationResult != nil {
+			if err := invocation.FetchOutputWithContext(ctx, client, *opts.OutputLocation, v); err != nil {
+				c.Logger.Warn(err)
+			}
+		}
+
+		results <- v
+	}
+}
@@ -0,0 +1,176 @@
+package fleet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	ssmx "github.com/disneystreaming/ssm-helpers/ssm"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+	"github.com/disneystreaming/ssm-helpers/util/batch"
+)
+
+// collect returns every result received before the channel was closed
+func collect(results <-chan *Result) (received []*Result) {
+	for v := range results {
+		received = append(received, v)
+	}
+
+	return received
+}
+
+func TestRun(t *testing.T) {
+	assert := assert.New(t)
+	ssmx.PollInterval = time.Millisecond
+
+	mockSvc := &mocks.MockSSMInvocationClient{}
+	c := newTestClient(func(sess *session.Session) ssmiface.SSMAPI { return mockSvc })
+	targets := Targets{Profiles: []string{"profile1"}, Regions: []string{"us-east-1"}, Instances: []string{"i-1", "i-2"}}
+
+	results, err := c.Run(context.Background(), targets, ShellScript("uptime"), Options{Comment: "requested by test"})
+	assert.NoError(err)
+
+	received := collect(results)
+	if assert.Len(received, 2) {
+		assert.Equal(invocation.CommandSuccess, received[0].Status)
+		assert.Equal("profile1", received[0].ProfileName)
+		assert.Equal("us-east-1", received[0].Region)
+	}
+
+	if assert.Len(mockSvc.SentCommands, 1) {
+		input := mockSvc.SentCommands[0]
+		assert.Equal("AWS-RunShellScript", *input.DocumentName)
+		assert.Equal([]string{"uptime"}, aws.StringValueSlice(input.Parameters["commands"]))
+		assert.Equal([]string{"i-1", "i-2"}, aws.StringValueSlice(input.InstanceIds))
+		assert.Equal("50", *input.MaxConcurrency)
+		assert.Equal("0", *input.MaxErrors)
+		assert.Equal("requested by test", *input.Comment)
+	}
+
+	_, err = c.Run(context.Background(), targets, Document{}, Options{})
+	assert.Error(err)
+
+	_, err = c.Run(context.Background(), Targets{Profiles: []string{"profile1"}, Regions: []string{"us-east-1"}}, ShellScript("uptime"), Options{})
+	assert.Error(err)
+}
+
+func TestRunRollout(t *testing.T) {
+	assert := assert.New(t)
+	ssmx.PollInterval = time.Millisecond
+
+	// Filters the API can't evaluate are resolved to instance IDs, and run on as a rollout
+	filters, err := ssmx.ParseFilters([]string{"attr:PlatformType=Win*"})
+	assert.NoError(err)
+	targets := Targets{Profiles: []string{"profile1"}, Regions: []string{"us-east-1"}, Filters: filters}
+
+	mockSvc := &mocks.MockSSMInvocationClient{}
+	c := newTestClient(func(sess *session.Session) ssmiface.SSMAPI { return mockSvc })
+
+	results, err := c.Run(context.Background(), targets, ShellScript("uptime"), Options{})
+	assert.NoError(err)
+	assert.Len(collect(results), 2)
+	if assert.Len(mockSvc.SentCommands, 1) {
+		assert.Equal([]string{"i-78901", "i-67890"}, aws.StringValueSlice(mockSvc.SentCommands[0].InstanceIds))
+	}
+
+	// Failures don't halt the default rollout, which has a single batch
+	mockSvc = &mocks.MockSSMInvocationClient{Statuses: map[string]string{"i-78901": "Failed"}}
+	c = newTestClient(func(sess *session.Session) ssmiface.SSMAPI { return mockSvc })
+
+	results, err = c.Run(context.Background(), targets, ShellScript("uptime"), Options{MaxErrors: "1"})
+	assert.NoError(err)
+
+	received := collect(results)
+	if assert.Len(received, 2) {
+		for _, r := range received {
+			assert.NotEqual(invocation.ClientError, r.Status)
+			assert.NoError(r.Error)
+		}
+	}
+
+	// A halted rollout is reported as a client error
+	mockSvc = &mocks.MockSSMInvocationClient{Statuses: map[string]string{"i-78901": "Failed"}}
+	c = newTestClient(func(sess *session.Session) ssmiface.SSMAPI { return mockSvc })
+
+	opts := Options{Rollout: &ssmx.Rollout{BatchSize: batch.Size{Count: 1}}}
+	commands, err := c.Commands(context.Background(), targets, ShellScript("uptime"), opts)
+	assert.NoError(err)
+	results, err = c.Send(context.Background(), commands, opts)
+	assert.NoError(err)
+
+	received = collect(results)
+	if assert.Len(received, 2) {
+		assert.Equal(invocation.CommandFailed, received[0].Status)
+		assert.Equal(invocation.ClientError, received[1].Status)
+		assert.Error(received[1].Error)
+	}
+
+	// The instances of every batch are set on the commands, including those the halted rollout didn't run
+	if assert.Len(commands, 1) {
+		assert.Equal([]string{"i-78901", "i-67890"}, commands[0].Instances)
+	}
+}
+
+func TestRunInstancesAndFilters(t *testing.T) {
+	assert := assert.New(t)
+	ssmx.PollInterval = time.Millisecond
+
+	// Filters on the provided instances are resolved to the IDs of those that match, as SendCommand doesn't
+	// accept targets along with instance IDs. The mock matches filter values anywhere in the instance information.
+	filters, err := ssmx.ParseFilters([]string{"platform=Windows"})
+	assert.NoError(err)
+	targets := Targets{Profiles: []string{"profile1"}, Regions: []string{"us-east-1"}, Instances: []string{"i-78901", "i-12345"}, Filters: filters}
+
+	mockSvc := &mocks.MockSSMInvocationClient{}
+	c := newTestClient(func(sess *session.Session) ssmiface.SSMAPI { return mockSvc })
+
+	results, err := c.Run(context.Background(), targets, ShellScript("uptime"), Options{})
+	assert.NoError(err)
+	assert.Len(collect(results), 1)
+	if assert.Len(mockSvc.SentCommands, 1) {
+		assert.Empty(mockSvc.SentCommands[0].Targets)
+		assert.Equal([]string{"i-78901"}, aws.StringValueSlice(mockSvc.SentCommands[0].InstanceIds))
+	}
+}
+
+func TestRetryCommands(t *testing.T) {
+	assert := assert.New(t)
+	ssmx.PollInterval = time.Millisecond
+
+	run := invocation.NewRunRecord("AWS-RunShellScript", "", map[string][]*string{"commands": aws.StringSlice([]string{"uptime"})})
+	run.AddSession("profile1", "us-east-1", nil, &ssm.SendCommandInput{InstanceIds: aws.StringSlice([]string{"i-1", "i-2", "i-3"})}, nil)
+	run.AddResult(&Result{ProfileName: "profile1", Region: "us-east-1", Status: invocation.CommandSuccess, InvocationResult: &ssm.GetCommandInvocationOutput{InstanceId: aws.String("i-1")}})
+	run.AddResult(&Result{ProfileName: "profile1", Region: "us-east-1", Status: invocation.CommandFailed, InvocationResult: &ssm.GetCommandInvocationOutput{InstanceId: aws.String("i-2")}})
+	run.AddResult(&Result{ProfileName: "profile1", Region: "us-east-1", Status: invocation.CommandDeliveryTimedOut, InvocationResult: &ssm.GetCommandInvocationOutput{InstanceId: aws.String("i-3")}})
+
+	mockSvc := &mocks.MockSSMInvocationClient{}
+	c := newTestClient(func(sess *session.Session) ssmiface.SSMAPI { return mockSvc })
+
+	// Only the failed instances are targeted, with the document of the run
+	commands, err := c.RetryCommands(run, Options{})
+	assert.NoError(err)
+	if assert.Len(commands, 1) {
+		assert.Equal("profile1", commands[0].Session.ProfileName)
+		assert.Equal("AWS-RunShellScript", *commands[0].Input.DocumentName)
+		assert.Equal([]string{"i-2", "i-3"}, aws.StringValueSlice(commands[0].Input.InstanceIds))
+	}
+
+	results, err := c.Send(context.Background(), commands, Options{})
+	assert.NoError(err)
+	assert.Len(collect(results), 2)
+	if assert.Len(mockSvc.SentCommands, 1) {
+		assert.Equal([]string{"uptime"}, aws.StringValueSlice(mockSvc.SentCommands[0].Parameters["commands"]))
+	}
+
+	// Nothing is sent without commands
+	results, err = c.Send(context.Background(), nil, Options{})
+	assert.NoError(err)
+	assert.Empty(collect(results))
+}
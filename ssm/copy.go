@@ -0,0 +1,347 @@
+package ssm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+)
+
+// MaxCommandCopySize is the size of the largest file that can be copied through SendCommand
+const MaxCommandCopySize = 256 * 1024
+
+// uploadChunkSize is the number of bytes of a file sent to the instances by each command
+const uploadChunkSize = 32 * 1024
+
+// downloadChunkSize is the number of bytes of a file read from the instances by each command, chosen so that
+// the base64-encoded chunk fits in the 24000 characters of output returned by the GetCommandInvocation API
+const downloadChunkSize = 16 * 1024
+
+// copyHeredocMarker delimits the base64-encoded data in the upload scripts
+const copyHeredocMarker = "SSM_HELPERS_CP_EOF"
+
+// CopyResult is the outcome of copying a file to or from a single instance
+type CopyResult struct {
+	InstanceID string
+	Profile    string
+	Region     string
+
+	// Path is the path of the file on the instance
+	Path string
+
+	// Checksum is the SHA-256 checksum of the file on the instance, in hex
+	Checksum string
+
+	// Data is the content of the file, for downloads
+	Data []byte
+
+	Err error
+}
+
+// Checksum returns the SHA-256 checksum of data, in hex, as printed by sha256sum
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// shellQuote quotes s to be used as a single word by the shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteDestination returns shell commands that set $dest to the remote path, or to the named file inside it
+// if the remote path is a directory
+func remoteDestination(remotePath, name string) []string {
+	return []string{
+		"dest=" + shellQuote(remotePath),
+		`if [ -d "$dest" ]; then dest="${dest%/}/"` + shellQuote(name) + "; fi",
+	}
+}
+
+// uploadScripts returns the shell commands that write data to a temporary file next to the destination in chunks,
+// one command per chunk, followed by the command that moves the file into place and prints its checksum
+func uploadScripts(data []byte, remotePath, name string) (scripts [][]string) {
+	for offset := 0; offset == 0 || offset < len(data); offset += uploadChunkSize {
+		end := offset + uploadChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		redirect := ">>"
+		if offset == 0 {
+			redirect = ">"
+		}
+
+		script := []string{"set -e"}
+		script = append(script, remoteDestination(remotePath, name)...)
+		script = append(script,
+			fmt.Sprintf(`base64 -d %s "$dest.ssm-cp.tmp" <<'%s'`, redirect, copyHeredocMarker),
+			base64.StdEncoding.EncodeToString(data[offset:end]),
+			copyHeredocMarker,
+		)
+		scripts = append(scripts, script)
+	}
+
+	final := []string{"set -e"}
+	final = append(final, remoteDestination(remotePath, name)...)
+	final = append(final, `mv -f "$dest.ssm-cp.tmp" "$dest"`, `sha256sum "$dest"`)
+
+	return append(scripts, final)
+}
+
+// checksumScript returns the shell commands that print the checksum of the remote file
+func checksumScript(remotePath, name string) []string {
+	script := []string{"set -e"}
+	script = append(script, remoteDestination(remotePath, name)...)
+	return append(script, `sha256sum "$dest"`)
+}
+
+// statScript returns the shell commands that print the size of the remote file, followed by its checksum
+func statScript(remotePath string) []string {
+	p := shellQuote(remotePath)
+	return []string{
+		"set -e",
+		fmt.Sprintf("[ -f %s ] || { echo 'not a regular file' >&2; exit 1; }", p),
+		fmt.Sprintf("wc -c < %s", p),
+		fmt.Sprintf("sha256sum %s", p),
+	}
+}
+
+// downloadScript returns the shell commands that print the base64-encoded chunk of the remote file at the given index
+func downloadScript(remotePath string, chunk int) []string {
+	return []string{
+		"set -e",
+		fmt.Sprintf("dd if=%s bs=%d skip=%d count=1 2>/dev/null | base64 | tr -d '\\n'", shellQuote(remotePath), downloadChunkSize, chunk),
+	}
+}
+
+// parseChecksum returns the checksum and path printed by sha256sum
+func parseChecksum(output string) (checksum string, path string, err error) {
+	// sha256sum escapes the line with a backslash if the path contains special characters
+	fields := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(output), `\`), "  ", 2)
+	if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+		return "", "", fmt.Errorf("Unexpected sha256sum output: %q", output)
+	}
+
+	return fields[0], fields[1], nil
+}
+
+// parseStat returns the size and checksum printed by statScript
+func parseStat(output string) (size int, checksum string, err error) {
+	lines := strings.SplitN(strings.TrimSpace(output), "\n", 2)
+	if len(lines) != 2 {
+		return 0, "", fmt.Errorf("Unexpected output: %q", output)
+	}
+
+	if size, err = strconv.Atoi(strings.TrimSpace(lines[0])); err != nil {
+		return 0, "", fmt.Errorf("Unexpected file size: %q", lines[0])
+	}
+
+	checksum, _, err = parseChecksum(lines[1])
+	return size, checksum, err
+}
+
+// copyStep runs each of the scripts in turn on the instances, and returns the standard output of the last
+// script for each instance it succeeded on. Instances that a script fails on are not sent the next one,
+// and their error is recorded in errs.
+func copyStep(ctx context.Context, instances []rolloutInstance, scripts [][]string, errs map[string]error) map[string]string {
+	var stdout map[string]string
+
+	for _, script := range scripts {
+		input := &ssm.SendCommandInput{
+			DocumentName: aws.String("AWS-RunShellScript"),
+			Parameters:   map[string][]*string{"commands": aws.StringSlice(script)},
+			Comment:      aws.String("ssm-helpers cp"),
+		}
+
+		stdout = make(map[string]string)
+		runBatch(ctx, instances, input, nil, func(v *invocation.Result) {
+			id := v.InstanceID()
+			switch {
+			case id == "":
+				// Errors that prevented the command from running at all fail every instance of the session
+				for _, i := range instances {
+					if i.target.Session.ProfileName == v.ProfileName && *i.target.Session.Session.Config.Region == v.Region {
+						errs[i.id] = v.Error
+					}
+				}
+			case v.Error != nil:
+				errs[id] = v.Error
+			case v.Status != invocation.CommandSuccess:
+				errs[id] = fmt.Errorf("%s: %s", v.Status, strings.TrimSpace(aws.StringValue(v.InvocationResult.StandardErrorContent)))
+			default:
+				stdout[id] = aws.StringValue(v.InvocationResult.StandardOutputContent)
+			}
+		})
+
+		// Only the instances that succeeded are sent the next script
+		remaining := instances[:0:0]
+		for _, i := range instances {
+			if _, ok := stdout[i.id]; ok {
+				remaining = append(remaining, i)
+			} else if errs[i.id] == nil {
+				errs[i.id] = fmt.Errorf("No result was returned for the instance")
+			}
+		}
+		instances = remaining
+
+		if len(instances) == 0 {
+			break
+		}
+	}
+
+	return stdout
+}
+
+// copyInstances returns every instance of the targets
+func copyInstances(targets []*RolloutTarget) (instances []rolloutInstance) {
+	for _, t := range targets {
+		for _, id := range t.Instances {
+			instances = append(instances, rolloutInstance{target: t, id: id})
+		}
+	}
+
+	return instances
+}
+
+// copyResults returns the result for each instance of the targets, with the error recorded for it if any
+func copyResults(targets []*RolloutTarget, errs map[string]error, fn func(r *CopyResult)) (results []*CopyResult) {
+	for _, i := range copyInstances(targets) {
+		r := &CopyResult{
+			InstanceID: i.id,
+			Profile:    i.target.Session.ProfileName,
+			Region:     *i.target.Session.Session.Config.Region,
+			Err:        errs[i.id],
+		}
+
+		if r.Err == nil {
+			fn(r)
+		}
+		results = append(results, r)
+	}
+
+	return results
+}
+
+// Upload writes data to the remote path on every instance of the targets through SendCommand, and verifies the
+// checksum of the written file on each of them. If the remote path is a directory, the file is written to
+// name inside it. data may be at most MaxCommandCopySize bytes.
+func Upload(ctx context.Context, targets []*RolloutTarget, data []byte, remotePath, name string) []*CopyResult {
+	errs := make(map[string]error)
+	checksum := Checksum(data)
+
+	if len(data) > MaxCommandCopySize {
+		err := fmt.Errorf("File is larger than the %d bytes that can be copied through SendCommand", MaxCommandCopySize)
+		for _, i := range copyInstances(targets) {
+			errs[i.id] = err
+		}
+	}
+
+	var stdout map[string]string
+	if len(errs) == 0 {
+		stdout = copyStep(ctx, copyInstances(targets), uploadScripts(data, remotePath, name), errs)
+	}
+
+	return copyResults(targets, errs, func(r *CopyResult) {
+		r.Checksum, r.Path, r.Err = parseChecksum(stdout[r.InstanceID])
+		if r.Err == nil && r.Checksum != checksum {
+			r.Err = fmt.Errorf("Checksum mismatch: %s was written, expected %s", r.Checksum, checksum)
+		}
+	})
+}
+
+// Download reads the remote file from every instance of the targets through SendCommand, and verifies the
+// checksum of the data read from each of them. The file may be at most MaxCommandCopySize bytes.
+func Download(ctx context.Context, targets []*RolloutTarget, remotePath string) []*CopyResult {
+	errs := make(map[string]error)
+	sizes := make(map[string]int)
+	checksums := make(map[string]string)
+
+	instances := copyInstances(targets)
+	stat := copyStep(ctx, instances, [][]string{statScript(remotePath)}, errs)
+
+	// Read the number of chunks needed for the largest file from every instance that it could be read from
+	maxSize := 0
+	remaining := instances[:0:0]
+	for _, i := range instances {
+		out, ok := stat[i.id]
+		if !ok {
+			continue
+		}
+
+		size, checksum, err := parseStat(out)
+		switch {
+		case err != nil:
+			errs[i.id] = err
+		case size > MaxCommandCopySize:
+			errs[i.id] = fmt.Errorf("File is larger than the %d bytes that can be copied through SendCommand", MaxCommandCopySize)
+		default:
+			sizes[i.id], checksums[i.id] = size, checksum
+			remaining = append(remaining, i)
+			if size > maxSize {
+				maxSize = size
+			}
+		}
+	}
+
+	data := make(map[string]*bytes.Buffer)
+	for chunk := 0; chunk*downloadChunkSize < maxSize && len(remaining) > 0; chunk++ {
+		stdout := copyStep(ctx, remaining, [][]string{downloadScript(remotePath, chunk)}, errs)
+
+		next := remaining[:0:0]
+		for _, i := range remaining {
+			out, ok := stdout[i.id]
+			if !ok {
+				continue
+			}
+
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out))
+			if err != nil {
+				errs[i.id] = fmt.Errorf("Could not decode chunk %d of the file\n%v", chunk, err)
+				continue
+			}
+
+			if data[i.id] == nil {
+				data[i.id] = &bytes.Buffer{}
+			}
+			data[i.id].Write(decoded)
+			next = append(next, i)
+		}
+		remaining = next
+	}
+
+	return copyResults(targets, errs, func(r *CopyResult) {
+		r.Path = remotePath
+		if data[r.InstanceID] != nil {
+			r.Data = data[r.InstanceID].Bytes()
+		}
+
+		r.Checksum = Checksum(r.Data)
+		switch {
+		case len(r.Data) != sizes[r.InstanceID]:
+			r.Err = fmt.Errorf("Size mismatch: read %d bytes, expected %d", len(r.Data), sizes[r.InstanceID])
+		case r.Checksum != checksums[r.InstanceID]:
+			r.Err = fmt.Errorf("Checksum mismatch: read %s, expected %s", r.Checksum, checksums[r.InstanceID])
+		}
+	})
+}
+
+// RemoteChecksums returns the checksum of the remote file on every instance of the targets, e.g. to verify a file
+// copied with scp. If the remote path is a directory, the checksum of the file with the given name inside it is returned.
+func RemoteChecksums(ctx context.Context, targets []*RolloutTarget, remotePath, name string) []*CopyResult {
+	errs := make(map[string]error)
+	stdout := copyStep(ctx, copyInstances(targets), [][]string{checksumScript(remotePath, name)}, errs)
+
+	return copyResults(targets, errs, func(r *CopyResult) {
+		r.Checksum, r.Path, r.Err = parseChecksum(stdout[r.InstanceID])
+	})
+}
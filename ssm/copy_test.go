@@ -0,0 +1,167 @@
+package ssm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+)
+
+func testCopyTargets(client *mocks.MockSSMInvocationClient, instances ...string) []*RolloutTarget {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	sess := &session.Session{
+		Logger:      logger,
+		ProfileName: "testprofile",
+		Session:     awssession.Must(awssession.NewSession(&aws.Config{Region: aws.String("us-east-1")})),
+	}
+
+	return []*RolloutTarget{{Session: sess, Client: client, Instances: instances}}
+}
+
+func TestUploadScripts(t *testing.T) {
+	assert := assert.New(t)
+
+	data := bytes.Repeat([]byte("x"), 2*uploadChunkSize+1)
+	scripts := uploadScripts(data, "/etc/app's.conf", "app.conf")
+	assert.Len(scripts, 4)
+
+	var written []byte
+	for i, script := range scripts[:3] {
+		assert.Equal(`dest='/etc/app'\''s.conf'`, script[1])
+		if i == 0 {
+			assert.Contains(script[3], `> "$dest.ssm-cp.tmp"`)
+		} else {
+			assert.Contains(script[3], `>> "$dest.ssm-cp.tmp"`)
+		}
+
+		chunk, err := base64.StdEncoding.DecodeString(script[4])
+		assert.NoError(err)
+		written = append(written, chunk...)
+	}
+	assert.Equal(data, written)
+	assert.Contains(scripts[3], `mv -f "$dest.ssm-cp.tmp" "$dest"`)
+
+	// Empty files are still created
+	assert.Len(uploadScripts(nil, "/tmp/empty", "empty"), 2)
+}
+
+func TestParseStat(t *testing.T) {
+	assert := assert.New(t)
+	sum := Checksum([]byte("hello"))
+
+	size, checksum, err := parseStat(fmt.Sprintf("5\n%s  /tmp/hello\n", sum))
+	assert.NoError(err)
+	assert.Equal(5, size)
+	assert.Equal(sum, checksum)
+
+	checksum, path, err := parseChecksum(fmt.Sprintf("\\%s  /tmp/new\\nline", sum))
+	assert.NoError(err)
+	assert.Equal(sum, checksum)
+	assert.Equal(`/tmp/new\nline`, path)
+
+	_, _, err = parseStat("5\n")
+	assert.Error(err)
+	_, _, err = parseChecksum("sha256sum: /tmp/hello: No such file or directory")
+	assert.Error(err)
+}
+
+func TestUpload(t *testing.T) {
+	assert := assert.New(t)
+	PollInterval = time.Millisecond
+
+	data := bytes.Repeat([]byte("0123456789"), uploadChunkSize/5)
+
+	// Simulate the instances by decoding the chunks sent to them, corrupting the file on i-3
+	written := make(map[string][]byte)
+	mockSvc := &mocks.MockSSMInvocationClient{
+		Statuses: map[string]string{"i-2": "Failed"},
+		Output: func(commands []string, instanceID string) string {
+			if !strings.HasPrefix(commands[len(commands)-1], "sha256sum") {
+				chunk, _ := base64.StdEncoding.DecodeString(commands[4])
+				written[instanceID] = append(written[instanceID], chunk...)
+				return ""
+			}
+
+			if instanceID == "i-3" {
+				written[instanceID] = written[instanceID][1:]
+			}
+			return fmt.Sprintf("%s  /tmp/data\n", Checksum(written[instanceID]))
+		},
+	}
+
+	results := Upload(context.Background(), testCopyTargets(mockSvc, "i-1", "i-2", "i-3"), data, "/tmp/", "data")
+	assert.Len(results, 3)
+
+	assert.NoError(results[0].Err)
+	assert.Equal("i-1", results[0].InstanceID)
+	assert.Equal("/tmp/data", results[0].Path)
+	assert.Equal(Checksum(data), results[0].Checksum)
+	assert.Equal(data, written["i-1"])
+
+	assert.Error(results[1].Err)
+	assert.Contains(results[2].Err.Error(), "Checksum mismatch")
+
+	// Files too large to be sent through SendCommand are not sent at all
+	mockSvc.SentCommands = nil
+	results = Upload(context.Background(), testCopyTargets(mockSvc, "i-1"), make([]byte, MaxCommandCopySize+1), "/tmp/data", "data")
+	assert.Error(results[0].Err)
+	assert.Empty(mockSvc.SentCommands)
+}
+
+func TestDownload(t *testing.T) {
+	assert := assert.New(t)
+	PollInterval = time.Millisecond
+
+	data := bytes.Repeat([]byte("0123456789"), downloadChunkSize/4)
+	skip := regexp.MustCompile(`skip=(\d+)`)
+
+	mockSvc := &mocks.MockSSMInvocationClient{
+		Output: func(commands []string, instanceID string) string {
+			file := data
+			if instanceID == "i-2" {
+				file = []byte("short")
+			}
+
+			last := commands[len(commands)-1]
+			if strings.HasPrefix(last, "sha256sum") {
+				return fmt.Sprintf("%d\n%s  /tmp/data\n", len(file), Checksum(file))
+			}
+
+			chunk, _ := strconv.Atoi(skip.FindStringSubmatch(last)[1])
+			start, end := chunk*downloadChunkSize, (chunk+1)*downloadChunkSize
+			if start > len(file) {
+				start = len(file)
+			}
+			if end > len(file) {
+				end = len(file)
+			}
+			return base64.StdEncoding.EncodeToString(file[start:end])
+		},
+	}
+
+	results := Download(context.Background(), testCopyTargets(mockSvc, "i-1", "i-2"), "/tmp/data")
+	assert.Len(results, 2)
+
+	assert.NoError(results[0].Err)
+	assert.Equal(data, results[0].Data)
+	assert.Equal(Checksum(data), results[0].Checksum)
+
+	assert.NoError(results[1].Err)
+	assert.Equal([]byte("short"), results[1].Data)
+}
@@ -1,31 +1,381 @@
 package ssm
 
 import (
+	"context"
+	"fmt"
+	"strings"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+
+	ec2helpers "github.com/disneystreaming/ssm-helpers/ec2"
+	"github.com/disneystreaming/ssm-helpers/ssm/instance"
 )
 
-// AppendSSMFilter appends a single *ssm.InstanceInformationStringFilter to an existing array of filters, then returns the appended array
-func AppendSSMFilter(filters *[]*ssm.InstanceInformationStringFilter, filterToAdd *ssm.InstanceInformationStringFilter) {
-	*filters = append(*filters, filterToAdd)
+// maxCommandTargets is the maximum number of targets accepted by a single call to the SendCommand API
+const maxCommandTargets = 5
+
+// attributePrefix prefixes the keys of filters on an attribute of the instances rather than a tag
+const attributePrefix = "attr:"
+
+// instanceInformationKeys are the DescribeInstanceInformation filter keys of the attributes that the API can filter on
+var instanceInformationKeys = map[string]string{
+	"PingStatus":   "PingStatus",
+	"PlatformType": "PlatformTypes",
+	"AgentVersion": "AgentVersion",
+}
+
+// FilterOperator is the comparison made by a Filter between a tag of an instance and the values of the filter
+type FilterOperator int
+
+const (
+	// FilterEquals matches instances with the tag set to any of the values (key=value1,value2)
+	FilterEquals FilterOperator = iota
+
+	// FilterNotEquals matches instances without the tag, or with the tag set to none of the values (key!=value)
+	FilterNotEquals
+
+	// FilterExists matches instances with the tag set to any value (has:key)
+	FilterExists
+)
+
+// Filter is a single tag filter expression, or a filter on an attribute of the instances if its key is attr:<field>
+// (e.g. attr:InstanceType=t3.*). Values may contain * wildcards, which match any number of characters.
+type Filter struct {
+	Key      string
+	Operator FilterOperator
+	Values   []string
+}
+
+// Filters is a list of filter expressions, which an instance must all match
+type Filters []Filter
+
+// ParseFilter parses a filter expression: key=value, key!=value or has:key. Any number of comma-separated values
+// may be given, of which the tag must match at least one (or, for !=, none).
+func ParseFilter(expr string) (f Filter, err error) {
+	if strings.HasPrefix(expr, "has:") {
+		f = Filter{Key: strings.TrimPrefix(expr, "has:"), Operator: FilterExists}
+	} else {
+		idx := strings.Index(expr, "=")
+		if idx < 0 {
+			return f, fmt.Errorf("Invalid filter %q, expected key=value, key!=value or has:key", expr)
+		}
+
+		f = Filter{Key: expr[:idx], Operator: FilterEquals, Values: strings.Split(expr[idx+1:], ",")}
+		if strings.HasSuffix(f.Key, "!") {
+			f.Key, f.Operator = strings.TrimSuffix(f.Key, "!"), FilterNotEquals
+		}
+	}
+
+	if f.Key == "" {
+		return f, fmt.Errorf("Invalid filter %q, the tag key cannot be empty", expr)
+	}
+
+	if strings.HasPrefix(strings.ToLower(f.Key), attributePrefix) {
+		field, err := instance.ParseField(f.Key[len(attributePrefix):])
+		if err != nil || strings.HasPrefix(field, "tag:") {
+			return f, fmt.Errorf("Invalid filter %q, unknown attribute %q", expr, f.Key[len(attributePrefix):])
+		}
+
+		// Instances are only ever searched for in the selected profiles and regions
+		if field == "Profile" || field == "Region" {
+			return f, fmt.Errorf("Invalid filter %q, use --profile and --region to select profiles and regions", expr)
+		}
+
+		f.Key = attributePrefix + field
+	}
+
+	return f, nil
+}
+
+// ParseFilters parses each of the provided filter expressions
+func ParseFilters(exprs []string) (filters Filters, err error) {
+	for _, expr := range exprs {
+		f, err := ParseFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	return filters, nil
+}
+
+func (f Filter) String() string {
+	switch f.Operator {
+	case FilterExists:
+		return "has:" + f.Key
+	case FilterNotEquals:
+		return f.Key + "!=" + strings.Join(f.Values, ",")
+	default:
+		return f.Key + "=" + strings.Join(f.Values, ",")
+	}
+}
+
+// attribute returns the name of the attribute that the filter is on, if it isn't on a tag
+func (f Filter) attribute() (string, bool) {
+	if strings.HasPrefix(f.Key, attributePrefix) {
+		return f.Key[len(attributePrefix):], true
+	}
+	return "", false
 }
 
-// buildFilters takes a map of tags (in key[value] format) and converts them into a format that is compatible
-// with *ssm.InstanceInformationStringFilter, updating a provided []*ssm.InstanceInformationStringFilter object
-func buildFilters(commonTags map[string]string, filtersList *[]*ssm.InstanceInformationStringFilter) {
+// Match returns whether the tags of an instance match the filter
+func (f Filter) Match(tags map[string]string) bool {
+	return f.MatchInstance(&instance.InstanceInfo{Tags: tags})
+}
 
-	merged := make(map[string]string)
+// MatchInstance returns whether the tags or attributes of an instance match the filter. Attributes that are empty
+// are considered to not exist.
+func (f Filter) MatchInstance(i *instance.InstanceInfo) bool {
+	value, exists := i.Tags[f.Key]
+	if name, ok := f.attribute(); ok {
+		value = i.Field(name)
+		exists = value != ""
+	}
 
-	for k, v := range commonTags {
-		merged[k] = v
+	switch f.Operator {
+	case FilterExists:
+		return exists
+	case FilterNotEquals:
+		return !exists || !matchAny(f.Values, value)
+	default:
+		return exists && matchAny(f.Values, value)
 	}
+}
+
+// Match returns whether the tags of an instance match every filter
+func (fs Filters) Match(tags map[string]string) bool {
+	return fs.MatchInstance(&instance.InstanceInfo{Tags: tags})
+}
 
-	for k, v := range merged {
-		filter := newSSMFilter("tag:"+k, v)
-		*filtersList = append(*filtersList, filter)
+// MatchInstance returns whether the tags and attributes of an instance match every filter
+func (fs Filters) MatchInstance(i *instance.InstanceInfo) bool {
+	for _, f := range fs {
+		if !f.MatchInstance(i) {
+			return false
+		}
 	}
 
-	return
+	return true
+}
+
+// exact returns whether the filter only compares the tag to exact values, which the SSM APIs can do themselves
+func (f Filter) exact() bool {
+	if f.Operator != FilterEquals {
+		return false
+	}
+
+	for _, v := range f.Values {
+		if v == "" || strings.Contains(v, "*") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// split returns the instance information filters that evaluate the filters with the DescribeInstanceInformation
+// API, and the filters that must be evaluated against the tags and attributes of each instance instead. Filters
+// on a tag value are only evaluated by the API once per tag key, the API can only check that a single tag exists,
+// and only a few attributes can be filtered on by the API.
+func (fs Filters) split() (api []*ssm.InstanceInformationStringFilter, local Filters) {
+	keys := make(map[string]bool)
+	tagKey := false
+
+	for _, f := range fs {
+		if name, ok := f.attribute(); ok {
+			if key, supported := instanceInformationKeys[name]; supported && f.exact() && !keys[f.Key] {
+				keys[f.Key] = true
+				api = append(api, newSSMFilter(key, f.Values...))
+			} else {
+				local = append(local, f)
+			}
+			continue
+		}
+
+		switch {
+		case f.exact() && !keys[f.Key]:
+			keys[f.Key] = true
+			api = append(api, newSSMFilter("tag:"+f.Key, f.Values...))
+			continue
+
+		case f.Operator == FilterExists && !tagKey:
+			tagKey = true
+			api = append(api, newSSMFilter("tag-key", f.Key))
+			continue
+
+		case f.Operator == FilterEquals && !tagKey:
+			// Instances without the tag can't match its wildcards, so they are excluded by the API
+			tagKey = true
+			api = append(api, newSSMFilter("tag-key", f.Key))
+		}
+
+		local = append(local, f)
+	}
+
+	return api, local
+}
+
+// InstanceInformationFilters returns the filters to pass to the DescribeInstanceInformation API, which evaluates
+// as many of the filters as it can; the others are returned by ClientSide
+func (fs Filters) InstanceInformationFilters() []*ssm.InstanceInformationStringFilter {
+	api, _ := fs.split()
+	return api
+}
+
+// ClientSide returns the filters that can't be evaluated by the DescribeInstanceInformation API, and must be
+// evaluated against the tags of each instance with FilterInstances
+func (fs Filters) ClientSide() Filters {
+	_, local := fs.split()
+	return local
+}
+
+// Targets returns the filters as SendCommand targets, if the SendCommand API can evaluate all of them.
+// Otherwise, the instances must be resolved with ResolveFilteredInstances and targeted by instance ID.
+func (fs Filters) Targets() (targets []*ssm.Target, ok bool) {
+	// SendCommand can only target instances by tag
+	for _, f := range fs {
+		if _, ok := f.attribute(); ok {
+			return nil, false
+		}
+	}
+
+	api, local := fs.split()
+	if len(local) > 0 || len(api) > maxCommandTargets {
+		return nil, false
+	}
+
+	for _, f := range api {
+		targets = append(targets, &ssm.Target{Key: f.Key, Values: f.Values})
+	}
+
+	return targets, true
+}
+
+// FilterInstances returns the instances whose tags and attributes match the filters that can't be evaluated by
+// the DescribeInstanceInformation API. The tags and attributes of EC2 instances are read from EC2, the tags of
+// other managed instances from SSM.
+func FilterInstances(ssmClient ssmiface.SSMAPI, ec2Client ec2iface.EC2API, filters Filters, instances []*ssm.InstanceInformation) ([]*ssm.InstanceInformation, error) {
+	return FilterInstancesWithContext(context.Background(), ssmClient, ec2Client, filters, instances)
+}
+
+// FilterInstancesWithContext is FilterInstances, stopping the lookup of the instances once ctx is canceled
+func FilterInstancesWithContext(ctx context.Context, ssmClient ssmiface.SSMAPI, ec2Client ec2iface.EC2API, filters Filters, instances []*ssm.InstanceInformation) ([]*ssm.InstanceInformation, error) {
+	local := filters.ClientSide()
+	if len(local) == 0 || len(instances) == 0 {
+		return instances, nil
+	}
+
+	details, err := DescribeInstancesWithContext(ctx, ssmClient, ec2Client, instances)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []*ssm.InstanceInformation
+	for idx, i := range instances {
+		if local.MatchInstance(&details[idx]) {
+			matched = append(matched, i)
+		}
+	}
+
+	return matched, nil
+}
+
+// DescribeInstances returns the information of each of the provided instances, including their tags and EC2
+// attributes. The profile and region of the returned instances are left empty.
+func DescribeInstances(ssmClient ssmiface.SSMAPI, ec2Client ec2iface.EC2API, instances []*ssm.InstanceInformation) ([]instance.InstanceInfo, error) {
+	return DescribeInstancesWithContext(context.Background(), ssmClient, ec2Client, instances)
+}
+
+// DescribeInstancesWithContext is DescribeInstances, stopping the lookup once ctx is canceled
+func DescribeInstancesWithContext(ctx context.Context, ssmClient ssmiface.SSMAPI, ec2Client ec2iface.EC2API, instances []*ssm.InstanceInformation) ([]instance.InstanceInfo, error) {
+	var ec2Instances []*string
+	for _, i := range instances {
+		if !strings.HasPrefix(aws.StringValue(i.InstanceId), "mi-") {
+			ec2Instances = append(ec2Instances, i.InstanceId)
+		}
+	}
+
+	ec2Info := make(map[string]*ec2.Instance)
+	if len(ec2Instances) > 0 {
+		described, err := ec2helpers.GetEC2InstanceInfoWithContext(ctx, ec2Client, ec2Instances)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range described {
+			if i != nil {
+				ec2Info[*i.InstanceId] = i
+			}
+		}
+	}
+
+	details := make([]instance.InstanceInfo, len(instances))
+	for idx, i := range instances {
+		details[idx] = instance.NewInstanceInfo("", "", i, ec2Info[aws.StringValue(i.InstanceId)])
+		if !strings.HasPrefix(aws.StringValue(i.InstanceId), "mi-") {
+			continue
+		}
+
+		// On-premises instances aren't known to EC2, their tags are managed by SSM
+		output, err := ssmClient.ListTagsForResourceWithContext(ctx, &ssm.ListTagsForResourceInput{
+			ResourceId:   i.InstanceId,
+			ResourceType: aws.String(ssm.ResourceTypeForTaggingManagedInstance),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Could not list the tags of managed instance %s\n%v", aws.StringValue(i.InstanceId), err)
+		}
+
+		for _, t := range output.TagList {
+			details[idx].Tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+	}
+
+	return details, nil
+}
+
+// matchAny returns whether value matches any of the patterns
+func matchAny(patterns []string, value string) bool {
+	for _, p := range patterns {
+		if wildcardMatch(p, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wildcardMatch returns whether s matches pattern, in which * matches any number of characters
+func wildcardMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	// The text before the first wildcard and after the last must match the start and end of s
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(s, part)
+		if idx < 0 {
+			return false
+		}
+		s = s[idx+len(part):]
+	}
+
+	return strings.HasSuffix(s, last)
+}
+
+// AppendSSMFilter appends a single *ssm.InstanceInformationStringFilter to an existing array of filters, then returns the appended array
+func AppendSSMFilter(filters *[]*ssm.InstanceInformationStringFilter, filterToAdd *ssm.InstanceInformationStringFilter) {
+	*filters = append(*filters, filterToAdd)
 }
 
 // NewSSMInstanceFilter takes a name and any number of instance IDs to create an *ssm.InstanceInformationStringFilter
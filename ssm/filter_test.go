@@ -6,6 +6,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
 )
 
 func TestAppendSSMFilter(t *testing.T) {
@@ -30,26 +33,155 @@ func TestAppendSSMFilter(t *testing.T) {
 	assert.Lenf(filters, 2, "Function returned slice of size %d, expected a size of 2", len(filters))
 }
 
-func Test_buildFilters(t *testing.T) {
+func TestParseFilters(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create our filter slice
-	filters := []*ssm.InstanceInformationStringFilter{
-		{
-			Key:    aws.String("PingStatus"),
-			Values: aws.StringSlice([]string{"Online"}),
-		},
+	filters, err := ParseFilters([]string{"env=prod,staging", "app!=legacy", "role=web-*", "has:owner", "url=a=b"})
+	assert.NoError(err)
+	assert.Equal(Filters{
+		{Key: "env", Operator: FilterEquals, Values: []string{"prod", "staging"}},
+		{Key: "app", Operator: FilterNotEquals, Values: []string{"legacy"}},
+		{Key: "role", Operator: FilterEquals, Values: []string{"web-*"}},
+		{Key: "owner", Operator: FilterExists},
+		{Key: "url", Operator: FilterEquals, Values: []string{"a=b"}},
+	}, filters)
+
+	for i, expr := range []string{"env=prod,staging", "app!=legacy", "role=web-*", "has:owner"} {
+		assert.Equal(expr, filters[i].String())
 	}
 
-	// Create the tags to be built and appended to the filter
-	tags := map[string]string{
-		"env": "dev",
-		"foo": "bar",
+	// Attribute names are case-insensitive
+	filters, err = ParseFilters([]string{"attr:instancetype=t3.*", "has:attr:PublicIPAddress"})
+	assert.NoError(err)
+	assert.Equal("attr:InstanceType", filters[0].Key)
+	assert.Equal("attr:PublicIPAddress", filters[1].Key)
+	assert.Equal(FilterExists, filters[1].Operator)
+
+	for _, expr := range []string{"env", "=prod", "!=prod", "has:", "attr:Color=red", "attr:tag:env=prod", "attr:Region=us-east-1"} {
+		_, err = ParseFilter(expr)
+		assert.Errorf(err, "%q should not be a valid filter", expr)
+	}
+}
+
+func TestFiltersMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	filters, _ := ParseFilters([]string{"env=prod,staging", "app!=legacy", "role=web-*", "has:owner"})
+
+	assert.True(filters.Match(map[string]string{"env": "staging", "role": "web-01", "owner": ""}))
+	assert.True(filters.Match(map[string]string{"env": "prod", "app": "api", "role": "web-", "owner": "me"}))
+	assert.False(filters.Match(map[string]string{"env": "dev", "role": "web-01", "owner": "me"}))
+	assert.False(filters.Match(map[string]string{"env": "prod", "app": "legacy", "role": "web-01", "owner": "me"}))
+	assert.False(filters.Match(map[string]string{"env": "prod", "role": "db-01", "owner": "me"}))
+	assert.False(filters.Match(map[string]string{"env": "prod", "role": "web-01"}))
+	assert.False(filters.Match(nil))
+
+	// Every instance matches an empty list of filters
+	assert.True(Filters{}.Match(nil))
+
+	// Attributes are matched like tags, empty attributes don't exist
+	filters, _ = ParseFilters([]string{"attr:InstanceType=t3.*", "attr:State!=stopped", "has:attr:PrivateIPAddress"})
+	assert.True(filters.MatchInstance(&instance.InstanceInfo{InstanceType: "t3.micro", State: "running", PrivateIPAddress: "10.0.0.1"}))
+	assert.False(filters.MatchInstance(&instance.InstanceInfo{InstanceType: "m5.large", State: "running", PrivateIPAddress: "10.0.0.1"}))
+	assert.False(filters.MatchInstance(&instance.InstanceInfo{InstanceType: "t3.micro", State: "stopped", PrivateIPAddress: "10.0.0.1"}))
+	assert.False(filters.MatchInstance(&instance.InstanceInfo{InstanceType: "t3.micro", State: "running"}))
+}
+
+func Test_wildcardMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(wildcardMatch("web", "web"))
+	assert.False(wildcardMatch("web", "web-01"))
+	assert.True(wildcardMatch("*", ""))
+	assert.True(wildcardMatch("web-*", "web-01"))
+	assert.True(wildcardMatch("*-01", "web-01"))
+	assert.True(wildcardMatch("w*b*1", "web-01"))
+	assert.False(wildcardMatch("w*b*2", "web-01"))
+	assert.False(wildcardMatch("ab*b", "ab"))
+}
+
+func TestFiltersSplit(t *testing.T) {
+	assert := assert.New(t)
+
+	// Exact values and a single tag key are evaluated by the API
+	filters, _ := ParseFilters([]string{"env=prod,staging", "has:owner", "team=core"})
+	assert.Len(filters.InstanceInformationFilters(), 3)
+	assert.Empty(filters.ClientSide())
+
+	targets, ok := filters.Targets()
+	assert.True(ok)
+	assert.Len(targets, 3)
+	assert.Equal("tag:env", *targets[0].Key)
+	assert.Equal([]string{"prod", "staging"}, aws.StringValueSlice(targets[0].Values))
+	assert.Equal("tag-key", *targets[1].Key)
+
+	// Wildcards, negations and further tag keys are evaluated client-side
+	filters, _ = ParseFilters([]string{"role=web-*", "app!=legacy", "has:owner", "env=prod", "env=staging"})
+	api := filters.InstanceInformationFilters()
+	assert.Len(api, 2)
+	assert.Equal("tag-key", *api[0].Key)
+	assert.Equal([]string{"role"}, aws.StringValueSlice(api[0].Values))
+	assert.Equal("tag:env", *api[1].Key)
+	assert.Len(filters.ClientSide(), 4)
+
+	_, ok = filters.Targets()
+	assert.False(ok)
+
+	// Only some attributes can be filtered on by the API, and none by SendCommand
+	filters, _ = ParseFilters([]string{"attr:PingStatus=Online", "attr:PlatformType=Linux", "attr:InstanceType=t3.micro", "attr:PingStatus=Online"})
+	api = filters.InstanceInformationFilters()
+	assert.Len(api, 2)
+	assert.Equal("PingStatus", *api[0].Key)
+	assert.Equal("PlatformTypes", *api[1].Key)
+	assert.Len(filters.ClientSide(), 2)
+
+	_, ok = Filters{filters[0]}.Targets()
+	assert.False(ok)
+
+	// SendCommand accepts at most 5 targets
+	filters, _ = ParseFilters([]string{"a=1", "b=2", "c=3", "d=4", "e=5", "f=6"})
+	assert.Len(filters.InstanceInformationFilters(), 6)
+	_, ok = filters.Targets()
+	assert.False(ok)
+}
+
+func TestFilterInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	instances := []*ssm.InstanceInformation{
+		{InstanceId: aws.String("i-123")},
+		{InstanceId: aws.String("i-456")},
+		{InstanceId: aws.String("i-789")},
+		{InstanceId: aws.String("mi-123")},
 	}
 
-	buildFilters(tags, &filters)
+	ids := func(filtered []*ssm.InstanceInformation) (ids []string) {
+		for _, i := range filtered {
+			ids = append(ids, *i.InstanceId)
+		}
+		return ids
+	}
 
-	assert.Lenf(filters, 3, "Filter slice was built incorrectly, got %d filters, expected 3", len(filters))
+	filters, _ := ParseFilters([]string{"env!=qa,dev"})
+	filtered, err := FilterInstances(&mocks.MockSSMClient{}, &mocks.MockEC2Client{}, filters, instances)
+	assert.NoError(err)
+	assert.Equal([]string{"i-456", "mi-123"}, ids(filtered))
+
+	filters, _ = ParseFilters([]string{"role=web-*"})
+	filtered, err = FilterInstances(&mocks.MockSSMClient{}, &mocks.MockEC2Client{}, filters, instances)
+	assert.NoError(err)
+	assert.Equal([]string{"mi-123"}, ids(filtered))
+
+	filters, _ = ParseFilters([]string{"attr:InstanceType=t3.*", "attr:State=running"})
+	filtered, err = FilterInstances(&mocks.MockSSMClient{}, &mocks.MockEC2Client{}, filters, instances)
+	assert.NoError(err)
+	assert.Equal([]string{"i-123"}, ids(filtered))
+
+	// Filters evaluated by the API don't need the tags of the instances
+	filters, _ = ParseFilters([]string{"env=prod"})
+	filtered, err = FilterInstances(nil, nil, filters, instances)
+	assert.NoError(err)
+	assert.Len(filtered, 4)
 }
 
 func TestNewSSMInstanceFilter(t *testing.T) {
@@ -1,11 +1,13 @@
 package ssm
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
@@ -18,12 +20,10 @@ import (
 )
 
 //CreateSSMDescribeInstanceInput returns an *ssm.DescribeInstanceInformationInput object for use when calling the DescribeInstanceInformation() method
-func CreateSSMDescribeInstanceInput(filters map[string]string, instances CommaSlice) *ssm.DescribeInstanceInformationInput {
-	var iisFilters []*ssm.InstanceInformationStringFilter
-
-	//if you have multiple filter groups, this drops all but the last
-	buildFilters(filters, &iisFilters)
+// The filters that the API can't evaluate are left out, and must be applied to the result with FilterInstances.
+func CreateSSMDescribeInstanceInput(filters Filters, instances CommaSlice) *ssm.DescribeInstanceInformationInput {
 	// Build our filters based on --filter and --instances flags
+	iisFilters := filters.InstanceInformationFilters()
 
 	if len(instances) > 0 {
 		AppendSSMFilter(&iisFilters, NewSSMInstanceFilter("InstanceIds", instances))
@@ -39,23 +39,12 @@ func CreateSSMDescribeInstanceInput(filters map[string]string, instances CommaSl
 	return ssmInput
 }
 
-func addInstanceInfo(instanceID *string, ec2Instance ec2.Instance, instancePool *instance.InstanceInfoSafe, profile string, region string) {
-	tags := make(map[string]string)
-	for _, tag := range ec2Instance.Tags {
-		tags[*tag.Key] = *tag.Value
-	}
-
+func addInstanceInfo(info *ssm.InstanceInformation, ec2Instance *ec2.Instance, instancePool *instance.InstanceInfoSafe, profile string, region string) {
 	instancePool.Lock()
 	defer instancePool.Unlock()
 
 	// If the instance is good, append its info to the master list
-	instancePool.AllInstances[*instanceID] = instance.InstanceInfo{
-		InstanceID: *instanceID,
-		Profile:    profile,
-		Region:     region,
-		Tags:       tags,
-		VpcId:      *ec2Instance.VpcId,
-	}
+	instancePool.AllInstances[*info.InstanceId] = instance.NewInstanceInfo(profile, region, info, ec2Instance)
 }
 
 func checkInvocationStatus(client ssmiface.SSMAPI, commandID *string) (done bool, err error) {
@@ -70,141 +59,279 @@ func checkInvocationStatus(client ssmiface.SSMAPI, commandID *string) (done bool
 		return true, fmt.Errorf("Incorrect number of invocations returned for given command ID; expected 1, got %d", len(invocation.Commands))
 	}
 
+	// Canceled commands are Cancelling until every invocation has been canceled
 	switch *invocation.Commands[0].Status {
-	case "Pending", "InProgress":
+	case "Pending", "InProgress", "Cancelling":
 		return false, nil
 	default:
 		return true, nil
 	}
 }
 
-// RunInvocations invokes an SSM document with given parameters on the provided slice of instances
-func RunInvocations(sess *session.Session, client ssmiface.SSMAPI, wg *sync.WaitGroup, input *ssm.SendCommandInput, results *invocation.ResultSafe) {
+// PollInterval is the delay between each check of the status of a running command
+var PollInterval = 2 * time.Second
+
+// CancelWaitTimeout is the maximum amount of time to wait for invocations to be canceled after calling CancelCommand
+var CancelWaitTimeout = 60 * time.Second
+
+// RunInvocations invokes an SSM document with given parameters on the provided slice of instances. The result
+// for each instance is sent to the results channel as soon as its invocation reaches a terminal state, and
+// the per-state invocation counts are reported to progress (if not nil) each time the command is polled.
+//
+// If ctx is canceled while the command is running, CancelCommand is called and polling continues until the
+// remaining invocations have been canceled, so that the results of instances that had already completed
+// are still reported. If the deadline of ctx is exceeded instead, polling stops and every unfinished
+// invocation is reported as having timed out.
+func RunInvocations(ctx context.Context, sess *session.Session, client ssmiface.SSMAPI, wg *sync.WaitGroup, input *ssm.SendCommandInput, results chan<- *invocation.Result, progress *invocation.Progress) {
 	defer wg.Done()
 	var scOutput *ssm.SendCommandOutput
 	var err error
 
-	// Send our command input to SSM
-	if scOutput, err = client.SendCommand(input); err != nil {
+	region := *sess.Session.Config.Region
+
+	// Don't start anything new if we've already been interrupted
+	if ctx.Err() != nil {
+		sendError(results, sess, fmt.Errorf("Command was not sent: %v", ctx.Err()))
+		return
+	}
+
+	// Send our command input to SSM. The command is still polled with the API calls that don't take ctx once it
+	// has been sent, as the invocations have to be followed until they are canceled.
+	if scOutput, err = client.SendCommandWithContext(ctx, input); err != nil {
 		sess.Logger.Error("Error when calling the SendCommand API")
-		addError(results, sess, err)
+		sendError(results, sess, err)
 		return
 	}
 
 	commandID := scOutput.Command.CommandId
-	sess.Logger.Infof("Started invocation %v for %v in %v", *commandID, sess.ProfileName, *sess.Session.Config.Region)
+	sess.Logger.Infof("Started invocation %v for %v in %v", *commandID, sess.ProfileName, region)
 
-	// Watch status of invocation to see when it's done and we can get the output
-	for done := false; !done; time.Sleep(2 * time.Second) {
-		if done, err = checkInvocationStatus(client, commandID); err != nil {
-			addError(results, sess, err)
-			return
-		}
-	}
+	// Instances whose results have already been sent
+	seen := make(map[string]bool)
+
+	// Set once the command has been canceled
+	var cancelDeadline time.Time
 
-	// Set up our channels and LCI input object
+	// Set up our channels for fetching invocation output
 	oc := make(chan *ssm.GetCommandInvocationOutput)
 	ec := make(chan error)
-	lciInput := &ssm.ListCommandInvocationsInput{
-		CommandId: commandID,
-	}
 
-	// Iterate through the details of the invocations returned
-	if err = client.ListCommandInvocationsPages(
-		lciInput,
-		func(page *ssm.ListCommandInvocationsOutput, lastPage bool) bool {
-			for _, entry := range page.CommandInvocations {
-				// Fetch the results of our invocation for all provided instances
-				go invocation.GetResult(client, commandID, entry.InstanceId, oc, ec)
-
-				// Wait for results to return until the combined total of results and errors
-				select {
-				case result := <-oc:
-					addInvocationResults(results, sess, result)
-				case err := <-ec:
-					addError(results, sess, err)
+	for {
+		// Check the status of the command before listing its invocations, so that the last pass
+		// through the invocation list is guaranteed to see every invocation in a terminal state
+		done, err := checkInvocationStatus(client, commandID)
+		if err != nil {
+			sendError(results, sess, err)
+			return
+		}
+
+		var counts invocation.Counts
+		var unfinished []*ssm.CommandInvocation
+		lciInput := &ssm.ListCommandInvocationsInput{
+			CommandId: commandID,
+		}
+
+		// Iterate through the details of the invocations returned
+		if err = client.ListCommandInvocationsPages(
+			lciInput,
+			func(page *ssm.ListCommandInvocationsOutput, lastPage bool) bool {
+				for _, entry := range page.CommandInvocations {
+					status := aws.StringValue(entry.Status)
+					counts.Add(status)
+
+					if !invocation.IsTerminal(status) {
+						unfinished = append(unfinished, entry)
+						continue
+					}
+
+					if seen[*entry.InstanceId] {
+						continue
+					}
+					seen[*entry.InstanceId] = true
+
+					// Fetch the results of our invocation for the finished instance
+					go invocation.GetResult(client, commandID, entry.InstanceId, oc, ec)
+
+					select {
+					case result := <-oc:
+						sendInvocationResult(results, sess, result)
+					case err := <-ec:
+						sendInstanceError(results, sess, entry, err)
+					}
 				}
-			}
 
-			// Last page, break out
-			if page.NextToken == nil {
-				return false
+				// If it's not the last page, continue
+				return !lastPage
+			}); err != nil {
+			sess.Logger.Error("Error when calling ListCommandInvocations API")
+			sendError(results, sess, err)
+			return
+		}
+
+		if progress != nil {
+			progress.Update(fmt.Sprintf("%s@%s", sess.ProfileName, region), counts)
+		}
+
+		// Once the command has been canceled, polling continues until every invocation has reached its final state
+		if done && (cancelDeadline.IsZero() || len(unfinished) == 0) {
+			return
+		}
+
+		if cancelDeadline.IsZero() {
+			select {
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					sess.Logger.Errorf("Deadline exceeded while waiting for invocation %v for %v in %v", *commandID, sess.ProfileName, region)
+					sendTimedOut(results, sess, unfinished)
+					return
+				}
+
+				sess.Logger.Warnf("Canceling invocation %v for %v in %v", *commandID, sess.ProfileName, region)
+				if _, err = client.CancelCommand(&ssm.CancelCommandInput{CommandId: commandID}); err != nil {
+					sess.Logger.Errorf("Error when calling the CancelCommand API for invocation %v\n%v", *commandID, err)
+					sendError(results, sess, err)
+					return
+				}
+				cancelDeadline = time.Now().Add(CancelWaitTimeout)
+			case <-time.After(PollInterval):
 			}
+			continue
+		}
 
-			lciInput.SetNextToken(*page.NextToken)
-			return true
-		}); err != nil {
-		sess.Logger.Error("Error when calling ListCommandInvocations API")
-		addError(results, sess, err)
+		// Wait for the canceled invocations to reach their final state
+		if time.Now().After(cancelDeadline) {
+			sess.Logger.Errorf("Timed out waiting for invocation %v to be canceled for %v in %v", *commandID, sess.ProfileName, region)
+			return
+		}
+		time.Sleep(PollInterval)
 	}
 }
 
-func addInvocationResults(results *invocation.ResultSafe, session *session.Session, info ...*ssm.GetCommandInvocationOutput) {
-	var newResults []*invocation.Result
-	for _, v := range info {
-		results.Add(&invocation.Result{
-			InvocationResult: v,
-			ProfileName:      session.ProfileName,
-			Region:           *session.Session.Config.Region,
-			Status:           invocation.Status(*v.StatusDetails),
-		})
+func sendInvocationResult(results chan<- *invocation.Result, session *session.Session, info *ssm.GetCommandInvocationOutput) {
+	result := &invocation.Result{
+		InvocationResult: info,
+		ProfileName:      session.ProfileName,
+		Region:           *session.Session.Config.Region,
+		Status:           invocation.Status(*info.StatusDetails),
 	}
+	result.Truncated = result.IsTruncated()
+
+	results <- result
+}
+
+// sendTimedOut reports each of the provided unfinished invocations as timed out. Invocations that were
+// never delivered are reported as delivery timeouts, all others as execution timeouts.
+func sendTimedOut(results chan<- *invocation.Result, session *session.Session, unfinished []*ssm.CommandInvocation) {
+	for _, entry := range unfinished {
+		status := invocation.CommandExecutionTimedOut
+		switch aws.StringValue(entry.Status) {
+		case "Pending", "Delayed":
+			status = invocation.CommandDeliveryTimedOut
+		}
 
-	results.Lock()
-	results.InvocationResults = append(results.InvocationResults, newResults...)
-	results.Unlock()
+		results <- &invocation.Result{
+			InvocationResult: &ssm.GetCommandInvocationOutput{
+				CommandId:     entry.CommandId,
+				InstanceId:    entry.InstanceId,
+				Status:        entry.Status,
+				StatusDetails: aws.String(string(status)),
+			},
+			ProfileName: session.ProfileName,
+			Region:      *session.Session.Config.Region,
+			Status:      status,
+			Error:       fmt.Errorf("Deadline exceeded before the invocation reached a final state (last status: %s)", aws.StringValue(entry.Status)),
+		}
+	}
 }
 
-func addError(results *invocation.ResultSafe, session *session.Session, err error) {
-	results.Add(&invocation.Result{
+// sendInstanceError reports an error that prevented the result of a single invocation from being retrieved
+func sendInstanceError(results chan<- *invocation.Result, session *session.Session, entry *ssm.CommandInvocation, err error) {
+	results <- &invocation.Result{
+		InvocationResult: &ssm.GetCommandInvocationOutput{
+			CommandId:  entry.CommandId,
+			InstanceId: entry.InstanceId,
+			Status:     entry.Status,
+		},
 		ProfileName: session.ProfileName,
 		Region:      *session.Session.Config.Region,
 		Status:      invocation.ClientError,
 		Error:       err,
-	})
+	}
 }
 
-// CheckInstanceReadiness iterates through a list of instances and verifies whether or not it is start-session capable. If it is, it appends the instance info to an instances.InstanceInfoSafe slice.
-func CheckInstanceReadiness(session *session.Session, client ssmiface.SSMAPI, instanceList []*ssm.InstanceInformation, limit int, readyInstancePool *instance.InstanceInfoSafe) {
-	var readyInstances, ec2Instances []*string
-	var instanceCount int
+func sendError(results chan<- *invocation.Result, session *session.Session, err error) {
+	results <- &invocation.Result{
+		ProfileName: session.ProfileName,
+		Region:      *session.Session.Config.Region,
+		Status:      invocation.ClientError,
+		Error:       err,
+	}
+}
 
-	for _, instance := range instanceList {
-		if instanceCount >= limit {
-			continue
-		}
+// ReadinessConcurrency is the number of instances of a session whose readiness is checked at once
+var ReadinessConcurrency = 5
 
-		// Check and see if our instance supports start-session
-		ready, err := startsession.CheckSessionReadiness(client, instance.InstanceId)
-		if !ready && err != nil {
-			session.Logger.Error(fmt.Errorf("Error when trying to check session readiness for instance %v\n%v", *instance.InstanceId, err))
-			return
+// CheckInstanceReadiness iterates through a list of instances and verifies whether or not it is start-session capable. If it is, it appends the instance info to an instances.InstanceInfoSafe slice.
+// At most limit instances are added, the first ones of the list that are ready. Instances whose readiness could not be checked are logged and skipped.
+func CheckInstanceReadiness(session *session.Session, client ssmiface.SSMAPI, instanceList []*ssm.InstanceInformation, limit int, readyInstancePool *instance.InstanceInfoSafe) {
+	var readyInstances []*ssm.InstanceInformation
+	var ec2Instances []*string
+
+	// Check the instances in chunks, so that no more of them are checked than needed to reach the limit
+	ready := make([]bool, len(instanceList))
+	for start := 0; start < len(instanceList) && len(readyInstances) < limit; start += ReadinessConcurrency {
+		end := start + ReadinessConcurrency
+		if end > len(instanceList) {
+			end = len(instanceList)
 		}
 
-		// Instances that are verified as being ready for sessions
-		readyInstances = append(readyInstances, instance.InstanceId)
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
 
-		// EC2 instances are all non-managed, so let's create a slice of instances that have fetchable tags
-		if !strings.HasPrefix(*instance.InstanceId, "mi-") {
-			ec2Instances = append(ec2Instances, instance.InstanceId)
+				// Check and see if our instance supports start-session
+				ok, err := startsession.CheckSessionReadiness(client, instanceList[i].InstanceId)
+				if err != nil {
+					session.Logger.Error(fmt.Errorf("Error when trying to check session readiness for instance %v\n%v", *instanceList[i].InstanceId, err))
+				}
+				ready[i] = ok
+			}(i)
 		}
+		wg.Wait()
 
-		instanceCount++
-	}
+		for i := start; i < end && len(readyInstances) < limit; i++ {
+			if !ready[i] {
+				continue
+			}
 
-	// If the instance is good, let's get the tags to display during instance selection
-	ec2Client := ec2.New(session.Session)
-	instanceInfo, err := ec2helpers.GetEC2InstanceInfo(ec2Client, ec2Instances)
-	if err != nil {
-		session.Logger.Error(err)
+			// Instances that are verified as being ready for sessions
+			readyInstances = append(readyInstances, instanceList[i])
+
+			// EC2 instances are all non-managed, so let's create a slice of instances that have fetchable tags
+			if !strings.HasPrefix(*instanceList[i].InstanceId, "mi-") {
+				ec2Instances = append(ec2Instances, instanceList[i].InstanceId)
+			}
+		}
 	}
 
-	if limit > len(readyInstances) {
-		limit = len(readyInstances)
+	// If the instance is good, let's get its tags and EC2 attributes to display during instance selection
+	ec2Info := make(map[string]*ec2.Instance)
+	if len(ec2Instances) > 0 {
+		described, err := ec2helpers.GetEC2InstanceInfo(ec2.New(session.Session), ec2Instances)
+		if err != nil {
+			session.Logger.Error(err)
+		}
+		for _, i := range described {
+			if i != nil {
+				ec2Info[*i.InstanceId] = i
+			}
+		}
 	}
 
-	for idx, i := range readyInstances[:limit] {
+	for _, i := range readyInstances {
 		// Append our instance info to the master list
-		addInstanceInfo(i, *instanceInfo[idx], readyInstancePool, session.ProfileName, *session.Session.Config.Region)
+		addInstanceInfo(i, ec2Info[*i.InstanceId], readyInstancePool, session.ProfileName, *session.Session.Config.Region)
 	}
 }
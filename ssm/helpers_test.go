@@ -1,23 +1,34 @@
 package ssm
 
 import (
+	"context"
+	"io/ioutil"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/disneystreaming/ssm-helpers/aws/session"
 	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
 )
 
 func TestCreateSSMDescribeInstanceInput(t *testing.T) {
 	assert := assert.New(t)
 
-	filters := map[string]string{
-		"foo": "1",
-		"bar": "2",
-		"baz": "3",
+	filters := Filters{
+		{Key: "foo", Values: []string{"1"}},
+		{Key: "bar", Values: []string{"2", "3"}},
+		{Key: "baz", Operator: FilterNotEquals, Values: []string{"3"}},
+		{Key: "qux", Operator: FilterExists},
 	}
 
 	instances := &CommaSlice{"i-12345", "i-67890"}
@@ -25,7 +36,7 @@ func TestCreateSSMDescribeInstanceInput(t *testing.T) {
 	instanceInput := CreateSSMDescribeInstanceInput(filters, *instances)
 
 	// Ensure that appending of filters is working correctly for multiple tags
-	assert.Lenf(instanceInput.Filters, 4, "Filter slice has wrong number of entries, got %d, expected 4 items (instance IDs + all tags)", len(instanceInput.Filters))
+	assert.Lenf(instanceInput.Filters, 4, "Filter slice has wrong number of entries, got %d, expected 4 items (instance IDs + tags evaluated by the API)", len(instanceInput.Filters))
 
 	// Ensure that MaxResults is set to 50, which is the maximum number of results returned per page
 	assert.Equalf(*instanceInput.MaxResults, int64(50), "MaxResults was not set to the correct value, got %d, expected 50", *instanceInput.MaxResults)
@@ -51,10 +62,16 @@ func TestAddInstanceInfo(t *testing.T) {
 		cleanedTags[*tag.Key] = *tag.Value
 	}
 
-	dummyInstance := ec2.Instance{
-		InstanceId: aws.String(id),
-		Tags:       tags,
-		VpcId:      aws.String("vpc-123"),
+	dummyInstance := &ec2.Instance{
+		InstanceId:   aws.String(id),
+		Tags:         tags,
+		VpcId:        aws.String("vpc-123"),
+		InstanceType: aws.String("t3.micro"),
+		State:        &ec2.InstanceState{Name: aws.String("running")},
+	}
+	info := &ssm.InstanceInformation{
+		InstanceId:   aws.String(id),
+		PlatformName: aws.String("Ubuntu"),
 	}
 
 	// Initialize our mutex-safe map
@@ -62,7 +79,7 @@ func TestAddInstanceInfo(t *testing.T) {
 		AllInstances: map[string]instance.InstanceInfo{},
 	}
 
-	addInstanceInfo(aws.String(id), dummyInstance, ip, "testprofile", "us-east-1")
+	addInstanceInfo(info, dummyInstance, ip, "testprofile", "us-east-1")
 
 	assert.Equalf(
 		ip.AllInstances[id].InstanceID, id,
@@ -72,4 +89,214 @@ func TestAddInstanceInfo(t *testing.T) {
 
 	assert.True(reflect.DeepEqual(ip.AllInstances[id].Tags, cleanedTags))
 
+	// Both the SSM and EC2 attributes of the instance are kept
+	assert.Equal("Ubuntu", ip.AllInstances[id].PlatformName)
+	assert.Equal("t3.micro", ip.AllInstances[id].InstanceType)
+	assert.Equal("running", ip.AllInstances[id].State)
+
+}
+
+func TestRunInvocations(t *testing.T) {
+	assert := assert.New(t)
+
+	PollInterval = time.Millisecond
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	sess := &session.Session{
+		Logger:      logger,
+		ProfileName: "testprofile",
+		Session:     awssession.Must(awssession.NewSession(&aws.Config{Region: aws.String("us-east-1")})),
+	}
+
+	mockSvc := &mocks.MockSSMInvocationClient{
+		Instances: []string{"i-123", "i-456", "i-789"},
+		Statuses:  map[string]string{"i-456": "Failed"},
+	}
+
+	var wg sync.WaitGroup
+	results, progress := make(chan *invocation.Result), invocation.NewProgress()
+
+	wg.Add(1)
+	go func() {
+		RunInvocations(context.Background(), sess, mockSvc, &wg, &ssm.SendCommandInput{}, results, progress)
+		close(results)
+	}()
+
+	var received []string
+	statuses := make(map[string]invocation.Status)
+	for r := range results {
+		received = append(received, *r.InvocationResult.InstanceId)
+		statuses[*r.InvocationResult.InstanceId] = r.Status
+	}
+	wg.Wait()
+
+	// Results should be streamed in the order that each instance finished
+	assert.Equal([]string{"i-123", "i-456", "i-789"}, received)
+	assert.Equal(invocation.CommandSuccess, statuses["i-123"])
+	assert.Equal(invocation.CommandFailed, statuses["i-456"])
+	assert.Equal("testprofile@us-east-1: 0 pending, 0 in progress, 2 success, 1 failed", progress.String())
+}
+
+func TestRunInvocationsCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	PollInterval = time.Millisecond
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	sess := &session.Session{
+		Logger:      logger,
+		ProfileName: "testprofile",
+		Session:     awssession.Must(awssession.NewSession(&aws.Config{Region: aws.String("us-east-1")})),
+	}
+
+	mockSvc := &mocks.MockSSMInvocationClient{
+		Instances: []string{"i-1", "i-2", "i-3", "i-4", "i-5", "i-6", "i-7", "i-8", "i-9", "i-10"},
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan *invocation.Result)
+
+	wg.Add(1)
+	go func() {
+		RunInvocations(ctx, sess, mockSvc, &wg, &ssm.SendCommandInput{}, results, nil)
+		close(results)
+	}()
+
+	// Interrupt the command as soon as the first instance completes
+	statuses := make(map[invocation.Status]int)
+	for r := range results {
+		cancel()
+		statuses[r.Status]++
+	}
+	wg.Wait()
+
+	// The instances that were canceled are reported once the command is no longer Cancelling
+	assert.Equal([]string{"running-id"}, mockSvc.CanceledCommands)
+	assert.GreaterOrEqual(statuses[invocation.CommandSuccess], 1)
+	assert.Less(statuses[invocation.CommandSuccess], 10)
+	assert.GreaterOrEqual(statuses[invocation.CommandCanceled], 1)
+	assert.Equal(10, statuses[invocation.CommandSuccess]+statuses[invocation.CommandCanceled])
+
+	t.Run("cancel timeout", func(t *testing.T) {
+		CancelWaitTimeout = 5 * time.Millisecond
+		defer func() { CancelWaitTimeout = 60 * time.Second }()
+
+		mockSvc := &mocks.MockSSMInvocationClient{
+			Instances:       []string{"i-1", "i-2", "i-3"},
+			CancellingPolls: 1000000,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		results := make(chan *invocation.Result)
+
+		wg.Add(1)
+		go func() {
+			RunInvocations(ctx, sess, mockSvc, &wg, &ssm.SendCommandInput{}, results, nil)
+			close(results)
+		}()
+
+		// Polling stops once the invocations have been Cancelling for longer than CancelWaitTimeout
+		var received int
+		for range results {
+			cancel()
+			received++
+		}
+		wg.Wait()
+
+		assert.Equal(1, received)
+		assert.Equal([]string{"running-id"}, mockSvc.CanceledCommands)
+	})
+
+	t.Run("already interrupted", func(t *testing.T) {
+		results := make(chan *invocation.Result, 1)
+		wg.Add(1)
+		RunInvocations(ctx, sess, mockSvc, &wg, &ssm.SendCommandInput{}, results, nil)
+
+		r := <-results
+		assert.Equal(invocation.ClientError, r.Status)
+	})
+}
+
+func TestRunInvocationsDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	PollInterval = time.Millisecond
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	sess := &session.Session{
+		Logger:      logger,
+		ProfileName: "testprofile",
+		Session:     awssession.Must(awssession.NewSession(&aws.Config{Region: aws.String("us-east-1")})),
+	}
+
+	mockSvc := &mocks.MockSSMInvocationClient{
+		Instances: []string{"i-1", "i-2", "i-3", "i-4", "i-5", "i-6", "i-7", "i-8", "i-9", "i-10"},
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Millisecond)
+	defer cancel()
+	results := make(chan *invocation.Result)
+
+	wg.Add(1)
+	go func() {
+		RunInvocations(ctx, sess, mockSvc, &wg, &ssm.SendCommandInput{}, results, nil)
+		close(results)
+	}()
+
+	statuses := make(map[invocation.Status]int)
+	for r := range results {
+		statuses[r.Status]++
+		if r.Status == invocation.CommandExecutionTimedOut {
+			assert.Error(r.Error)
+		}
+	}
+	wg.Wait()
+
+	// Every instance is reported, and those still running when the deadline passed are marked as timed out
+	assert.Empty(mockSvc.CanceledCommands)
+	assert.GreaterOrEqual(statuses[invocation.CommandExecutionTimedOut], 1)
+	assert.Equal(10, statuses[invocation.CommandSuccess]+statuses[invocation.CommandExecutionTimedOut])
+}
+
+func TestCheckInstanceReadiness(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(n int) { ReadinessConcurrency = n }(ReadinessConcurrency)
+	ReadinessConcurrency = 2
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	sess := &session.Session{
+		Logger:      logger,
+		ProfileName: "testprofile",
+		Session:     awssession.Must(awssession.NewSession(&aws.Config{Region: aws.String("us-east-1")})),
+	}
+
+	var instances []*ssm.InstanceInformation
+	for _, id := range []string{"mi-1", "mi-2-offline", "mi-3-throttled", "mi-4", "mi-5"} {
+		instances = append(instances, &ssm.InstanceInformation{InstanceId: aws.String(id)})
+	}
+
+	// Instances that are offline or whose check failed are skipped, and no more than limit are added
+	pool := &instance.InstanceInfoSafe{AllInstances: make(map[string]instance.InstanceInfo)}
+	CheckInstanceReadiness(sess, &mocks.MockSSMClient{}, instances, 2, pool)
+
+	var ids []string
+	for id := range pool.AllInstances {
+		ids = append(ids, id)
+	}
+	assert.ElementsMatch([]string{"mi-1", "mi-4"}, ids)
+
+	// A higher limit picks up the rest of the ready instances
+	pool = &instance.InstanceInfoSafe{AllInstances: make(map[string]instance.InstanceInfo)}
+	CheckInstanceReadiness(sess, &mocks.MockSSMClient{}, instances, 10, pool)
+	assert.Len(pool.AllInstances, 3)
 }
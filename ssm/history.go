@@ -0,0 +1,171 @@
+package ssm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+)
+
+// requesterPrefix is the start of the comment set on commands sent by ssm run, followed by the requesting user
+const requesterPrefix = "ssm-helpers run by "
+
+// maxCommentLength is the maximum length of the comment of a command accepted by the SendCommand API
+const maxCommentLength = 100
+
+// RequesterComment returns the comment to set on a command to record the user that requested it
+func RequesterComment(user string) string {
+	comment := requesterPrefix + user
+	if len(comment) > maxCommentLength {
+		comment = comment[:maxCommentLength]
+	}
+
+	return comment
+}
+
+// CommentRequester returns the user recorded in the comment of a command by RequesterComment,
+// or an empty string if the command was not sent by ssm run
+func CommentRequester(comment string) string {
+	if !strings.HasPrefix(comment, requesterPrefix) {
+		return ""
+	}
+
+	return strings.TrimPrefix(comment, requesterPrefix)
+}
+
+// CommandFilter selects the commands returned by ListCommands. Zero values match every command.
+type CommandFilter struct {
+	// Statuses are the ListCommands statuses to match, e.g. Success or Failed
+	Statuses []string
+
+	// Document is the name of the document the command ran
+	Document string
+
+	// After and Before bound the time the command was requested at
+	After  time.Time
+	Before time.Time
+
+	// Requester matches the user recorded in the comment of the command by ssm run
+	Requester string
+}
+
+// listCommandsInput returns the input for the ListCommands API, with every filter it supports set
+func (f CommandFilter) listCommandsInput() *ssm.ListCommandsInput {
+	input := &ssm.ListCommandsInput{}
+
+	addFilter := func(key, value string) {
+		input.Filters = append(input.Filters, &ssm.CommandFilter{Key: aws.String(key), Value: aws.String(value)})
+	}
+
+	if f.Document != "" {
+		addFilter(ssm.CommandFilterKeyDocumentName, f.Document)
+	}
+	if !f.After.IsZero() {
+		addFilter(ssm.CommandFilterKeyInvokedAfter, f.After.UTC().Format(time.RFC3339))
+	}
+	if !f.Before.IsZero() {
+		addFilter(ssm.CommandFilterKeyInvokedBefore, f.Before.UTC().Format(time.RFC3339))
+	}
+
+	// The API only accepts a single value per filter, so multiple statuses are matched by Match instead
+	if len(f.Statuses) == 1 {
+		addFilter(ssm.CommandFilterKeyStatus, f.Statuses[0])
+	}
+
+	return input
+}
+
+// Match returns whether the command matches the filters that cannot be evaluated by the ListCommands API
+func (f CommandFilter) Match(c *ssm.Command) bool {
+	if len(f.Statuses) > 1 {
+		matched := false
+		for _, s := range f.Statuses {
+			matched = matched || strings.EqualFold(s, aws.StringValue(c.Status))
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if f.Requester != "" {
+		return strings.EqualFold(f.Requester, CommentRequester(aws.StringValue(c.Comment)))
+	}
+
+	return true
+}
+
+// ListCommands returns up to limit of the most recent commands matching the filter, or every matching command if limit is 0
+func ListCommands(client ssmiface.SSMAPI, filter CommandFilter, limit int) (commands []*ssm.Command, err error) {
+	if err = client.ListCommandsPages(
+		filter.listCommandsInput(),
+		func(page *ssm.ListCommandsOutput, lastPage bool) bool {
+			for _, c := range page.Commands {
+				if !filter.Match(c) {
+					continue
+				}
+
+				commands = append(commands, c)
+				if limit > 0 && len(commands) >= limit {
+					return false
+				}
+			}
+
+			// If it's not the last page, continue
+			return !lastPage
+		}); err != nil {
+		return nil, fmt.Errorf("Could not list commands\n%v", err)
+	}
+
+	return commands, nil
+}
+
+// GetCommand returns the command with the given ID, or nil if it does not exist in the account and region of the client
+func GetCommand(client ssmiface.SSMAPI, commandID string) (*ssm.Command, error) {
+	out, err := client.ListCommands(&ssm.ListCommandsInput{CommandId: aws.String(commandID)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeInvalidCommandId {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve command %s\n%v", commandID, err)
+	}
+
+	if len(out.Commands) == 0 {
+		return nil, nil
+	}
+
+	return out.Commands[0], nil
+}
+
+// SendCommandResults sends the result of every invocation of an existing command to the results channel,
+// whether or not the invocation has reached a terminal state
+func SendCommandResults(sess *session.Session, client ssmiface.SSMAPI, commandID string, results chan<- *invocation.Result) {
+	oc := make(chan *ssm.GetCommandInvocationOutput)
+	ec := make(chan error)
+
+	if err := client.ListCommandInvocationsPages(
+		&ssm.ListCommandInvocationsInput{CommandId: aws.String(commandID)},
+		func(page *ssm.ListCommandInvocationsOutput, lastPage bool) bool {
+			for _, entry := range page.CommandInvocations {
+				go invocation.GetResult(client, entry.CommandId, entry.InstanceId, oc, ec)
+
+				select {
+				case result := <-oc:
+					sendInvocationResult(results, sess, result)
+				case err := <-ec:
+					sendInstanceError(results, sess, entry, err)
+				}
+			}
+
+			// If it's not the last page, continue
+			return !lastPage
+		}); err != nil {
+		sendError(results, sess, fmt.Errorf("Could not list the invocations of command %s\n%v", commandID, err))
+	}
+}
@@ -0,0 +1,137 @@
+package ssm
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+)
+
+func testCommands() []*ssm.Command {
+	return []*ssm.Command{
+		{
+			CommandId:    aws.String("command-1"),
+			DocumentName: aws.String("AWS-RunShellScript"),
+			Status:       aws.String("Success"),
+			Comment:      aws.String(RequesterComment("alice")),
+		},
+		{
+			CommandId:    aws.String("command-2"),
+			DocumentName: aws.String("AWS-RunShellScript"),
+			Status:       aws.String("Failed"),
+			Comment:      aws.String(RequesterComment("bob")),
+		},
+		{
+			CommandId:    aws.String("command-3"),
+			DocumentName: aws.String("AWS-ApplyPatchBaseline"),
+			Status:       aws.String("TimedOut"),
+		},
+	}
+}
+
+func TestRequesterComment(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("alice", CommentRequester(RequesterComment("alice")))
+	assert.Equal("", CommentRequester("some other comment"))
+	assert.Len(RequesterComment(string(make([]byte, 200))), maxCommentLength)
+}
+
+func TestCommandFilterInput(t *testing.T) {
+	assert := assert.New(t)
+
+	after := time.Date(2020, 3, 5, 17, 0, 0, 0, time.UTC)
+	input := CommandFilter{Statuses: []string{"Failed"}, Document: "AWS-RunShellScript", After: after}.listCommandsInput()
+
+	filters := make(map[string]string)
+	for _, f := range input.Filters {
+		filters[*f.Key] = *f.Value
+	}
+	assert.Equal(map[string]string{
+		ssm.CommandFilterKeyDocumentName: "AWS-RunShellScript",
+		ssm.CommandFilterKeyInvokedAfter: "2020-03-05T17:00:00Z",
+		ssm.CommandFilterKeyStatus:       "Failed",
+	}, filters)
+
+	// Multiple statuses can't be passed to the API
+	input = CommandFilter{Statuses: []string{"Failed", "TimedOut"}}.listCommandsInput()
+	assert.Empty(input.Filters)
+}
+
+func TestListCommands(t *testing.T) {
+	assert := assert.New(t)
+	mockSvc := &mocks.MockSSMHistoryClient{Commands: testCommands()}
+
+	ids := func(commands []*ssm.Command) (ids []string) {
+		for _, c := range commands {
+			ids = append(ids, *c.CommandId)
+		}
+		return ids
+	}
+
+	commands, err := ListCommands(mockSvc, CommandFilter{}, 0)
+	assert.NoError(err)
+	assert.Equal([]string{"command-1", "command-2", "command-3"}, ids(commands))
+
+	commands, err = ListCommands(mockSvc, CommandFilter{}, 2)
+	assert.NoError(err)
+	assert.Equal([]string{"command-1", "command-2"}, ids(commands))
+
+	commands, err = ListCommands(mockSvc, CommandFilter{Statuses: []string{"failed", "timedout"}}, 0)
+	assert.NoError(err)
+	assert.Equal([]string{"command-2", "command-3"}, ids(commands))
+
+	commands, err = ListCommands(mockSvc, CommandFilter{Document: "AWS-RunShellScript", Requester: "bob"}, 0)
+	assert.NoError(err)
+	assert.Equal([]string{"command-2"}, ids(commands))
+}
+
+func TestGetCommand(t *testing.T) {
+	assert := assert.New(t)
+	mockSvc := &mocks.MockSSMHistoryClient{Commands: testCommands()}
+
+	command, err := GetCommand(mockSvc, "command-2")
+	assert.NoError(err)
+	assert.Equal("Failed", *command.Status)
+
+	command, err = GetCommand(mockSvc, "missing")
+	assert.NoError(err)
+	assert.Nil(command)
+}
+
+func TestSendCommandResults(t *testing.T) {
+	assert := assert.New(t)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	sess := &session.Session{
+		Logger:      logger,
+		ProfileName: "testprofile",
+		Session:     awssession.Must(awssession.NewSession(&aws.Config{Region: aws.String("us-east-1")})),
+	}
+
+	mockSvc := &mocks.MockSSMInvocationClient{Instances: []string{"i-123", "i-456"}}
+
+	results := make(chan *invocation.Result)
+	go func() {
+		SendCommandResults(sess, mockSvc, "running-id", results)
+		close(results)
+	}()
+
+	var received []string
+	for r := range results {
+		received = append(received, r.InstanceID())
+		assert.Equal("testprofile", r.ProfileName)
+	}
+	assert.Equal([]string{"i-123", "i-456"}, received)
+}
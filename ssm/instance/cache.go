@@ -0,0 +1,171 @@
+package instance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/disneystreaming/ssm-helpers/util"
+)
+
+// DefaultCacheTTL is how long the cached instances of a profile/region combination are used as they are,
+// before they are refreshed in the background
+var DefaultCacheTTL = 10 * time.Minute
+
+// MaxCacheAge is how old cached instances can get before they are no longer used at all, and are looked up again
+// before returning
+var MaxCacheAge = 24 * time.Hour
+
+// cacheEntry is the cached list of instances of a single profile/region combination
+type cacheEntry struct {
+	Instances []InstanceInfo `json:"instances"`
+	Updated   time.Time      `json:"updated"`
+}
+
+// DefaultCacheDir returns the directory the instances of each profile/region combination are cached in by default
+func DefaultCacheDir() (string, error) {
+	dir, err := util.CacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "instances"), nil
+}
+
+// Cache stores the instances of each profile/region combination on disk, so that they don't have to be looked up
+// again each time they are needed
+type Cache struct {
+	Logger *logrus.Logger
+
+	// Dir is the directory the instances are cached in, with a file for each profile/region combination
+	Dir string
+
+	// TTL is how long cached instances are used before they are refreshed in the background
+	TTL time.Duration
+
+	// Refresh ignores the cached instances, always looking them up again
+	Refresh bool
+
+	now     func() time.Time
+	pending sync.WaitGroup
+}
+
+// NewCache returns a Cache of the instances in dir, which are refreshed once they are older than ttl
+func NewCache(dir string, ttl time.Duration, logger *logrus.Logger) *Cache {
+	return &Cache{Logger: logger, Dir: dir, TTL: ttl, now: time.Now}
+}
+
+// Get returns the instances of the profile/region combination. Instances cached within the TTL are returned as
+// they are, and older ones are returned while fetch looks them up again in the background, see Wait. If none are
+// cached, or they are older than MaxCacheAge, they are looked up with fetch before returning.
+func (c *Cache) Get(profile, region string, fetch func() ([]InstanceInfo, error)) ([]InstanceInfo, error) {
+	if !c.Refresh {
+		if entry, ok := c.load(profile, region); ok {
+			age := c.now().Sub(entry.Updated)
+			if age < c.TTL {
+				return entry.Instances, nil
+			}
+			if age < MaxCacheAge {
+				c.pending.Add(1)
+				go func() {
+					defer c.pending.Done()
+					if _, err := c.update(profile, region, fetch); err != nil {
+						c.Logger.Debugf("Could not refresh the cached instances of %s in %s: %v", profile, region, err)
+					}
+				}()
+
+				return entry.Instances, nil
+			}
+		}
+	}
+
+	return c.update(profile, region, fetch)
+}
+
+// Wait blocks until the instances being refreshed in the background have been cached
+func (c *Cache) Wait() {
+	c.pending.Wait()
+}
+
+// Invalidate removes the cached instances of the profile/region combination, e.g. after failing to connect to one
+// of them, so that they are looked up again next time
+func (c *Cache) Invalidate(profile, region string) error {
+	if err := os.Remove(c.path(profile, region)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove instance cache %s\n%v", c.path(profile, region), err)
+	}
+
+	return nil
+}
+
+// update looks up the instances of the profile/region combination with fetch, and caches them
+func (c *Cache) update(profile, region string, fetch func() ([]InstanceInfo, error)) ([]InstanceInfo, error) {
+	instances, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.save(profile, region, cacheEntry{Instances: instances, Updated: c.now().UTC()}); err != nil {
+		// The instances can still be used, they will be looked up again next time
+		c.Logger.Warn(err)
+	}
+
+	return instances, nil
+}
+
+// path returns the file the instances of the profile/region combination are cached in
+func (c *Cache) path(profile, region string) string {
+	return filepath.Join(c.Dir, url.QueryEscape(profile)+"@"+url.QueryEscape(region)+".json")
+}
+
+// load returns the cached instances of the profile/region combination, if they can be read
+func (c *Cache) load(profile, region string) (entry cacheEntry, ok bool) {
+	data, err := ioutil.ReadFile(c.path(profile, region))
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		c.Logger.Debugf("Ignoring invalid instance cache %s: %v", c.path(profile, region), err)
+		return entry, false
+	}
+
+	return entry, true
+}
+
+// save caches the instances of the profile/region combination. The file is replaced in a single step, as other
+// invocations may be reading or refreshing it at the same time.
+func (c *Cache) save(profile, region string, entry cacheEntry) error {
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return fmt.Errorf("Could not create cache directory %s\n%v", c.Dir, err)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(c.Dir, ".instances-*")
+	if err != nil {
+		return fmt.Errorf("Could not write instance cache %s\n%v", c.path(profile, region), err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(profile, region))
+	}
+	if err != nil {
+		return fmt.Errorf("Could not write instance cache %s\n%v", c.path(profile, region), err)
+	}
+
+	return nil
+}
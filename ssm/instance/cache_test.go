@@ -0,0 +1,93 @@
+package instance
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	assert := assert.New(t)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	c := NewCache(t.TempDir(), 10*time.Minute, logger)
+	c.now = func() time.Time { return now }
+
+	calls := 0
+	fetch := func(id string) func() ([]InstanceInfo, error) {
+		return func() ([]InstanceInfo, error) {
+			calls++
+			return []InstanceInfo{{InstanceID: id, Profile: "profile1", Region: "us-east-1"}}, nil
+		}
+	}
+
+	// Nothing is cached yet, so the instances are looked up
+	instances, err := c.Get("profile1", "us-east-1", fetch("i-123"))
+	assert.NoError(err)
+	assert.Equal("i-123", instances[0].InstanceID)
+	assert.Equal(1, calls)
+
+	// Within the TTL, the cached instances are used
+	now = now.Add(5 * time.Minute)
+	instances, err = c.Get("profile1", "us-east-1", fetch("i-456"))
+	assert.NoError(err)
+	assert.Equal("i-123", instances[0].InstanceID)
+	assert.Equal(1, calls)
+
+	// Other profile/region combinations are cached separately
+	instances, err = c.Get("profile1", "us-west-2", fetch("i-789"))
+	assert.NoError(err)
+	assert.Equal("i-789", instances[0].InstanceID)
+	assert.Equal(2, calls)
+
+	// Once stale, the cached instances are still returned, and refreshed in the background
+	now = now.Add(time.Hour)
+	instances, err = c.Get("profile1", "us-east-1", fetch("i-456"))
+	assert.NoError(err)
+	assert.Equal("i-123", instances[0].InstanceID)
+	c.Wait()
+	assert.Equal(3, calls)
+
+	instances, err = c.Get("profile1", "us-east-1", fetch("i-000"))
+	assert.NoError(err)
+	assert.Equal("i-456", instances[0].InstanceID)
+	assert.Equal(3, calls)
+
+	// Instances older than MaxCacheAge are looked up again before returning
+	now = now.Add(MaxCacheAge)
+	instances, err = c.Get("profile1", "us-east-1", fetch("i-000"))
+	assert.NoError(err)
+	assert.Equal("i-000", instances[0].InstanceID)
+	assert.Equal(4, calls)
+
+	// Refresh ignores the cache
+	c.Refresh = true
+	instances, err = c.Get("profile1", "us-east-1", fetch("i-111"))
+	assert.NoError(err)
+	assert.Equal("i-111", instances[0].InstanceID)
+	assert.Equal(5, calls)
+	c.Refresh = false
+
+	// Invalidated instances are looked up again
+	assert.NoError(c.Invalidate("profile1", "us-east-1"))
+	instances, err = c.Get("profile1", "us-east-1", fetch("i-222"))
+	assert.NoError(err)
+	assert.Equal("i-222", instances[0].InstanceID)
+	assert.Equal(6, calls)
+
+	// Invalidating instances that aren't cached is not an error
+	assert.NoError(c.Invalidate("profile2", "us-east-1"))
+
+	// Lookup errors are returned, and nothing is cached
+	_, err = c.Get("profile2", "us-east-1", func() ([]InstanceInfo, error) { return nil, fmt.Errorf("AccessDenied") })
+	assert.Error(err)
+	_, ok := c.load("profile2", "us-east-1")
+	assert.False(ok)
+}
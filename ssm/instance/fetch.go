@@ -1,6 +1,7 @@
 package instance
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/service/ssm"
@@ -8,8 +9,14 @@ import (
 )
 
 func GetSessionInstances(client ssmiface.SSMAPI, diiInput *ssm.DescribeInstanceInformationInput) (output []*ssm.InstanceInformation, err error) {
+	return GetSessionInstancesWithContext(context.Background(), client, diiInput)
+}
+
+// GetSessionInstancesWithContext is GetSessionInstances, stopping the lookup once ctx is canceled
+func GetSessionInstancesWithContext(ctx context.Context, client ssmiface.SSMAPI, diiInput *ssm.DescribeInstanceInformationInput) (output []*ssm.InstanceInformation, err error) {
 	// Fetch all instances that match the provided filters
-	if err = client.DescribeInstanceInformationPages(
+	if err = client.DescribeInstanceInformationPagesWithContext(
+		ctx,
 		diiInput,
 		func(page *ssm.DescribeInstanceInformationOutput, lastPage bool) bool {
 			output = append(output, page.InstanceInformationList...)
@@ -0,0 +1,148 @@
+package instance
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Fields lists the names of the fields of InstanceInfo that can be shown as columns and sorted on. Tags are
+// referred to as tag:<key>.
+var Fields = []string{
+	"InstanceID", "Region", "Profile", "VpcId",
+	"PingStatus", "PlatformType", "PlatformName", "PlatformVersion", "AgentVersion", "IPAddress", "ComputerName", "LastPingDateTime",
+	"InstanceType", "State", "AvailabilityZone", "PrivateIPAddress", "PublicIPAddress", "LaunchTime",
+}
+
+// timeFormat is the format of the time fields of an instance, and sortTimeFormat a format that sorts chronologically
+const (
+	timeFormat     = "2006-01-02 15:04:05"
+	sortTimeFormat = "2006-01-02T15:04:05.000000000"
+)
+
+// ParseField returns the canonical name of the field with the provided name, ignoring case
+func ParseField(name string) (string, error) {
+	if strings.HasPrefix(strings.ToLower(name), "tag:") && len(name) > len("tag:") {
+		return "tag:" + name[len("tag:"):], nil
+	}
+
+	for _, f := range Fields {
+		if strings.EqualFold(f, name) {
+			return f, nil
+		}
+	}
+
+	return "", fmt.Errorf("Unknown field %q, must be tag:<key> or one of %v", name, Fields)
+}
+
+// Field returns the value of the field with the provided canonical name, as returned by ParseField
+func (i *InstanceInfo) Field(name string) string {
+	if strings.HasPrefix(name, "tag:") {
+		return i.Tags[strings.TrimPrefix(name, "tag:")]
+	}
+
+	switch name {
+	case "InstanceID":
+		return i.InstanceID
+	case "Region":
+		return i.Region
+	case "Profile":
+		return i.Profile
+	case "VpcId":
+		return i.VpcId
+	case "PingStatus":
+		return i.PingStatus
+	case "PlatformType":
+		return i.PlatformType
+	case "PlatformName":
+		return i.PlatformName
+	case "PlatformVersion":
+		return i.PlatformVersion
+	case "AgentVersion":
+		return i.AgentVersion
+	case "IPAddress":
+		return i.IPAddress
+	case "ComputerName":
+		return i.ComputerName
+	case "LastPingDateTime":
+		return formatTime(i.LastPingDateTime)
+	case "InstanceType":
+		return i.InstanceType
+	case "State":
+		return i.State
+	case "AvailabilityZone":
+		return i.AvailabilityZone
+	case "PrivateIPAddress":
+		return i.PrivateIPAddress
+	case "PublicIPAddress":
+		return i.PublicIPAddress
+	case "LaunchTime":
+		if i.LaunchTime == nil {
+			return ""
+		}
+		return formatTime(*i.LaunchTime)
+	}
+
+	return ""
+}
+
+// column returns the value of the field with the provided name, or of the tag with that name if there is
+// no such field. Unlike ParseField, field names are case-sensitive, as tags are.
+func (i *InstanceInfo) column(name string) string {
+	if strings.HasPrefix(name, "tag:") {
+		return i.Field(name)
+	}
+
+	for _, f := range Fields {
+		if f == name {
+			return i.Field(name)
+		}
+	}
+
+	return i.Tags[name]
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format(timeFormat)
+}
+
+// SortKey is a field that instances are sorted on
+type SortKey struct {
+	Field      string
+	Descending bool
+}
+
+// Sort sorts the instances on each of the keys in turn
+func Sort(instances []InstanceInfo, keys []SortKey) {
+	sort.SliceStable(instances, func(a, b int) bool {
+		for _, k := range keys {
+			va, vb := instances[a].sortValue(k.Field), instances[b].sortValue(k.Field)
+			if va == vb {
+				continue
+			}
+			if k.Descending {
+				return va > vb
+			}
+			return va < vb
+		}
+		return false
+	})
+}
+
+// sortValue returns the value of a field in a form that sorts in the same order as the field
+func (i *InstanceInfo) sortValue(name string) string {
+	switch name {
+	case "LastPingDateTime":
+		return i.LastPingDateTime.UTC().Format(sortTimeFormat)
+	case "LaunchTime":
+		if i.LaunchTime == nil {
+			return ""
+		}
+		return i.LaunchTime.UTC().Format(sortTimeFormat)
+	}
+	return i.Field(name)
+}
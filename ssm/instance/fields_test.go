@@ -0,0 +1,107 @@
+package instance
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestNewInstanceInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	lastPing := time.Date(2020, 3, 5, 17, 0, 0, 0, time.UTC)
+	info := &ssm.InstanceInformation{
+		InstanceId:       aws.String("i-123"),
+		PingStatus:       aws.String("Online"),
+		PlatformName:     aws.String("Amazon Linux"),
+		AgentVersion:     aws.String("3.1.0.0"),
+		IPAddress:        aws.String("10.0.0.1"),
+		ComputerName:     aws.String("ip-10-0-0-1"),
+		LastPingDateTime: aws.Time(lastPing),
+	}
+	ec2Instance := &ec2.Instance{
+		VpcId: aws.String("vpc-123"),
+		Tags:  []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("web")}},
+	}
+
+	i := NewInstanceInfo("test", "us-east-1", info, ec2Instance)
+	assert.Equal("i-123", i.Field("InstanceID"))
+	assert.Equal("test", i.Field("Profile"))
+	assert.Equal("us-east-1", i.Field("Region"))
+	assert.Equal("vpc-123", i.Field("VpcId"))
+	assert.Equal("Online", i.Field("PingStatus"))
+	assert.Equal("Amazon Linux", i.Field("PlatformName"))
+	assert.Equal("3.1.0.0", i.Field("AgentVersion"))
+	assert.Equal("10.0.0.1", i.Field("IPAddress"))
+	assert.Equal("ip-10-0-0-1", i.Field("ComputerName"))
+	assert.Equal(lastPing.Local().Format(timeFormat), i.Field("LastPingDateTime"))
+	assert.Equal("web", i.Field("tag:Name"))
+	assert.Equal("", i.Field("tag:missing"))
+
+	// On-premises instances have no EC2 description
+	i = NewInstanceInfo("test", "us-east-1", &ssm.InstanceInformation{InstanceId: aws.String("mi-123")}, nil)
+	assert.Equal("mi-123", i.InstanceID)
+	assert.Empty(i.Tags)
+	assert.Equal("", i.Field("LastPingDateTime"))
+	assert.Equal("", i.Field("LaunchTime"))
+
+	// Attributes that only EC2 instances have are left out of JSON and YAML output
+	b, err := json.Marshal(i)
+	assert.NoError(err)
+	assert.NotContains(string(b), "launch_time")
+	b, err = yaml.Marshal(i)
+	assert.NoError(err)
+	assert.NotContains(string(b), "launch_time")
+
+	launchTime := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	i = NewInstanceInfo("test", "us-east-1", info, &ec2.Instance{LaunchTime: aws.Time(launchTime)})
+	assert.Equal(launchTime.Local().Format(timeFormat), i.Field("LaunchTime"))
+}
+
+func TestParseField(t *testing.T) {
+	assert := assert.New(t)
+
+	field, err := ParseField("ipaddress")
+	assert.NoError(err)
+	assert.Equal("IPAddress", field)
+
+	field, err = ParseField("TAG:Name")
+	assert.NoError(err)
+	assert.Equal("tag:Name", field)
+
+	_, err = ParseField("tag:")
+	assert.Error(err)
+	_, err = ParseField("Color")
+	assert.Error(err)
+}
+
+func TestSort(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	instances := []InstanceInfo{
+		{InstanceID: "i-1", Region: "us-west-2", LastPingDateTime: now.Add(-time.Hour)},
+		{InstanceID: "i-2", Region: "us-east-1", LastPingDateTime: now.Add(-time.Minute)},
+		{InstanceID: "i-3", Region: "us-east-1", LastPingDateTime: now.Add(-500 * time.Millisecond)},
+		{InstanceID: "i-4", Region: "us-west-2", LastPingDateTime: now},
+	}
+
+	ids := func() (ids []string) {
+		for _, i := range instances {
+			ids = append(ids, i.InstanceID)
+		}
+		return ids
+	}
+
+	Sort(instances, []SortKey{{Field: "Region"}, {Field: "InstanceID", Descending: true}})
+	assert.Equal([]string{"i-3", "i-2", "i-4", "i-1"}, ids())
+
+	Sort(instances, []SortKey{{Field: "LastPingDateTime", Descending: true}})
+	assert.Equal([]string{"i-4", "i-3", "i-2", "i-1"}, ids())
+}
@@ -6,6 +6,11 @@ import (
 	"strings"
 	"sync"
 	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
 
 	"github.com/disneystreaming/ssm-helpers/util"
 )
@@ -18,11 +23,72 @@ type InstanceInfoSafe struct {
 
 // InstanceInfo is used to store information, including EC2 tags, about a particular instance
 type InstanceInfo struct {
-	InstanceID string
-	Region     string
-	Profile    string
-	VpcId      string
-	Tags       map[string]string
+	InstanceID string            `json:"instance_id" yaml:"instance_id"`
+	Region     string            `json:"region" yaml:"region"`
+	Profile    string            `json:"profile" yaml:"profile"`
+	VpcId      string            `json:"vpc_id" yaml:"vpc_id"`
+	Tags       map[string]string `json:"tags" yaml:"tags"`
+
+	// Attributes of the instance reported by the SSM agent
+	PingStatus       string    `json:"ping_status" yaml:"ping_status"`
+	PlatformType     string    `json:"platform_type" yaml:"platform_type"`
+	PlatformName     string    `json:"platform_name" yaml:"platform_name"`
+	PlatformVersion  string    `json:"platform_version" yaml:"platform_version"`
+	AgentVersion     string    `json:"agent_version" yaml:"agent_version"`
+	IPAddress        string    `json:"ip_address" yaml:"ip_address"`
+	ComputerName     string    `json:"computer_name" yaml:"computer_name"`
+	LastPingDateTime time.Time `json:"last_ping_date_time" yaml:"last_ping_date_time"`
+
+	// Attributes of EC2 instances, which are empty for on-premises instances
+	InstanceType     string     `json:"instance_type,omitempty" yaml:"instance_type,omitempty"`
+	State            string     `json:"state,omitempty" yaml:"state,omitempty"`
+	AvailabilityZone string     `json:"availability_zone,omitempty" yaml:"availability_zone,omitempty"`
+	PrivateIPAddress string     `json:"private_ip_address,omitempty" yaml:"private_ip_address,omitempty"`
+	PublicIPAddress  string     `json:"public_ip_address,omitempty" yaml:"public_ip_address,omitempty"`
+	LaunchTime       *time.Time `json:"launch_time,omitempty" yaml:"launch_time,omitempty"`
+}
+
+// NewInstanceInfo returns the information of a managed instance from its SSM instance information, and its
+// EC2 description if it is an EC2 instance (ec2Instance may be nil)
+func NewInstanceInfo(profile, region string, info *ssm.InstanceInformation, ec2Instance *ec2.Instance) InstanceInfo {
+	i := InstanceInfo{
+		InstanceID:       aws.StringValue(info.InstanceId),
+		Region:           region,
+		Profile:          profile,
+		Tags:             make(map[string]string),
+		PingStatus:       aws.StringValue(info.PingStatus),
+		PlatformType:     aws.StringValue(info.PlatformType),
+		PlatformName:     aws.StringValue(info.PlatformName),
+		PlatformVersion:  aws.StringValue(info.PlatformVersion),
+		AgentVersion:     aws.StringValue(info.AgentVersion),
+		IPAddress:        aws.StringValue(info.IPAddress),
+		ComputerName:     aws.StringValue(info.ComputerName),
+		LastPingDateTime: aws.TimeValue(info.LastPingDateTime),
+	}
+
+	if ec2Instance == nil {
+		return i
+	}
+
+	i.VpcId = aws.StringValue(ec2Instance.VpcId)
+	i.InstanceType = aws.StringValue(ec2Instance.InstanceType)
+	i.PrivateIPAddress = aws.StringValue(ec2Instance.PrivateIpAddress)
+	i.PublicIPAddress = aws.StringValue(ec2Instance.PublicIpAddress)
+	if ec2Instance.LaunchTime != nil {
+		launchTime := *ec2Instance.LaunchTime
+		i.LaunchTime = &launchTime
+	}
+	if ec2Instance.State != nil {
+		i.State = aws.StringValue(ec2Instance.State.Name)
+	}
+	if ec2Instance.Placement != nil {
+		i.AvailabilityZone = aws.StringValue(ec2Instance.Placement.AvailabilityZone)
+	}
+	for _, tag := range ec2Instance.Tags {
+		i.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	return i
 }
 
 // FormatStringSlice is used to return a strings preformatted to the correct width for selection prompts
@@ -52,11 +118,9 @@ func (i *InstanceInfoSafe) FormatStringSlice(includeFields ...string) (outSlice
 func (i *InstanceInfo) FormatString(includeFields ...string) string {
 	// Formatted string will always contain at least base info
 	formattedString := fmt.Sprintf("%s\t%s\t%s\t", i.InstanceID, i.Region, i.Profile)
-	fields := i.Tags
-	fields["VpcId"] = i.VpcId
 
 	for _, v := range includeFields {
-		formattedString = fmt.Sprintf("%s%s\t", formattedString, fields[v])
+		formattedString = fmt.Sprintf("%s%s\t", formattedString, i.column(v))
 	}
 
 	return formattedString
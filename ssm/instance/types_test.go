@@ -47,3 +47,21 @@ func TestFormatString(t *testing.T) {
 		ii.FormatString("foo", "longkey"),
 	)
 }
+
+func TestFormatStringAttributes(t *testing.T) {
+	assert := assert.New(t)
+
+	ii := InstanceInfo{
+		InstanceID:   "i-123",
+		Region:       "us-east-1",
+		Profile:      "test",
+		InstanceType: "t3.micro",
+		Tags: map[string]string{
+			"State": "tagged",
+		},
+	}
+
+	// Attribute names are case-sensitive, so tags with similar names can still be shown
+	assert.Equal("i-123\tus-east-1\ttest\tt3.micro\t\ttagged\t", ii.FormatString("InstanceType", "State", "tag:State"))
+	assert.Equal("i-123\tus-east-1\ttest\tt3.micro\t", ii.FormatString("InstanceType"))
+}
@@ -0,0 +1,205 @@
+package invocation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Group is a set of results that produced identical stdout and stderr
+type Group struct {
+	Hash    string
+	Stdout  string
+	Stderr  string
+	Results []*Result
+
+	// Outlier is set when the group is smaller than the most common group
+	Outlier bool
+}
+
+// Member identifies a single result within a Group
+type Member struct {
+	InstanceID  string `json:"instance_id" yaml:"instance_id"`
+	ProfileName string `json:"profile" yaml:"profile"`
+	Region      string `json:"region" yaml:"region"`
+	Status      Status `json:"status" yaml:"status"`
+}
+
+// GroupRecord is the serializable representation of a Group
+type GroupRecord struct {
+	Type    string   `json:"type" yaml:"type"`
+	Hash    string   `json:"hash" yaml:"hash"`
+	Count   int      `json:"count" yaml:"count"`
+	Outlier bool     `json:"outlier" yaml:"outlier"`
+	Members []Member `json:"members" yaml:"members"`
+	Stdout  string   `json:"stdout" yaml:"stdout"`
+	Stderr  string   `json:"stderr" yaml:"stderr"`
+}
+
+// output returns the stdout and stderr of a result, using the error message as stderr for client errors
+func (r *Result) output() (stdout, stderr string) {
+	if r.InvocationResult != nil && r.Status != ClientError {
+		return aws.StringValue(r.InvocationResult.StandardOutputContent), aws.StringValue(r.InvocationResult.StandardErrorContent)
+	}
+
+	if r.Error != nil {
+		return "", r.Error.Error()
+	}
+
+	return "", ""
+}
+
+// Aggregate groups results by the hash of their stdout and stderr. Groups are sorted from most to least
+// common, and every group smaller than the most common one is marked as an outlier.
+func Aggregate(results []*Result) []*Group {
+	var groups []*Group
+	byHash := make(map[string]*Group)
+
+	for _, r := range results {
+		stdout, stderr := r.output()
+
+		sum := sha256.Sum256([]byte(stdout + "\x00" + stderr))
+		hash := hex.EncodeToString(sum[:])[:12]
+
+		g, ok := byHash[hash]
+		if !ok {
+			g = &Group{Hash: hash, Stdout: stdout, Stderr: stderr}
+			byHash[hash] = g
+			groups = append(groups, g)
+		}
+		g.Results = append(g.Results, r)
+	}
+
+	// Keep groups of equal size in the order they were first seen
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].Results) > len(groups[j].Results)
+	})
+
+	for _, g := range groups {
+		g.Outlier = len(g.Results) < len(groups[0].Results)
+	}
+
+	return groups
+}
+
+// Record converts a Group into its serializable representation
+func (g *Group) Record() GroupRecord {
+	rec := GroupRecord{
+		Type:    "group",
+		Hash:    g.Hash,
+		Count:   len(g.Results),
+		Outlier: g.Outlier,
+		Members: []Member{},
+		Stdout:  g.Stdout,
+		Stderr:  g.Stderr,
+	}
+
+	for _, r := range g.Results {
+		rec.Members = append(rec.Members, Member{
+			InstanceID:  r.InstanceID(),
+			ProfileName: r.ProfileName,
+			Region:      r.Region,
+			Status:      r.Status,
+		})
+	}
+
+	return rec
+}
+
+// NewAggregateWriter returns a ResultWriter that buffers all results, then writes each distinct output
+// once along with the instances that produced it when the summary is written
+func NewAggregateWriter(format Format, w io.Writer, log *logrus.Logger) ResultWriter {
+	return &aggregateWriter{format: format, w: w, log: log}
+}
+
+type aggregateWriter struct {
+	format  Format
+	w       io.Writer
+	log     *logrus.Logger
+	results []*Result
+}
+
+type aggregateDocument struct {
+	Groups  []GroupRecord `json:"groups" yaml:"groups"`
+	Summary *Summary      `json:"summary" yaml:"summary"`
+}
+
+func (a *aggregateWriter) Write(v *Result) error {
+	a.results = append(a.results, v)
+	return nil
+}
+
+func (a *aggregateWriter) WriteSummary(s *Summary) error {
+	groups := Aggregate(a.results)
+
+	switch a.format {
+	case FormatJSON, FormatYAML:
+		doc := aggregateDocument{Groups: []GroupRecord{}, Summary: s}
+		for _, g := range groups {
+			doc.Groups = append(doc.Groups, g.Record())
+		}
+
+		if a.format == FormatYAML {
+			enc := yaml.NewEncoder(a.w)
+			defer enc.Close()
+			return enc.Encode(doc)
+		}
+
+		enc := json.NewEncoder(a.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+
+	case FormatNDJSON:
+		enc := json.NewEncoder(a.w)
+		for _, g := range groups {
+			if err := enc.Encode(g.Record()); err != nil {
+				return err
+			}
+		}
+		return enc.Encode(s)
+
+	default:
+		a.writeTable(groups, s)
+		return nil
+	}
+}
+
+func (a *aggregateWriter) writeTable(groups []*Group, s *Summary) {
+	for _, g := range groups {
+		var members []string
+		for _, r := range g.Results {
+			if id := r.InstanceID(); id != "" {
+				members = append(members, fmt.Sprintf("%s (%s)", id, r.Status))
+			} else {
+				members = append(members, fmt.Sprintf("%s@%s (%s)", r.ProfileName, r.Region, r.Status))
+			}
+		}
+
+		// Outliers are highlighted by logging them at warn level
+		logf := a.log.Infof
+		label := ""
+		if g.Outlier {
+			logf = a.log.Warnf
+			label = " [OUTLIER]"
+		}
+
+		logf("%d/%d instances produced output %s%s:\n%s", len(g.Results), s.Total, g.Hash, label, strings.Join(members, ", "))
+
+		if g.Stdout != "" {
+			logf("%s", g.Stdout)
+		}
+		if g.Stderr != "" {
+			logf("stderr:\n%s", g.Stderr)
+		}
+	}
+
+	a.log.Infof("Execution results: %d SUCCESS, %d FAILED, %d distinct outputs", s.Success, s.Failed, len(groups))
+}
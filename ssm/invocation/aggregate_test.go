@@ -0,0 +1,78 @@
+package invocation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+)
+
+func newOutputResult(instanceID, stdout string, status Status) *Result {
+	return &Result{
+		InvocationResult: &ssm.GetCommandInvocationOutput{
+			InstanceId:            aws.String(instanceID),
+			StandardOutputContent: aws.String(stdout),
+			StandardErrorContent:  aws.String(""),
+		},
+		ProfileName: "profile1",
+		Region:      "us-east-1",
+		Status:      status,
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	assert := assert.New(t)
+
+	results := []*Result{
+		newOutputResult("i-1", "openssl-1.0.2k", CommandSuccess),
+		newOutputResult("i-2", "openssl-1.1.1g", CommandSuccess),
+		newOutputResult("i-3", "openssl-1.1.1g", CommandSuccess),
+		newOutputResult("i-4", "openssl-1.1.1g", CommandSuccess),
+		{ProfileName: "profile2", Region: "us-east-1", Status: ClientError, Error: fmt.Errorf("access denied")},
+	}
+
+	groups := Aggregate(results)
+	assert.Len(groups, 3)
+
+	// The most common output comes first and is not an outlier
+	assert.Equal("openssl-1.1.1g", groups[0].Stdout)
+	assert.Len(groups[0].Results, 3)
+	assert.False(groups[0].Outlier)
+
+	// Groups of equal size keep the order they were first seen in
+	assert.Equal("openssl-1.0.2k", groups[1].Stdout)
+	assert.True(groups[1].Outlier)
+	assert.Equal("access denied", groups[2].Stderr)
+	assert.True(groups[2].Outlier)
+
+	rec := groups[0].Record()
+	assert.Equal(3, rec.Count)
+	assert.Equal("i-2", rec.Members[0].InstanceID)
+
+	assert.Empty(Aggregate(nil))
+}
+
+func TestAggregateWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := new(bytes.Buffer)
+	w, s := NewAggregateWriter(FormatJSON, buf, nil), NewSummary()
+	for _, r := range []*Result{
+		newOutputResult("i-1", "Linux", CommandSuccess),
+		newOutputResult("i-2", "Linux", CommandSuccess),
+	} {
+		s.Add(r)
+		assert.NoError(w.Write(r))
+	}
+	assert.NoError(w.WriteSummary(s))
+
+	var doc aggregateDocument
+	assert.NoError(json.Unmarshal(buf.Bytes(), &doc))
+	assert.Len(doc.Groups, 1)
+	assert.Equal(2, doc.Groups[0].Count)
+	assert.Equal(2, doc.Summary.Success)
+}
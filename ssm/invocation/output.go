@@ -0,0 +1,245 @@
+package invocation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is the format used when writing invocation results
+type Format string
+
+const (
+	// FormatTable writes results as human-readable log lines
+	FormatTable Format = "table"
+
+	// FormatJSON writes all results and the summary as a single JSON document
+	FormatJSON Format = "json"
+
+	// FormatNDJSON writes each result and the summary as a separate line of JSON
+	FormatNDJSON Format = "ndjson"
+
+	// FormatYAML writes all results and the summary as a single YAML document
+	FormatYAML Format = "yaml"
+)
+
+// Formats lists every supported output format
+var Formats = []Format{FormatTable, FormatJSON, FormatNDJSON, FormatYAML}
+
+// ParseFormat returns the Format matching the provided string
+func ParseFormat(s string) (Format, error) {
+	for _, f := range Formats {
+		if Format(strings.ToLower(s)) == f {
+			return f, nil
+		}
+	}
+
+	return "", fmt.Errorf("Invalid output format %q, must be one of %v", s, Formats)
+}
+
+// Record is the serializable representation of a single Result
+type Record struct {
+	Type             string `json:"type" yaml:"type"`
+	InstanceID       string `json:"instance_id" yaml:"instance_id"`
+	ProfileName      string `json:"profile" yaml:"profile"`
+	Region           string `json:"region" yaml:"region"`
+	CommandID        string `json:"command_id" yaml:"command_id"`
+	Status           Status `json:"status" yaml:"status"`
+	ResponseCode     *int64 `json:"response_code" yaml:"response_code"`
+	Stdout           string `json:"stdout" yaml:"stdout"`
+	Stderr           string `json:"stderr" yaml:"stderr"`
+	Truncated        bool   `json:"truncated" yaml:"truncated"`
+	OutputURL        string `json:"output_url" yaml:"output_url"`
+	ExecutionStart   string `json:"execution_start" yaml:"execution_start"`
+	ExecutionEnd     string `json:"execution_end" yaml:"execution_end"`
+	ExecutionElapsed string `json:"execution_elapsed" yaml:"execution_elapsed"`
+	Error            string `json:"error" yaml:"error"`
+}
+
+// Summary contains the counters written after all results
+type Summary struct {
+	Type     string         `json:"type" yaml:"type"`
+	Total    int            `json:"total" yaml:"total"`
+	Success  int            `json:"success" yaml:"success"`
+	Failed   int            `json:"failed" yaml:"failed"`
+	Statuses map[Status]int `json:"statuses" yaml:"statuses"`
+}
+
+// NewSummary returns an empty Summary
+func NewSummary() *Summary {
+	return &Summary{
+		Type:     "summary",
+		Statuses: make(map[Status]int),
+	}
+}
+
+// Add counts the provided result towards the summary totals
+func (s *Summary) Add(r *Result) {
+	s.Total++
+	s.Statuses[r.Status]++
+
+	if r.Status == CommandSuccess {
+		s.Success++
+	} else {
+		s.Failed++
+	}
+}
+
+// Record converts a Result into its serializable representation
+func (r *Result) Record() Record {
+	rec := Record{
+		Type:        "result",
+		ProfileName: r.ProfileName,
+		Region:      r.Region,
+		Status:      r.Status,
+		Truncated:   r.Truncated,
+		OutputURL:   r.OutputURL,
+	}
+
+	if r.Error != nil {
+		rec.Error = r.Error.Error()
+	}
+
+	if v := r.InvocationResult; v != nil {
+		rec.InstanceID = aws.StringValue(v.InstanceId)
+		rec.CommandID = aws.StringValue(v.CommandId)
+		rec.ResponseCode = v.ResponseCode
+		rec.Stdout = aws.StringValue(v.StandardOutputContent)
+		rec.Stderr = aws.StringValue(v.StandardErrorContent)
+		rec.ExecutionStart = aws.StringValue(v.ExecutionStartDateTime)
+		rec.ExecutionEnd = aws.StringValue(v.ExecutionEndDateTime)
+		rec.ExecutionElapsed = aws.StringValue(v.ExecutionElapsedTime)
+	}
+
+	return rec
+}
+
+// ResultWriter writes invocation results in a particular output format
+type ResultWriter interface {
+	// Write outputs a single result, or buffers it until the summary is written
+	Write(*Result) error
+
+	// WriteSummary outputs the summary counters, flushing any buffered results
+	WriteSummary(*Summary) error
+}
+
+// NewResultWriter returns a ResultWriter for the given format. Table output is
+// written through the provided logger, all other formats are written to w.
+func NewResultWriter(format Format, w io.Writer, log *logrus.Logger) ResultWriter {
+	switch format {
+	case FormatJSON, FormatYAML:
+		return &documentWriter{format: format, w: w, records: []Record{}}
+	case FormatNDJSON:
+		return &ndjsonWriter{enc: json.NewEncoder(w)}
+	default:
+		return &tableWriter{log: log}
+	}
+}
+
+const resultFormat = "%-24s %-15s %-15s %s"
+
+type tableWriter struct {
+	log           *logrus.Logger
+	headerWritten bool
+}
+
+func (t *tableWriter) Write(v *Result) error {
+	if !t.headerWritten {
+		t.log.Infof(resultFormat, "Instance ID", "Region", "Profile", "Status")
+		t.headerWritten = true
+	}
+
+	if v.Status == ClientError {
+		id := v.InstanceID()
+		if id == "" {
+			id = "---"
+		}
+		t.log.Errorf(resultFormat, id, v.Region, v.ProfileName, v.Status)
+		if v.Error != nil {
+			t.log.Error(v.Error)
+		}
+		return nil
+	}
+
+	if v.Status == CommandSuccess {
+		t.log.Infof(resultFormat, *v.InvocationResult.InstanceId, v.Region, v.ProfileName, v.Status)
+	} else {
+		t.log.Errorf(resultFormat, *v.InvocationResult.InstanceId, v.Region, v.ProfileName, v.Status)
+	}
+
+	// stdout is always written back at info level
+	if stdout := aws.StringValue(v.InvocationResult.StandardOutputContent); stdout != "" {
+		t.log.Info(stdout)
+	}
+
+	// stderr is written back at warn if the invocation was successful, and error if not
+	if stderr := aws.StringValue(v.InvocationResult.StandardErrorContent); stderr != "" {
+		if v.Status == CommandSuccess {
+			t.log.Warn(stderr)
+		} else {
+			t.log.Error(stderr)
+		}
+	}
+
+	if v.Truncated {
+		if v.OutputURL != "" {
+			t.log.Debugf("Output was truncated by the SSM API, complete output was retrieved from %s", v.OutputURL)
+		} else {
+			t.log.Warnf("Output was truncated to %d characters by the SSM API, use --s3-bucket to retrieve the complete output", MaxOutputLength)
+		}
+	}
+
+	return nil
+}
+
+func (t *tableWriter) WriteSummary(s *Summary) error {
+	t.log.Infof("Execution results: %d SUCCESS, %d FAILED", s.Success, s.Failed)
+	return nil
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(v *Result) error {
+	return n.enc.Encode(v.Record())
+}
+
+func (n *ndjsonWriter) WriteSummary(s *Summary) error {
+	return n.enc.Encode(s)
+}
+
+type documentWriter struct {
+	format  Format
+	w       io.Writer
+	records []Record
+}
+
+type document struct {
+	Results []Record `json:"results" yaml:"results"`
+	Summary *Summary `json:"summary" yaml:"summary"`
+}
+
+func (d *documentWriter) Write(v *Result) error {
+	d.records = append(d.records, v.Record())
+	return nil
+}
+
+func (d *documentWriter) WriteSummary(s *Summary) error {
+	doc := document{Results: d.records, Summary: s}
+
+	if d.format == FormatYAML {
+		enc := yaml.NewEncoder(d.w)
+		defer enc.Close()
+		return enc.Encode(doc)
+	}
+
+	enc := json.NewEncoder(d.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
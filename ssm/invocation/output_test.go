@@ -0,0 +1,117 @@
+package invocation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func testResults() []*Result {
+	return []*Result{
+		{
+			InvocationResult: &ssm.GetCommandInvocationOutput{
+				InstanceId:            aws.String("i-123"),
+				CommandId:             aws.String("success-id"),
+				ResponseCode:          aws.Int64(0),
+				StandardOutputContent: aws.String("Linux"),
+				StandardErrorContent:  aws.String(""),
+			},
+			ProfileName: "profile1",
+			Region:      "us-east-1",
+			Status:      CommandSuccess,
+		},
+		{
+			ProfileName: "profile2",
+			Region:      "us-west-2",
+			Status:      ClientError,
+			Error:       fmt.Errorf("access denied"),
+		},
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, f := range []string{"table", "json", "NDJSON", "yaml"} {
+		format, err := ParseFormat(f)
+		assert.NoError(err)
+		assert.Equal(Format(strings.ToLower(f)), format)
+	}
+
+	_, err := ParseFormat("xml")
+	assert.Error(err)
+}
+
+func TestRecord(t *testing.T) {
+	assert := assert.New(t)
+	results := testResults()
+
+	t.Run("invocation result", func(t *testing.T) {
+		rec := results[0].Record()
+		assert.Equal("result", rec.Type)
+		assert.Equal("i-123", rec.InstanceID)
+		assert.Equal("success-id", rec.CommandID)
+		assert.Equal(CommandSuccess, rec.Status)
+		assert.Equal(int64(0), *rec.ResponseCode)
+		assert.Equal("Linux", rec.Stdout)
+		assert.Empty(rec.Error)
+	})
+
+	t.Run("client error", func(t *testing.T) {
+		rec := results[1].Record()
+		assert.Empty(rec.InstanceID)
+		assert.Nil(rec.ResponseCode)
+		assert.Equal("access denied", rec.Error)
+	})
+}
+
+func TestResultWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	write := func(format Format) string {
+		buf := new(bytes.Buffer)
+		w, s := NewResultWriter(format, buf, nil), NewSummary()
+		for _, r := range testResults() {
+			s.Add(r)
+			assert.NoError(w.Write(r))
+		}
+		assert.NoError(w.WriteSummary(s))
+		return buf.String()
+	}
+
+	t.Run("ndjson", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(write(FormatNDJSON)), "\n")
+		assert.Len(lines, 3)
+
+		var trailer Summary
+		assert.NoError(json.Unmarshal([]byte(lines[2]), &trailer))
+		assert.Equal("summary", trailer.Type)
+		assert.Equal(2, trailer.Total)
+		assert.Equal(1, trailer.Success)
+		assert.Equal(1, trailer.Failed)
+		assert.Equal(1, trailer.Statuses[ClientError])
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var doc document
+		assert.NoError(json.Unmarshal([]byte(write(FormatJSON)), &doc))
+		assert.Len(doc.Results, 2)
+		assert.Equal("i-123", doc.Results[0].InstanceID)
+		assert.Equal(2, doc.Summary.Total)
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		var doc document
+		assert.NoError(yaml.Unmarshal([]byte(write(FormatYAML)), &doc))
+		assert.Len(doc.Results, 2)
+		assert.Equal("profile2", doc.Results[1].ProfileName)
+		assert.Equal(1, doc.Summary.Failed)
+	})
+}
@@ -0,0 +1,85 @@
+package invocation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IsTerminal returns whether a command invocation status (as returned by the ListCommandInvocations API) is final
+func IsTerminal(status string) bool {
+	switch status {
+	case "Success", "Failed", "TimedOut", "Cancelled":
+		return true
+	default:
+		return false
+	}
+}
+
+// Counts holds the number of invocations of a single command in each state
+type Counts struct {
+	Pending    int
+	InProgress int
+	Success    int
+	Failed     int
+}
+
+// Add counts a single invocation with the given ListCommandInvocations status
+func (c *Counts) Add(status string) {
+	switch status {
+	case "Pending", "Delayed":
+		c.Pending++
+	case "InProgress", "Cancelling":
+		c.InProgress++
+	case "Success":
+		c.Success++
+	default:
+		c.Failed++
+	}
+}
+
+// String returns a short, human-readable representation of the counts
+func (c Counts) String() string {
+	return fmt.Sprintf("%d pending, %d in progress, %d success, %d failed", c.Pending, c.InProgress, c.Success, c.Failed)
+}
+
+// Progress allows for concurrent-safe tracking of the invocation counts of each profile/region combination
+type Progress struct {
+	sync.Mutex
+	counts map[string]Counts
+}
+
+// NewProgress returns an empty *Progress object
+func NewProgress() *Progress {
+	return &Progress{
+		counts: make(map[string]Counts),
+	}
+}
+
+// Update replaces the counts for the given profile/region key
+func (p *Progress) Update(key string, c Counts) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.counts[key] = c
+}
+
+// String returns the counts of every profile/region combination on a single line, sorted by key
+func (p *Progress) String() string {
+	p.Lock()
+	defer p.Unlock()
+
+	keys := make([]string, 0, len(p.counts))
+	for k := range p.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	entries := make([]string, 0, len(keys))
+	for _, k := range keys {
+		entries = append(entries, fmt.Sprintf("%s: %s", k, p.counts[k]))
+	}
+
+	return strings.Join(entries, " | ")
+}
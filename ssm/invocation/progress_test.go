@@ -0,0 +1,41 @@
+package invocation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTerminal(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, s := range []string{"Success", "Failed", "TimedOut", "Cancelled"} {
+		assert.Truef(IsTerminal(s), "%s should be a terminal status", s)
+	}
+
+	for _, s := range []string{"Pending", "InProgress", "Delayed", "Cancelling"} {
+		assert.Falsef(IsTerminal(s), "%s should not be a terminal status", s)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	var c Counts
+	for _, s := range []string{"Pending", "Delayed", "InProgress", "Success", "Failed", "TimedOut"} {
+		c.Add(s)
+	}
+	assert.Equal(Counts{Pending: 2, InProgress: 1, Success: 1, Failed: 2}, c)
+
+	p := NewProgress()
+	assert.Empty(p.String())
+
+	p.Update("profile2@us-east-1", Counts{Success: 1})
+	p.Update("profile1@us-east-1", Counts{Pending: 1})
+	p.Update("profile1@us-east-1", c)
+
+	assert.Equal(
+		"profile1@us-east-1: 2 pending, 1 in progress, 1 success, 2 failed | profile2@us-east-1: 0 pending, 0 in progress, 1 success, 0 failed",
+		p.String(),
+	)
+}
@@ -0,0 +1,270 @@
+package invocation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+)
+
+// LastRun can be passed to LoadRun in place of a run ID to load the most recent run
+const LastRun = "last"
+
+// MaxSavedRuns is the number of runs kept by SaveRun; older runs are deleted
+var MaxSavedRuns = 100
+
+// runIDFormat is used to generate run IDs, which sort in the order the runs were started
+const runIDFormat = "20060102T150405.000Z"
+
+// RunRecord is the persisted record of a single run of a command, used to retry the instances that failed
+type RunRecord struct {
+	ID              string              `json:"id"`
+	Time            time.Time           `json:"time"`
+	DocumentName    string              `json:"document"`
+	DocumentVersion string              `json:"document_version,omitempty"`
+	Parameters      map[string][]string `json:"parameters"`
+	Sessions        []RunSession        `json:"sessions"`
+	Results         []RunResult         `json:"results"`
+}
+
+// RunSession is the targeting of a command sent through a single profile/region combination
+type RunSession struct {
+	Profile     string      `json:"profile"`
+	Region      string      `json:"region"`
+	InstanceIDs []string    `json:"instance_ids,omitempty"`
+	Targets     []RunTarget `json:"targets,omitempty"`
+
+	// Role is set when the command was sent by assuming a role in an account of an organization,
+	// in which case Profile names that account
+	Role *session.Role `json:"role,omitempty"`
+}
+
+// RunTarget is the serializable representation of an *ssm.Target
+type RunTarget struct {
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
+}
+
+// RunResult is the outcome of a run for a single instance. Errors that prevented the command from
+// running in a profile/region combination at all are recorded without an instance ID.
+type RunResult struct {
+	InstanceID string `json:"instance_id,omitempty"`
+	Profile    string `json:"profile"`
+	Region     string `json:"region"`
+	CommandID  string `json:"command_id,omitempty"`
+	Status     Status `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NewRunRecord returns an empty RunRecord for a run of the given document, with an ID based on the current time
+func NewRunRecord(document, documentVersion string, parameters map[string][]*string) *RunRecord {
+	now := time.Now().UTC()
+	rec := &RunRecord{
+		ID:              now.Format(runIDFormat),
+		Time:            now,
+		DocumentName:    document,
+		DocumentVersion: documentVersion,
+		Parameters:      make(map[string][]string),
+	}
+
+	for k, v := range parameters {
+		rec.Parameters[k] = aws.StringValueSlice(v)
+	}
+
+	return rec
+}
+
+// AddSession records the targeting of the command sent through the given profile/region combination,
+// and the role assumed to send it if any. If instanceIDs is not nil, the command was sent to those instances
+// after resolving the targeting of input, e.g. by a rollout, and they are recorded instead.
+func (r *RunRecord) AddSession(profile, region string, role *session.Role, input *ssm.SendCommandInput, instanceIDs []string) {
+	s := RunSession{
+		Profile:     profile,
+		Region:      region,
+		InstanceIDs: aws.StringValueSlice(input.InstanceIds),
+		Role:        role,
+	}
+
+	if instanceIDs != nil {
+		s.InstanceIDs = instanceIDs
+	} else {
+		for _, t := range input.Targets {
+			s.Targets = append(s.Targets, RunTarget{Key: aws.StringValue(t.Key), Values: aws.StringValueSlice(t.Values)})
+		}
+	}
+
+	r.Sessions = append(r.Sessions, s)
+}
+
+// AddResult records the outcome of the run for a single instance
+func (r *RunRecord) AddResult(v *Result) {
+	res := RunResult{
+		InstanceID: v.InstanceID(),
+		Profile:    v.ProfileName,
+		Region:     v.Region,
+		Status:     v.Status,
+	}
+
+	if v.InvocationResult != nil {
+		res.CommandID = aws.StringValue(v.InvocationResult.CommandId)
+	}
+	if v.Error != nil {
+		res.Error = v.Error.Error()
+	}
+
+	r.Results = append(r.Results, res)
+}
+
+// SSMParameters returns the document parameters of the run in the format expected by the SendCommand API
+func (r *RunRecord) SSMParameters() map[string][]*string {
+	parameters := make(map[string][]*string)
+	for k, v := range r.Parameters {
+		parameters[k] = aws.StringSlice(v)
+	}
+
+	return parameters
+}
+
+// IsRetryable returns whether an instance with the given status should be targeted when retrying a run
+func IsRetryable(status Status) bool {
+	switch status {
+	case CommandFailed, CommandDeliveryTimedOut, CommandExecutionTimedOut, CommandUndeliverable, ClientError:
+		return true
+	default:
+		return false
+	}
+}
+
+// RetrySessions returns the targeting needed to retry the failed instances of the run. Instances are
+// targeted by ID, along with the instances targeted by ID that have no result, e.g. those of the batches
+// that a halted rollout never ran; if an error prevented the command from running in a profile/region
+// combination at all, that combination is retried with its original targeting instead.
+func (r *RunRecord) RetrySessions() []RunSession {
+	var retry []RunSession
+
+	for _, s := range r.Sessions {
+		var ids []string
+		retryAll := false
+		ran := make(map[string]bool)
+
+		for _, v := range r.Results {
+			if v.Profile != s.Profile || v.Region != s.Region {
+				continue
+			}
+			ran[v.InstanceID] = true
+			if !IsRetryable(v.Status) {
+				continue
+			}
+
+			if v.InstanceID == "" {
+				retryAll = true
+				break
+			}
+			ids = append(ids, v.InstanceID)
+		}
+
+		for _, id := range s.InstanceIDs {
+			if !ran[id] {
+				ids = append(ids, id)
+			}
+		}
+
+		switch {
+		case retryAll:
+			retry = append(retry, s)
+		case len(ids) > 0:
+			retry = append(retry, RunSession{Profile: s.Profile, Region: s.Region, InstanceIDs: ids, Role: s.Role})
+		}
+	}
+
+	return retry
+}
+
+// Input returns the SendCommand targeting of the session
+func (s RunSession) Input() (instanceIDs []*string, targets []*ssm.Target) {
+	for _, t := range s.Targets {
+		targets = append(targets, &ssm.Target{Key: aws.String(t.Key), Values: aws.StringSlice(t.Values)})
+	}
+
+	return aws.StringSlice(s.InstanceIDs), targets
+}
+
+// SaveRun writes the record to dir as <id>.json, deleting the oldest runs beyond MaxSavedRuns
+func SaveRun(dir string, r *RunRecord) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Could not create run history directory %s\n%v", dir, err)
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, r.ID+".json"), data, 0600); err != nil {
+		return fmt.Errorf("Could not save run %s\n%v", r.ID, err)
+	}
+
+	ids, err := listRuns(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(ids) > MaxSavedRuns {
+		os.Remove(filepath.Join(dir, ids[0]+".json"))
+		ids = ids[1:]
+	}
+
+	return nil
+}
+
+// LoadRun reads the record of the run with the given ID from dir. The most recent run is loaded if id is LastRun.
+func LoadRun(dir string, id string) (*RunRecord, error) {
+	if id == LastRun {
+		ids, err := listRuns(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("No previous runs found in %s", dir)
+		}
+		id = ids[len(ids)-1]
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(id)+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not load run %s\n%v", id, err)
+	}
+
+	r := &RunRecord{}
+	if err = json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("Could not parse run %s\n%v", id, err)
+	}
+
+	return r, nil
+}
+
+// listRuns returns the IDs of the runs saved in dir, from oldest to newest
+func listRuns(dir string) (ids []string, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Could not read run history directory %s\n%v", dir, err)
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
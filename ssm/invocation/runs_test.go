@@ -0,0 +1,143 @@
+package invocation
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+)
+
+func testRunRecord() *RunRecord {
+	r := NewRunRecord("AWS-RunShellScript", "", map[string][]*string{
+		"commands": aws.StringSlice([]string{"uname"}),
+	})
+
+	r.AddSession("profile1", "us-east-1", nil, &ssm.SendCommandInput{
+		Targets: []*ssm.Target{{Key: aws.String("tag:app"), Values: aws.StringSlice([]string{"myapp"})}},
+	}, nil)
+	r.AddSession("profile2", "us-west-2", nil, &ssm.SendCommandInput{
+		Targets: []*ssm.Target{{Key: aws.String("tag:app"), Values: aws.StringSlice([]string{"myapp"})}},
+	}, nil)
+	r.AddSession("profile3", "us-west-2", &session.Role{SourceProfile: "management", ARN: "arn:aws:iam::333333333333:role/OrganizationAccountAccessRole"}, &ssm.SendCommandInput{
+		InstanceIds: aws.StringSlice([]string{"i-789"}),
+	}, nil)
+
+	// A rollout resolved the filters of the command to the instances it was sent to
+	r.AddSession("profile4", "us-east-1", nil, &ssm.SendCommandInput{}, []string{"i-901", "i-902"})
+
+	result := func(id string, status Status) *Result {
+		return &Result{
+			InvocationResult: &ssm.GetCommandInvocationOutput{InstanceId: aws.String(id), CommandId: aws.String("command-id")},
+			ProfileName:      "profile1",
+			Region:           "us-east-1",
+			Status:           status,
+		}
+	}
+
+	r.AddResult(result("i-123", CommandSuccess))
+	r.AddResult(result("i-234", CommandFailed))
+	r.AddResult(result("i-345", CommandDeliveryTimedOut))
+	r.AddResult(result("i-456", CommandCanceled))
+	r.AddResult(&Result{ProfileName: "profile2", Region: "us-west-2", Status: ClientError, Error: fmt.Errorf("access denied")})
+	r.AddResult(&Result{
+		InvocationResult: &ssm.GetCommandInvocationOutput{InstanceId: aws.String("i-789"), CommandId: aws.String("command-id")},
+		ProfileName:      "profile3",
+		Region:           "us-west-2",
+		Status:           CommandFailed,
+	})
+	r.AddResult(&Result{
+		InvocationResult: &ssm.GetCommandInvocationOutput{InstanceId: aws.String("i-901"), CommandId: aws.String("command-id")},
+		ProfileName:      "profile4",
+		Region:           "us-east-1",
+		Status:           CommandSuccess,
+	})
+
+	return r
+}
+
+func TestRetrySessions(t *testing.T) {
+	assert := assert.New(t)
+
+	retry := testRunRecord().RetrySessions()
+	assert.Len(retry, 4)
+
+	// Failed instances are retried by ID
+	assert.Equal(RunSession{Profile: "profile1", Region: "us-east-1", InstanceIDs: []string{"i-234", "i-345"}}, retry[0])
+
+	// Errors that prevented the command from running at all retry the original targets
+	instanceIDs, targets := retry[1].Input()
+	assert.Equal("profile2", retry[1].Profile)
+	assert.Empty(instanceIDs)
+	assert.Equal("tag:app", *targets[0].Key)
+	assert.Equal([]string{"myapp"}, aws.StringValueSlice(targets[0].Values))
+
+	// Instances in organization accounts are retried through the same role
+	assert.Equal([]string{"i-789"}, retry[2].InstanceIDs)
+	assert.Equal("arn:aws:iam::333333333333:role/OrganizationAccountAccessRole", retry[2].Role.ARN)
+
+	// Instances that were never run, e.g. because a rollout was halted, are retried by ID
+	assert.Equal(RunSession{Profile: "profile4", Region: "us-east-1", InstanceIDs: []string{"i-902"}}, retry[3])
+
+	// Errors that prevented the command from running at all retry the instances it was resolved to
+	r := testRunRecord()
+	r.AddResult(&Result{ProfileName: "profile4", Region: "us-east-1", Status: ClientError, Error: fmt.Errorf("throttled")})
+	assert.Equal([]string{"i-901", "i-902"}, r.RetrySessions()[3].InstanceIDs)
+}
+
+func TestSaveLoadRun(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	r := testRunRecord()
+	assert.NoError(SaveRun(dir, r))
+
+	loaded, err := LoadRun(dir, r.ID)
+	assert.NoError(err)
+	assert.Equal(r.ID, loaded.ID)
+	assert.Equal([]string{"uname"}, aws.StringValueSlice(loaded.SSMParameters()["commands"]))
+	assert.Equal(r.Results, loaded.Results)
+	assert.Equal("access denied", loaded.Results[4].Error)
+	assert.Equal(r.Sessions[2], loaded.Sessions[2])
+
+	t.Run("last run", func(t *testing.T) {
+		newer := testRunRecord()
+		newer.ID = r.ID + "1"
+		assert.NoError(SaveRun(dir, newer))
+
+		loaded, err := LoadRun(dir, LastRun)
+		assert.NoError(err)
+		assert.Equal(newer.ID, loaded.ID)
+	})
+
+	t.Run("old runs are pruned", func(t *testing.T) {
+		MaxSavedRuns = 2
+		defer func() { MaxSavedRuns = 100 }()
+
+		newest := testRunRecord()
+		newest.ID = r.ID + "2"
+		assert.NoError(SaveRun(dir, newest))
+
+		files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		assert.Len(files, 2)
+
+		_, err := LoadRun(dir, r.ID)
+		assert.Error(err)
+	})
+
+	t.Run("no runs", func(t *testing.T) {
+		_, err := LoadRun(filepath.Join(dir, "missing"), LastRun)
+		assert.Error(err)
+	})
+
+	t.Run("invalid run", func(t *testing.T) {
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, "invalid.json"), []byte("{"), 0600))
+		_, err := LoadRun(dir, "invalid")
+		assert.Error(err)
+	})
+}
@@ -0,0 +1,147 @@
+package invocation
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+)
+
+// MaxOutputLength is the maximum number of characters of stdout and stderr returned by the GetCommandInvocation API
+const MaxOutputLength = 24000
+
+// OutputLocation is the S3 bucket and key prefix that SSM writes the complete output of commands to
+type OutputLocation struct {
+	Bucket string
+	Prefix string
+}
+
+// InstancePrefix returns the key prefix under which SSM stores the output of a command for a single instance
+func (o OutputLocation) InstancePrefix(commandID, instanceID string) string {
+	return strings.TrimPrefix(path.Join(o.Prefix, commandID, instanceID), "/") + "/"
+}
+
+// URL returns the s3:// URL of the output of a command for a single instance
+func (o OutputLocation) URL(commandID, instanceID string) string {
+	return fmt.Sprintf("s3://%s/%s", o.Bucket, o.InstancePrefix(commandID, instanceID))
+}
+
+// IsTruncated returns whether the stdout or stderr content of a result appears to have been truncated by the SSM API
+func (r *Result) IsTruncated() bool {
+	if r.InvocationResult == nil {
+		return false
+	}
+
+	return len(aws.StringValue(r.InvocationResult.StandardOutputContent)) >= MaxOutputLength ||
+		len(aws.StringValue(r.InvocationResult.StandardErrorContent)) >= MaxOutputLength
+}
+
+// NewS3Client returns an S3 client for the given session, optionally using a custom endpoint
+// so that an S3-compatible service can stand in for S3
+func NewS3Client(sess *session.Session, endpoint string) s3iface.S3API {
+	if endpoint == "" {
+		return s3.New(sess.Session)
+	}
+
+	return s3.New(sess.Session, &aws.Config{
+		Endpoint:         aws.String(endpoint),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+}
+
+// FetchOutput downloads the complete stdout and stderr of an invocation from S3, replacing the (possibly truncated)
+// content returned by the GetCommandInvocation API. Documents with multiple steps write one stdout and stderr
+// object per step; these are concatenated in key order.
+func FetchOutput(client s3iface.S3API, loc OutputLocation, result *Result) error {
+	return FetchOutputWithContext(context.Background(), client, loc, result)
+}
+
+// FetchOutputWithContext is FetchOutput, stopping the download once ctx is canceled
+func FetchOutputWithContext(ctx context.Context, client s3iface.S3API, loc OutputLocation, result *Result) error {
+	if result.InvocationResult == nil {
+		return nil
+	}
+
+	commandID, instanceID := aws.StringValue(result.InvocationResult.CommandId), aws.StringValue(result.InvocationResult.InstanceId)
+
+	var keys []string
+	if err := client.ListObjectsV2PagesWithContext(
+		ctx,
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(loc.Bucket),
+			Prefix: aws.String(loc.InstancePrefix(commandID, instanceID)),
+		},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, *obj.Key)
+			}
+
+			// If it's not the last page, continue
+			return !lastPage
+		}); err != nil {
+		return fmt.Errorf("Could not list command output in %s\n%v", loc.URL(commandID, instanceID), err)
+	}
+
+	// Commands that write nothing to stdout or stderr leave no objects
+	if len(keys) == 0 {
+		if aws.StringValue(result.InvocationResult.StandardOutputContent) == "" && aws.StringValue(result.InvocationResult.StandardErrorContent) == "" {
+			return nil
+		}
+		return fmt.Errorf("No command output found in %s", loc.URL(commandID, instanceID))
+	}
+
+	sort.Strings(keys)
+
+	var stdout, stderr strings.Builder
+	for _, key := range keys {
+		var dest *strings.Builder
+		switch path.Base(key) {
+		case "stdout":
+			dest = &stdout
+		case "stderr":
+			dest = &stderr
+		default:
+			continue
+		}
+
+		content, err := getObject(ctx, client, loc.Bucket, key)
+		if err != nil {
+			return err
+		}
+		dest.WriteString(content)
+	}
+
+	result.Truncated = stdout.Len() > len(aws.StringValue(result.InvocationResult.StandardOutputContent)) ||
+		stderr.Len() > len(aws.StringValue(result.InvocationResult.StandardErrorContent))
+	result.OutputURL = loc.URL(commandID, instanceID)
+	result.InvocationResult.SetStandardOutputContent(stdout.String())
+	result.InvocationResult.SetStandardErrorContent(stderr.String())
+
+	return nil
+}
+
+func getObject(ctx context.Context, client s3iface.S3API, bucket, key string) (string, error) {
+	out, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Could not download command output from s3://%s/%s\n%v", bucket, key, err)
+	}
+	defer out.Body.Close()
+
+	content, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return "", fmt.Errorf("Could not read command output from s3://%s/%s\n%v", bucket, key, err)
+	}
+
+	return string(content), nil
+}
@@ -0,0 +1,122 @@
+package invocation
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+)
+
+func TestOutputLocation(t *testing.T) {
+	assert := assert.New(t)
+
+	loc := OutputLocation{Bucket: "bucket"}
+	assert.Equal("cmd-id/i-123/", loc.InstancePrefix("cmd-id", "i-123"))
+
+	loc.Prefix = "ssm/output/"
+	assert.Equal("ssm/output/cmd-id/i-123/", loc.InstancePrefix("cmd-id", "i-123"))
+	assert.Equal("s3://bucket/ssm/output/cmd-id/i-123/", loc.URL("cmd-id", "i-123"))
+}
+
+func TestIsTruncated(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &Result{
+		InvocationResult: &ssm.GetCommandInvocationOutput{
+			StandardOutputContent: aws.String("short"),
+		},
+	}
+	assert.False(r.IsTruncated())
+
+	r.InvocationResult.SetStandardErrorContent(strings.Repeat("x", MaxOutputLength))
+	assert.True(r.IsTruncated())
+
+	assert.False((&Result{Status: ClientError}).IsTruncated())
+}
+
+func TestFetchOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	fullOutput := strings.Repeat("a", MaxOutputLength+100)
+	server := mocks.NewMockS3Server(map[string]string{
+		"bucket/prefix/cmd-id/i-123/awsrunShellScript/0.awsrunShellScript/stdout": fullOutput,
+		"bucket/prefix/cmd-id/i-123/awsrunShellScript/0.awsrunShellScript/stderr": "warning",
+		"bucket/prefix/cmd-id/i-456/awsrunShellScript/0.awsrunShellScript/stdout": "other instance",
+	})
+	defer server.Close()
+
+	client := s3.New(session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+	})))
+	loc := OutputLocation{Bucket: "bucket", Prefix: "prefix"}
+
+	t.Run("truncated output is replaced", func(t *testing.T) {
+		r := &Result{
+			InvocationResult: &ssm.GetCommandInvocationOutput{
+				CommandId:             aws.String("cmd-id"),
+				InstanceId:            aws.String("i-123"),
+				StandardOutputContent: aws.String(fullOutput[:MaxOutputLength]),
+				StandardErrorContent:  aws.String("warning"),
+			},
+		}
+
+		assert.NoError(FetchOutput(client, loc, r))
+		assert.True(r.Truncated)
+		assert.Equal(fullOutput, *r.InvocationResult.StandardOutputContent)
+		assert.Equal("warning", *r.InvocationResult.StandardErrorContent)
+		assert.Equal("s3://bucket/prefix/cmd-id/i-123/", r.OutputURL)
+	})
+
+	t.Run("complete output is unchanged", func(t *testing.T) {
+		r := &Result{
+			InvocationResult: &ssm.GetCommandInvocationOutput{
+				CommandId:             aws.String("cmd-id"),
+				InstanceId:            aws.String("i-456"),
+				StandardOutputContent: aws.String("other instance"),
+				StandardErrorContent:  aws.String(""),
+			},
+		}
+
+		assert.NoError(FetchOutput(client, loc, r))
+		assert.False(r.Truncated)
+		assert.Equal("other instance", *r.InvocationResult.StandardOutputContent)
+	})
+
+	t.Run("no output", func(t *testing.T) {
+		r := &Result{
+			InvocationResult: &ssm.GetCommandInvocationOutput{
+				CommandId:             aws.String("cmd-id"),
+				InstanceId:            aws.String("i-789"),
+				StandardOutputContent: aws.String(""),
+				StandardErrorContent:  aws.String(""),
+			},
+		}
+
+		assert.NoError(FetchOutput(client, loc, r))
+		assert.False(r.Truncated)
+		assert.Equal("", *r.InvocationResult.StandardOutputContent)
+	})
+
+	t.Run("missing output", func(t *testing.T) {
+		r := &Result{
+			InvocationResult: &ssm.GetCommandInvocationOutput{
+				CommandId:             aws.String("cmd-id"),
+				InstanceId:            aws.String("i-789"),
+				StandardOutputContent: aws.String("written to S3"),
+			},
+		}
+
+		assert.Error(FetchOutput(client, loc, r))
+		assert.Empty(r.OutputURL)
+	})
+}
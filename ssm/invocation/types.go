@@ -3,6 +3,7 @@ package invocation
 import (
 	"sync"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
@@ -57,6 +58,21 @@ type Result struct {
 	Region           string
 	Status           Status
 	Error            error
+
+	// Truncated is set when the output returned by the GetCommandInvocation API was incomplete
+	Truncated bool
+
+	// OutputURL is set when the complete output was retrieved from S3
+	OutputURL string
+}
+
+// InstanceID returns the ID of the instance the result belongs to, or an empty string for client errors
+func (r *Result) InstanceID() string {
+	if r.InvocationResult == nil {
+		return ""
+	}
+
+	return aws.StringValue(r.InvocationResult.InstanceId)
 }
 
 // ResultSafe allows for concurrent-safe access to a slice of InvocationResult info
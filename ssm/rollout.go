@@ -0,0 +1,231 @@
+package ssm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/sirupsen/logrus"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	"github.com/disneystreaming/ssm-helpers/ssm/instance"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+	"github.com/disneystreaming/ssm-helpers/util/batch"
+)
+
+// maxInstanceIds is the maximum number of instance IDs accepted by a single call to the SendCommand API
+const maxInstanceIds = 50
+
+// RolloutTarget is the list of instances reachable through a single session that a rollout runs a command on
+type RolloutTarget struct {
+	Session   *session.Session
+	Client    ssmiface.SSMAPI
+	Instances []string
+}
+
+// Rollout runs a command on a list of instances in consecutive batches, instead of sending it to every
+// instance at once. The rollout is halted before the next batch is started if too many instances of
+// a batch failed, or if the health check failed on any of them.
+type Rollout struct {
+	// BatchSize is the number of instances in each batch, as a count or a percentage of all instances
+	BatchSize batch.Size
+
+	// Canary is the number of instances in the first batch; if zero, the first batch uses BatchSize
+	Canary int
+
+	// Pause is the time to wait between the end of a batch and the start of the next
+	Pause time.Duration
+
+	// MaxErrors is the number of failed instances allowed per batch, as a count or a percentage of the batch
+	MaxErrors batch.Size
+
+	// HealthCheck, if set, is sent to the instances of each batch once the command has completed on them
+	HealthCheck *ssm.SendCommandInput
+
+	Logger *logrus.Logger
+}
+
+// rolloutInstance is a single instance, along with the target it belongs to
+type rolloutInstance struct {
+	target *RolloutTarget
+	id     string
+}
+
+// ResolveInstances returns the IDs of the managed instances that match the provided SendCommand targets,
+// so that they can be targeted by instance ID instead
+func ResolveInstances(ctx context.Context, client ssmiface.SSMAPI, targets []*ssm.Target) (ids []string, err error) {
+	diiInput := &ssm.DescribeInstanceInformationInput{}
+	for _, t := range targets {
+		AppendSSMFilter(&diiInput.Filters, &ssm.InstanceInformationStringFilter{Key: t.Key, Values: t.Values})
+	}
+
+	// Max number of results per page allowed by the API is 50
+	diiInput.SetMaxResults(50)
+
+	instances, err := instance.GetSessionInstancesWithContext(ctx, client, diiInput)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range instances {
+		ids = append(ids, *i.InstanceId)
+	}
+
+	return ids, nil
+}
+
+// ResolveFilteredInstances returns the IDs of the managed instances that match the provided filters, for filters that
+// can't be evaluated by the SendCommand API. If instance IDs are provided, only those instances are considered.
+func ResolveFilteredInstances(ctx context.Context, ssmClient ssmiface.SSMAPI, ec2Client ec2iface.EC2API, filters Filters, instanceIDs []string) (ids []string, err error) {
+	instances, err := instance.GetSessionInstancesWithContext(ctx, ssmClient, CreateSSMDescribeInstanceInput(filters, instanceIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	if instances, err = FilterInstancesWithContext(ctx, ssmClient, ec2Client, filters, instances); err != nil {
+		return nil, err
+	}
+
+	for _, i := range instances {
+		ids = append(ids, *i.InstanceId)
+	}
+
+	return ids, nil
+}
+
+// Batches returns the [start, end) bounds of each batch of the rollout for the given number of instances
+func (r *Rollout) Batches(total int) (bounds [][2]int) {
+	start := 0
+	if r.Canary > 0 {
+		start = r.Canary
+		if start > total {
+			start = total
+		}
+		bounds = append(bounds, [2]int{0, start})
+	}
+
+	size := r.BatchSize.Of(total)
+	if size < 1 {
+		size = 1
+	}
+
+	batch.Chunk(total-start, size, func(min int, max int) (bool, error) {
+		bounds = append(bounds, [2]int{start + min, start + max})
+		return true, nil
+	})
+
+	return bounds
+}
+
+// Run sends input to the instances of each target batch by batch, writing the result of every instance to
+// results. An error is returned if the rollout was halted or interrupted before every batch was run.
+func (r *Rollout) Run(ctx context.Context, targets []*RolloutTarget, input *ssm.SendCommandInput, results chan<- *invocation.Result, progress *invocation.Progress) error {
+	var instances []rolloutInstance
+	for _, t := range targets {
+		for _, id := range t.Instances {
+			instances = append(instances, rolloutInstance{target: t, id: id})
+		}
+	}
+
+	bounds := r.Batches(len(instances))
+	for idx, b := range bounds {
+		remaining := len(instances) - b[0]
+
+		if idx > 0 && r.Pause > 0 {
+			r.Logger.Infof("Waiting %v before starting the next batch", r.Pause)
+			select {
+			case <-ctx.Done():
+			case <-time.After(r.Pause):
+			}
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("Rollout stopped before batch %d of %d, %d instance(s) were not run: %v", idx+1, len(bounds), remaining, ctx.Err())
+		}
+
+		batchInstances := instances[b[0]:b[1]]
+		r.Logger.Infof("Starting batch %d of %d (%d instance(s))", idx+1, len(bounds), len(batchInstances))
+
+		failed := 0
+		runBatch(ctx, batchInstances, input, progress, func(v *invocation.Result) {
+			if v.Status != invocation.CommandSuccess {
+				failed++
+			}
+			results <- v
+		})
+
+		if r.MaxErrors.ExceededBy(failed, len(batchInstances)) {
+			return fmt.Errorf("Rollout halted after batch %d of %d: %d of %d instance(s) failed, exceeding the maximum of %s; %d instance(s) were not run",
+				idx+1, len(bounds), failed, len(batchInstances), r.MaxErrors, remaining-len(batchInstances))
+		}
+
+		if r.HealthCheck == nil || ctx.Err() != nil {
+			continue
+		}
+
+		unhealthy := 0
+		runBatch(ctx, batchInstances, r.HealthCheck, nil, func(v *invocation.Result) {
+			if v.Status == invocation.CommandSuccess {
+				return
+			}
+			unhealthy++
+
+			if v.InvocationResult == nil {
+				r.Logger.Errorf("Health check could not be run on %s@%s: %v", v.ProfileName, v.Region, v.Error)
+				return
+			}
+			r.Logger.Errorf("Health check failed on %s (%s): %s", v.InstanceID(), v.Status, aws.StringValue(v.InvocationResult.StandardErrorContent))
+		})
+
+		if unhealthy > 0 {
+			return fmt.Errorf("Rollout halted after batch %d of %d: health check failed on %d of %d instance(s); %d instance(s) were not run",
+				idx+1, len(bounds), unhealthy, len(batchInstances), remaining-len(batchInstances))
+		}
+	}
+
+	return nil
+}
+
+// runBatch sends input to the provided instances, with one SendCommand call per target (split further to
+// respect the instance ID limit of the API), and waits for every invocation to complete. The result of each
+// instance is passed to handle, which is never called concurrently.
+func runBatch(ctx context.Context, instances []rolloutInstance, input *ssm.SendCommandInput, progress *invocation.Progress, handle func(*invocation.Result)) {
+	var targets []*RolloutTarget
+	ids := make(map[*RolloutTarget][]string)
+	for _, i := range instances {
+		if _, ok := ids[i.target]; !ok {
+			targets = append(targets, i.target)
+		}
+		ids[i.target] = append(ids[i.target], i.id)
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan *invocation.Result)
+
+	for _, t := range targets {
+		targetIds := ids[t]
+		batch.Chunk(len(targetIds), maxInstanceIds, func(min int, max int) (bool, error) {
+			batchInput := *input
+			batchInput.Targets = nil
+			batchInput.InstanceIds = aws.StringSlice(targetIds[min:max])
+
+			wg.Add(1)
+			go RunInvocations(ctx, t.Session, t.Client, &wg, &batchInput, results, progress)
+			return true, nil
+		})
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for v := range results {
+		handle(v)
+	}
+}
@@ -0,0 +1,121 @@
+package ssm
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/disneystreaming/ssm-helpers/aws/session"
+	"github.com/disneystreaming/ssm-helpers/ssm/invocation"
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+	"github.com/disneystreaming/ssm-helpers/util/batch"
+)
+
+func TestResolveInstances(t *testing.T) {
+	assert := assert.New(t)
+	mockSvc := &mocks.MockSSMClient{}
+
+	ids, err := ResolveInstances(context.Background(), mockSvc, []*ssm.Target{
+		{Key: aws.String("PlatformTypes"), Values: aws.StringSlice([]string{"Windows"})},
+	})
+	assert.NoError(err)
+	assert.Equal([]string{"i-78901", "i-67890"}, ids)
+}
+
+func TestRolloutBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &Rollout{BatchSize: batch.Size{Count: 40, Percent: true}, Canary: 1}
+	assert.Equal([][2]int{{0, 1}, {1, 5}, {5, 9}, {9, 10}}, r.Batches(10))
+
+	r = &Rollout{BatchSize: batch.Size{Count: 3}}
+	assert.Equal([][2]int{{0, 3}, {3, 5}}, r.Batches(5))
+
+	// A canary larger than the number of instances is a single batch
+	r = &Rollout{BatchSize: batch.Size{Count: 100, Percent: true}, Canary: 5}
+	assert.Equal([][2]int{{0, 2}}, r.Batches(2))
+}
+
+func TestRolloutRun(t *testing.T) {
+	assert := assert.New(t)
+
+	PollInterval = time.Millisecond
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	sess := &session.Session{
+		Logger:      logger,
+		ProfileName: "testprofile",
+		Session:     awssession.Must(awssession.NewSession(&aws.Config{Region: aws.String("us-east-1")})),
+	}
+
+	run := func(mockSvc *mocks.MockSSMInvocationClient, r *Rollout) (received []string, err error) {
+		results := make(chan *invocation.Result)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for v := range results {
+				received = append(received, v.InstanceID())
+			}
+		}()
+
+		targets := []*RolloutTarget{{Session: sess, Client: mockSvc, Instances: []string{"i-1", "i-2", "i-3", "i-4", "i-5"}}}
+		err = r.Run(context.Background(), targets, &ssm.SendCommandInput{DocumentName: aws.String("AWS-RunShellScript")}, results, nil)
+		close(results)
+		<-done
+
+		return received, err
+	}
+
+	t.Run("all batches succeed", func(t *testing.T) {
+		mockSvc := &mocks.MockSSMInvocationClient{}
+		received, err := run(mockSvc, &Rollout{BatchSize: batch.Size{Count: 2}, Logger: logger})
+
+		assert.NoError(err)
+		assert.Equal([]string{"i-1", "i-2", "i-3", "i-4", "i-5"}, received)
+		assert.Len(mockSvc.SentCommands, 3)
+		assert.Equal([]string{"i-5"}, aws.StringValueSlice(mockSvc.SentCommands[2].InstanceIds))
+	})
+
+	t.Run("halted when too many instances fail", func(t *testing.T) {
+		mockSvc := &mocks.MockSSMInvocationClient{Statuses: map[string]string{"i-2": "Failed"}}
+		received, err := run(mockSvc, &Rollout{BatchSize: batch.Size{Count: 2}, Logger: logger})
+
+		assert.Error(err)
+		assert.Equal([]string{"i-1", "i-2"}, received)
+		assert.Len(mockSvc.SentCommands, 1)
+	})
+
+	t.Run("failures within the threshold", func(t *testing.T) {
+		mockSvc := &mocks.MockSSMInvocationClient{Statuses: map[string]string{"i-2": "Failed"}}
+		received, err := run(mockSvc, &Rollout{BatchSize: batch.Size{Count: 2}, MaxErrors: batch.Size{Count: 50, Percent: true}, Logger: logger})
+
+		assert.NoError(err)
+		assert.Len(received, 5)
+	})
+
+	t.Run("halted when the health check fails", func(t *testing.T) {
+		mockSvc := &mocks.MockSSMInvocationClient{
+			DocumentStatuses: map[string]map[string]string{"health-check": {"i-1": "Failed"}},
+		}
+		received, err := run(mockSvc, &Rollout{
+			BatchSize:   batch.Size{Count: 2},
+			Canary:      1,
+			HealthCheck: &ssm.SendCommandInput{DocumentName: aws.String("health-check")},
+			Logger:      logger,
+		})
+
+		// Health check results are not reported as results of the command itself
+		assert.Error(err)
+		assert.Equal([]string{"i-1"}, received)
+		assert.Len(mockSvc.SentCommands, 2)
+		assert.Equal("health-check", *mockSvc.SentCommands[1].DocumentName)
+	})
+}
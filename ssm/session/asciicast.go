@@ -0,0 +1,244 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Event types of asciicast recordings
+const (
+	CastOutputEvent = "o"
+	CastResizeEvent = "r"
+)
+
+// maxCastLine is the length of the longest line of a recording that can be replayed
+const maxCastLine = 4 * 1024 * 1024
+
+// CastHeader is the first line of an asciicast v2 recording
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// CastEvent is a single event of an asciicast v2 recording
+type CastEvent struct {
+	// Time is the number of seconds since the start of the recording
+	Time float64
+	Type string
+	Data string
+}
+
+// Recorder writes the output of a session, and the resizes of its terminal, as an asciicast v2 recording
+// that can be played back with ssm replay or asciinema
+type Recorder struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+	size  TerminalSize
+
+	// Bytes of an incomplete UTF-8 sequence at the end of the last output, written with the next output
+	pending []byte
+}
+
+// NewRecorder writes the header of a recording of a terminal of the given size to w, and returns a recorder for its events
+func NewRecorder(w io.Writer, size TerminalSize, title string, env map[string]string) (*Recorder, error) {
+	r := &Recorder{w: w, start: time.Now(), size: size}
+
+	header, _ := json.Marshal(CastHeader{
+		Version:   2,
+		Width:     size.Cols,
+		Height:    size.Rows,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env:       env,
+	})
+
+	if _, err := fmt.Fprintf(w, "%s\n", header); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Recorder) event(eventType, data string) error {
+	b, _ := json.Marshal([]interface{}{time.Since(r.start).Seconds(), eventType, data})
+	_, err := fmt.Fprintf(r.w, "%s\n", b)
+	return err
+}
+
+// Write records the output of the session
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Output events are strings, so UTF-8 sequences split between writes are kept whole
+	data := append(r.pending, p...)
+	end := completeUTF8(data)
+	r.pending = append([]byte(nil), data[end:]...)
+
+	if end == 0 {
+		return len(p), nil
+	}
+
+	if err := r.event(CastOutputEvent, string(data[:end])); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Resize records a change of the size of the terminal
+func (r *Recorder) Resize(size TerminalSize) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if size == r.size {
+		return nil
+	}
+	r.size = size
+
+	return r.event(CastResizeEvent, fmt.Sprintf("%dx%d", size.Cols, size.Rows))
+}
+
+// Close records the output left over from an incomplete UTF-8 sequence, if any
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.pending) == 0 {
+		return nil
+	}
+
+	err := r.event(CastOutputEvent, string(r.pending))
+	r.pending = nil
+	return err
+}
+
+// completeUTF8 returns the length of b without an incomplete UTF-8 sequence at its end
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+
+	return len(b)
+}
+
+// CastReader reads the events of an asciicast v2 recording
+type CastReader struct {
+	Header  CastHeader
+	scanner *bufio.Scanner
+}
+
+// NewCastReader reads the header of the recording, and returns a reader for its events
+func NewCastReader(r io.Reader) (*CastReader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxCastLine)
+
+	c := &CastReader{scanner: scanner}
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Recording is empty")
+	}
+
+	if err := json.Unmarshal(scanner.Bytes(), &c.Header); err != nil {
+		return nil, fmt.Errorf("Could not parse the header of the recording\n%v", err)
+	}
+	if c.Header.Version != 2 {
+		return nil, fmt.Errorf("Unsupported asciicast version %d, only version 2 is supported", c.Header.Version)
+	}
+
+	return c, nil
+}
+
+// Next returns the next event of the recording, or io.EOF at the end of the recording
+func (c *CastReader) Next() (e CastEvent, err error) {
+	for c.scanner.Scan() {
+		line := c.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var fields []json.RawMessage
+		if err = json.Unmarshal(line, &fields); err != nil || len(fields) != 3 {
+			return e, fmt.Errorf("Invalid event in the recording: %s", line)
+		}
+
+		if err = json.Unmarshal(fields[0], &e.Time); err == nil {
+			if err = json.Unmarshal(fields[1], &e.Type); err == nil {
+				err = json.Unmarshal(fields[2], &e.Data)
+			}
+		}
+		if err != nil {
+			return e, fmt.Errorf("Invalid event in the recording: %s", line)
+		}
+
+		return e, nil
+	}
+
+	if err = c.scanner.Err(); err != nil {
+		return e, err
+	}
+
+	return e, io.EOF
+}
+
+// Replay writes the output of the recording to w with its original timing, sped up by speed. Pauses longer
+// than maxIdle are shortened to maxIdle, unless it is 0.
+func Replay(ctx context.Context, c *CastReader, w io.Writer, speed float64, maxIdle time.Duration) error {
+	if speed <= 0 {
+		return fmt.Errorf("Invalid replay speed %v", speed)
+	}
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	last := 0.0
+	for {
+		e, err := c.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		delay := time.Duration((e.Time - last) * float64(time.Second))
+		if maxIdle > 0 && delay > maxIdle {
+			delay = maxIdle
+		}
+		last = e.Time
+
+		if delay > 0 {
+			timer.Reset(time.Duration(float64(delay) / speed))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// Resizes can't be applied to the terminal the recording is played in
+		if e.Type == CastOutputEvent {
+			if _, err = io.WriteString(w, e.Data); err != nil {
+				return err
+			}
+		}
+	}
+}
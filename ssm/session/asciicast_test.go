@@ -0,0 +1,78 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := &bytes.Buffer{}
+	r, err := NewRecorder(buf, TerminalSize{Cols: 80, Rows: 24}, "i-123", map[string]string{"TERM": "xterm"})
+	assert.NoError(err)
+
+	// "é" is split between two writes
+	r.Write([]byte("caf\xc3"))
+	r.Write([]byte("\xa9\r\n"))
+	assert.NoError(r.Resize(TerminalSize{Cols: 80, Rows: 24}))
+	assert.NoError(r.Resize(TerminalSize{Cols: 120, Rows: 40}))
+	r.Write([]byte("\xe2\x82"))
+	assert.NoError(r.Close())
+
+	c, err := NewCastReader(buf)
+	assert.NoError(err)
+	assert.Equal(CastHeader{Version: 2, Width: 80, Height: 24, Timestamp: c.Header.Timestamp, Title: "i-123", Env: map[string]string{"TERM": "xterm"}}, c.Header)
+
+	var events []CastEvent
+	for e, err := c.Next(); err != io.EOF; e, err = c.Next() {
+		assert.NoError(err)
+		events = append(events, e)
+	}
+
+	// Unchanged sizes are not recorded
+	if assert.Len(events, 4) {
+		assert.Equal("o", events[0].Type)
+		assert.Equal("caf", events[0].Data)
+		assert.Equal("é\r\n", events[1].Data)
+		assert.Equal(CastEvent{Time: events[2].Time, Type: "r", Data: "120x40"}, events[2])
+		// Incomplete sequences left at the end are recorded as replacement characters
+		assert.Equal("\ufffd\ufffd", events[3].Data)
+		assert.True(events[1].Time >= events[0].Time)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	recording := `{"version": 2, "width": 80, "height": 24}
+[0.1, "o", "hello "]
+[0.2, "r", "100x30"]
+[60.5, "o", "world"]
+`
+
+	c, err := NewCastReader(strings.NewReader(recording))
+	assert.NoError(err)
+
+	// The minute of idle time is shortened, and the rest sped up
+	out := &bytes.Buffer{}
+	start := time.Now()
+	assert.NoError(Replay(context.Background(), c, out, 10, 500*time.Millisecond))
+	assert.Equal("hello world", out.String())
+	assert.True(time.Since(start) < 5*time.Second)
+
+	c, _ = NewCastReader(strings.NewReader(recording))
+	assert.Error(Replay(context.Background(), c, out, 0, 0))
+
+	_, err = NewCastReader(strings.NewReader(`{"version": 1}`))
+	assert.Error(err)
+
+	c, _ = NewCastReader(strings.NewReader("{\"version\": 2}\n[0.1, \"o\"]\n"))
+	assert.Error(Replay(context.Background(), c, out, 1, 0))
+}
@@ -0,0 +1,530 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ClientVersion is the version of the session-manager-plugin protocol implemented by DataChannel
+const ClientVersion = "1.2.0.0"
+
+// pingInterval is the delay between the pings sent to keep the websocket open while the session is idle
+var pingInterval = 5 * time.Minute
+
+// resendTimeout is how long an input message may go unacknowledged by the agent before it is sent again
+var resendTimeout = time.Second
+
+// maxResends is the number of times an input message is sent again before the session is considered lost
+const maxResends = 300
+
+// Handshake action statuses
+const (
+	actionSuccess     = 1
+	actionUnsupported = 3
+)
+
+// Session types requested by the agent during the handshake
+const (
+	StandardStreamSession = "Standard_Stream"
+	PortSession           = "Port"
+)
+
+// TerminalSize is the size of the local terminal, sent to the agent so that the remote terminal matches it
+type TerminalSize struct {
+	Cols uint32 `json:"cols"`
+	Rows uint32 `json:"rows"`
+}
+
+// openDataChannelInput is the first message sent on the websocket, authenticating the client with the session token
+type openDataChannelInput struct {
+	MessageSchemaVersion string
+	RequestId            string
+	TokenValue           string
+	ClientId             string
+	ClientVersion        string
+}
+
+type acknowledgeContent struct {
+	AcknowledgedMessageType           string
+	AcknowledgedMessageId             string
+	AcknowledgedMessageSequenceNumber int64
+	IsSequentialMessage               bool
+}
+
+type handshakeRequest struct {
+	AgentVersion           string
+	RequestedClientActions []struct {
+		ActionType       string
+		ActionParameters json.RawMessage
+	}
+}
+
+type sessionTypeRequest struct {
+	SessionType string
+	Properties  map[string]interface{}
+}
+
+type processedClientAction struct {
+	ActionType   string
+	ActionStatus int
+	Error        string `json:",omitempty"`
+}
+
+type handshakeResponse struct {
+	ClientVersion          string
+	ProcessedClientActions []processedClientAction
+	Errors                 []string
+}
+
+type channelClosed struct {
+	SessionId string
+	Output    string
+}
+
+// NewDialer returns a websocket dialer for data channels that uses the proxy, dialer and TLS settings of the HTTP client
+// of the AWS session, so that data channels are opened the same way as the API calls that start the sessions
+func NewDialer(client *http.Client) *websocket.Dialer {
+	d := &websocket.Dialer{
+		Proxy: http.ProxyFromEnvironment,
+	}
+
+	if client == nil {
+		return d
+	}
+
+	d.HandshakeTimeout = client.Timeout
+	if t, ok := client.Transport.(*http.Transport); ok {
+		d.NetDial = t.Dial
+		d.NetDialContext = t.DialContext
+		d.TLSClientConfig = t.TLSClientConfig
+		if t.Proxy != nil {
+			d.Proxy = t.Proxy
+		}
+	}
+
+	return d
+}
+
+// DataChannel streams the input and output of a session to and from the SSM agent over the websocket
+// returned by the StartSession API, implementing the same protocol as the session-manager-plugin
+type DataChannel struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	// Sequence number of the next input message sent, and of the next output message to process
+	inputMu        sync.Mutex
+	inputSequence  int64
+	outputSequence int64
+
+	// Input messages sent but not acknowledged by the agent yet, which are sent again until they are
+	pending map[int64]*pendingInput
+
+	// Output messages received ahead of their turn
+	buffered map[int64]*AgentMessage
+
+	// SessionType is the type of session set by the agent during the handshake
+	SessionType string
+
+	// publishing is false while the agent has asked for input to be paused
+	publishing     bool
+	publishingCond *sync.Cond
+
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// Dial opens the data channel of a session, from the stream URL and token returned by the StartSession API
+func Dial(ctx context.Context, dialer *websocket.Dialer, streamURL, token string) (*DataChannel, error) {
+	conn, _, err := dialer.DialContext(ctx, streamURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the session data channel\n%v", err)
+	}
+
+	c := &DataChannel{
+		conn:           conn,
+		buffered:       make(map[int64]*AgentMessage),
+		pending:        make(map[int64]*pendingInput),
+		publishing:     true,
+		publishingCond: sync.NewCond(&sync.Mutex{}),
+		ready:          make(chan struct{}),
+	}
+
+	open, _ := json.Marshal(openDataChannelInput{
+		MessageSchemaVersion: "1.0",
+		RequestId:            NewUUID().String(),
+		TokenValue:           token,
+		ClientId:             NewUUID().String(),
+		ClientVersion:        ClientVersion,
+	})
+
+	if err = c.write(websocket.TextMessage, open); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Could not authenticate to the session data channel\n%v", err)
+	}
+
+	return c, nil
+}
+
+// Close closes the websocket of the data channel
+func (c *DataChannel) Close() error {
+	return c.conn.Close()
+}
+
+func (c *DataChannel) write(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.conn.WriteMessage(messageType, data)
+}
+
+func (c *DataChannel) send(m *AgentMessage) error {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return c.write(websocket.BinaryMessage, b)
+}
+
+// pendingInput is an input message that the agent hasn't acknowledged yet
+type pendingInput struct {
+	message *AgentMessage
+	sent    time.Time
+	resends int
+}
+
+// sendInput sends an input stream message with the next sequence number, waiting while publication is paused
+func (c *DataChannel) sendInput(payloadType PayloadType, payload []byte) error {
+	c.publishingCond.L.Lock()
+	for !c.publishing {
+		c.publishingCond.Wait()
+	}
+	c.publishingCond.L.Unlock()
+
+	return c.sendInputNow(payloadType, payload)
+}
+
+// sendInputNow sends an input stream message with the next sequence number, even while publication is paused.
+// It is kept until the agent acknowledges it, see resend.
+func (c *DataChannel) sendInputNow(payloadType PayloadType, payload []byte) error {
+	// Messages must be sent in the order of their sequence numbers
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+
+	m := newMessage(InputStreamMessage, c.inputSequence, flagData, payloadType, payload)
+	c.pending[c.inputSequence] = &pendingInput{message: m, sent: time.Now()}
+	c.inputSequence++
+
+	return c.send(m)
+}
+
+// acknowledged forgets the input message with the sequence number acknowledged by the agent
+func (c *DataChannel) acknowledged(payload []byte) {
+	ack := acknowledgeContent{}
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		return
+	}
+
+	c.inputMu.Lock()
+	delete(c.pending, ack.AcknowledgedMessageSequenceNumber)
+	c.inputMu.Unlock()
+}
+
+// resend sends the input messages that the agent hasn't acknowledged within resendTimeout again, in order.
+// An error is returned once a message has been sent maxResends times without being acknowledged.
+func (c *DataChannel) resend(now time.Time) error {
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+
+	var sequences []int64
+	for sequence, p := range c.pending {
+		if now.Sub(p.sent) >= resendTimeout {
+			sequences = append(sequences, sequence)
+		}
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+
+	for _, sequence := range sequences {
+		p := c.pending[sequence]
+		if p.resends >= maxResends {
+			return fmt.Errorf("The session agent did not acknowledge input message %d after %d attempts", sequence, p.resends+1)
+		}
+
+		p.sent, p.resends = now, p.resends+1
+		if err := c.send(p.message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *DataChannel) setPublishing(publishing bool) {
+	c.publishingCond.L.Lock()
+	c.publishing = publishing
+	c.publishingCond.L.Unlock()
+	c.publishingCond.Broadcast()
+}
+
+func (c *DataChannel) acknowledge(m *AgentMessage) error {
+	payload, _ := json.Marshal(acknowledgeContent{
+		AcknowledgedMessageType:           m.MessageType,
+		AcknowledgedMessageId:             m.MessageID.String(),
+		AcknowledgedMessageSequenceNumber: m.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+
+	return c.send(newMessage(AcknowledgeMessage, 0, flagAck, 0, payload))
+}
+
+// markReady is called once the session can accept input: after the handshake, or after the first output
+// of agents that predate the handshake
+func (c *DataChannel) markReady() {
+	c.readyOnce.Do(func() { close(c.ready) })
+}
+
+// Resize sends the size of the local terminal to the agent
+func (c *DataChannel) Resize(size TerminalSize) error {
+	payload, _ := json.Marshal(size)
+	return c.sendInput(PayloadSize, payload)
+}
+
+// Run streams stdin to the session and the output of the session to stdout, until the agent closes the session,
+// stdin is closed or ctx is canceled. Each terminal size received from sizes is sent to the agent; sizes may be nil.
+func (c *DataChannel) Run(ctx context.Context, stdin io.Reader, stdout io.Writer, sizes <-chan TerminalSize) error {
+	// The first error, or the end of the session, stops the session
+	done := make(chan error, 1)
+	stop := func(err error) {
+		select {
+		case done <- err:
+		default:
+		}
+	}
+
+	go func() {
+		stop(c.readLoop(stdout))
+	}()
+
+	go func() {
+		// Input is only accepted by the agent once the handshake has completed
+		select {
+		case <-c.ready:
+		case <-ctx.Done():
+			return
+		}
+
+		buf := make([]byte, 4096)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				if err := c.sendInput(PayloadOutput, append([]byte(nil), buf[:n]...)); err != nil {
+					stop(err)
+					return
+				}
+			}
+
+			if err == io.EOF {
+				stop(nil)
+				return
+			}
+			if err != nil {
+				stop(err)
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	resend := time.NewTicker(resendTimeout)
+	defer resend.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, []byte("keepalive"), time.Now().Add(10*time.Second)); err != nil {
+				return err
+			}
+		case now := <-resend.C:
+			if err := c.resend(now); err != nil {
+				return err
+			}
+		case size, ok := <-sizes:
+			if !ok {
+				sizes = nil
+				continue
+			}
+
+			// Sizes received before the session is ready are sent once it is
+			go func() {
+				select {
+				case <-c.ready:
+					if err := c.Resize(size); err != nil {
+						stop(err)
+					}
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+}
+
+// readLoop handles the messages received from the agent until the session is closed
+func (c *DataChannel) readLoop(stdout io.Writer) error {
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("Session data channel closed unexpectedly\n%v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		m := &AgentMessage{}
+		if err = m.UnmarshalBinary(data); err != nil {
+			return err
+		}
+
+		switch m.MessageType {
+		case OutputStreamMessage:
+			// Unacknowledged messages are resent by the agent, so failing to acknowledge one is not fatal
+			c.acknowledge(m)
+
+			// Messages are processed in order, ignoring those that were already processed
+			if m.SequenceNumber < c.outputSequence {
+				continue
+			}
+			c.buffered[m.SequenceNumber] = m
+
+			for next, ok := c.buffered[c.outputSequence]; ok; next, ok = c.buffered[c.outputSequence] {
+				delete(c.buffered, c.outputSequence)
+				c.outputSequence++
+
+				if err = c.process(next, stdout); err != nil {
+					return err
+				}
+			}
+
+		case ChannelClosedMessage:
+			closed := channelClosed{}
+			json.Unmarshal(m.Payload, &closed)
+			if closed.Output != "" {
+				return fmt.Errorf("Session %s was closed: %s", closed.SessionId, closed.Output)
+			}
+			return nil
+
+		case AcknowledgeMessage:
+			c.acknowledged(m.Payload)
+
+		case StartPublicationMessage:
+			c.setPublishing(true)
+
+		case PausePublicationMessage:
+			c.setPublishing(false)
+		}
+	}
+}
+
+// process handles an output stream message from the agent, in sequence
+func (c *DataChannel) process(m *AgentMessage, stdout io.Writer) error {
+	switch m.PayloadType {
+	case PayloadOutput, PayloadStdErr:
+		c.markReady()
+		_, err := stdout.Write(m.Payload)
+		return err
+
+	case PayloadHandshakeRequest:
+		return c.handshake(m.Payload)
+
+	case PayloadHandshakeComplete:
+		c.markReady()
+	}
+
+	return nil
+}
+
+// handshake replies to the handshake request of the agent, accepting the session types that are supported
+func (c *DataChannel) handshake(payload []byte) error {
+	request := handshakeRequest{}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return fmt.Errorf("Could not parse the session handshake request\n%v", err)
+	}
+
+	response := handshakeResponse{ClientVersion: ClientVersion, Errors: []string{}}
+	var sessionErr error
+
+	for _, action := range request.RequestedClientActions {
+		processed := processedClientAction{ActionType: action.ActionType, ActionStatus: actionSuccess}
+
+		switch action.ActionType {
+		case "SessionType":
+			sessionType := sessionTypeRequest{}
+			json.Unmarshal(action.ActionParameters, &sessionType)
+			c.SessionType = sessionType.SessionType
+
+			// Only the agents that multiplex the connections of local port forwarding sessions are supported, see mux
+			portType, _ := sessionType.Properties["type"].(string)
+			if c.SessionType == PortSession && portType == "LocalPortForwarding" && !versionAtLeast(request.AgentVersion, muxAgentVersion) {
+				processed.ActionStatus, processed.Error = actionUnsupported, "Port forwarding without multiplexing is not supported"
+				sessionErr = fmt.Errorf("Port forwarding requires version %s or later of the SSM agent, the instance runs %q", muxAgentVersion, request.AgentVersion)
+			}
+
+		default:
+			// KMS encryption of the session data is not implemented
+			processed.ActionStatus, processed.Error = actionUnsupported, fmt.Sprintf("%s is not supported", action.ActionType)
+			sessionErr = fmt.Errorf("The session requires %s, which is not supported natively", action.ActionType)
+		}
+
+		if processed.Error != "" {
+			response.Errors = append(response.Errors, processed.Error)
+		}
+		response.ProcessedClientActions = append(response.ProcessedClientActions, processed)
+	}
+
+	// The response is sent from the read loop, which would no longer see the agent resume publication if it
+	// waited for it
+	b, _ := json.Marshal(response)
+	if err := c.sendInputNow(PayloadHandshakeResponse, b); err != nil {
+		return err
+	}
+
+	return sessionErr
+}
+
+// versionAtLeast returns whether the dotted version is the same as or later than min. Versions that can't be
+// parsed are considered earlier.
+func versionAtLeast(version, min string) bool {
+	v, m := strings.Split(version, "."), strings.Split(min, ".")
+	for i := range m {
+		want, _ := strconv.Atoi(m[i])
+
+		got := 0
+		if i < len(v) {
+			var err error
+			if got, err = strconv.Atoi(v[i]); err != nil {
+				return false
+			}
+		}
+
+		if got != want {
+			return got > want
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,460 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+)
+
+// fakeAgent is the agent end of a data channel, served over a local websocket
+type fakeAgent struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	sequence int64
+
+	// received are the sequence numbers of the input messages received
+	received map[int64]bool
+
+	// open is the first message sent by the client
+	open openDataChannelInput
+}
+
+// newFakeAgentServer serves a data channel at the returned websocket URL, handled by fn. The returned channel
+// is closed once fn returns; the websocket is kept open until the client closes it.
+func newFakeAgentServer(t *testing.T, fn func(a *fakeAgent)) (*httptest.Server, string, <-chan struct{}) {
+	upgrader := websocket.Upgrader{}
+	done := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		a := &fakeAgent{t: t, conn: conn, received: make(map[int64]bool)}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		json.Unmarshal(data, &a.open)
+
+		fn(a)
+		close(done)
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+
+	return server, "ws" + strings.TrimPrefix(server.URL, "http"), done
+}
+
+// output sends an output stream message with the given sequence number
+func (a *fakeAgent) output(sequence int64, payloadType PayloadType, payload []byte) {
+	b, _ := newMessage(OutputStreamMessage, sequence, flagData, payloadType, payload).MarshalBinary()
+	if err := a.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		a.t.Error(err)
+	}
+}
+
+// send sends an output stream message with the next sequence number
+func (a *fakeAgent) send(payloadType PayloadType, payload []byte) {
+	a.output(a.sequence, payloadType, payload)
+	a.sequence++
+}
+
+func (a *fakeAgent) sendMessage(messageType string, payload []byte) {
+	b, _ := newMessage(messageType, 0, flagData, 0, payload).MarshalBinary()
+	if err := a.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		a.t.Error(err)
+	}
+}
+
+// receive returns the next input stream message sent by the client and acknowledges it, skipping the messages
+// that were sent again
+func (a *fakeAgent) receive() *AgentMessage {
+	for {
+		m := a.next()
+		a.ack(m)
+		if !a.received[m.SequenceNumber] {
+			a.received[m.SequenceNumber] = true
+			return m
+		}
+	}
+}
+
+// next returns the next input stream message sent by the client, skipping acknowledgements, without
+// acknowledging it
+func (a *fakeAgent) next() *AgentMessage {
+	for {
+		_, data, err := a.conn.ReadMessage()
+		if err != nil {
+			a.t.Error(err)
+			return &AgentMessage{}
+		}
+
+		m := &AgentMessage{}
+		if err = m.UnmarshalBinary(data); err != nil {
+			a.t.Error(err)
+			return m
+		}
+
+		if m.MessageType == InputStreamMessage {
+			return m
+		}
+	}
+}
+
+// handshake requests a session of the given type as the given version of the agent, and returns the response
+// of the client
+func (a *fakeAgent) handshake(agentVersion, sessionType string, properties map[string]interface{}) handshakeResponse {
+	request, _ := json.Marshal(sessionTypeRequest{SessionType: sessionType, Properties: properties})
+	handshake, _ := json.Marshal(map[string]interface{}{
+		"AgentVersion": agentVersion,
+		"RequestedClientActions": []map[string]interface{}{
+			{"ActionType": "SessionType", "ActionParameters": json.RawMessage(request)},
+		},
+	})
+	a.send(PayloadHandshakeRequest, handshake)
+
+	m := a.receive()
+	assert.Equal(a.t, PayloadHandshakeResponse, m.PayloadType)
+
+	response := handshakeResponse{}
+	json.Unmarshal(m.Payload, &response)
+	return response
+}
+
+func (a *fakeAgent) ack(m *AgentMessage) {
+	payload, _ := json.Marshal(acknowledgeContent{
+		AcknowledgedMessageType:           m.MessageType,
+		AcknowledgedMessageId:             m.MessageID.String(),
+		AcknowledgedMessageSequenceNumber: m.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+	a.sendMessage(AcknowledgeMessage, payload)
+}
+
+func (a *fakeAgent) close(output string) {
+	payload, _ := json.Marshal(channelClosed{SessionId: "session-1", Output: output})
+	a.sendMessage(ChannelClosedMessage, payload)
+}
+
+// syncBuffer is a buffer that can be written by the data channel while being read by the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDataChannelRun(t *testing.T) {
+	assert := assert.New(t)
+
+	var response handshakeResponse
+	var input, size *AgentMessage
+	var open openDataChannelInput
+
+	server, url, done := newFakeAgentServer(t, func(a *fakeAgent) {
+		open = a.open
+		response = a.handshake("3.1.0.0", StandardStreamSession, nil)
+		a.send(PayloadHandshakeComplete, []byte("{}"))
+		a.send(PayloadOutput, []byte("hello\r\n"))
+
+		// The terminal size and the input can arrive in any order
+		for i := 0; i < 2; i++ {
+			m := a.receive()
+			if m.PayloadType == PayloadSize {
+				size = m
+			} else {
+				input = m
+			}
+		}
+
+		a.send(PayloadOutput, []byte("exit\r\n"))
+		a.close("")
+	})
+	defer server.Close()
+
+	c, err := Dial(context.Background(), NewDialer(nil), url, "token")
+	assert.NoError(err)
+	defer c.Close()
+
+	sizes := make(chan TerminalSize, 1)
+	sizes <- TerminalSize{Cols: 80, Rows: 24}
+
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	go stdinWriter.Write([]byte("exit\n"))
+
+	stdout := &syncBuffer{}
+	assert.NoError(c.Run(context.Background(), stdin, stdout, sizes))
+	<-done
+
+	assert.Equal("token", open.TokenValue)
+	assert.Equal(ClientVersion, open.ClientVersion)
+
+	assert.Equal(StandardStreamSession, c.SessionType)
+	assert.Empty(response.Errors)
+	assert.Equal(actionSuccess, response.ProcessedClientActions[0].ActionStatus)
+
+	if assert.NotNil(input) {
+		assert.Equal([]byte("exit\n"), input.Payload)
+	}
+	if assert.NotNil(size) {
+		assert.JSONEq(`{"cols":80,"rows":24}`, string(size.Payload))
+	}
+
+	assert.Equal("hello\r\nexit\r\n", stdout.String())
+}
+
+func TestDataChannelOutputOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	server, url, _ := newFakeAgentServer(t, func(a *fakeAgent) {
+		// Messages are sent out of order, and some of them more than once
+		a.output(1, PayloadOutput, []byte("b"))
+		a.output(0, PayloadOutput, []byte("a"))
+		a.output(0, PayloadOutput, []byte("a"))
+		a.output(3, PayloadOutput, []byte("d"))
+		a.output(2, PayloadOutput, []byte("c"))
+		a.close("")
+	})
+	defer server.Close()
+
+	c, err := Dial(context.Background(), NewDialer(nil), url, "token")
+	assert.NoError(err)
+	defer c.Close()
+
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+
+	stdout := &syncBuffer{}
+	assert.NoError(c.Run(context.Background(), stdin, stdout, nil))
+	assert.Equal("abcd", stdout.String())
+}
+
+func TestDataChannelResend(t *testing.T) {
+	assert := assert.New(t)
+	resendTimeout = 20 * time.Millisecond
+	defer func() { resendTimeout = time.Second }()
+
+	var first, second *AgentMessage
+	server, url, done := newFakeAgentServer(t, func(a *fakeAgent) {
+		a.handshake("3.1.0.0", StandardStreamSession, nil)
+		a.send(PayloadHandshakeComplete, []byte("{}"))
+
+		// The acknowledgement of the input is lost, so the client sends it again
+		first = a.next()
+		second = a.next()
+		a.ack(second)
+
+		a.send(PayloadOutput, []byte("exit\r\n"))
+		a.close("")
+	})
+	defer server.Close()
+
+	c, err := Dial(context.Background(), NewDialer(nil), url, "token")
+	assert.NoError(err)
+	defer c.Close()
+
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	go stdinWriter.Write([]byte("exit\n"))
+
+	assert.NoError(c.Run(context.Background(), stdin, ioutil.Discard, nil))
+	<-done
+
+	if assert.NotNil(first) && assert.NotNil(second) {
+		assert.Equal(first.SequenceNumber, second.SequenceNumber)
+		assert.Equal([]byte("exit\n"), second.Payload)
+	}
+
+	// Acknowledged messages are no longer sent again
+	c.inputMu.Lock()
+	assert.Empty(c.pending)
+	c.inputMu.Unlock()
+}
+
+func TestDataChannelHandshakeWhilePaused(t *testing.T) {
+	assert := assert.New(t)
+
+	var response handshakeResponse
+	server, url, done := newFakeAgentServer(t, func(a *fakeAgent) {
+		// The handshake is still answered while the agent has paused input
+		a.sendMessage(PausePublicationMessage, nil)
+		response = a.handshake("3.1.0.0", StandardStreamSession, nil)
+		a.sendMessage(StartPublicationMessage, nil)
+		a.send(PayloadHandshakeComplete, []byte("{}"))
+		a.close("")
+	})
+	defer server.Close()
+
+	c, err := Dial(context.Background(), NewDialer(nil), url, "token")
+	assert.NoError(err)
+	defer c.Close()
+
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	assert.NoError(c.Run(ctx, stdin, ioutil.Discard, nil))
+	<-done
+	assert.Empty(response.Errors)
+}
+
+func TestDataChannelClosedWithError(t *testing.T) {
+	server, url, _ := newFakeAgentServer(t, func(a *fakeAgent) {
+		a.close("Session could not be started")
+	})
+	defer server.Close()
+
+	c, err := Dial(context.Background(), NewDialer(nil), url, "token")
+	assert.NoError(t, err)
+	defer c.Close()
+
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+
+	err = c.Run(context.Background(), stdin, ioutil.Discard, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Session could not be started")
+	}
+}
+
+func TestDataChannelUnsupportedHandshake(t *testing.T) {
+	assert := assert.New(t)
+
+	var response handshakeResponse
+	server, url, done := newFakeAgentServer(t, func(a *fakeAgent) {
+		request, _ := json.Marshal(map[string]interface{}{
+			"AgentVersion": "3.1.0.0",
+			"RequestedClientActions": []map[string]interface{}{
+				{"ActionType": "KMSEncryption", "ActionParameters": map[string]string{"KMSKeyId": "key"}},
+			},
+		})
+		a.send(PayloadHandshakeRequest, request)
+
+		m := a.receive()
+		json.Unmarshal(m.Payload, &response)
+	})
+	defer server.Close()
+
+	c, err := Dial(context.Background(), NewDialer(nil), url, "token")
+	assert.NoError(err)
+	defer c.Close()
+
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+
+	assert.Error(c.Run(context.Background(), stdin, ioutil.Discard, nil))
+	<-done
+	assert.Equal(actionUnsupported, response.ProcessedClientActions[0].ActionStatus)
+	assert.Len(response.Errors, 1)
+}
+
+func TestStart(t *testing.T) {
+	assert := assert.New(t)
+
+	server, url, _ := newFakeAgentServer(t, func(a *fakeAgent) {
+		a.send(PayloadOutput, []byte("hello"))
+		a.close("")
+	})
+	defer server.Close()
+
+	client := &mocks.MockSSMStreamClient{StreamUrl: url, TokenValue: "token"}
+
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+
+	stdout := &syncBuffer{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	assert.NoError(Start(ctx, client, NewDialer(nil), &ssm.StartSessionInput{Target: aws.String("i-123")}, stdin, stdout, nil))
+	assert.Equal("hello", stdout.String())
+	assert.Equal([]string{"session-1"}, client.Terminated)
+
+	// Sessions that can't be started are reported
+	client.StreamUrl = ""
+	assert.Error(Start(ctx, client, NewDialer(nil), &ssm.StartSessionInput{Target: aws.String("i-456")}, stdin, stdout, nil))
+	assert.Len(client.Terminated, 1)
+}
+
+func TestDataChannelPortHandshake(t *testing.T) {
+	assert := assert.New(t)
+
+	properties := map[string]interface{}{"portNumber": "80", "type": "LocalPortForwarding"}
+	for version, supported := range map[string]bool{"3.0.196.0": true, "3.1.1004.0": true, "3.0.161.0": false, "": false} {
+		var response handshakeResponse
+		server, url, done := newFakeAgentServer(t, func(a *fakeAgent) {
+			response = a.handshake(version, PortSession, properties)
+			a.send(PayloadHandshakeComplete, []byte("{}"))
+			a.close("")
+		})
+
+		c, err := Dial(context.Background(), NewDialer(nil), url, "token")
+		assert.NoError(err)
+
+		stdin, stdinWriter := io.Pipe()
+		err = c.Run(context.Background(), stdin, ioutil.Discard, nil)
+		<-done
+
+		if supported {
+			assert.NoError(err, version)
+			assert.Empty(response.Errors, version)
+		} else {
+			assert.Error(err, version)
+			assert.Equal(actionUnsupported, response.ProcessedClientActions[0].ActionStatus, version)
+		}
+
+		stdinWriter.Close()
+		c.Close()
+		server.Close()
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(versionAtLeast("3.0.196.0", "3.0.196.0"))
+	assert.True(versionAtLeast("3.0.1124.0", "3.0.196.0"))
+	assert.True(versionAtLeast("3.1", "3.0.196.0"))
+	assert.False(versionAtLeast("3.0.161.0", "3.0.196.0"))
+	assert.False(versionAtLeast("2.3.1319.0", "3.0.196.0"))
+	assert.False(versionAtLeast("", "3.0.196.0"))
+	assert.False(versionAtLeast("latest", "3.0.196.0"))
+}
@@ -0,0 +1,232 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// PortForwardingDocument forwards a local port to a port on the target instance
+	PortForwardingDocument = "AWS-StartPortForwardingSession"
+
+	// RemoteHostPortForwardingDocument forwards a local port to a host reachable from the target instance,
+	// e.g. an RDS endpoint behind a bastion
+	RemoteHostPortForwardingDocument = "AWS-StartPortForwardingSessionToRemoteHost"
+)
+
+// PortForward describes a single port forwarded through a session with an instance
+type PortForward struct {
+	// LocalPort is the port to listen on locally, or 0 to pick a free port
+	LocalPort int
+
+	// Host is the remote host to forward to, or empty to forward to the instance itself
+	Host string
+
+	// RemotePort is the port on the instance or remote host to forward to
+	RemotePort int
+}
+
+// ParsePortForward parses a forward in [local_port:][host:]remote_port format, e.g. 8080:80 or 5432:db.example.com:5432
+func ParsePortForward(spec string) (f PortForward, err error) {
+	parts := strings.Split(spec, ":")
+
+	switch len(parts) {
+	case 1:
+		f.RemotePort, err = parsePort(parts[0])
+	case 2:
+		// Either local_port:remote_port or host:remote_port, depending on whether the first part is a number
+		if _, convErr := strconv.Atoi(parts[0]); convErr == nil {
+			f.LocalPort, err = parsePort(parts[0])
+		} else {
+			f.Host = parts[0]
+		}
+		if err == nil {
+			f.RemotePort, err = parsePort(parts[1])
+		}
+	case 3:
+		f.Host = parts[1]
+		if f.LocalPort, err = parsePort(parts[0]); err == nil {
+			f.RemotePort, err = parsePort(parts[2])
+		}
+	default:
+		err = fmt.Errorf("expected [local_port:][host:]remote_port")
+	}
+
+	if err == nil && len(parts) == 3 && f.Host == "" {
+		err = fmt.Errorf("host cannot be empty")
+	}
+	if err != nil {
+		return PortForward{}, fmt.Errorf("Invalid port forward %q: %v", spec, err)
+	}
+
+	return f, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a valid port number", s)
+	}
+
+	return port, nil
+}
+
+// Document returns the name of the SSM document used to start the port forwarding session
+func (f PortForward) Document() string {
+	if f.Host != "" {
+		return RemoteHostPortForwardingDocument
+	}
+
+	return PortForwardingDocument
+}
+
+// Parameters returns the parameters of the port forwarding document
+func (f PortForward) Parameters() map[string][]string {
+	parameters := map[string][]string{
+		"portNumber":      {strconv.Itoa(f.RemotePort)},
+		"localPortNumber": {strconv.Itoa(f.LocalPort)},
+	}
+
+	if f.Host != "" {
+		parameters["host"] = []string{f.Host}
+	}
+
+	return parameters
+}
+
+// SessionInput returns the StartSession input of the port forwarding session with the given instance
+func (f PortForward) SessionInput(instanceID string) *ssm.StartSessionInput {
+	parameters := map[string][]*string{}
+	for k, v := range f.Parameters() {
+		parameters[k] = aws.StringSlice(v)
+	}
+
+	return &ssm.StartSessionInput{
+		Target:       aws.String(instanceID),
+		DocumentName: aws.String(f.Document()),
+		Parameters:   parameters,
+	}
+}
+
+// Listen listens on the local port of the forward, setting LocalPort to a free port if it was not set. The
+// listener is passed to Forward, so that the port can't be taken in the meantime.
+func (f *PortForward) Listen() (net.Listener, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", f.LocalPort))
+	if err != nil {
+		return nil, fmt.Errorf("Could not listen on local port %d\n%v", f.LocalPort, err)
+	}
+
+	f.LocalPort = l.Addr().(*net.TCPAddr).Port
+	return l, nil
+}
+
+func (f PortForward) String() string {
+	host := f.Host
+	if host == "" {
+		host = "instance"
+	}
+
+	return fmt.Sprintf("localhost:%d -> %s:%d", f.LocalPort, host, f.RemotePort)
+}
+
+// Forward forwards the connections accepted on l, returned by the Listen method of f, to the instance through a
+// port forwarding session, until the session ends or ctx is canceled. l is closed once Forward returns.
+func Forward(ctx context.Context, client ssmiface.SSMAPI, dialer *websocket.Dialer, instanceID string, f PortForward, l net.Listener) error {
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The connections are multiplexed over the input and output of the session
+	stdin, muxWriter := io.Pipe()
+	muxReader, stdout := io.Pipe()
+	m := newMux(muxWriter)
+
+	var muxErr error
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		if muxErr = m.readLoop(muxReader); muxErr != nil {
+			cancel()
+		}
+	}()
+
+	go m.keepAlive(ctx)
+
+	var conns sync.WaitGroup
+	acceptDone := make(chan struct{})
+	go func() {
+		defer close(acceptDone)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				forwardConn(ctx, conn, m)
+			}()
+		}
+	}()
+
+	err := Start(ctx, client, dialer, f.SessionInput(instanceID), stdin, stdout, nil)
+
+	// Stop accepting connections, and close those still open
+	l.Close()
+	cancel()
+	m.close(io.EOF)
+	stdin.Close()
+	stdout.Close()
+	<-readDone
+	<-acceptDone
+	conns.Wait()
+
+	// A protocol error stops the session, which then returns that it was canceled
+	if muxErr != nil && (err == nil || errors.Is(err, context.Canceled)) {
+		return fmt.Errorf("Port forwarding session with %s failed\n%v", instanceID, muxErr)
+	}
+
+	return err
+}
+
+// forwardConn copies the data of the local connection to a new stream of the mux and back, until either is closed
+// or ctx is canceled
+func forwardConn(ctx context.Context, conn net.Conn, m *mux) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	s, err := m.open()
+	if err != nil {
+		return
+	}
+	defer s.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(conn, s)
+		conn.Close()
+	}()
+
+	io.Copy(s, conn)
+	s.Close()
+	<-done
+}
@@ -0,0 +1,211 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+
+	mocks "github.com/disneystreaming/ssm-helpers/testing"
+)
+
+func TestParsePortForward(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]PortForward{
+		"80":                        {RemotePort: 80},
+		"8080:80":                   {LocalPort: 8080, RemotePort: 80},
+		"db.example.com:5432":       {Host: "db.example.com", RemotePort: 5432},
+		"15432:db.example.com:5432": {LocalPort: 15432, Host: "db.example.com", RemotePort: 5432},
+	}
+
+	for spec, expected := range tests {
+		f, err := ParsePortForward(spec)
+		assert.NoError(err, spec)
+		assert.Equal(expected, f, spec)
+	}
+
+	for _, spec := range []string{"", "http", "0", "70000", "8080:", "1:2:3:4", "8080::80", "8080:db:port"} {
+		_, err := ParsePortForward(spec)
+		assert.Error(err, spec)
+	}
+}
+
+func TestPortForwardSessionInput(t *testing.T) {
+	assert := assert.New(t)
+
+	input := PortForward{LocalPort: 8080, RemotePort: 80}.SessionInput("i-123")
+	assert.Equal("i-123", aws.StringValue(input.Target))
+	assert.Equal(PortForwardingDocument, aws.StringValue(input.DocumentName))
+	assert.Equal(map[string][]*string{
+		"localPortNumber": aws.StringSlice([]string{"8080"}),
+		"portNumber":      aws.StringSlice([]string{"80"}),
+	}, input.Parameters)
+
+	input = PortForward{LocalPort: 15432, Host: "db.example.com", RemotePort: 5432}.SessionInput("i-123")
+	assert.Equal(RemoteHostPortForwardingDocument, aws.StringValue(input.DocumentName))
+	assert.Equal([]string{"db.example.com"}, aws.StringValueSlice(input.Parameters["host"]))
+}
+
+func TestPortForwardListen(t *testing.T) {
+	assert := assert.New(t)
+
+	f := PortForward{RemotePort: 80}
+	l, err := f.Listen()
+	assert.NoError(err)
+	defer l.Close()
+	assert.NotZero(f.LocalPort)
+	assert.Equal(f.LocalPort, l.Addr().(*net.TCPAddr).Port)
+
+	// The port stays taken until the listener is closed
+	_, err = (&PortForward{LocalPort: f.LocalPort, RemotePort: 80}).Listen()
+	assert.Error(err)
+}
+
+// muxFrame builds a frame of the port forwarding protocol
+func muxFrame(cmd byte, id uint32, data []byte) []byte {
+	frame := make([]byte, muxHeaderLength, muxHeaderLength+len(data))
+	frame[0], frame[1] = muxVersion, cmd
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:], id)
+	return append(frame, data...)
+}
+
+func TestForward(t *testing.T) {
+	assert := assert.New(t)
+
+	var opened []uint32
+	server, url, done := newFakeAgentServer(t, func(a *fakeAgent) {
+		a.handshake("3.1.0.0", PortSession, map[string]interface{}{"portNumber": "80", "type": "LocalPortForwarding"})
+		a.send(PayloadHandshakeComplete, []byte("{}"))
+
+		// The agent echoes the data of the stream in upper case, then closes the session once the stream is closed
+		var input []byte
+		for {
+			input = append(input, a.receive().Payload...)
+			for len(input) >= muxHeaderLength {
+				length := int(binary.LittleEndian.Uint16(input[2:]))
+				if len(input) < muxHeaderLength+length {
+					break
+				}
+				cmd, id, data := input[1], binary.LittleEndian.Uint32(input[4:]), input[muxHeaderLength:muxHeaderLength+length]
+				input = input[muxHeaderLength+length:]
+
+				switch cmd {
+				case muxSYN:
+					opened = append(opened, id)
+				case muxPSH:
+					a.send(PayloadOutput, muxFrame(muxPSH, id, bytes.ToUpper(data)))
+				case muxFIN:
+					a.close("")
+					return
+				}
+			}
+		}
+	})
+	defer server.Close()
+
+	f := PortForward{RemotePort: 80}
+	l, err := f.Listen()
+	assert.NoError(err)
+
+	client := &mocks.MockSSMStreamClient{StreamUrl: url, TokenValue: "token"}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	forwardErr := make(chan error, 1)
+	go func() {
+		forwardErr <- Forward(ctx, client, NewDialer(nil), "i-123", f, l)
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(f.LocalPort))
+	if !assert.NoError(err) {
+		return
+	}
+
+	conn.Write([]byte("hello"))
+	echo := make([]byte, 5)
+	_, err = io.ReadFull(conn, echo)
+	assert.NoError(err)
+	assert.Equal("HELLO", string(echo))
+	conn.Close()
+
+	assert.NoError(<-forwardErr)
+	<-done
+
+	assert.Equal([]uint32{3}, opened)
+	assert.Equal(PortForwardingDocument, aws.StringValue(client.Started[0].DocumentName))
+	assert.Equal([]string{"session-1"}, client.Terminated)
+}
+
+func TestForwardOldAgent(t *testing.T) {
+	server, url, _ := newFakeAgentServer(t, func(a *fakeAgent) {
+		a.handshake("3.0.161.0", PortSession, map[string]interface{}{"portNumber": "80", "type": "LocalPortForwarding"})
+	})
+	defer server.Close()
+
+	f := PortForward{RemotePort: 80}
+	l, err := f.Listen()
+	assert.NoError(t, err)
+
+	client := &mocks.MockSSMStreamClient{StreamUrl: url, TokenValue: "token"}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = Forward(ctx, client, NewDialer(nil), "i-123", f, l)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), muxAgentVersion)
+	}
+}
+
+func TestMux(t *testing.T) {
+	assert := assert.New(t)
+
+	out := &syncBuffer{}
+	m := newMux(out)
+
+	s, err := m.open()
+	assert.NoError(err)
+
+	// Writes are split into frames of at most muxMaxFrameSize bytes
+	n, err := s.Write(make([]byte, muxMaxFrameSize+1))
+	assert.NoError(err)
+	assert.Equal(muxMaxFrameSize+1, n)
+
+	var expected []byte
+	expected = append(expected, muxFrame(muxSYN, 3, nil)...)
+	expected = append(expected, muxFrame(muxPSH, 3, make([]byte, muxMaxFrameSize))...)
+	expected = append(expected, muxFrame(muxPSH, 3, make([]byte, 1))...)
+	assert.Equal(string(expected), out.String())
+
+	// The data of the agent is read from the stream until the agent closes it
+	r, w := io.Pipe()
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- m.readLoop(r)
+	}()
+	go func() {
+		w.Write(muxFrame(muxNOP, 0, nil))
+		w.Write(muxFrame(muxPSH, 3, []byte("hello")))
+		w.Write(muxFrame(muxFIN, 3, nil))
+		w.Write([]byte{2, muxPSH, 0, 0, 3, 0, 0, 0})
+	}()
+
+	data, err := ioutil.ReadAll(s)
+	assert.NoError(err)
+	assert.Equal("hello", string(data))
+	assert.Error(<-readErr)
+
+	// Streams can't be opened once the mux is closed
+	m.close(io.EOF)
+	_, err = m.open()
+	assert.Equal(io.EOF, err)
+}
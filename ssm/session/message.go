@@ -0,0 +1,177 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message types of the Session Manager data channel
+const (
+	InputStreamMessage      = "input_stream_data"
+	OutputStreamMessage     = "output_stream_data"
+	AcknowledgeMessage      = "acknowledge"
+	ChannelClosedMessage    = "channel_closed"
+	StartPublicationMessage = "start_publication"
+	PausePublicationMessage = "pause_publication"
+)
+
+// PayloadType identifies the content of the payload of a stream data message
+type PayloadType uint32
+
+// Payload types of stream data messages
+const (
+	PayloadOutput            PayloadType = 1
+	PayloadError             PayloadType = 2
+	PayloadSize              PayloadType = 3
+	PayloadParameter         PayloadType = 4
+	PayloadHandshakeRequest  PayloadType = 5
+	PayloadHandshakeResponse PayloadType = 6
+	PayloadHandshakeComplete PayloadType = 7
+	PayloadEncChallengeReq   PayloadType = 8
+	PayloadEncChallengeResp  PayloadType = 9
+	PayloadFlag              PayloadType = 10
+	PayloadStdErr            PayloadType = 11
+	PayloadExitCode          PayloadType = 12
+)
+
+// Flags of stream data messages
+const (
+	flagData uint64 = 0
+	flagAck  uint64 = 3
+)
+
+// Offsets of the fields of a serialized message. The header length field covers every field up to the payload length.
+const (
+	headerLengthOffset   = 0
+	messageTypeOffset    = 4
+	schemaVersionOffset  = 36
+	createdDateOffset    = 40
+	sequenceNumberOffset = 48
+	flagsOffset          = 56
+	messageIDOffset      = 64
+	payloadDigestOffset  = 80
+	payloadTypeOffset    = 112
+	payloadLengthOffset  = 116
+	payloadOffset        = 120
+
+	messageTypeLength = 32
+	headerLength      = payloadLengthOffset
+)
+
+// UUID is a random (version 4) UUID identifying a message
+type UUID [16]byte
+
+// NewUUID returns a new random UUID
+func NewUUID() (u UUID) {
+	rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return u
+}
+
+func (u UUID) String() string {
+	h := hex.EncodeToString(u[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// AgentMessage is a single message sent over the data channel in either direction
+type AgentMessage struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    time.Time
+	SequenceNumber int64
+	Flags          uint64
+	MessageID      UUID
+	PayloadType    PayloadType
+	Payload        []byte
+}
+
+// newMessage returns a message of the given type with a new ID, created now
+func newMessage(messageType string, sequenceNumber int64, flags uint64, payloadType PayloadType, payload []byte) *AgentMessage {
+	return &AgentMessage{
+		MessageType:    messageType,
+		SchemaVersion:  1,
+		CreatedDate:    time.Now(),
+		SequenceNumber: sequenceNumber,
+		Flags:          flags,
+		MessageID:      NewUUID(),
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+}
+
+// MarshalBinary serializes the message in the big-endian format used by the data channel
+func (m *AgentMessage) MarshalBinary() ([]byte, error) {
+	if len(m.MessageType) > messageTypeLength {
+		return nil, fmt.Errorf("Message type %q is longer than %d bytes", m.MessageType, messageTypeLength)
+	}
+
+	b := make([]byte, payloadOffset+len(m.Payload))
+	binary.BigEndian.PutUint32(b[headerLengthOffset:], headerLength)
+
+	// The message type is padded with spaces
+	copy(b[messageTypeOffset:schemaVersionOffset], bytes.Repeat([]byte(" "), messageTypeLength))
+	copy(b[messageTypeOffset:], m.MessageType)
+
+	binary.BigEndian.PutUint32(b[schemaVersionOffset:], m.SchemaVersion)
+	binary.BigEndian.PutUint64(b[createdDateOffset:], uint64(m.CreatedDate.UnixNano()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint64(b[sequenceNumberOffset:], uint64(m.SequenceNumber))
+	binary.BigEndian.PutUint64(b[flagsOffset:], m.Flags)
+
+	// The least significant half of the message ID is sent first
+	copy(b[messageIDOffset:], m.MessageID[8:])
+	copy(b[messageIDOffset+8:], m.MessageID[:8])
+
+	digest := sha256.Sum256(m.Payload)
+	copy(b[payloadDigestOffset:], digest[:])
+
+	binary.BigEndian.PutUint32(b[payloadTypeOffset:], uint32(m.PayloadType))
+	binary.BigEndian.PutUint32(b[payloadLengthOffset:], uint32(len(m.Payload)))
+	copy(b[payloadOffset:], m.Payload)
+
+	return b, nil
+}
+
+// UnmarshalBinary parses a message serialized by MarshalBinary, verifying the digest of its payload
+func (m *AgentMessage) UnmarshalBinary(b []byte) error {
+	if len(b) < payloadOffset {
+		return fmt.Errorf("Message of %d bytes is shorter than the message header", len(b))
+	}
+
+	// The payload length field always follows the header, whatever its length
+	hl := int(binary.BigEndian.Uint32(b[headerLengthOffset:]))
+	if hl < headerLength || hl+4 > len(b) {
+		return fmt.Errorf("Invalid message header length %d", hl)
+	}
+
+	m.MessageType = strings.TrimRight(string(bytes.TrimRight(b[messageTypeOffset:schemaVersionOffset], "\x00")), " ")
+	m.SchemaVersion = binary.BigEndian.Uint32(b[schemaVersionOffset:])
+	m.CreatedDate = time.Unix(0, int64(binary.BigEndian.Uint64(b[createdDateOffset:]))*int64(time.Millisecond))
+	m.SequenceNumber = int64(binary.BigEndian.Uint64(b[sequenceNumberOffset:]))
+	m.Flags = binary.BigEndian.Uint64(b[flagsOffset:])
+
+	copy(m.MessageID[8:], b[messageIDOffset:messageIDOffset+8])
+	copy(m.MessageID[:8], b[messageIDOffset+8:messageIDOffset+16])
+
+	m.PayloadType = PayloadType(binary.BigEndian.Uint32(b[payloadTypeOffset:]))
+
+	length := int(binary.BigEndian.Uint32(b[hl:]))
+	start := hl + 4
+	if start+length > len(b) {
+		return fmt.Errorf("Message payload of %d bytes is longer than the %d bytes received", length, len(b)-start)
+	}
+	m.Payload = b[start : start+length]
+
+	digest := sha256.Sum256(m.Payload)
+	if !bytes.Equal(digest[:], b[payloadDigestOffset:payloadDigestOffset+sha256.Size]) {
+		return fmt.Errorf("Digest mismatch for the payload of message %s", m.MessageID)
+	}
+
+	return nil
+}
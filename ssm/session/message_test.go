@@ -0,0 +1,58 @@
+package session
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentMessageRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newMessage(OutputStreamMessage, 42, flagData, PayloadOutput, []byte("hello"))
+	b, err := m.MarshalBinary()
+	assert.NoError(err)
+	assert.Len(b, payloadOffset+5)
+	assert.Equal(uint32(headerLength), binary.BigEndian.Uint32(b))
+	assert.Equal("output_stream_data              ", string(b[messageTypeOffset:schemaVersionOffset]))
+
+	// The least significant half of the ID comes first
+	assert.Equal(m.MessageID[8:], b[messageIDOffset:messageIDOffset+8])
+
+	parsed := &AgentMessage{}
+	assert.NoError(parsed.UnmarshalBinary(b))
+	assert.Equal(OutputStreamMessage, parsed.MessageType)
+	assert.Equal(int64(42), parsed.SequenceNumber)
+	assert.Equal(m.MessageID, parsed.MessageID)
+	assert.Equal(PayloadOutput, parsed.PayloadType)
+	assert.Equal([]byte("hello"), parsed.Payload)
+	assert.Equal(m.CreatedDate.Truncate(time.Millisecond).UnixNano(), parsed.CreatedDate.UnixNano())
+}
+
+func TestAgentMessageInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	b, _ := newMessage(OutputStreamMessage, 0, flagData, PayloadOutput, []byte("hello")).MarshalBinary()
+
+	// Corrupted payloads are rejected
+	corrupted := append([]byte(nil), b...)
+	corrupted[payloadOffset] = 'j'
+	assert.Error((&AgentMessage{}).UnmarshalBinary(corrupted))
+
+	// As are truncated messages
+	assert.Error((&AgentMessage{}).UnmarshalBinary(b[:payloadOffset-1]))
+	assert.Error((&AgentMessage{}).UnmarshalBinary(b[:len(b)-1]))
+
+	_, err := newMessage("a_message_type_that_is_far_too_long", 0, flagData, PayloadOutput, nil).MarshalBinary()
+	assert.Error(err)
+}
+
+func TestUUIDString(t *testing.T) {
+	u := NewUUID()
+	s := u.String()
+
+	assert.Len(t, s, 36)
+	assert.Equal(t, byte('4'), s[14])
+}
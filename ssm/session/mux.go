@@ -0,0 +1,216 @@
+package session
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// The connections of local port forwarding sessions are multiplexed over the data channel with version 1 of the
+// smux protocol (github.com/xtaci/smux), the agent being the server. Each frame has an 8-byte header: the version,
+// the command, then the length of the data and the ID of its stream, in little endian.
+const (
+	muxVersion      = 1
+	muxHeaderLength = 8
+
+	// muxMaxFrameSize is the largest amount of data sent in a single frame
+	muxMaxFrameSize = 32768
+
+	// muxAgentVersion is the earliest version of the SSM agent that multiplexes connections
+	muxAgentVersion = "3.0.196.0"
+)
+
+// Commands of mux frames
+const (
+	muxSYN byte = iota // opens a stream
+	muxFIN             // closes a stream
+	muxPSH             // carries data of a stream
+	muxNOP             // keeps the session alive
+)
+
+// muxKeepAliveInterval is the delay between the frames sent to keep the session open while every stream is idle,
+// as the agent closes sessions it hasn't heard from in 30 seconds
+var muxKeepAliveInterval = 10 * time.Second
+
+// mux is the client end of the connections multiplexed over a port forwarding session. Frames are written to the
+// input of the session, and those of the agent are read from its output by readLoop.
+type mux struct {
+	w       io.Writer
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+
+	// err is set once the mux is closed
+	err error
+}
+
+func newMux(w io.Writer) *mux {
+	// Streams opened by the client have odd IDs, starting at 3
+	return &mux{w: w, streams: make(map[uint32]*muxStream), nextID: 1}
+}
+
+func (m *mux) writeFrame(cmd byte, id uint32, data []byte) error {
+	frame := make([]byte, muxHeaderLength, muxHeaderLength+len(data))
+	frame[0], frame[1] = muxVersion, cmd
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:], id)
+
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	_, err := m.w.Write(append(frame, data...))
+	return err
+}
+
+// open opens a new stream to the forwarded port
+func (m *mux) open() (*muxStream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+
+	m.nextID += 2
+	r, w := io.Pipe()
+	s := &muxStream{id: m.nextID, m: m, r: r, w: w}
+	m.streams[s.id] = s
+	m.mu.Unlock()
+
+	if err := m.writeFrame(muxSYN, s.id, nil); err != nil {
+		m.remove(s.id)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (m *mux) stream(id uint32) *muxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.streams[id]
+}
+
+func (m *mux) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// close closes every stream, which then fail to read with err, and prevents new ones from being opened
+func (m *mux) close(err error) {
+	m.mu.Lock()
+	streams := m.streams
+	m.streams, m.err = make(map[uint32]*muxStream), err
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.w.CloseWithError(err)
+	}
+}
+
+// readLoop passes the data of the frames read from r to their streams until r is closed. Data is passed on as it
+// is read, so a stream that isn't read holds up the others.
+func (m *mux) readLoop(r io.Reader) error {
+	header := make([]byte, muxHeaderLength)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if header[0] != muxVersion {
+			return fmt.Errorf("Unsupported version %d of the port forwarding protocol", header[0])
+		}
+
+		data := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+
+		// Frames of streams that were closed locally are dropped
+		s := m.stream(binary.LittleEndian.Uint32(header[4:]))
+
+		switch header[1] {
+		case muxPSH:
+			if s != nil {
+				s.w.Write(data)
+			}
+		case muxFIN:
+			if s != nil {
+				s.w.Close()
+			}
+		case muxSYN, muxNOP:
+			// The agent doesn't open streams, and its keepalives need no reply
+		default:
+			return fmt.Errorf("Invalid port forwarding command %d", header[1])
+		}
+	}
+}
+
+// keepAlive writes a keepalive frame every muxKeepAliveInterval until ctx is canceled
+func (m *mux) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(muxKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.writeFrame(muxNOP, 0, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// muxStream is a connection to the forwarded port, multiplexed over the session
+type muxStream struct {
+	id uint32
+	m  *mux
+
+	// The data received from the agent is written to w by the read loop of the mux
+	r *io.PipeReader
+	w *io.PipeWriter
+
+	closeOnce sync.Once
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// Write sends p to the agent, split into as many frames as needed
+func (s *muxStream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		size := len(p)
+		if size > muxMaxFrameSize {
+			size = muxMaxFrameSize
+		}
+
+		if err = s.m.writeFrame(muxPSH, s.id, p[:size]); err != nil {
+			return n, err
+		}
+		n, p = n+size, p[size:]
+	}
+
+	return n, nil
+}
+
+// Close closes the stream on both ends
+func (s *muxStream) Close() (err error) {
+	s.closeOnce.Do(func() {
+		s.m.remove(s.id)
+		s.r.Close()
+		err = s.m.writeFrame(muxFIN, s.id, nil)
+	})
+
+	return err
+}
@@ -1,12 +1,14 @@
 package session
 
 import (
-	"github.com/aws/aws-sdk-go/aws/awserr"
+	"strings"
+
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 )
 
-// CheckSessionReadiness takes an SSM API session and instance ID and verifies whether or not the instance is available for start-session functionality
+// CheckSessionReadiness takes an SSM API session and instance ID and verifies whether or not the instance is available for start-session functionality.
+// Throttled calls are returned as errors once the client has stopped retrying them, rather than reported as not ready.
 func CheckSessionReadiness(context ssmiface.SSMAPI, instanceID *string) (connected bool, err error) {
 	// Create our getConnectionStatus input object
 	gcsInput := &ssm.GetConnectionStatusInput{
@@ -16,12 +18,7 @@ func CheckSessionReadiness(context ssmiface.SSMAPI, instanceID *string) (connect
 	// Call GetConnectionStatus to determine if the given instance is ready for a session
 	output, err := context.GetConnectionStatus(gcsInput)
 
-	// Suppress errors due to rate limiting
-	if awsErr, ok := err.(awserr.Error); ok && err != nil && awsErr.Code() == "ThrottlingException" {
-		return false, nil
-	}
-
-	if err != nil || *output.Status == "NotConnected" {
+	if err != nil || strings.EqualFold(*output.Status, ssm.ConnectionStatusNotConnected) {
 		return false, err
 	}
 
@@ -0,0 +1,20 @@
+package session
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// SSHSessionDocument tunnels a session over stdin/stdout to a port on the target instance, for use as an SSH ProxyCommand
+const SSHSessionDocument = "AWS-StartSSHSession"
+
+// SSHSessionInput returns the StartSession input of an SSH tunnel to the given port of the instance
+func SSHSessionInput(instanceID string, port int) *ssm.StartSessionInput {
+	return &ssm.StartSessionInput{
+		Target:       aws.String(instanceID),
+		DocumentName: aws.String(SSHSessionDocument),
+		Parameters:   map[string][]*string{"portNumber": aws.StringSlice([]string{strconv.Itoa(port)})},
+	}
+}
@@ -0,0 +1,17 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSHSessionInput(t *testing.T) {
+	assert := assert.New(t)
+
+	input := SSHSessionInput("i-123", 22)
+	assert.Equal("i-123", *input.Target)
+	assert.Equal(SSHSessionDocument, *input.DocumentName)
+	assert.Equal([]string{"22"}, aws.StringValueSlice(input.Parameters["portNumber"]))
+}
@@ -0,0 +1,33 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/gorilla/websocket"
+)
+
+// Start starts a session with the StartSession API and streams stdin and stdout over its data channel
+// until the session ends, then terminates it. Each terminal size received from sizes is sent to the
+// agent; sizes may be nil for sessions that are not attached to a terminal.
+func Start(ctx context.Context, client ssmiface.SSMAPI, dialer *websocket.Dialer, input *ssm.StartSessionInput, stdin io.Reader, stdout io.Writer, sizes <-chan TerminalSize) error {
+	out, err := client.StartSession(input)
+	if err != nil {
+		return fmt.Errorf("Could not start a session with %s\n%v", aws.StringValue(input.Target), err)
+	}
+
+	// The session is terminated even if the data channel fails, so that it doesn't linger until it times out
+	defer client.TerminateSession(&ssm.TerminateSessionInput{SessionId: out.SessionId})
+
+	c, err := Dial(ctx, dialer, aws.StringValue(out.StreamUrl), aws.StringValue(out.TokenValue))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Run(ctx, stdin, stdout, sizes)
+}
@@ -2,6 +2,7 @@ package mocks
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
@@ -19,7 +20,9 @@ func (m *MockEC2Client) DescribeInstances(input *ec2.DescribeInstancesInput) (ou
 			{
 				Instances: []*ec2.Instance{
 					{
-						InstanceId: aws.String("i-123"),
+						InstanceId:   aws.String("i-123"),
+						InstanceType: aws.String("t3.micro"),
+						State:        &ec2.InstanceState{Name: aws.String("running")},
 						Tags: []*ec2.Tag{
 							{
 								Key:   aws.String("id_foo"),
@@ -32,7 +35,9 @@ func (m *MockEC2Client) DescribeInstances(input *ec2.DescribeInstancesInput) (ou
 						},
 					},
 					{
-						InstanceId: aws.String("i-456"),
+						InstanceId:   aws.String("i-456"),
+						InstanceType: aws.String("m5.large"),
+						State:        &ec2.InstanceState{Name: aws.String("running")},
 						Tags: []*ec2.Tag{
 							{
 								Key:   aws.String("id_bar"),
@@ -45,7 +50,9 @@ func (m *MockEC2Client) DescribeInstances(input *ec2.DescribeInstancesInput) (ou
 						},
 					},
 					{
-						InstanceId: aws.String("i-789"),
+						InstanceId:   aws.String("i-789"),
+						InstanceType: aws.String("t3.large"),
+						State:        &ec2.InstanceState{Name: aws.String("stopped")},
 						Tags: []*ec2.Tag{
 							{
 								Key:   aws.String("id_baz"),
@@ -62,6 +69,26 @@ func (m *MockEC2Client) DescribeInstances(input *ec2.DescribeInstancesInput) (ou
 		},
 	}
 
+	// Only the instances matching an instance-id filter are described, unknown IDs are left out
+	for _, f := range input.Filters {
+		if aws.StringValue(f.Name) != "instance-id" {
+			continue
+		}
+
+		ids := make(map[string]bool)
+		for _, v := range f.Values {
+			ids[aws.StringValue(v)] = true
+		}
+
+		var matching []*ec2.Instance
+		for _, i := range output.Reservations[0].Instances {
+			if ids[aws.StringValue(i.InstanceId)] {
+				matching = append(matching, i)
+			}
+		}
+		output.Reservations[0].Instances = matching
+	}
+
 	return output, nil
 }
 
@@ -86,3 +113,24 @@ func (m *MockEC2Client) DescribeInstancesPages(input *ec2.DescribeInstancesInput
 
 	return err
 }
+
+func (m *MockEC2Client) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	return m.DescribeInstancesPages(input, fn)
+}
+
+func (m *MockEC2Client) DescribeRegions(input *ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error) {
+	region := func(name, status string) *ec2.Region {
+		return &ec2.Region{RegionName: aws.String(name), OptInStatus: aws.String(status)}
+	}
+
+	return &ec2.DescribeRegionsOutput{
+		Regions: []*ec2.Region{
+			region("us-west-2", "opt-in-not-required"),
+			region("us-east-1", "opt-in-not-required"),
+			region("eu-west-1", "opt-in-not-required"),
+			region("ap-southeast-1", "opt-in-not-required"),
+			region("af-south-1", "not-opted-in"),
+			region("ap-east-1", "opted-in"),
+		},
+	}, nil
+}
@@ -0,0 +1,99 @@
+package mocks
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+)
+
+// MockOrganizationsClient simulates an organization with a root r-root, the OUs below it and their accounts
+type MockOrganizationsClient struct {
+	organizationsiface.OrganizationsAPI
+
+	// Parents maps the ID of each account and OU to that of its parent
+	Parents map[string]string
+
+	// Accounts holds the accounts of the organization, in the order they are listed
+	Accounts []*organizations.Account
+
+	// Tags holds the tags of each account
+	Tags map[string]map[string]string
+}
+
+// NewMockOrganizationsClient returns an organization with accounts in an ou-dev OU, an ou-prod OU and an
+// ou-prod-eu OU nested below ou-prod
+func NewMockOrganizationsClient() *MockOrganizationsClient {
+	account := func(id, name, status string) *organizations.Account {
+		return &organizations.Account{Id: aws.String(id), Name: aws.String(name), Status: aws.String(status)}
+	}
+
+	return &MockOrganizationsClient{
+		Parents: map[string]string{
+			"ou-dev":       "r-root",
+			"ou-prod":      "r-root",
+			"ou-prod-eu":   "ou-prod",
+			"000000000000": "r-root",
+			"111111111111": "ou-dev",
+			"222222222222": "ou-prod",
+			"333333333333": "ou-prod-eu",
+			"444444444444": "ou-prod",
+		},
+		Accounts: []*organizations.Account{
+			account("000000000000", "management", organizations.AccountStatusActive),
+			account("222222222222", "prod-us", organizations.AccountStatusActive),
+			account("111111111111", "dev", organizations.AccountStatusActive),
+			account("333333333333", "prod-eu", organizations.AccountStatusActive),
+			account("444444444444", "closed", organizations.AccountStatusSuspended),
+		},
+		Tags: map[string]map[string]string{
+			"111111111111": {"env": "dev", "team": "platform"},
+			"222222222222": {"env": "prod", "team": "platform"},
+			"333333333333": {"env": "prod", "team": "data"},
+		},
+	}
+}
+
+func (m *MockOrganizationsClient) ListAccountsPages(input *organizations.ListAccountsInput, fn func(*organizations.ListAccountsOutput, bool) bool) error {
+	// Return one account per page to exercise pagination
+	for i, a := range m.Accounts {
+		if !fn(&organizations.ListAccountsOutput{Accounts: []*organizations.Account{a}}, i == len(m.Accounts)-1) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (m *MockOrganizationsClient) ListAccountsForParentPages(input *organizations.ListAccountsForParentInput, fn func(*organizations.ListAccountsForParentOutput, bool) bool) error {
+	output := &organizations.ListAccountsForParentOutput{}
+	for _, a := range m.Accounts {
+		if m.Parents[aws.StringValue(a.Id)] == aws.StringValue(input.ParentId) {
+			output.Accounts = append(output.Accounts, a)
+		}
+	}
+
+	fn(output, true)
+	return nil
+}
+
+func (m *MockOrganizationsClient) ListOrganizationalUnitsForParentPages(input *organizations.ListOrganizationalUnitsForParentInput, fn func(*organizations.ListOrganizationalUnitsForParentOutput, bool) bool) error {
+	output := &organizations.ListOrganizationalUnitsForParentOutput{}
+	for id, parent := range m.Parents {
+		if parent == aws.StringValue(input.ParentId) && len(id) > 3 && id[:3] == "ou-" {
+			output.OrganizationalUnits = append(output.OrganizationalUnits, &organizations.OrganizationalUnit{Id: aws.String(id)})
+		}
+	}
+
+	fn(output, true)
+	return nil
+}
+
+func (m *MockOrganizationsClient) ListTagsForResourcePages(input *organizations.ListTagsForResourceInput, fn func(*organizations.ListTagsForResourceOutput, bool) bool) error {
+	output := &organizations.ListTagsForResourceOutput{}
+	for k, v := range m.Tags[aws.StringValue(input.ResourceId)] {
+		output.Tags = append(output.Tags, &organizations.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	fn(output, true)
+	return nil
+}
@@ -0,0 +1,71 @@
+package mocks
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+)
+
+type listBucketResult struct {
+	XMLName     xml.Name       `xml:"ListBucketResult"`
+	Name        string         `xml:"Name"`
+	Prefix      string         `xml:"Prefix"`
+	KeyCount    int            `xml:"KeyCount"`
+	MaxKeys     int            `xml:"MaxKeys"`
+	IsTruncated bool           `xml:"IsTruncated"`
+	Contents    []listBucketKV `xml:"Contents"`
+}
+
+type listBucketKV struct {
+	Key  string `xml:"Key"`
+	Size int    `xml:"Size"`
+}
+
+// NewMockS3Server starts a minimal S3-compatible HTTP server for use with a path-style endpoint override.
+// It serves ListObjectsV2 and GetObject requests for the provided objects, which are keyed by "bucket/key".
+func NewMockS3Server(objects map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/")
+
+		// Requests for the bucket itself are object listings
+		if !strings.Contains(path, "/") {
+			prefix := path + "/" + r.URL.Query().Get("prefix")
+			result := listBucketResult{
+				Name:    path,
+				Prefix:  r.URL.Query().Get("prefix"),
+				MaxKeys: 1000,
+			}
+
+			var keys []string
+			for k := range objects {
+				if strings.HasPrefix(k, prefix) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				result.Contents = append(result.Contents, listBucketKV{
+					Key:  strings.TrimPrefix(k, path+"/"),
+					Size: len(objects[k]),
+				})
+			}
+			result.KeyCount = len(result.Contents)
+
+			w.Header().Set("Content-Type", "application/xml")
+			xml.NewEncoder(w).Encode(result)
+			return
+		}
+
+		content, ok := objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+			return
+		}
+
+		w.Write([]byte(content))
+	}))
+}
@@ -3,9 +3,11 @@ package mocks
 import (
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 )
@@ -96,6 +98,10 @@ func (m *MockSSMClient) SendCommand(input *ssm.SendCommandInput) (output *ssm.Se
 	return output, nil
 }
 
+func (m *MockSSMClient) SendCommandWithContext(ctx aws.Context, input *ssm.SendCommandInput, opts ...request.Option) (*ssm.SendCommandOutput, error) {
+	return m.SendCommand(input)
+}
+
 func (m *MockSSMClient) DescribeInstanceInformation(input *ssm.DescribeInstanceInformationInput) (output *ssm.DescribeInstanceInformationOutput, err error) {
 
 	// Mock our response from the SSM API
@@ -183,6 +189,41 @@ func (m *MockSSMClient) DescribeInstanceInformationPages(input *ssm.DescribeInst
 	return err
 }
 
+func (m *MockSSMClient) DescribeInstanceInformationPagesWithContext(ctx aws.Context, input *ssm.DescribeInstanceInformationInput, fn func(*ssm.DescribeInstanceInformationOutput, bool) bool, opts ...request.Option) error {
+	return m.DescribeInstanceInformationPages(input, fn)
+}
+
+// GetConnectionStatus reports instances whose ID ends in "-offline" as not connected, and throttles calls for IDs ending in "-throttled"
+func (m *MockSSMClient) GetConnectionStatus(input *ssm.GetConnectionStatusInput) (output *ssm.GetConnectionStatusOutput, err error) {
+	target := aws.StringValue(input.Target)
+	switch {
+	case strings.HasSuffix(target, "-throttled"):
+		return nil, awserr.New("ThrottlingException", "Rate exceeded", nil)
+	case strings.HasSuffix(target, "-offline"):
+		return &ssm.GetConnectionStatusOutput{Target: input.Target, Status: aws.String(ssm.ConnectionStatusNotConnected)}, nil
+	}
+
+	return &ssm.GetConnectionStatusOutput{Target: input.Target, Status: aws.String(ssm.ConnectionStatusConnected)}, nil
+}
+
+// ListTagsForResource returns the same tags for every managed instance
+func (m *MockSSMClient) ListTagsForResource(input *ssm.ListTagsForResourceInput) (output *ssm.ListTagsForResourceOutput, err error) {
+	if aws.StringValue(input.ResourceType) != ssm.ResourceTypeForTaggingManagedInstance {
+		return nil, awserr.New(ssm.ErrCodeInvalidResourceType, "Invalid resource type", nil)
+	}
+
+	return &ssm.ListTagsForResourceOutput{
+		TagList: []*ssm.Tag{
+			{Key: aws.String("env"), Value: aws.String("onprem")},
+			{Key: aws.String("role"), Value: aws.String("web-01")},
+		},
+	}, nil
+}
+
+func (m *MockSSMClient) ListTagsForResourceWithContext(ctx aws.Context, input *ssm.ListTagsForResourceInput, opts ...request.Option) (*ssm.ListTagsForResourceOutput, error) {
+	return m.ListTagsForResource(input)
+}
+
 func filterDescribeInstanceInformationOutput(input *ssm.DescribeInstanceInformationInput, output *ssm.DescribeInstanceInformationOutput) (*ssm.DescribeInstanceInformationOutput, error) {
 	filteredOutput := []*ssm.InstanceInformation{}
 
@@ -218,3 +259,273 @@ func instanceMatchesFilter(instance ssm.InstanceInformation, filter ssm.Instance
 
 	return false
 }
+
+// MockSSMInvocationClient simulates a running command, where one more of the provided instances
+// reaches its final status each time the status of the command is checked with ListCommands.
+// Sending a command with instance IDs replaces the running command with a new one targeting them.
+type MockSSMInvocationClient struct {
+	MockSSMClient
+	sync.Mutex
+
+	// Instances is the ordered list of instances targeted by the command
+	Instances []string
+
+	// Statuses maps each instance to the final status of its invocation, defaulting to Success
+	Statuses map[string]string
+
+	// DocumentStatuses overrides Statuses for commands running the given document
+	DocumentStatuses map[string]map[string]string
+
+	// SentCommands lists the inputs passed to SendCommand
+	SentCommands []*ssm.SendCommandInput
+
+	// CanceledCommands lists the IDs passed to CancelCommand
+	CanceledCommands []string
+
+	// CancellingPolls is the number of times the status of a canceled command is checked while it is still
+	// Cancelling, defaulting to 1
+	CancellingPolls int
+
+	// Output, if set, returns the standard output of the running command on each instance
+	Output func(commands []string, instanceID string) string
+
+	polls       int
+	cancelPolls int
+	commands    []string
+	finished    int
+	document    string
+}
+
+// invocationStatus returns the ListCommandInvocations status and the status details of an instance
+func (m *MockSSMInvocationClient) invocationStatus(instanceID string) (status string, details string) {
+	for idx, id := range m.Instances {
+		if id != instanceID {
+			continue
+		}
+
+		switch {
+		case idx < m.finished:
+			if status, ok := m.DocumentStatuses[m.document][instanceID]; ok {
+				return status, status
+			}
+			if status, ok := m.Statuses[instanceID]; ok {
+				return status, status
+			}
+			return "Success", "Success"
+		case len(m.CanceledCommands) > 0 && m.cancelling():
+			return "Cancelling", "Cancelling"
+		case len(m.CanceledCommands) > 0:
+			return "Cancelled", "Canceled"
+		}
+	}
+
+	return "InProgress", "InProgress"
+}
+
+// cancelling returns whether the canceled command is still being canceled
+func (m *MockSSMInvocationClient) cancelling() bool {
+	polls := m.CancellingPolls
+	if polls == 0 {
+		polls = 1
+	}
+
+	return m.cancelPolls <= polls
+}
+
+func (m *MockSSMInvocationClient) SendCommand(input *ssm.SendCommandInput) (output *ssm.SendCommandOutput, err error) {
+	if len(input.InstanceIds) > 0 && len(input.Targets) > 0 {
+		return nil, fmt.Errorf("Cannot specify instance IDs and SSM targets in same SendCommandInput")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.SentCommands = append(m.SentCommands, input)
+	m.document = aws.StringValue(input.DocumentName)
+	m.commands = aws.StringValueSlice(input.Parameters["commands"])
+	if len(input.InstanceIds) > 0 {
+		m.Instances = aws.StringValueSlice(input.InstanceIds)
+		m.polls, m.finished = 0, 0
+	}
+
+	return &ssm.SendCommandOutput{
+		Command: &ssm.Command{
+			CommandId:    aws.String("running-id"),
+			DocumentName: input.DocumentName,
+			InstanceIds:  input.InstanceIds,
+			Parameters:   input.Parameters,
+			Targets:      input.Targets,
+		},
+	}, nil
+}
+
+func (m *MockSSMInvocationClient) SendCommandWithContext(ctx aws.Context, input *ssm.SendCommandInput, opts ...request.Option) (*ssm.SendCommandOutput, error) {
+	return m.SendCommand(input)
+}
+
+func (m *MockSSMInvocationClient) CancelCommand(input *ssm.CancelCommandInput) (output *ssm.CancelCommandOutput, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.CanceledCommands = append(m.CanceledCommands, *input.CommandId)
+	return &ssm.CancelCommandOutput{}, nil
+}
+
+func (m *MockSSMInvocationClient) ListCommands(input *ssm.ListCommandsInput) (output *ssm.ListCommandsOutput, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	// Invocations stop finishing once the command has been canceled, and are Cancelling for CancellingPolls polls
+	status := "InProgress"
+	switch {
+	case len(m.CanceledCommands) > 0:
+		m.cancelPolls++
+		status = "Cancelled"
+		if m.cancelling() {
+			status = "Cancelling"
+		}
+	default:
+		m.polls++
+		m.finished = m.polls
+		if m.finished >= len(m.Instances) {
+			status = "Success"
+		}
+	}
+
+	return &ssm.ListCommandsOutput{
+		Commands: []*ssm.Command{
+			{
+				CommandId: input.CommandId,
+				Status:    aws.String(status),
+			},
+		},
+	}, nil
+}
+
+func (m *MockSSMInvocationClient) ListCommandInvocationsPages(input *ssm.ListCommandInvocationsInput, fn func(*ssm.ListCommandInvocationsOutput, bool) bool) error {
+	m.Lock()
+	output := &ssm.ListCommandInvocationsOutput{}
+	for _, id := range m.Instances {
+		status, _ := m.invocationStatus(id)
+		output.CommandInvocations = append(output.CommandInvocations, &ssm.CommandInvocation{
+			CommandId:  input.CommandId,
+			InstanceId: aws.String(id),
+			Status:     aws.String(status),
+		})
+	}
+	m.Unlock()
+
+	fn(output, true)
+	return nil
+}
+
+func (m *MockSSMInvocationClient) GetCommandInvocation(input *ssm.GetCommandInvocationInput) (output *ssm.GetCommandInvocationOutput, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	status, details := m.invocationStatus(*input.InstanceId)
+
+	stdout := ""
+	if m.Output != nil {
+		stdout = m.Output(m.commands, *input.InstanceId)
+	}
+
+	return &ssm.GetCommandInvocationOutput{
+		InstanceId:            input.InstanceId,
+		CommandId:             input.CommandId,
+		Status:                aws.String(status),
+		StatusDetails:         aws.String(details),
+		StandardOutputContent: aws.String(stdout),
+		StandardErrorContent:  aws.String(""),
+	}, nil
+}
+
+// MockSSMHistoryClient returns the provided commands from the ListCommands API,
+// applying the document name and status filters supported by the API
+type MockSSMHistoryClient struct {
+	MockSSMClient
+
+	// Commands are the commands returned by ListCommands, most recent first
+	Commands []*ssm.Command
+}
+
+func (m *MockSSMHistoryClient) ListCommands(input *ssm.ListCommandsInput) (output *ssm.ListCommandsOutput, err error) {
+	output = &ssm.ListCommandsOutput{}
+
+	for _, c := range m.Commands {
+		if input.CommandId != nil && *input.CommandId != *c.CommandId {
+			continue
+		}
+
+		match := true
+		for _, f := range input.Filters {
+			switch *f.Key {
+			case ssm.CommandFilterKeyDocumentName:
+				match = match && *f.Value == *c.DocumentName
+			case ssm.CommandFilterKeyStatus:
+				match = match && *f.Value == *c.Status
+			}
+		}
+
+		if match {
+			output.Commands = append(output.Commands, c)
+		}
+	}
+
+	if input.CommandId != nil && len(output.Commands) == 0 {
+		return nil, awserr.New(ssm.ErrCodeInvalidCommandId, "InvalidCommandId", nil)
+	}
+
+	return output, nil
+}
+
+func (m *MockSSMHistoryClient) ListCommandsPages(input *ssm.ListCommandsInput, fn func(*ssm.ListCommandsOutput, bool) bool) error {
+	output, err := m.ListCommands(input)
+	if err != nil {
+		return err
+	}
+
+	// Return each command on its own page to exercise pagination
+	for idx, c := range output.Commands {
+		if !fn(&ssm.ListCommandsOutput{Commands: []*ssm.Command{c}}, idx == len(output.Commands)-1) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// MockSSMStreamClient starts sessions whose data channel is served at StreamUrl, and records the sessions terminated
+type MockSSMStreamClient struct {
+	ssmiface.SSMAPI
+	StreamUrl  string
+	TokenValue string
+
+	mu         sync.Mutex
+	Started    []*ssm.StartSessionInput
+	Terminated []string
+}
+
+func (m *MockSSMStreamClient) StartSession(input *ssm.StartSessionInput) (output *ssm.StartSessionOutput, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Started = append(m.Started, input)
+	if m.StreamUrl == "" {
+		return nil, awserr.New("TargetNotConnected", fmt.Sprintf("%s is not connected", aws.StringValue(input.Target)), nil)
+	}
+
+	return &ssm.StartSessionOutput{
+		SessionId:  aws.String(fmt.Sprintf("session-%d", len(m.Started))),
+		StreamUrl:  aws.String(m.StreamUrl),
+		TokenValue: aws.String(m.TokenValue),
+	}, nil
+}
+
+func (m *MockSSMStreamClient) TerminateSession(input *ssm.TerminateSessionInput) (output *ssm.TerminateSessionOutput, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Terminated = append(m.Terminated, aws.StringValue(input.SessionId))
+	return &ssm.TerminateSessionOutput{SessionId: input.SessionId}, nil
+}
@@ -0,0 +1,86 @@
+package mocks
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/sso/ssoiface"
+	"github.com/aws/aws-sdk-go/service/ssooidc"
+	"github.com/aws/aws-sdk-go/service/ssooidc/ssooidciface"
+)
+
+// MockSSOOIDCClient simulates a device authorization that the user confirms after the token has been
+// requested Pending times
+type MockSSOOIDCClient struct {
+	ssooidciface.SSOOIDCAPI
+	sync.Mutex
+
+	// Pending is the number of token requests answered with AuthorizationPendingException
+	Pending int
+
+	// Registrations counts the calls to RegisterClient
+	Registrations int
+
+	// TokenRequests counts the calls to CreateToken
+	TokenRequests int
+}
+
+func (m *MockSSOOIDCClient) RegisterClient(input *ssooidc.RegisterClientInput) (*ssooidc.RegisterClientOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Registrations++
+	return &ssooidc.RegisterClientOutput{
+		ClientId:              aws.String("client-id"),
+		ClientSecret:          aws.String("client-secret"),
+		ClientSecretExpiresAt: aws.Int64(4102444800), // 2100-01-01
+	}, nil
+}
+
+func (m *MockSSOOIDCClient) StartDeviceAuthorization(input *ssooidc.StartDeviceAuthorizationInput) (*ssooidc.StartDeviceAuthorizationOutput, error) {
+	return &ssooidc.StartDeviceAuthorizationOutput{
+		DeviceCode:              aws.String("device-code"),
+		UserCode:                aws.String("ABCD-EFGH"),
+		VerificationUri:         aws.String("https://device.sso.us-east-1.amazonaws.com/"),
+		VerificationUriComplete: aws.String("https://device.sso.us-east-1.amazonaws.com/?user_code=ABCD-EFGH"),
+		ExpiresIn:               aws.Int64(600),
+	}, nil
+}
+
+func (m *MockSSOOIDCClient) CreateToken(input *ssooidc.CreateTokenInput) (*ssooidc.CreateTokenOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.TokenRequests++
+	if m.TokenRequests <= m.Pending {
+		return nil, awserr.New(ssooidc.ErrCodeAuthorizationPendingException, "Authorization is still pending", nil)
+	}
+
+	return &ssooidc.CreateTokenOutput{
+		AccessToken: aws.String("access-token"),
+		ExpiresIn:   aws.Int64(28800),
+		TokenType:   aws.String("Bearer"),
+	}, nil
+}
+
+// MockSSOClient returns role credentials for the access token "access-token", and rejects any other token
+type MockSSOClient struct {
+	ssoiface.SSOAPI
+}
+
+func (m *MockSSOClient) GetRoleCredentials(input *sso.GetRoleCredentialsInput) (*sso.GetRoleCredentialsOutput, error) {
+	if aws.StringValue(input.AccessToken) != "access-token" {
+		return nil, awserr.New(sso.ErrCodeUnauthorizedException, "Session token not found or invalid", nil)
+	}
+
+	return &sso.GetRoleCredentialsOutput{
+		RoleCredentials: &sso.RoleCredentials{
+			AccessKeyId:     aws.String("AKIA" + aws.StringValue(input.AccountId)),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("session-token"),
+			Expiration:      aws.Int64(4102444800000), // 2100-01-01
+		},
+	}, nil
+}
@@ -0,0 +1,64 @@
+package batch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Size is a number of items, either as an absolute count or as a percentage of a total
+type Size struct {
+	Count   int
+	Percent bool
+}
+
+// ParseSize parses a size such as "10" or "25%"
+func ParseSize(s string) (Size, error) {
+	size := Size{}
+
+	if strings.HasSuffix(s, "%") {
+		size.Percent = true
+		s = strings.TrimSuffix(s, "%")
+	}
+
+	count, err := strconv.Atoi(s)
+	if err != nil || count < 0 || (size.Percent && count > 100) {
+		return Size{}, fmt.Errorf("Invalid size %q, must be a number (e.g. 10) or a percentage between 0%% and 100%% (e.g. 10%%)", s)
+	}
+	size.Count = count
+
+	return size, nil
+}
+
+// String returns the size in the format accepted by ParseSize
+func (s Size) String() string {
+	if s.Percent {
+		return fmt.Sprintf("%d%%", s.Count)
+	}
+
+	return strconv.Itoa(s.Count)
+}
+
+// Of returns the number of items the size represents out of total. Percentages are rounded up,
+// so that any non-zero percentage of a non-empty total is at least one item.
+func (s Size) Of(total int) int {
+	n := s.Count
+	if s.Percent {
+		n = (s.Count*total + 99) / 100
+	}
+
+	if n > total {
+		return total
+	}
+
+	return n
+}
+
+// ExceededBy returns whether count items out of total is more than the size allows
+func (s Size) ExceededBy(count, total int) bool {
+	if s.Percent {
+		return count*100 > s.Count*total
+	}
+
+	return count > s.Count
+}
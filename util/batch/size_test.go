@@ -0,0 +1,48 @@
+package batch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	assert := assert.New(t)
+
+	size, err := ParseSize("10")
+	assert.NoError(err)
+	assert.Equal(Size{Count: 10}, size)
+
+	size, err = ParseSize("25%")
+	assert.NoError(err)
+	assert.Equal(Size{Count: 25, Percent: true}, size)
+	assert.Equal("25%", size.String())
+
+	for _, invalid := range []string{"", "abc", "-1", "101%", "%"} {
+		_, err = ParseSize(invalid)
+		assert.Errorf(err, "expected an error for %q", invalid)
+	}
+}
+
+func TestSizeOf(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(10, Size{Count: 10}.Of(50))
+	assert.Equal(5, Size{Count: 10}.Of(5))
+	assert.Equal(5, Size{Count: 10, Percent: true}.Of(50))
+
+	// Percentages are rounded up
+	assert.Equal(1, Size{Count: 10, Percent: true}.Of(3))
+	assert.Equal(0, Size{Count: 0, Percent: true}.Of(3))
+}
+
+func TestSizeExceededBy(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(Size{Count: 0}.ExceededBy(0, 10))
+	assert.True(Size{Count: 0}.ExceededBy(1, 10))
+	assert.False(Size{Count: 2}.ExceededBy(2, 10))
+
+	assert.False(Size{Count: 20, Percent: true}.ExceededBy(2, 10))
+	assert.True(Size{Count: 20, Percent: true}.ExceededBy(3, 10))
+}
@@ -2,12 +2,13 @@ package util
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/ssm"
+	"gopkg.in/yaml.v3"
 )
 
 // CommaSplit is a function used to split a comma-delimited list of strings into a slice of strings
@@ -31,20 +32,6 @@ func SliceToMap(kvslice []string, filterMap *map[string]string) {
 	}
 }
 
-func SliceToTargets(kvslice []string) (targets []*ssm.Target) {
-	var elements []string
-
-	for i := 0; i < len(kvslice); i++ {
-		elements = strings.Split(kvslice[i], "=")
-		targets = append(targets, &ssm.Target{
-			Key:    aws.String("tag:" + elements[0]),
-			Values: aws.StringSlice([]string{elements[1]}),
-		})
-	}
-
-	return targets
-}
-
 func ReadScriptFile(inputFile string, commandList *[]string) error {
 	// Open our file for reading
 	file, err := os.Open(inputFile)
@@ -67,3 +54,44 @@ func ReadScriptFile(inputFile string, commandList *[]string) error {
 
 	return nil
 }
+
+// ReadParametersFile reads a JSON or YAML file containing SSM document parameters. Each top-level key
+// is a parameter name, and its value may be either a single scalar or a list of scalars.
+func ReadParametersFile(inputFile string) (map[string][]string, error) {
+	data, err := os.ReadFile(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open file at %s\n%s", inputFile, err)
+	}
+
+	raw := make(map[string]interface{})
+	if strings.EqualFold(filepath.Ext(inputFile), ".json") {
+		err = json.Unmarshal(data, &raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse parameters file %s\n%s", inputFile, err)
+	}
+
+	params := make(map[string][]string)
+	for k, v := range raw {
+		switch value := v.(type) {
+		case []interface{}:
+			params[k] = []string{}
+			for _, item := range value {
+				if _, nested := item.(map[string]interface{}); nested {
+					return nil, fmt.Errorf("Invalid value for parameter %q, lists may only contain scalar values", k)
+				}
+				params[k] = append(params[k], fmt.Sprint(item))
+			}
+		case map[string]interface{}:
+			return nil, fmt.Errorf("Invalid value for parameter %q, must be a scalar or a list of scalars", k)
+		case nil:
+			params[k] = []string{}
+		default:
+			params[k] = []string{fmt.Sprint(value)}
+		}
+	}
+
+	return params, nil
+}
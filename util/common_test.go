@@ -59,3 +59,58 @@ func TestSliceToMap(t *testing.T) {
 	)
 
 }
+
+func TestReadParametersFile(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("yaml file", func(t *testing.T) {
+		params, err := ReadParametersFile("../testing/test_parameters.yaml")
+		assert.NoError(err)
+		assert.Equal([]string{"s3://bucket/site.yml"}, params["playbookurl"])
+		assert.Equal([]string{"False"}, params["check"])
+		assert.Equal([]string{"SSM=True", "version=2"}, params["extravars"])
+	})
+
+	t.Run("json file", func(t *testing.T) {
+		params, err := ReadParametersFile("../testing/test_parameters.json")
+		assert.NoError(err)
+		assert.Equal([]string{"Get-Service", "hostname"}, params["commands"])
+		assert.Equal([]string{"3600"}, params["executionTimeout"])
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		params, err := ReadParametersFile("../testing/does_not_exist.yaml")
+		assert.Nil(params)
+		assert.Error(err)
+	})
+}
+
+func TestConfigDir(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("XDG_CONFIG_HOME", "/tmp/xdg")
+	dir, err := ConfigDir()
+	assert.NoError(err)
+	assert.Equal("/tmp/xdg/ssm-helpers", dir)
+
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("HOME", "/home/test")
+	dir, err = ConfigDir()
+	assert.NoError(err)
+	assert.Equal("/home/test/.config/ssm-helpers", dir)
+}
+
+func TestCacheDir(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("XDG_CACHE_HOME", "/tmp/xdg-cache")
+	dir, err := CacheDir()
+	assert.NoError(err)
+	assert.Equal("/tmp/xdg-cache/ssm-helpers", dir)
+
+	t.Setenv("XDG_CACHE_HOME", "")
+	t.Setenv("HOME", "/home/test")
+	dir, err = CacheDir()
+	assert.NoError(err)
+	assert.Equal("/home/test/.cache/ssm-helpers", dir)
+}
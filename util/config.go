@@ -0,0 +1,82 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the user configuration of ssm-helpers, read from config.yaml in ConfigDir
+type Config struct {
+	// Targets are the named targets that can be used as @name in place of the flags they set
+	Targets map[string]*Target `yaml:"targets"`
+}
+
+// Target is a named set of instances, along with the columns shown when selecting among them
+type Target struct {
+	Profiles   []string `yaml:"profiles"`
+	Regions    []string `yaml:"regions"`
+	Filters    []string `yaml:"filters"`
+	Instances  []string `yaml:"instances"`
+	Addresses  []string `yaml:"addresses"`
+	Tags       []string `yaml:"tags"`
+	Attributes []string `yaml:"attributes"`
+	Limit      int      `yaml:"limit"`
+}
+
+// ConfigFile returns the path of the user configuration file
+func ConfigFile() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "config.yaml"), nil
+}
+
+// ReadConfig reads the user configuration from path. A missing file is an empty configuration.
+func ReadConfig(path string) (*Config, error) {
+	config := &Config{}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not open config file at %s\n%s", path, err)
+	}
+
+	// Unknown keys are rejected, so that typos don't silently widen a target
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Could not parse config file %s\n%s", path, err)
+	}
+
+	return config, nil
+}
+
+// Target returns the target with the given name
+func (c *Config) Target(name string) (*Target, error) {
+	if t, ok := c.Targets[name]; ok && t != nil {
+		return t, nil
+	}
+
+	if len(c.Targets) == 0 {
+		return nil, fmt.Errorf("Unknown target @%s, no targets are defined", name)
+	}
+
+	names := make([]string, 0, len(c.Targets))
+	for n := range c.Targets {
+		names = append(names, "@"+n)
+	}
+	sort.Strings(names)
+
+	return nil, fmt.Errorf("Unknown target @%s, must be one of: %s", name, strings.Join(names, ", "))
+}
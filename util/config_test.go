@@ -0,0 +1,58 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadConfig(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "config.yaml")
+	os.WriteFile(path, []byte(`targets:
+  api-prod:
+    profiles: [prod-a, prod-b]
+    regions: [us-east-1, us-west-2]
+    filters: [app=api, env=prod]
+    tags: [Name]
+    limit: 20
+  bastion:
+    instances: [i-0d770cb81ae0fc316]
+`), 0600)
+
+	config, err := ReadConfig(path)
+	assert.NoError(err)
+
+	target, err := config.Target("api-prod")
+	assert.NoError(err)
+	assert.Equal(&Target{
+		Profiles: []string{"prod-a", "prod-b"},
+		Regions:  []string{"us-east-1", "us-west-2"},
+		Filters:  []string{"app=api", "env=prod"},
+		Tags:     []string{"Name"},
+		Limit:    20,
+	}, target)
+
+	_, err = config.Target("api-dev")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "@api-prod, @bastion")
+	}
+
+	// Missing and empty files have no targets
+	for _, p := range []string{filepath.Join(dir, "missing.yaml"), filepath.Join(dir, "empty.yaml")} {
+		os.WriteFile(filepath.Join(dir, "empty.yaml"), nil, 0600)
+		config, err = ReadConfig(p)
+		assert.NoError(err)
+		_, err = config.Target("api-prod")
+		assert.Error(err)
+	}
+
+	// Unknown keys are rejected
+	os.WriteFile(path, []byte("targets:\n  api-prod:\n    filter: [app=api]\n"), 0600)
+	_, err = ReadConfig(path)
+	assert.Error(err)
+}
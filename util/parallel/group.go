@@ -0,0 +1,45 @@
+// Package parallel bounds the number of functions that run at once
+package parallel
+
+import "sync"
+
+// DefaultLimit is the number of profile/region combinations worked on at once unless configured otherwise
+const DefaultLimit = 20
+
+// Group runs functions concurrently, at most limit of them at a time
+type Group struct {
+	wg  sync.WaitGroup
+	sem chan struct{}
+}
+
+// NewGroup returns a Group that runs at most limit functions at a time, or any number of them if limit is 0 or less
+func NewGroup(limit int) *Group {
+	g := &Group{}
+	if limit > 0 {
+		g.sem = make(chan struct{}, limit)
+	}
+
+	return g
+}
+
+// Go runs fn in a new goroutine, blocking until fewer than limit functions of the group are running
+func (g *Group) Go(fn func()) {
+	if g.sem != nil {
+		g.sem <- struct{}{}
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if g.sem != nil {
+			defer func() { <-g.sem }()
+		}
+
+		fn()
+	}()
+}
+
+// Wait blocks until every function of the group has returned
+func (g *Group) Wait() {
+	g.wg.Wait()
+}
@@ -0,0 +1,43 @@
+package parallel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, limit := range []int{0, 1, 3} {
+		var mu sync.Mutex
+		running, maxRunning, done := 0, 0, 0
+
+		g := NewGroup(limit)
+		for i := 0; i < 10; i++ {
+			g.Go(func() {
+				mu.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+
+				time.Sleep(5 * time.Millisecond)
+
+				mu.Lock()
+				running--
+				done++
+				mu.Unlock()
+			})
+		}
+		g.Wait()
+
+		assert.Equal(10, done)
+		if limit > 0 {
+			assert.LessOrEqual(maxRunning, limit)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// appName is the name of the directory that ssm-helpers stores its files in
+const appName = "ssm-helpers"
+
+// ConfigDir returns the directory used to store ssm-helpers configuration and state,
+// $XDG_CONFIG_HOME/ssm-helpers if set, or ~/.config/ssm-helpers otherwise
+func ConfigDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, appName), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("Could not determine the home directory of the current user\n%v", err)
+	}
+
+	return filepath.Join(home, ".config", appName), nil
+}
+
+// CacheDir returns the directory used to cache data looked up from AWS, $XDG_CACHE_HOME/ssm-helpers if set,
+// or ~/.cache/ssm-helpers otherwise
+func CacheDir() (string, error) {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, appName), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("Could not determine the home directory of the current user\n%v", err)
+	}
+
+	return filepath.Join(home, ".cache", appName), nil
+}